@@ -0,0 +1,249 @@
+package tsnsrv
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"golang.org/x/exp/slog"
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/tailcfg"
+)
+
+var accessDenied = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "tsnsrv_access_denied_total",
+	Help: "Number of requests denied by access rules",
+}, []string{"service_name"})
+
+// Actions of an AccessRule.
+const (
+	AccessAllow = "allow"
+	AccessDeny  = "deny"
+)
+
+var errAccessFormat = errors.New("access rule format must be '[PREFIX=]allow|deny [user:LOGIN] [domain:DOMAIN] [tag:TAG] [node:NAME] [cap:CAPABILITY]...'")
+
+// AccessRule allows or denies requests based on the Tailscale identity
+// of the requestor.
+//
+// A rule applies to requests under its Prefix (all requests if empty),
+// and matches requestors that fit any one of its selectors; a rule
+// without selectors matches everyone, including requests whose identity
+// is unknown, like funnel requests. The first matching rule decides.
+// Requests that no rule matches are denied if an allow rule applied to
+// their path, and allowed otherwise.
+type AccessRule struct {
+	Prefix string `yaml:"prefix,omitempty"`
+	Action string `yaml:"action"`
+
+	Users        []string `yaml:"users,omitempty"`
+	Domains      []string `yaml:"domains,omitempty"`
+	Tags         []string `yaml:"tags,omitempty"`
+	Nodes        []string `yaml:"nodes,omitempty"`
+	Capabilities []string `yaml:"capabilities,omitempty"`
+}
+
+// parseAccessRule parses the commandline form of an access rule:
+//
+//	[PREFIX=]allow|deny [user:LOGIN] [domain:DOMAIN] [tag:TAG] [node:NAME] [cap:CAPABILITY]...
+func parseAccessRule(value string) (AccessRule, error) {
+	fields := strings.Fields(value)
+	if len(fields) == 0 {
+		return AccessRule{}, errAccessFormat
+	}
+	var rule AccessRule
+	if prefix, action, ok := strings.Cut(fields[0], "="); ok {
+		rule.Prefix, rule.Action = prefix, action
+	} else {
+		rule.Action = fields[0]
+	}
+	for _, sel := range fields[1:] {
+		kind, val, ok := strings.Cut(sel, ":")
+		if !ok || val == "" {
+			return AccessRule{}, fmt.Errorf("%w: invalid selector %q", errAccessFormat, sel)
+		}
+		switch kind {
+		case "user":
+			rule.Users = append(rule.Users, val)
+		case "domain":
+			rule.Domains = append(rule.Domains, val)
+		case "tag":
+			rule.Tags = append(rule.Tags, sel)
+		case "node":
+			rule.Nodes = append(rule.Nodes, val)
+		case "cap":
+			rule.Capabilities = append(rule.Capabilities, val)
+		default:
+			return AccessRule{}, fmt.Errorf("%w: unknown selector %q", errAccessFormat, kind)
+		}
+	}
+	return rule, rule.validate()
+}
+
+func (r AccessRule) validate() error {
+	if r.Action != AccessAllow && r.Action != AccessDeny {
+		return fmt.Errorf("access rule action must be %q or %q, got %q", AccessAllow, AccessDeny, r.Action)
+	}
+	if r.Prefix != "" && !strings.HasPrefix(parsePrefix(r.Prefix).path, "/") {
+		return fmt.Errorf("access rule prefix must start with '/', got %q", r.Prefix)
+	}
+	for _, tag := range r.Tags {
+		if !strings.HasPrefix(tag, "tag:") {
+			return fmt.Errorf("access rule tag %q: %w", tag, errTagFormat)
+		}
+	}
+	return nil
+}
+
+func (r AccessRule) String() string {
+	parts := []string{r.Action}
+	if r.Prefix != "" {
+		parts[0] = r.Prefix + "=" + r.Action
+	}
+	for _, sel := range []struct {
+		kind   string
+		values []string
+	}{{"user:", r.Users}, {"domain:", r.Domains}, {"", r.Tags}, {"node:", r.Nodes}, {"cap:", r.Capabilities}} {
+		for _, v := range sel.values {
+			parts = append(parts, sel.kind+v)
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// accessRules collects access rules given on the commandline.
+type accessRules []AccessRule
+
+func (a *accessRules) String() string {
+	var coll []string
+	for _, r := range *a {
+		coll = append(coll, r.String())
+	}
+	return strings.Join(coll, ", ")
+}
+
+func (a *accessRules) Set(value string) error {
+	rule, err := parseAccessRule(value)
+	if err != nil {
+		return err
+	}
+	*a = append(*a, rule)
+	return nil
+}
+
+// parse validates the rules.
+func (a accessRules) parse() ([]accessRule, error) {
+	var errs []error
+	var parsed []accessRule
+	for _, r := range a {
+		if err := r.validate(); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		pref := prefix{path: "/"}
+		if r.Prefix != "" {
+			pref = parsePrefix(r.Prefix)
+		}
+		parsed = append(parsed, accessRule{AccessRule: r, prefix: pref})
+	}
+	return parsed, errors.Join(errs...)
+}
+
+// accessRule is a validated AccessRule.
+type accessRule struct {
+	AccessRule
+	prefix prefix
+}
+
+func (r *accessRule) matchesIdentity(who *apitype.WhoIsResponse) bool {
+	if len(r.Users)+len(r.Domains)+len(r.Tags)+len(r.Nodes)+len(r.Capabilities) == 0 {
+		return true
+	}
+	if who == nil {
+		return false
+	}
+	if who.UserProfile != nil {
+		login := who.UserProfile.LoginName
+		if slices.ContainsFunc(r.Users, func(u string) bool { return strings.EqualFold(u, login) }) {
+			return true
+		}
+		if _, domain, ok := strings.Cut(login, "@"); ok &&
+			slices.ContainsFunc(r.Domains, func(d string) bool { return strings.EqualFold(d, domain) }) {
+			return true
+		}
+	}
+	if who.Node != nil {
+		if slices.ContainsFunc(r.Tags, func(t string) bool { return slices.Contains(who.Node.Tags, t) }) {
+			return true
+		}
+		if slices.ContainsFunc(r.Nodes, func(n string) bool { return strings.EqualFold(n, who.Node.ComputedName) }) {
+			return true
+		}
+	}
+	return slices.ContainsFunc(r.Capabilities, func(c string) bool {
+		return who.CapMap.HasCapability(tailcfg.PeerCapability(c))
+	})
+}
+
+// decideAccess returns whether the rules allow the request, and the
+// rule that decided it (nil if no rule matched).
+func decideAccess(rules []accessRule, r *http.Request, forFunnel bool, who *apitype.WhoIsResponse) (bool, *accessRule) {
+	allowListed := false
+	for i := range rules {
+		rule := &rules[i]
+		if !rule.prefix.covers(r.URL, forFunnel) {
+			continue
+		}
+		if rule.Action == AccessAllow {
+			allowListed = true
+		}
+		if rule.matchesIdentity(who) {
+			return rule.Action == AccessAllow, rule
+		}
+	}
+	return !allowListed, nil
+}
+
+// accessMiddleware rejects requests that the service's access rules deny with a 403.
+func (s *ValidTailnetSrv) accessMiddleware(forFunnel bool, next http.Handler) http.Handler {
+	if len(s.access) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		who, err := s.whoisFor(r)
+		if err != nil {
+			who = nil
+		}
+		allowed, rule := decideAccess(s.access, r, forFunnel, who)
+		if allowed {
+			next.ServeHTTP(w, r)
+			return
+		}
+		var user, node string
+		if who != nil && who.UserProfile != nil {
+			user = who.UserProfile.LoginName
+		}
+		if who != nil && who.Node != nil {
+			node = who.Node.ComputedName
+		}
+		reason := "no matching rule"
+		if rule != nil {
+			reason = rule.String()
+		}
+		slog.Info("access denied",
+			"service", s.Name,
+			"user", user,
+			"node", node,
+			"remote_addr", r.RemoteAddr,
+			"url", r.URL,
+			"forFunnel", forFunnel,
+			"rule", reason,
+		)
+		accessDenied.With(prometheus.Labels{"service_name": s.Name}).Inc()
+		http.Error(w, "Forbidden", http.StatusForbidden)
+	})
+}
@@ -0,0 +1,163 @@
+package tsnsrv
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/tailcfg"
+)
+
+func TestParseAccessRule(t *testing.T) {
+	t.Parallel()
+	for _, elt := range []struct {
+		spec     string
+		expected AccessRule
+		err      bool
+	}{
+		{spec: "allow", expected: AccessRule{Action: "allow"}},
+		{spec: "/admin=allow user:alice@example.com tag:admin", expected: AccessRule{
+			Prefix: "/admin", Action: "allow", Users: []string{"alice@example.com"}, Tags: []string{"tag:admin"},
+		}},
+		{spec: "tailnet:/=deny domain:contractor.example node:kiosk cap:example.com/cap/blocked", expected: AccessRule{
+			Prefix: "tailnet:/", Action: "deny",
+			Domains: []string{"contractor.example"}, Nodes: []string{"kiosk"}, Capabilities: []string{"example.com/cap/blocked"},
+		}},
+		{spec: "", err: true},
+		{spec: "permit user:bob@example.com", err: true},
+		{spec: "allow group:admins", err: true},
+		{spec: "allow user:", err: true},
+		{spec: "admin=allow", err: true},
+	} {
+		t.Run(elt.spec, func(t *testing.T) {
+			rule, err := parseAccessRule(elt.spec)
+			if elt.err {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, elt.expected, rule)
+			assert.Equal(t, elt.spec, rule.String())
+		})
+	}
+}
+
+func identity(login string, node string, tags []string, caps ...tailcfg.PeerCapability) *apitype.WhoIsResponse {
+	who := &apitype.WhoIsResponse{
+		UserProfile: &tailcfg.UserProfile{ID: 1, LoginName: login},
+		Node:        &tailcfg.Node{ComputedName: node, Tags: tags},
+		CapMap:      tailcfg.PeerCapMap{},
+	}
+	for _, c := range caps {
+		who.CapMap[c] = nil
+	}
+	return who
+}
+
+func TestDecideAccess(t *testing.T) {
+	t.Parallel()
+	rules, err := accessRules{
+		{Prefix: "/admin", Action: "deny", Domains: []string{"contractor.example"}},
+		{Prefix: "/admin", Action: "allow", Users: []string{"alice@example.com"}, Tags: []string{"tag:ops"}, Capabilities: []string{"example.com/cap/admin"}},
+		{Prefix: "funnel:/", Action: "deny"},
+	}.parse()
+	require.NoError(t, err)
+
+	for _, elt := range []struct {
+		name      string
+		path      string
+		forFunnel bool
+		who       *apitype.WhoIsResponse
+		allowed   bool
+	}{
+		{name: "uncovered path", path: "/", who: identity("bob@example.com", "laptop", nil), allowed: true},
+		{name: "allowed user", path: "/admin/users", who: identity("Alice@example.com", "laptop", nil), allowed: true},
+		{name: "other user", path: "/admin/users", who: identity("bob@example.com", "laptop", nil), allowed: false},
+		{name: "other user, encoded path", path: "/%61dmin/users", who: identity("bob@example.com", "laptop", nil), allowed: false},
+		{name: "other user, encoded slash", path: "/admin%2Fusers", who: identity("bob@example.com", "laptop", nil), allowed: false},
+		{name: "tagged node", path: "/admin", who: identity("tagged-devices", "ci", []string{"tag:ops"}), allowed: true},
+		{name: "capability", path: "/admin", who: identity("bob@example.com", "laptop", nil, "example.com/cap/admin"), allowed: true},
+		{name: "denied domain", path: "/admin", who: identity("alice@contractor.example", "laptop", nil, "example.com/cap/admin"), allowed: false},
+		{name: "unknown identity", path: "/admin", allowed: false},
+		{name: "funnel", path: "/", forFunnel: true, allowed: false},
+	} {
+		t.Run(elt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", elt.path, nil)
+			allowed, _ := decideAccess(rules, req, elt.forFunnel, elt.who)
+			assert.Equal(t, elt.allowed, allowed)
+		})
+	}
+}
+
+func TestDecideAccessReadmeExample(t *testing.T) {
+	t.Parallel()
+	var specs accessRules
+	require.NoError(t, specs.Set("/admin=allow user:alice@example.com tag:ops cap:example.com/cap/admin"))
+	require.NoError(t, specs.Set("deny domain:contractor.example"))
+	rules, err := specs.parse()
+	require.NoError(t, err)
+
+	alice := identity("alice@example.com", "laptop", nil)
+	bob := identity("bob@example.com", "laptop", nil)
+	contractor := identity("carol@contractor.example", "laptop", nil)
+	for _, elt := range []struct {
+		name    string
+		path    string
+		who     *apitype.WhoIsResponse
+		allowed bool
+	}{
+		{name: "alice on /admin", path: "/admin/users", who: alice, allowed: true},
+		{name: "alice elsewhere", path: "/", who: alice, allowed: true},
+		{name: "bob on /admin", path: "/admin", who: bob, allowed: false},
+		{name: "bob on encoded /admin", path: "/%61%64min", who: bob, allowed: false},
+		{name: "bob elsewhere", path: "/docs", who: bob, allowed: true},
+		{name: "contractor on /admin", path: "/admin", who: contractor, allowed: false},
+		{name: "contractor elsewhere", path: "/docs", who: contractor, allowed: false},
+		{name: "contractor on encoded path", path: "/%64ocs", who: contractor, allowed: false},
+	} {
+		t.Run(elt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", elt.path, nil)
+			allowed, _ := decideAccess(rules, req, false, elt.who)
+			assert.Equal(t, elt.allowed, allowed)
+		})
+	}
+}
+
+func TestAccessMiddleware(t *testing.T) {
+	t.Parallel()
+	rules, err := accessRules{{Action: "allow", Users: []string{"alice@example.com"}}}.parse()
+	require.NoError(t, err)
+	srv := &ValidTailnetSrv{
+		TailnetSrv: TailnetSrv{Name: "test"},
+		access:     rules,
+		client: &mockLocalClient{whoIsFunc: func(ctx context.Context, addr string) (*apitype.WhoIsResponse, error) {
+			switch addr {
+			case "100.100.100.1:1234":
+				return identity("alice@example.com", "laptop", nil), nil
+			case "100.100.100.2:1234":
+				return identity("bob@example.com", "laptop", nil), nil
+			}
+			return nil, errors.New("no such peer")
+		}},
+	}
+	handler := srv.accessMiddleware(false, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	for addr, expected := range map[string]int{
+		"100.100.100.1:1234": http.StatusNoContent,
+		"100.100.100.2:1234": http.StatusForbidden,
+		"192.0.2.1:1234":     http.StatusForbidden,
+	} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = addr
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		assert.Equal(t, expected, w.Code, addr)
+	}
+}
@@ -0,0 +1,587 @@
+package tsnsrv
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+// Access log formats.
+const (
+	AccessLogJSON     = "json"
+	AccessLogCommon   = "common"
+	AccessLogCombined = "combined"
+	AccessLogCaddy    = "caddy"
+)
+
+var errAccessLogFormat = errors.New("access log format must be json, common, combined or caddy")
+
+// AccessLog configures a log of every request a service answered.
+type AccessLog struct {
+	// Path is the file to log to, or "-" for stdout. Empty disables
+	// the access log.
+	Path string `yaml:"path,omitempty"`
+
+	// Format is one of json (default), common, combined (the Common
+	// and Combined Log Formats) or caddy (Caddy's JSON access logs).
+	Format string `yaml:"format,omitempty"`
+
+	// MaxSize is the size in bytes at which the file is rotated
+	// (default 100MiB).
+	MaxSize int64 `yaml:"maxSize,omitempty"`
+
+	// MaxAge is the age at which the file is rotated; 0 rotates only
+	// by size.
+	MaxAge time.Duration `yaml:"maxAge,omitempty"`
+
+	// MaxBackups is the number of rotated files that are kept
+	// (default 10).
+	MaxBackups int `yaml:"maxBackups,omitempty"`
+}
+
+func (al AccessLog) enabled() bool {
+	return al.Path != ""
+}
+
+func (al AccessLog) validate() error {
+	var errs []error
+	switch al.Format {
+	case "", AccessLogJSON, AccessLogCommon, AccessLogCombined, AccessLogCaddy:
+	default:
+		errs = append(errs, fmt.Errorf("%w, got %q", errAccessLogFormat, al.Format))
+	}
+	if al.MaxSize < 0 || al.MaxAge < 0 || al.MaxBackups < 0 {
+		errs = append(errs, errors.New("access log settings can not be negative"))
+	}
+	return errors.Join(errs...)
+}
+
+func (al AccessLog) withDefaults() AccessLog {
+	if al.Format == "" {
+		al.Format = AccessLogJSON
+	}
+	if al.MaxSize == 0 {
+		al.MaxSize = 100 << 20
+	}
+	if al.MaxBackups == 0 {
+		al.MaxBackups = 10
+	}
+	return al
+}
+
+// AccessLogger writes access log entries in one format.
+type AccessLogger struct {
+	format string
+	out    io.Writer
+	file   *rotatingFile
+}
+
+// NewAccessLogger opens the access log of a configuration. It returns
+// nil if no path is configured.
+func NewAccessLogger(al AccessLog) (*AccessLogger, error) {
+	if !al.enabled() {
+		return nil, nil
+	}
+	if err := al.validate(); err != nil {
+		return nil, err
+	}
+	al = al.withDefaults()
+	if al.Path == "-" {
+		return &AccessLogger{format: al.Format, out: os.Stdout}, nil
+	}
+	file, err := openRotatingFile(al)
+	if err != nil {
+		return nil, err
+	}
+	return &AccessLogger{format: al.Format, out: file, file: file}, nil
+}
+
+// Close closes the log file, once no other logger uses it.
+func (l *AccessLogger) Close() error {
+	if l == nil || l.file == nil {
+		return nil
+	}
+	return l.file.release()
+}
+
+// accessLogEntry is what is known about an answered request.
+type accessLogEntry struct {
+	time      time.Time
+	service   string
+	listener  string
+	req       *http.Request
+	status    int
+	size      int64
+	bytesRead int64
+	duration  time.Duration
+	user      string
+	node      string
+	upstream  string
+	retries   int
+	header    http.Header
+}
+
+func (l *AccessLogger) log(e *accessLogEntry) {
+	var line []byte
+	switch l.format {
+	case AccessLogCommon, AccessLogCombined:
+		line = e.clf(l.format == AccessLogCombined)
+	case AccessLogCaddy:
+		line = e.caddy()
+	default:
+		line = e.json()
+	}
+	if _, err := l.out.Write(append(line, '\n')); err != nil {
+		slog.Warn("could not write access log",
+			"service", e.service,
+			"error", err,
+		)
+	}
+}
+
+// uri returns the request target as the client sent it.
+func (e *accessLogEntry) uri() string {
+	if e.req.RequestURI != "" {
+		return e.req.RequestURI
+	}
+	return e.req.URL.RequestURI()
+}
+
+func dashIfEmpty(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// clf formats the entry in the Common Log Format, optionally with the
+// referer and user agent of the Combined Log Format.
+func (e *accessLogEntry) clf(combined bool) []byte {
+	host, _, err := net.SplitHostPort(e.req.RemoteAddr)
+	if err != nil {
+		host = e.req.RemoteAddr
+	}
+	user := "-"
+	if e.user != "" {
+		user = strings.ReplaceAll(e.user, " ", "_")
+	}
+	line := fmt.Sprintf("%s - %s [%s] %s %d %d",
+		dashIfEmpty(host),
+		user,
+		e.time.Format("02/Jan/2006:15:04:05 -0700"),
+		strconv.Quote(fmt.Sprintf("%s %s %s", e.req.Method, e.uri(), e.req.Proto)),
+		e.status,
+		e.size,
+	)
+	if combined {
+		line += fmt.Sprintf(" %s %s",
+			strconv.Quote(dashIfEmpty(e.req.Referer())),
+			strconv.Quote(dashIfEmpty(e.req.UserAgent())),
+		)
+	}
+	return []byte(line)
+}
+
+func (e *accessLogEntry) json() []byte {
+	line, _ := json.Marshal(struct {
+		Time       string  `json:"time"`
+		Service    string  `json:"service"`
+		Listener   string  `json:"listener"`
+		RemoteAddr string  `json:"remote_addr"`
+		Method     string  `json:"method"`
+		Host       string  `json:"host"`
+		URI        string  `json:"uri"`
+		Proto      string  `json:"proto"`
+		Status     int     `json:"status"`
+		Bytes      int64   `json:"bytes"`
+		BytesRead  int64   `json:"bytes_read"`
+		DurationMS float64 `json:"duration_ms"`
+		User       string  `json:"user,omitempty"`
+		Node       string  `json:"node,omitempty"`
+		UserAgent  string  `json:"user_agent,omitempty"`
+		Referer    string  `json:"referer,omitempty"`
+		Upstream   string  `json:"upstream,omitempty"`
+		Retries    int     `json:"retries,omitempty"`
+	}{
+		Time:       e.time.Format(time.RFC3339Nano),
+		Service:    e.service,
+		Listener:   e.listener,
+		RemoteAddr: e.req.RemoteAddr,
+		Method:     e.req.Method,
+		Host:       e.req.Host,
+		URI:        e.uri(),
+		Proto:      e.req.Proto,
+		Status:     e.status,
+		Bytes:      e.size,
+		BytesRead:  e.bytesRead,
+		DurationMS: float64(e.duration) / float64(time.Millisecond),
+		User:       e.user,
+		Node:       e.node,
+		UserAgent:  e.req.UserAgent(),
+		Referer:    e.req.Referer(),
+		Upstream:   e.upstream,
+		Retries:    e.retries,
+	})
+	return line
+}
+
+// redactedHeaders are masked in Caddy-style logs, like Caddy does.
+var redactedHeaders = []string{"Authorization", "Cookie", "Proxy-Authorization", "Set-Cookie"}
+
+func redact(h http.Header) http.Header {
+	out := h.Clone()
+	if out == nil {
+		out = http.Header{}
+	}
+	for _, name := range redactedHeaders {
+		if _, ok := out[name]; ok {
+			out[name] = []string{"REDACTED"}
+		}
+	}
+	return out
+}
+
+type caddyTLS struct {
+	Resumed     bool   `json:"resumed"`
+	Version     uint16 `json:"version"`
+	CipherSuite uint16 `json:"cipher_suite"`
+	Proto       string `json:"proto"`
+	ServerName  string `json:"server_name"`
+}
+
+// caddy formats the entry like Caddy's http.log.access logger.
+func (e *accessLogEntry) caddy() []byte {
+	ip, port, err := net.SplitHostPort(e.req.RemoteAddr)
+	if err != nil {
+		ip = e.req.RemoteAddr
+	}
+	var tlsInfo *caddyTLS
+	if cs := e.req.TLS; cs != nil {
+		tlsInfo = &caddyTLS{
+			Resumed:     cs.DidResume,
+			Version:     cs.Version,
+			CipherSuite: cs.CipherSuite,
+			Proto:       cs.NegotiatedProtocol,
+			ServerName:  cs.ServerName,
+		}
+	}
+	type caddyRequest struct {
+		RemoteIP   string      `json:"remote_ip"`
+		RemotePort string      `json:"remote_port"`
+		ClientIP   string      `json:"client_ip"`
+		Proto      string      `json:"proto"`
+		Method     string      `json:"method"`
+		Host       string      `json:"host"`
+		URI        string      `json:"uri"`
+		Headers    http.Header `json:"headers"`
+		TLS        *caddyTLS   `json:"tls,omitempty"`
+	}
+	line, _ := json.Marshal(struct {
+		Level       string       `json:"level"`
+		TS          float64      `json:"ts"`
+		Logger      string       `json:"logger"`
+		Msg         string       `json:"msg"`
+		Request     caddyRequest `json:"request"`
+		BytesRead   int64        `json:"bytes_read"`
+		UserID      string       `json:"user_id"`
+		Duration    float64      `json:"duration"`
+		Size        int64        `json:"size"`
+		Status      int          `json:"status"`
+		RespHeaders http.Header  `json:"resp_headers"`
+	}{
+		Level:  "info",
+		TS:     float64(e.time.UnixNano()) / float64(time.Second),
+		Logger: "http.log.access." + e.service,
+		Msg:    "handled request",
+		Request: caddyRequest{
+			RemoteIP:   ip,
+			RemotePort: port,
+			ClientIP:   ip,
+			Proto:      e.req.Proto,
+			Method:     e.req.Method,
+			Host:       e.req.Host,
+			URI:        e.uri(),
+			Headers:    redact(e.req.Header),
+			TLS:        tlsInfo,
+		},
+		BytesRead:   e.bytesRead,
+		UserID:      e.user,
+		Duration:    e.duration.Seconds(),
+		Size:        e.size,
+		Status:      e.status,
+		RespHeaders: redact(e.header),
+	})
+	return line
+}
+
+// accessRecordKey finds the accessRecord of a request.
+type accessRecordKey struct{}
+
+// accessRecord collects what the proxy learns about a request, for
+// its access log entry.
+type accessRecord struct {
+	proxy *proxyContext
+}
+
+// recordProxyContext remembers the proxy state of a request for the
+// access log.
+func recordProxyContext(r *http.Request, p *proxyContext) {
+	if rec, ok := r.Context().Value(accessRecordKey{}).(*accessRecord); ok {
+		rec.proxy = p
+	}
+}
+
+// statusWriter remembers the status and size of a response.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	size   int64
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	// Informational responses precede the final one:
+	if w.status == 0 && (code >= 200 || code == http.StatusSwitchingProtocols) {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController flush and hijack connections.
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// countingBody counts the bytes read from a request body.
+type countingBody struct {
+	io.ReadCloser
+	n int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+	return n, err
+}
+
+// accessLogMiddleware logs every request once it was answered, however
+// it was answered.
+func (s *ValidTailnetSrv) accessLogMiddleware(forFunnel bool, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logger := s.accessLogger
+		if logger == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		start := time.Now()
+		rec := &accessRecord{}
+		lw := &statusWriter{ResponseWriter: w}
+		var body *countingBody
+		if r.Body != nil && r.Body != http.NoBody {
+			body = &countingBody{ReadCloser: r.Body}
+		}
+		r2 := r.WithContext(context.WithValue(r.Context(), accessRecordKey{}, rec))
+		if body != nil {
+			r2.Body = body
+		}
+		defer func() {
+			e := &accessLogEntry{
+				time:     start,
+				service:  s.Name,
+				listener: "tailnet",
+				req:      r,
+				status:   lw.status,
+				size:     lw.size,
+				duration: time.Since(start),
+				header:   lw.Header(),
+			}
+			if forFunnel {
+				e.listener = "funnel"
+			}
+			if e.status == 0 {
+				// Nothing was written; net/http sends a 200.
+				e.status = http.StatusOK
+			}
+			if body != nil {
+				e.bytesRead = body.n
+			}
+			if !s.SuppressWhois && s.client != nil {
+				if who, err := s.whoisFor(r); err == nil && who != nil {
+					if who.UserProfile != nil {
+						e.user = who.UserProfile.LoginName
+					}
+					if who.Node != nil {
+						e.node = who.Node.ComputedName
+					}
+				}
+			}
+			if p := rec.proxy; p != nil {
+				e.upstream = p.rewrittenURL.String()
+				e.retries = p.retries
+			}
+			logger.log(e)
+		}()
+		next.ServeHTTP(lw, r2)
+	})
+}
+
+// rotatingFile is an append-only file that is renamed aside when it
+// gets too large or too old. Loggers of the same path share it.
+type rotatingFile struct {
+	config AccessLog
+	now    func() time.Time
+
+	mu     sync.Mutex
+	refs   int
+	f      *os.File
+	size   int64
+	opened time.Time
+}
+
+var accessLogFiles struct {
+	sync.Mutex
+	m map[string]*rotatingFile
+}
+
+// openRotatingFile opens the log file of al, or returns the already
+// open file at its path. The settings of the first opener win.
+func openRotatingFile(al AccessLog) (*rotatingFile, error) {
+	path, err := filepath.Abs(al.Path)
+	if err != nil {
+		return nil, err
+	}
+	accessLogFiles.Lock()
+	defer accessLogFiles.Unlock()
+	if rf, ok := accessLogFiles.m[path]; ok {
+		rf.mu.Lock()
+		rf.refs++
+		rf.mu.Unlock()
+		return rf, nil
+	}
+	al.Path = path
+	rf := &rotatingFile{config: al, now: time.Now, refs: 1}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	if accessLogFiles.m == nil {
+		accessLogFiles.m = map[string]*rotatingFile{}
+	}
+	accessLogFiles.m[path] = rf
+	return rf, nil
+}
+
+func (rf *rotatingFile) open() error {
+	f, err := os.OpenFile(rf.config.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o640)
+	if err != nil {
+		return fmt.Errorf("opening access log: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("opening access log: %w", err)
+	}
+	rf.f, rf.size, rf.opened = f, info.Size(), rf.now()
+	return nil
+}
+
+// release closes the file when its last logger is done with it.
+func (rf *rotatingFile) release() error {
+	accessLogFiles.Lock()
+	defer accessLogFiles.Unlock()
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	rf.refs--
+	if rf.refs > 0 {
+		return nil
+	}
+	delete(accessLogFiles.m, rf.config.Path)
+	return rf.f.Close()
+}
+
+func (rf *rotatingFile) Write(p []byte) (int, error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if rf.refs == 0 {
+		return 0, os.ErrClosed
+	}
+	if rf.size > 0 && (rf.size+int64(len(p)) > rf.config.MaxSize ||
+		rf.config.MaxAge > 0 && rf.now().Sub(rf.opened) >= rf.config.MaxAge) {
+		if err := rf.rotate(); err != nil {
+			// Keep logging to the current file; the next write tries again.
+			slog.Warn("could not rotate access log",
+				"path", rf.config.Path,
+				"error", err,
+			)
+		}
+	}
+	n, err := rf.f.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
+
+// backupTimeFormat names rotated files, so that they sort by age.
+const backupTimeFormat = "20060102T150405.000"
+
+// rotate moves the log file aside and starts a new one. If the file
+// can't be moved, it is reopened to keep logging to it.
+func (rf *rotatingFile) rotate() error {
+	err := rf.f.Close()
+	if err == nil {
+		err = os.Rename(rf.config.Path, rf.config.Path+"."+rf.now().UTC().Format(backupTimeFormat))
+	}
+	if openErr := rf.open(); openErr != nil {
+		return errors.Join(err, openErr)
+	}
+	if err != nil {
+		return fmt.Errorf("rotating access log: %w", err)
+	}
+	if err := rf.prune(); err != nil {
+		slog.Warn("could not remove old access logs",
+			"path", rf.config.Path,
+			"error", err,
+		)
+	}
+	return nil
+}
+
+// prune removes the oldest rotated files beyond MaxBackups.
+func (rf *rotatingFile) prune() error {
+	matches, err := filepath.Glob(rf.config.Path + ".*")
+	if err != nil {
+		return err
+	}
+	var backups []string
+	for _, m := range matches {
+		if _, err := time.Parse(backupTimeFormat, strings.TrimPrefix(m, rf.config.Path+".")); err == nil {
+			backups = append(backups, m)
+		}
+	}
+	slices.Sort(backups)
+	var errs []error
+	for len(backups) > rf.config.MaxBackups {
+		errs = append(errs, os.Remove(backups[0]))
+		backups = backups[1:]
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,234 @@
+package tsnsrv
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAccessLogValidate(t *testing.T) {
+	t.Parallel()
+	assert.NoError(t, AccessLog{}.validate())
+	assert.NoError(t, AccessLog{Path: "-", Format: AccessLogCaddy}.validate())
+	assert.ErrorIs(t, AccessLog{Path: "-", Format: "apache"}.validate(), errAccessLogFormat)
+	assert.Error(t, AccessLog{Path: "-", MaxBackups: -1}.validate())
+}
+
+func testAccessLogEntry() *accessLogEntry {
+	req := httptest.NewRequest("GET", "/search?q=x", nil)
+	req.Host = "app.example.ts.net"
+	req.RemoteAddr = "100.64.0.7:41234"
+	req.Header.Set("User-Agent", "curl/8.0")
+	req.Header.Set("Referer", "https://example.com/")
+	req.Header.Set("Cookie", "session=secret")
+	req.TLS = &tls.ConnectionState{Version: tls.VersionTLS13, ServerName: "app.example.ts.net"}
+	return &accessLogEntry{
+		time:     time.Date(2024, 3, 9, 21, 30, 1, 0, time.UTC),
+		service:  "app",
+		listener: "tailnet",
+		req:      req,
+		status:   200,
+		size:     1234,
+		duration: 1500 * time.Microsecond,
+		user:     "alice@example.com",
+		node:     "laptop",
+		upstream: "http://127.0.0.1:8080/search?q=x",
+		header:   http.Header{"Set-Cookie": {"session=new"}, "Content-Type": {"text/html"}},
+	}
+}
+
+func TestAccessLogFormats(t *testing.T) {
+	t.Parallel()
+	e := testAccessLogEntry()
+	assert.Equal(t,
+		`100.64.0.7 - alice@example.com [09/Mar/2024:21:30:01 +0000] "GET /search?q=x HTTP/1.1" 200 1234`,
+		string(e.clf(false)))
+	assert.Equal(t,
+		`100.64.0.7 - alice@example.com [09/Mar/2024:21:30:01 +0000] "GET /search?q=x HTTP/1.1" 200 1234 "https://example.com/" "curl/8.0"`,
+		string(e.clf(true)))
+
+	var entry map[string]any
+	require.NoError(t, json.Unmarshal(e.json(), &entry))
+	assert.Equal(t, "app", entry["service"])
+	assert.Equal(t, "GET", entry["method"])
+	assert.Equal(t, "/search?q=x", entry["uri"])
+	assert.EqualValues(t, 200, entry["status"])
+	assert.EqualValues(t, 1234, entry["bytes"])
+	assert.EqualValues(t, 1.5, entry["duration_ms"])
+	assert.Equal(t, "alice@example.com", entry["user"])
+	assert.Equal(t, "curl/8.0", entry["user_agent"])
+	assert.Equal(t, "http://127.0.0.1:8080/search?q=x", entry["upstream"])
+
+	var caddy struct {
+		Logger  string `json:"logger"`
+		Msg     string `json:"msg"`
+		Request struct {
+			RemoteIP string      `json:"remote_ip"`
+			URI      string      `json:"uri"`
+			Headers  http.Header `json:"headers"`
+			TLS      struct {
+				ServerName string `json:"server_name"`
+			} `json:"tls"`
+		} `json:"request"`
+		UserID      string      `json:"user_id"`
+		Duration    float64     `json:"duration"`
+		Size        int64       `json:"size"`
+		Status      int         `json:"status"`
+		RespHeaders http.Header `json:"resp_headers"`
+	}
+	require.NoError(t, json.Unmarshal(e.caddy(), &caddy))
+	assert.Equal(t, "http.log.access.app", caddy.Logger)
+	assert.Equal(t, "handled request", caddy.Msg)
+	assert.Equal(t, "100.64.0.7", caddy.Request.RemoteIP)
+	assert.Equal(t, "/search?q=x", caddy.Request.URI)
+	assert.Equal(t, []string{"REDACTED"}, caddy.Request.Headers["Cookie"])
+	assert.Equal(t, "app.example.ts.net", caddy.Request.TLS.ServerName)
+	assert.Equal(t, "alice@example.com", caddy.UserID)
+	assert.Equal(t, 0.0015, caddy.Duration)
+	assert.Equal(t, 200, caddy.Status)
+	assert.Equal(t, []string{"REDACTED"}, caddy.RespHeaders["Set-Cookie"])
+	assert.Equal(t, []string{"session=secret"}, e.req.Header["Cookie"], "the request isn't changed")
+}
+
+func TestAccessLogMiddleware(t *testing.T) {
+	t.Parallel()
+	var buf bytes.Buffer
+	dest, err := url.Parse("http://upstream")
+	require.NoError(t, err)
+	s := &ValidTailnetSrv{
+		TailnetSrv: TailnetSrv{
+			Name:            "app",
+			SuppressWhois:   true,
+			AllowedPrefixes: prefixes{parsePrefix("/app")},
+		},
+		DestURL:      dest,
+		accessLogger: &AccessLogger{format: AccessLogJSON, out: &buf},
+	}
+	handler := s.mux(roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		if req.URL.Path == "/app/down" {
+			return nil, errors.New("connection refused")
+		}
+		io.Copy(io.Discard, req.Body)
+		return &http.Response{StatusCode: 201, Body: io.NopCloser(strings.NewReader("created")), Request: req}, nil
+	}), true)
+
+	for _, req := range []*http.Request{
+		httptest.NewRequest("POST", "/app/items", strings.NewReader("name=x")),
+		httptest.NewRequest("GET", "/app/down", nil),
+		httptest.NewRequest("GET", "/elsewhere", nil),
+	} {
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	var entries []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var entry map[string]any
+		require.NoError(t, json.Unmarshal([]byte(line), &entry), line)
+		entries = append(entries, entry)
+	}
+	require.Len(t, entries, 3)
+	assert.Equal(t, "funnel", entries[0]["listener"])
+	assert.EqualValues(t, 201, entries[0]["status"])
+	assert.EqualValues(t, len("created"), entries[0]["bytes"])
+	assert.EqualValues(t, len("name=x"), entries[0]["bytes_read"])
+	assert.Equal(t, "http://upstream/app/items", entries[0]["upstream"])
+	assert.EqualValues(t, http.StatusBadGateway, entries[1]["status"], "proxy errors are logged")
+	assert.EqualValues(t, http.StatusNotFound, entries[2]["status"], "prefix denials are logged")
+	assert.Nil(t, entries[2]["upstream"])
+}
+
+func TestRotatingFile(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "access.log")
+	logger, err := NewAccessLogger(AccessLog{Path: path, MaxSize: 10, MaxAge: time.Hour, MaxBackups: 2})
+	require.NoError(t, err)
+	now := time.Date(2024, 3, 9, 0, 0, 0, 0, time.UTC)
+	rf := logger.file
+	rf.now = func() time.Time { return now }
+
+	other, err := NewAccessLogger(AccessLog{Path: path, Format: AccessLogCommon})
+	require.NoError(t, err)
+	assert.Same(t, rf, other.file, "loggers of the same path share the file")
+	require.NoError(t, other.Close())
+
+	write := func(s string) {
+		t.Helper()
+		now = now.Add(time.Second)
+		_, err := rf.Write([]byte(s))
+		require.NoError(t, err)
+	}
+	backups := func() []string {
+		t.Helper()
+		matches, err := filepath.Glob(path + ".*")
+		require.NoError(t, err)
+		return matches
+	}
+
+	write("1234\n")
+	write("1234\n")
+	assert.Empty(t, backups())
+	write("rotated by size\n")
+	assert.Len(t, backups(), 1)
+	now = now.Add(time.Hour)
+	write("x\n")
+	assert.Len(t, backups(), 2, "rotated by age")
+	write("rotated by size again\n")
+	assert.Len(t, backups(), 2, "old backups are removed")
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "rotated by size again\n", string(data))
+	require.NoError(t, logger.Close())
+	_, err = rf.Write([]byte("closed"))
+	assert.Error(t, err)
+}
+
+func TestRotatingFileFailures(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "access.log")
+	logger, err := NewAccessLogger(AccessLog{Path: path, MaxSize: 10, MaxBackups: 1})
+	require.NoError(t, err)
+	t.Cleanup(func() { logger.Close() })
+	now := time.Date(2024, 3, 9, 0, 0, 0, 0, time.UTC)
+	rf := logger.file
+	rf.now = func() time.Time { return now }
+	write := func(s string) {
+		t.Helper()
+		n, err := rf.Write([]byte(s))
+		require.NoError(t, err)
+		assert.Equal(t, len(s), n)
+	}
+	read := func() string {
+		t.Helper()
+		data, err := os.ReadFile(path)
+		require.NoError(t, err)
+		return string(data)
+	}
+
+	// A non-empty directory in the way of the backup can be neither
+	// replaced nor removed:
+	blocked := path + "." + now.Format(backupTimeFormat)
+	require.NoError(t, os.MkdirAll(filepath.Join(blocked, "in-the-way"), 0o750))
+
+	write("1234567890\n")
+	write("not rotated\n")
+	assert.Equal(t, "1234567890\nnot rotated\n", read(), "the file is kept when it can't be moved")
+
+	now = now.Add(time.Second)
+	write("rotated\n")
+	assert.Equal(t, "rotated\n", read(), "failing to remove old backups doesn't lose lines")
+	assert.DirExists(t, blocked)
+}
@@ -0,0 +1,126 @@
+package tsnsrv
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"golang.org/x/exp/slog"
+)
+
+// AdminHandler returns the admin API for inspecting and controlling the
+// services of an Orchestrator:
+//
+//	GET  /admin/services                 status of all services
+//	GET  /admin/services/{name}          status of one service
+//	POST /admin/services/{name}/stop     stop a service
+//	POST /admin/services/{name}/start    start a stopped or failed service
+//	POST /admin/services/{name}/restart  restart a service
+func AdminHandler(o *Orchestrator) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /admin/services", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, o.Status())
+	})
+	mux.HandleFunc("GET /admin/services/{name}", func(w http.ResponseWriter, r *http.Request) {
+		status, err := o.ServiceStatus(r.PathValue("name"))
+		if err != nil {
+			writeAdminError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, status)
+	})
+	for action, fn := range map[string]func(string) error{
+		"stop":    o.StopService,
+		"start":   o.StartService,
+		"restart": o.RestartService,
+	} {
+		mux.HandleFunc("POST /admin/services/{name}/"+action, func(w http.ResponseWriter, r *http.Request) {
+			name := r.PathValue("name")
+			slog.Info("admin request", "action", action, "service", name, "remote_addr", r.RemoteAddr)
+			if err := fn(name); err != nil {
+				writeAdminError(w, err)
+				return
+			}
+			status, err := o.ServiceStatus(name)
+			if err != nil {
+				writeAdminError(w, err)
+				return
+			}
+			writeJSON(w, http.StatusOK, status)
+		})
+	}
+	return mux
+}
+
+var errEmptyAdminToken = errors.New("admin token file is empty")
+
+// StartAdminServer serves the admin API on its own listener until ctx
+// is canceled. Addresses without a host only listen on loopback. If
+// tokenFile is set, requests must present the token it contains as a
+// bearer token.
+func StartAdminServer(ctx context.Context, addr, tokenFile string, o *Orchestrator) error {
+	handler := AdminHandler(o)
+	if tokenFile != "" {
+		data, err := os.ReadFile(tokenFile)
+		if err != nil {
+			return fmt.Errorf("reading admin token: %w", err)
+		}
+		token := strings.TrimSpace(string(data))
+		if token == "" {
+			return fmt.Errorf("%w: %v", errEmptyAdminToken, tokenFile)
+		}
+		handler = requireBearerToken(token, handler)
+	}
+	return serveInBackground(ctx, "admin", adminListenAddr(addr), handler)
+}
+
+// adminListenAddr restricts addresses without a host to loopback, so
+// the admin API is only reachable from elsewhere when asked for.
+func adminListenAddr(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || host != "" {
+		return addr
+	}
+	return net.JoinHostPort("localhost", port)
+}
+
+// requireBearerToken rejects requests that don't carry token in their
+// Authorization header.
+func requireBearerToken(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="tsnsrv admin"`)
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeAdminError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, errUnknownService):
+		status = http.StatusNotFound
+	case errors.Is(err, errServiceRunning), errors.Is(err, errServiceNotRunning):
+		status = http.StatusConflict
+	case errors.Is(err, errNotRunning):
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Warn("could not write JSON response", "error", err)
+	}
+}
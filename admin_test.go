@@ -0,0 +1,141 @@
+package tsnsrv
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAdminHandler(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	o := NewOrchestrator([]*ValidTailnetSrv{
+		{TailnetSrv: TailnetSrv{Name: "service1", ListenAddr: ":443", Funnel: true}},
+		{TailnetSrv: TailnetSrv{Name: "service2", ListenAddr: ":8443"}},
+	})
+	o.run = func(ctx context.Context, s *ValidTailnetSrv) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	result := make(chan error)
+	go func() { result <- o.Run(ctx) }()
+	require.Eventually(t, func() bool {
+		state, _ := o.ServiceState("service2")
+		return state == StateStarting
+	}, 5*time.Second, time.Millisecond)
+
+	admin := httptest.NewServer(AdminHandler(o))
+	t.Cleanup(admin.Close)
+
+	request := func(method, path string) (int, []byte) {
+		req, err := http.NewRequest(method, admin.URL+path, nil)
+		require.NoError(t, err)
+		resp, err := admin.Client().Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		var body json.RawMessage
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+		return resp.StatusCode, body
+	}
+
+	code, body := request("GET", "/admin/services")
+	assert.Equal(t, http.StatusOK, code)
+	var statuses []ServiceStatus
+	require.NoError(t, json.Unmarshal(body, &statuses))
+	require.Len(t, statuses, 2)
+	assert.Equal(t, "service1", statuses[0].Name)
+	assert.Equal(t, StateStarting, statuses[0].State)
+	assert.Equal(t, ":443", statuses[0].ListenAddr)
+	assert.True(t, statuses[0].Funnel)
+	assert.Equal(t, ":8443", statuses[1].ListenAddr)
+
+	code, _ = request("GET", "/admin/services/nope")
+	assert.Equal(t, http.StatusNotFound, code)
+
+	code, body = request("POST", "/admin/services/service1/stop")
+	assert.Equal(t, http.StatusOK, code)
+	var status ServiceStatus
+	require.NoError(t, json.Unmarshal(body, &status))
+	assert.Equal(t, StateStopped, status.State)
+
+	code, _ = request("POST", "/admin/services/service1/stop")
+	assert.Equal(t, http.StatusConflict, code)
+
+	// Stopping every service doesn't end the process:
+	code, _ = request("POST", "/admin/services/service2/stop")
+	assert.Equal(t, http.StatusOK, code)
+
+	code, body = request("POST", "/admin/services/service1/start")
+	assert.Equal(t, http.StatusOK, code)
+	require.NoError(t, json.Unmarshal(body, &status))
+	assert.Equal(t, StateStarting, status.State)
+
+	code, _ = request("POST", "/admin/services/service1/start")
+	assert.Equal(t, http.StatusConflict, code)
+
+	code, body = request("POST", "/admin/services/service2/restart")
+	assert.Equal(t, http.StatusOK, code)
+	require.NoError(t, json.Unmarshal(body, &status))
+	assert.Equal(t, StateStarting, status.State)
+
+	code, _ = request("GET", "/admin/services/service2")
+	assert.Equal(t, http.StatusOK, code)
+
+	cancel()
+	require.NoError(t, <-result)
+}
+
+func TestMetricsListenerHasNoAdminAPI(t *testing.T) {
+	t.Parallel()
+	o := NewOrchestrator([]*ValidTailnetSrv{{TailnetSrv: TailnetSrv{Name: "service1"}}})
+	mux := metricsMux(ProcessHandler(o, nil))
+	for _, req := range []*http.Request{
+		httptest.NewRequest("GET", "/admin/services", nil),
+		httptest.NewRequest("POST", "/admin/services/service1/stop", nil),
+	} {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusNotFound, w.Code, req.URL.Path)
+	}
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/healthz", nil))
+	assert.Equal(t, http.StatusOK, w.Code, "health checks are served next to the metrics")
+}
+
+func TestAdminListenAddr(t *testing.T) {
+	t.Parallel()
+	assert.Equal(t, "localhost:9098", adminListenAddr(":9098"))
+	assert.Equal(t, "0.0.0.0:9098", adminListenAddr("0.0.0.0:9098"))
+	assert.Equal(t, "100.64.0.1:9098", adminListenAddr("100.64.0.1:9098"))
+}
+
+func TestAdminBearerToken(t *testing.T) {
+	t.Parallel()
+	handler := requireBearerToken("s3cret", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	for _, elt := range []struct {
+		header string
+		code   int
+	}{
+		{"", http.StatusUnauthorized},
+		{"Bearer wrong", http.StatusUnauthorized},
+		{"Basic s3cret", http.StatusUnauthorized},
+		{"Bearer s3cret", http.StatusNoContent},
+	} {
+		req := httptest.NewRequest("POST", "/admin/services/x/stop", nil)
+		if elt.header != "" {
+			req.Header.Set("Authorization", elt.header)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		assert.Equal(t, elt.code, w.Code, elt.header)
+	}
+}
@@ -0,0 +1,232 @@
+package tsnsrv
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	authCacheLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "tsnsrv_auth_cache_lookups_total",
+		Help: "Forward auth decisions looked up in the cache, by result (hit, miss)",
+	}, []string{"service_name", "result"})
+	authCacheEntries = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tsnsrv_auth_cache_entries",
+		Help: "Number of cached forward auth decisions",
+	}, []string{"service_name"})
+	authCacheEvictions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "tsnsrv_auth_cache_evictions_total",
+		Help: "Number of cached forward auth decisions dropped to stay within the size limit",
+	}, []string{"service_name"})
+)
+
+// Request attributes that forward auth decisions can be cached by.
+const (
+	// AuthCacheKeyCookie is the Cookie header; "cookie:NAME" is only
+	// the value of the cookie NAME.
+	AuthCacheKeyCookie = "cookie"
+	// AuthCacheKeyAuthorization is the Authorization header.
+	AuthCacheKeyAuthorization = "authorization"
+	// AuthCacheKeyHost is the requested host.
+	AuthCacheKeyHost = "host"
+	// AuthCacheKeyMethod is the request method.
+	AuthCacheKeyMethod = "method"
+	// AuthCacheKeyPath is the request path, without the query;
+	// "path:N" is only its first N segments.
+	AuthCacheKeyPath = "path"
+	// AuthCacheKeyQuery is the query string of the request.
+	AuthCacheKeyQuery = "query"
+)
+
+// authDenialBodyLimit is the largest denial body that is cached.
+const authDenialBodyLimit = 64 << 10
+
+// AuthCache configures caching of forward auth decisions, so that the
+// auth service isn't asked again about requests that it has recently
+// decided on with the same credentials.
+type AuthCache struct {
+	// TTL is how long a decision is reused. 0 disables the cache.
+	TTL time.Duration `yaml:"ttl,omitempty"`
+
+	// MaxEntries limits the number of cached decisions (default
+	// 1000); the least recently used ones are dropped first.
+	MaxEntries int `yaml:"maxEntries,omitempty"`
+
+	// Key lists the request attributes that a decision is cached by
+	// (default cookie, authorization, host, method, path and query). Requests
+	// that carry none of the configured credential attributes (cookie,
+	// authorization) are never cached.
+	Key []string `yaml:"key,omitempty"`
+
+	// CacheDenials caches 401 and 403 responses, too. Only successful
+	// decisions are cached otherwise.
+	CacheDenials bool `yaml:"cacheDenials,omitempty"`
+}
+
+func (ac AuthCache) enabled() bool {
+	return ac.TTL > 0
+}
+
+func (ac AuthCache) validate() error {
+	if ac.TTL < 0 || ac.MaxEntries < 0 {
+		return fmt.Errorf("auth cache settings can not be negative")
+	}
+	for _, attr := range ac.Key {
+		kind, arg, hasArg := strings.Cut(attr, ":")
+		switch {
+		case kind == AuthCacheKeyCookie && (!hasArg || arg != ""):
+		case kind == AuthCacheKeyPath && hasArg:
+			if n, err := strconv.Atoi(arg); err != nil || n < 1 {
+				return fmt.Errorf("auth cache key %q: path depth must be a positive number", attr)
+			}
+		case !hasArg && (kind == AuthCacheKeyAuthorization || kind == AuthCacheKeyHost || kind == AuthCacheKeyMethod || kind == AuthCacheKeyPath || kind == AuthCacheKeyQuery):
+		default:
+			return fmt.Errorf("unknown auth cache key %q", attr)
+		}
+	}
+	return nil
+}
+
+func (ac AuthCache) withDefaults() AuthCache {
+	if ac.MaxEntries == 0 {
+		ac.MaxEntries = 1000
+	}
+	if len(ac.Key) == 0 {
+		ac.Key = []string{AuthCacheKeyCookie, AuthCacheKeyAuthorization, AuthCacheKeyHost, AuthCacheKeyMethod, AuthCacheKeyPath, AuthCacheKeyQuery}
+	}
+	return ac
+}
+
+// key returns the cache key of r, and false if r should not be cached.
+func (ac AuthCache) key(r *http.Request) (string, bool) {
+	h := sha256.New()
+	hasCredentials := false
+	for _, attr := range ac.Key {
+		kind, arg, hasArg := strings.Cut(attr, ":")
+		var value string
+		switch kind {
+		case AuthCacheKeyCookie:
+			if hasArg {
+				if c, err := r.Cookie(arg); err == nil {
+					value = c.Value
+				}
+			} else {
+				value = strings.Join(r.Header.Values("Cookie"), "; ")
+			}
+			hasCredentials = hasCredentials || value != ""
+		case AuthCacheKeyAuthorization:
+			value = r.Header.Get("Authorization")
+			hasCredentials = hasCredentials || value != ""
+		case AuthCacheKeyHost:
+			value = r.Host
+		case AuthCacheKeyMethod:
+			value = r.Method
+		case AuthCacheKeyPath:
+			value = r.URL.Path
+			if hasArg {
+				depth, _ := strconv.Atoi(arg)
+				value = pathPrefix(value, depth)
+			}
+		case AuthCacheKeyQuery:
+			value = r.URL.RawQuery
+		}
+		// Length-prefix the values so that they can't run into each other:
+		fmt.Fprintf(h, "%s:%d:%s\n", attr, len(value), value)
+	}
+	if !hasCredentials {
+		return "", false
+	}
+	return hex.EncodeToString(h.Sum(nil)), true
+}
+
+// pathPrefix returns the first depth segments of path.
+func pathPrefix(path string, depth int) string {
+	segments := strings.SplitAfterN(strings.TrimPrefix(path, "/"), "/", depth+1)
+	if len(segments) <= depth {
+		return path
+	}
+	return "/" + strings.TrimSuffix(strings.Join(segments[:depth], ""), "/")
+}
+
+// authDecision is a response of the auth service, as far as it
+// matters for later requests.
+type authDecision struct {
+	status int
+	// header holds the copied headers of a granted request, or the
+	// response headers of a denial.
+	header http.Header
+	body   []byte
+}
+
+func (d authDecision) granted() bool {
+	return d.status >= 200 && d.status < 300
+}
+
+// authCache is a size-bounded LRU cache of auth decisions.
+type authCache struct {
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     list.List
+}
+
+type authCacheEntry struct {
+	key      string
+	decision authDecision
+	expires  time.Time
+}
+
+func (c *authCache) get(service, key string, now time.Time) (authDecision, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elt, ok := c.entries[key]; ok {
+		entry := elt.Value.(*authCacheEntry)
+		if now.Before(entry.expires) {
+			c.lru.MoveToFront(elt)
+			authCacheLookups.With(prometheus.Labels{"service_name": service, "result": "hit"}).Inc()
+			return entry.decision, true
+		}
+		c.removeLocked(elt)
+		authCacheEntries.With(prometheus.Labels{"service_name": service}).Set(float64(c.lru.Len()))
+	}
+	authCacheLookups.With(prometheus.Labels{"service_name": service, "result": "miss"}).Inc()
+	return authDecision{}, false
+}
+
+func (c *authCache) put(service, key string, decision authDecision, expires time.Time, maxEntries int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries == nil {
+		c.entries = make(map[string]*list.Element)
+	}
+	if elt, ok := c.entries[key]; ok {
+		c.removeLocked(elt)
+	}
+	c.entries[key] = c.lru.PushFront(&authCacheEntry{key: key, decision: decision, expires: expires})
+	for c.lru.Len() > maxEntries {
+		c.removeLocked(c.lru.Back())
+		authCacheEvictions.With(prometheus.Labels{"service_name": service}).Inc()
+	}
+	authCacheEntries.With(prometheus.Labels{"service_name": service}).Set(float64(c.lru.Len()))
+}
+
+func (c *authCache) removeLocked(elt *list.Element) {
+	delete(c.entries, elt.Value.(*authCacheEntry).key)
+	c.lru.Remove(elt)
+}
+
+func (c *authCache) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = nil
+	c.lru.Init()
+}
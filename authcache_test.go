@@ -0,0 +1,203 @@
+package tsnsrv
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuthCacheValidate(t *testing.T) {
+	t.Parallel()
+	for _, elt := range []struct {
+		key []string
+		ok  bool
+	}{
+		{[]string{"cookie", "authorization", "host", "method", "path", "query"}, true},
+		{[]string{"cookie:authelia_session", "path:2"}, true},
+		{[]string{"cookie:"}, false},
+		{[]string{"path:0"}, false},
+		{[]string{"path:x"}, false},
+		{[]string{"host:x"}, false},
+		{[]string{"query:x"}, false},
+	} {
+		err := AuthCache{TTL: time.Minute, Key: elt.key}.validate()
+		if elt.ok {
+			assert.NoError(t, err, "%v", elt.key)
+		} else {
+			assert.Error(t, err, "%v", elt.key)
+		}
+	}
+}
+
+func TestPathPrefix(t *testing.T) {
+	t.Parallel()
+	for _, elt := range []struct {
+		path  string
+		depth int
+		want  string
+	}{
+		{"/app/static/main.js", 1, "/app"},
+		{"/app/static/main.js", 2, "/app/static"},
+		{"/app/static/main.js", 5, "/app/static/main.js"},
+		{"/app", 1, "/app"},
+		{"/app/", 1, "/app"},
+		{"/", 1, "/"},
+	} {
+		assert.Equal(t, elt.want, pathPrefix(elt.path, elt.depth), "%s %d", elt.path, elt.depth)
+	}
+}
+
+func TestAuthCacheKey(t *testing.T) {
+	t.Parallel()
+	ac := AuthCache{Key: []string{"cookie:session", "host", "path:1"}}.withDefaults()
+	req := func(path, cookie string) *http.Request {
+		r := httptest.NewRequest("GET", path, nil)
+		if cookie != "" {
+			r.Header.Set("Cookie", cookie)
+		}
+		return r
+	}
+
+	_, ok := ac.key(req("/app/x", ""))
+	assert.False(t, ok, "requests without credentials aren't cached")
+	_, ok = ac.key(req("/app/x", "other=1"))
+	assert.False(t, ok, "only the configured cookie counts as a credential")
+
+	a, ok := ac.key(req("/app/x", "session=abc; other=1"))
+	require.True(t, ok)
+	b, _ := ac.key(req("/app/y", "other=2; session=abc"))
+	assert.Equal(t, a, b)
+	c, _ := ac.key(req("/admin/x", "session=abc"))
+	assert.NotEqual(t, a, c)
+	d, _ := ac.key(req("/app/x", "session=def"))
+	assert.NotEqual(t, a, d)
+	e, _ := ac.key(req("/app/x?tenant=2", "session=abc"))
+	assert.Equal(t, a, e, "the query only counts if it's part of the key")
+
+	// By default, it is:
+	ac = AuthCache{}.withDefaults()
+	a, _ = ac.key(req("/app/x?tenant=1", "session=abc"))
+	b, _ = ac.key(req("/app/x?tenant=2", "session=abc"))
+	assert.NotEqual(t, a, b)
+}
+
+func TestAuthCacheEviction(t *testing.T) {
+	t.Parallel()
+	var c authCache
+	now := time.Now()
+	expires := now.Add(time.Minute)
+	c.put("test", "a", authDecision{status: 200}, expires, 2)
+	c.put("test", "b", authDecision{status: 200}, expires, 2)
+	_, ok := c.get("test", "a", now)
+	require.True(t, ok)
+	c.put("test", "c", authDecision{status: 200}, expires, 2)
+
+	_, ok = c.get("test", "b", now)
+	assert.False(t, ok, "least recently used entry is evicted")
+	_, ok = c.get("test", "a", now)
+	assert.True(t, ok)
+	_, ok = c.get("test", "c", now)
+	assert.True(t, ok)
+
+	_, ok = c.get("test", "a", expires.Add(time.Second))
+	assert.False(t, ok, "expired entries aren't used")
+}
+
+func TestAuthMiddlewareCache(t *testing.T) {
+	t.Parallel()
+	var calls atomic.Int32
+	authServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		switch r.Header.Get("Authorization") {
+		case "Bearer good":
+			w.Header().Set("Remote-User", "testuser")
+			w.WriteHeader(http.StatusOK)
+		default:
+			w.Header().Set("Location", "https://auth.example.com/")
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte("log in first"))
+		}
+	}))
+	t.Cleanup(authServer.Close)
+
+	newServer := func(cache AuthCache) (*ValidTailnetSrv, http.Handler) {
+		s := &ValidTailnetSrv{TailnetSrv: TailnetSrv{
+			Name:            "test",
+			AuthURL:         authServer.URL,
+			AuthPath:        "/auth",
+			AuthTimeout:     5 * time.Second,
+			AuthCopyHeaders: headers{"Remote-User": []string{""}},
+			AuthCache:       cache,
+		}}
+		return s, s.authMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Upstream-User", r.Header.Get("Remote-User"))
+		}))
+	}
+	do := func(h http.Handler, authorization string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/app", nil)
+		req.Header.Set("Authorization", authorization)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("grants", func(t *testing.T) {
+		calls.Store(0)
+		_, h := newServer(AuthCache{TTL: time.Minute})
+		for range 3 {
+			w := do(h, "Bearer good")
+			assert.Equal(t, http.StatusOK, w.Code)
+			assert.Equal(t, "testuser", w.Header().Get("Upstream-User"), "copied headers are replayed")
+		}
+		assert.Equal(t, int32(1), calls.Load())
+	})
+
+	t.Run("denials not cached", func(t *testing.T) {
+		calls.Store(0)
+		_, h := newServer(AuthCache{TTL: time.Minute})
+		for range 3 {
+			w := do(h, "Bearer bad")
+			assert.Equal(t, http.StatusUnauthorized, w.Code)
+		}
+		assert.Equal(t, int32(3), calls.Load())
+	})
+
+	t.Run("denials cached", func(t *testing.T) {
+		calls.Store(0)
+		_, h := newServer(AuthCache{TTL: time.Minute, CacheDenials: true})
+		for range 3 {
+			w := do(h, "Bearer bad")
+			assert.Equal(t, http.StatusUnauthorized, w.Code)
+			assert.Equal(t, "https://auth.example.com/", w.Header().Get("Location"))
+			assert.Equal(t, "log in first", w.Body.String())
+		}
+		assert.Equal(t, int32(1), calls.Load())
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		calls.Store(0)
+		_, h := newServer(AuthCache{})
+		for range 3 {
+			do(h, "Bearer good")
+		}
+		assert.Equal(t, int32(3), calls.Load())
+	})
+
+	t.Run("spoofed copied headers", func(t *testing.T) {
+		calls.Store(0)
+		_, h := newServer(AuthCache{TTL: time.Minute})
+		do(h, "Bearer good")
+		req := httptest.NewRequest("GET", "/app", nil)
+		req.Header.Set("Authorization", "Bearer good")
+		req.Header.Set("Remote-User", "admin")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		assert.Equal(t, "testuser", w.Header().Get("Upstream-User"))
+		assert.Equal(t, int32(1), calls.Load())
+	})
+}
@@ -0,0 +1,292 @@
+package tsnsrv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Load balancing policies for services with multiple upstream targets.
+const (
+	// LoadBalanceRoundRobin sends requests to each target in turn.
+	LoadBalanceRoundRobin = "roundRobin"
+	// LoadBalanceLeastConn sends requests to the target with the
+	// fewest requests in flight.
+	LoadBalanceLeastConn = "leastConn"
+	// LoadBalanceUserHash sends all requests by the same Tailscale
+	// user to the same target, as long as the set of targets doesn't
+	// change. Requests without a known identity are sent round-robin.
+	LoadBalanceUserHash = "userHash"
+)
+
+var errLoadBalancing = fmt.Errorf("load balancing policy must be %q, %q or %q", LoadBalanceRoundRobin, LoadBalanceLeastConn, LoadBalanceUserHash)
+var errTargetFormat = errors.New("upstream target must be 'tcp:host:port', 'unix:/path/to/socket' or 'host:port'")
+var errTargetsAndAddr = errors.New("-upstreamTarget can not be combined with -upstreamTCPAddr or -upstreamUnixAddr")
+
+// upstreamTargets collects the addresses that a service load balances over.
+type upstreamTargets []string
+
+func (t *upstreamTargets) String() string {
+	return strings.Join(*t, ", ")
+}
+
+func (t *upstreamTargets) Set(value string) error {
+	if _, err := parseTarget(value); err != nil {
+		return err
+	}
+	*t = append(*t, value)
+	return nil
+}
+
+// parse validates the targets.
+func (t upstreamTargets) parse() ([]upstreamTarget, error) {
+	var errs []error
+	var parsed []upstreamTarget
+	for _, value := range t {
+		target, err := parseTarget(value)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		parsed = append(parsed, target)
+	}
+	return parsed, errors.Join(errs...)
+}
+
+// upstreamTarget is an address that serves a service's upstream.
+type upstreamTarget struct {
+	network, address string
+}
+
+func (t upstreamTarget) String() string {
+	return t.network + ":" + t.address
+}
+
+func parseTarget(value string) (upstreamTarget, error) {
+	switch {
+	case strings.HasPrefix(value, "unix:"):
+		path := strings.TrimPrefix(value, "unix:")
+		if path == "" {
+			return upstreamTarget{}, fmt.Errorf("%w: got %q", errTargetFormat, value)
+		}
+		return upstreamTarget{"unix", path}, nil
+	default:
+		addr := strings.TrimPrefix(value, "tcp:")
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return upstreamTarget{}, fmt.Errorf("%w: got %q", errTargetFormat, value)
+		}
+		return upstreamTarget{"tcp", addr}, nil
+	}
+}
+
+type dialFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+// dialTo returns a dial function that connects to target, whatever
+// address the transport asks for. TCP targets are dialed with dial,
+// unix sockets are always dialed locally.
+func dialTo(dial dialFunc, target upstreamTarget) dialFunc {
+	if target.network == "unix" {
+		return func(ctx context.Context, _, _ string) (net.Conn, error) {
+			d := net.Dialer{}
+			conn, err := d.DialContext(ctx, "unix", target.address)
+			if err != nil {
+				return nil, fmt.Errorf("connecting to unix %v: %w", target.address, err)
+			}
+			return conn, nil
+		}
+	}
+	return func(ctx context.Context, _, _ string) (net.Conn, error) {
+		conn, err := dial(ctx, "tcp", target.address)
+		if err != nil {
+			return nil, fmt.Errorf("connecting to tcp %v: %w", target.address, err)
+		}
+		return conn, nil
+	}
+}
+
+// backend is an upstream target with its own connection pool.
+type backend struct {
+	target    upstreamTarget
+	transport http.RoundTripper
+	active    atomic.Int64
+
+	// healthy is the outcome of the last active health check.
+	healthy atomic.Bool
+	// failures counts consecutive proxy errors.
+	failures atomic.Int64
+	// ejectedUntil is when a passively ejected backend may receive requests again.
+	ejectedUntil atomic.Int64
+}
+
+func (be *backend) available(now time.Time) bool {
+	return be.healthy.Load() && now.UnixNano() >= be.ejectedUntil.Load()
+}
+
+// balancer is a RoundTripper that spreads requests over several
+// backends according to a load balancing policy, skipping unhealthy
+// backends.
+type balancer struct {
+	service  string
+	policy   string
+	health   HealthCheck
+	backends []*backend
+	next     atomic.Uint64
+}
+
+func newBalancer(service, policy string, health HealthCheck, targets []upstreamTarget, transport func(upstreamTarget) http.RoundTripper) *balancer {
+	b := &balancer{service: service, policy: policy, health: health.withDefaults()}
+	for _, target := range targets {
+		be := &backend{target: target, transport: transport(target)}
+		be.healthy.Store(true)
+		b.backends = append(b.backends, be)
+	}
+	return b
+}
+
+func (b *balancer) RoundTrip(req *http.Request) (*http.Response, error) {
+	be := b.pick(req)
+	if be == nil {
+		return nil, errNoHealthyUpstream
+	}
+	if attempt := retryAttemptFor(req); attempt != nil {
+		attempt.tried = append(attempt.tried, be)
+	}
+	be.active.Add(1)
+	res, err := be.transport.RoundTrip(req)
+	if req.Context().Err() == nil {
+		// Requests that the client gave up on say nothing about the backend.
+		b.observe(be, err)
+	}
+	if err != nil {
+		be.active.Add(-1)
+		return nil, err
+	}
+	// The request is in flight until its response has been read:
+	body := &releasingBody{ReadCloser: res.Body, release: func() { be.active.Add(-1) }}
+	if w, ok := res.Body.(io.Writer); ok && res.StatusCode == http.StatusSwitchingProtocols {
+		// ReverseProxy needs to write to upgraded connections.
+		res.Body = upgradedBody{body, w}
+	} else {
+		res.Body = body
+	}
+	return res, nil
+}
+
+// pick returns the backend to send req to, or nil if no backend is
+// healthy. Retries go to a backend that wasn't tried yet, if possible.
+func (b *balancer) pick(req *http.Request) *backend {
+	now := time.Now()
+	tried := triedBackends(req)
+	if be := b.pickFrom(req, func(be *backend) bool { return be.available(now) && !slices.Contains(tried, be) }); be != nil || len(tried) == 0 {
+		return be
+	}
+	return b.pickFrom(req, func(be *backend) bool { return be.available(now) })
+}
+
+// pickFrom picks one of the usable backends according to the policy.
+func (b *balancer) pickFrom(req *http.Request, usable func(*backend) bool) *backend {
+	switch b.policy {
+	case LoadBalanceLeastConn:
+		return b.leastConn(usable)
+	case LoadBalanceUserHash:
+		if key := identityKey(req); key != "" {
+			return b.hashed(usable, key)
+		}
+	}
+	return b.roundRobin(usable)
+}
+
+func (b *balancer) roundRobin(usable func(*backend) bool) *backend {
+	n := b.next.Add(1) - 1
+	for i := range uint64(len(b.backends)) {
+		be := b.backends[(n+i)%uint64(len(b.backends))]
+		if usable(be) {
+			return be
+		}
+	}
+	return nil
+}
+
+func (b *balancer) leastConn(usable func(*backend) bool) *backend {
+	// Start at a rotating offset so ties are spread out:
+	start := int(b.next.Add(1) - 1)
+	var best *backend
+	for i := range b.backends {
+		be := b.backends[(start+i)%len(b.backends)]
+		if !usable(be) {
+			continue
+		}
+		if best == nil || be.active.Load() < best.active.Load() {
+			best = be
+		}
+	}
+	return best
+}
+
+// hashed picks a backend by rendezvous hashing, so that only the keys
+// of an unavailable target move when the set of targets changes.
+func (b *balancer) hashed(usable func(*backend) bool, key string) *backend {
+	var best *backend
+	var bestScore uint64
+	for _, be := range b.backends {
+		if !usable(be) {
+			continue
+		}
+		h := fnv.New64a()
+		h.Write([]byte(be.target.String()))
+		h.Write([]byte{0})
+		h.Write([]byte(key))
+		if score := mix(h.Sum64()); best == nil || score > bestScore {
+			best, bestScore = be, score
+		}
+	}
+	return best
+}
+
+// mix spreads the bits of an FNV hash, which differ only a little for
+// similar keys (splitmix64's finalizer).
+func mix(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// identityKey returns the Tailscale user that the request was
+// proxied for, as looked up while rewriting it.
+func identityKey(req *http.Request) string {
+	p, ok := req.Context().Value(proxyContextKey).(*proxyContext)
+	if !ok || p == nil || p.who == nil || p.who.UserProfile == nil {
+		return ""
+	}
+	return p.who.UserProfile.ID.String()
+}
+
+// releasingBody calls release once, when the body is closed.
+type releasingBody struct {
+	io.ReadCloser
+	once    atomic.Bool
+	release func()
+}
+
+func (b *releasingBody) Close() error {
+	if b.once.CompareAndSwap(false, true) {
+		b.release()
+	}
+	return b.ReadCloser.Close()
+}
+
+type upgradedBody struct {
+	*releasingBody
+	io.Writer
+}
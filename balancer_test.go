@@ -0,0 +1,134 @@
+package tsnsrv
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/tailcfg"
+)
+
+func TestParseTarget(t *testing.T) {
+	t.Parallel()
+	for _, elt := range []struct {
+		value    string
+		expected upstreamTarget
+		err      bool
+	}{
+		{value: "tcp:127.0.0.1:8080", expected: upstreamTarget{"tcp", "127.0.0.1:8080"}},
+		{value: "backend:80", expected: upstreamTarget{"tcp", "backend:80"}},
+		{value: "unix:/run/app.sock", expected: upstreamTarget{"unix", "/run/app.sock"}},
+		{value: "unix:", err: true},
+		{value: "backend", err: true},
+	} {
+		t.Run(elt.value, func(t *testing.T) {
+			target, err := parseTarget(elt.value)
+			if elt.err {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, elt.expected, target)
+		})
+	}
+}
+
+// serveTargets starts a TCP and a unix socket upstream that each respond with their name.
+func serveTargets(t *testing.T) []upstreamTarget {
+	name := func(n string) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, n)
+		})
+	}
+	tcp := httptest.NewServer(name("tcp"))
+	t.Cleanup(tcp.Close)
+
+	sock := filepath.Join(t.TempDir(), "upstream.sock")
+	l, err := net.Listen("unix", sock)
+	require.NoError(t, err)
+	unix := httptest.NewUnstartedServer(name("unix"))
+	unix.Listener = l
+	unix.Start()
+	t.Cleanup(unix.Close)
+
+	return []upstreamTarget{{"tcp", tcp.Listener.Addr().String()}, {"unix", sock}}
+}
+
+func newTestBalancer(policy string, health HealthCheck, targets []upstreamTarget) *balancer {
+	d := net.Dialer{}
+	return newBalancer("test", policy, health, targets, func(target upstreamTarget) http.RoundTripper {
+		return &http.Transport{DialContext: dialTo(d.DialContext, target)}
+	})
+}
+
+func get(t *testing.T, client *http.Client, ctx context.Context) string {
+	req, err := http.NewRequestWithContext(ctx, "GET", "http://upstream/", nil)
+	require.NoError(t, err)
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return string(body)
+}
+
+func TestBalancerRoundRobin(t *testing.T) {
+	t.Parallel()
+	client := &http.Client{Transport: newTestBalancer(LoadBalanceRoundRobin, HealthCheck{}, serveTargets(t))}
+	var seen []string
+	for range 4 {
+		seen = append(seen, get(t, client, context.Background()))
+	}
+	assert.Equal(t, []string{"tcp", "unix", "tcp", "unix"}, seen)
+}
+
+func TestBalancerLeastConn(t *testing.T) {
+	t.Parallel()
+	b := newTestBalancer(LoadBalanceLeastConn, HealthCheck{}, serveTargets(t))
+	client := &http.Client{Transport: b}
+
+	// Hold a response open on the first target:
+	req, err := http.NewRequest("GET", "http://upstream/", nil)
+	require.NoError(t, err)
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	busy, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	for range 3 {
+		assert.NotEqual(t, string(busy), get(t, client, context.Background()))
+	}
+	resp.Body.Close()
+	for _, be := range b.backends {
+		assert.Equal(t, int64(0), be.active.Load())
+	}
+}
+
+func TestBalancerUserHash(t *testing.T) {
+	t.Parallel()
+	client := &http.Client{Transport: newTestBalancer(LoadBalanceUserHash, HealthCheck{}, serveTargets(t))}
+	asUser := func(id tailcfg.UserID) context.Context {
+		return context.WithValue(context.Background(), proxyContextKey, &proxyContext{
+			who: &apitype.WhoIsResponse{UserProfile: &tailcfg.UserProfile{ID: id}},
+		})
+	}
+	seen := map[string]bool{}
+	for id := range tailcfg.UserID(20) {
+		first := get(t, client, asUser(id))
+		seen[first] = true
+		for range 3 {
+			assert.Equal(t, first, get(t, client, asUser(id)), "user %v is sticky", id)
+		}
+	}
+	assert.Len(t, seen, 2, "users are spread over all targets")
+
+	// Without an identity, requests are spread round-robin:
+	assert.NotEqual(t, get(t, client, context.Background()), get(t, client, context.Background()))
+}
@@ -0,0 +1,265 @@
+package tsnsrv
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"golang.org/x/exp/slog"
+)
+
+var (
+	breakerStates = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tsnsrv_circuit_breaker_state",
+		Help: "State of a circuit breaker (0: closed, 1: open, 2: half-open)",
+	}, []string{"service_name", "breaker"})
+	breakerTransitions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "tsnsrv_circuit_breaker_transitions_total",
+		Help: "Circuit breaker state changes, by the state changed to",
+	}, []string{"service_name", "breaker", "state"})
+)
+
+var errCircuitOpen = errors.New("circuit breaker is open")
+
+// CircuitBreakers stop sending requests to a service that keeps
+// failing, so that clients get an error right away instead of waiting
+// for a timeout.
+type CircuitBreakers struct {
+	// Upstream guards the main upstream, in front of any retries.
+	// Requests to routes' upstreams don't go through it.
+	Upstream CircuitBreaker `yaml:"upstream,omitempty"`
+
+	// Auth guards the forward auth service.
+	Auth CircuitBreaker `yaml:"auth,omitempty"`
+}
+
+// CircuitBreaker configures one circuit breaker.
+type CircuitBreaker struct {
+	// FailureThreshold is how many requests in a row must fail for
+	// the breaker to open. 0 disables the breaker.
+	FailureThreshold int `yaml:"failureThreshold,omitempty"`
+
+	// OpenDuration is how long an open breaker rejects requests before
+	// letting probes through (default 30s).
+	OpenDuration time.Duration `yaml:"openDuration,omitempty"`
+
+	// HalfOpenRequests is how many probe requests are let through at
+	// once, and how many must succeed to close the breaker again
+	// (default 1).
+	HalfOpenRequests int `yaml:"halfOpenRequests,omitempty"`
+
+	// ErrorPageFile is an HTML page served (with status 503) while
+	// the breaker is open. Without it, a plain text error is served.
+	ErrorPageFile string `yaml:"errorPageFile,omitempty"`
+}
+
+func (cb CircuitBreaker) enabled() bool {
+	return cb.FailureThreshold > 0
+}
+
+func (cb CircuitBreaker) withDefaults() CircuitBreaker {
+	if cb.OpenDuration == 0 {
+		cb.OpenDuration = 30 * time.Second
+	}
+	if cb.HalfOpenRequests == 0 {
+		cb.HalfOpenRequests = 1
+	}
+	return cb
+}
+
+func (cb CircuitBreaker) validate(name string) error {
+	if cb.FailureThreshold < 0 || cb.OpenDuration < 0 || cb.HalfOpenRequests < 0 {
+		return fmt.Errorf("%s circuit breaker settings can not be negative", name)
+	}
+	return nil
+}
+
+func (cbs CircuitBreakers) validate() error {
+	return errors.Join(cbs.Upstream.validate("upstream"), cbs.Auth.validate("auth"))
+}
+
+// breakerState is the state of a circuit breaker.
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func (st breakerState) String() string {
+	switch st {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// breakerResult is the outcome of a request, as far as a circuit
+// breaker is concerned.
+type breakerResult int
+
+const (
+	breakerSuccess breakerResult = iota
+	breakerFailure
+	// breakerIgnored is a request that says nothing about the
+	// service, e.g. because the client gave up on it.
+	breakerIgnored
+)
+
+// circuitBreaker counts failures of a service, and rejects requests
+// while it's open.
+type circuitBreaker struct {
+	service, name string
+	config        CircuitBreaker
+	errorPage     []byte
+
+	mu    sync.Mutex
+	state breakerState
+	// generation counts state changes, so that requests sent in an
+	// earlier state don't count towards the current one.
+	generation int
+	failures   int
+	openedAt   time.Time
+	probes     int
+	successes  int
+}
+
+// newCircuitBreaker sets up a breaker, reading its error page.
+func newCircuitBreaker(service, name string, config CircuitBreaker) (*circuitBreaker, error) {
+	cb := &circuitBreaker{service: service, name: name, config: config.withDefaults()}
+	if config.ErrorPageFile != "" {
+		page, err := os.ReadFile(config.ErrorPageFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading %s circuit breaker error page: %w", name, err)
+		}
+		cb.errorPage = page
+	}
+	breakerStates.With(prometheus.Labels{"service_name": service, "breaker": name}).Set(float64(breakerClosed))
+	return cb, nil
+}
+
+// allow returns whether a request may be sent. If so, the caller must
+// report its outcome with done.
+func (cb *circuitBreaker) allow(now time.Time) (done func(breakerResult), allowed bool) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if cb.state == breakerOpen && now.Sub(cb.openedAt) >= cb.config.OpenDuration {
+		cb.transitionLocked(breakerHalfOpen, now)
+	}
+	switch cb.state {
+	case breakerOpen:
+		return nil, false
+	case breakerHalfOpen:
+		if cb.probes >= cb.config.HalfOpenRequests {
+			return nil, false
+		}
+		cb.probes++
+	}
+	var once sync.Once
+	generation := cb.generation
+	return func(result breakerResult) { once.Do(func() { cb.record(generation, result, time.Now()) }) }, true
+}
+
+func (cb *circuitBreaker) record(generation int, result breakerResult, now time.Time) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if generation != cb.generation {
+		return
+	}
+	switch cb.state {
+	case breakerClosed:
+		switch result {
+		case breakerSuccess:
+			cb.failures = 0
+		case breakerFailure:
+			cb.failures++
+			if cb.failures >= cb.config.FailureThreshold {
+				cb.transitionLocked(breakerOpen, now)
+			}
+		}
+	case breakerHalfOpen:
+		cb.probes--
+		switch result {
+		case breakerIgnored:
+			return
+		case breakerFailure:
+			cb.transitionLocked(breakerOpen, now)
+			return
+		}
+		cb.successes++
+		if cb.successes >= cb.config.HalfOpenRequests {
+			cb.transitionLocked(breakerClosed, now)
+		}
+	}
+}
+
+func (cb *circuitBreaker) transitionLocked(to breakerState, now time.Time) {
+	from := cb.state
+	cb.state = to
+	cb.generation++
+	cb.failures, cb.probes, cb.successes = 0, 0, 0
+	if to == breakerOpen {
+		cb.openedAt = now
+	}
+	labels := prometheus.Labels{"service_name": cb.service, "breaker": cb.name}
+	breakerStates.With(labels).Set(float64(to))
+	labels["state"] = to.String()
+	breakerTransitions.With(labels).Inc()
+	log := slog.Info
+	if to == breakerOpen {
+		log = slog.Warn
+	}
+	log("circuit breaker state changed",
+		"service", cb.service,
+		"breaker", cb.name,
+		"from", from.String(),
+		"to", to.String(),
+	)
+}
+
+// serveOpen responds to a request that the open breaker rejected.
+func (cb *circuitBreaker) serveOpen(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", fmt.Sprint(int(cb.config.OpenDuration.Seconds())))
+	if cb.errorPage == nil {
+		http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	w.Write(cb.errorPage)
+}
+
+// breakerTransport is a RoundTripper that counts connection errors and
+// gateway errors of the upstream as failures.
+type breakerTransport struct {
+	breaker *circuitBreaker
+	next    http.RoundTripper
+}
+
+func (t *breakerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	done, ok := t.breaker.allow(time.Now())
+	if !ok {
+		return nil, errCircuitOpen
+	}
+	res, err := t.next.RoundTrip(req)
+	switch {
+	case req.Context().Err() != nil:
+		done(breakerIgnored)
+	case err != nil:
+		done(breakerFailure)
+	case res.StatusCode == http.StatusBadGateway || res.StatusCode == http.StatusServiceUnavailable || res.StatusCode == http.StatusGatewayTimeout:
+		done(breakerFailure)
+	default:
+		done(breakerSuccess)
+	}
+	return res, err
+}
@@ -0,0 +1,171 @@
+package tsnsrv
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCircuitBreakersValidate(t *testing.T) {
+	t.Parallel()
+	assert.NoError(t, CircuitBreakers{}.validate())
+	assert.NoError(t, CircuitBreakers{Upstream: CircuitBreaker{FailureThreshold: 5}}.validate())
+	assert.Error(t, CircuitBreakers{Auth: CircuitBreaker{FailureThreshold: -1}}.validate())
+	assert.Error(t, CircuitBreakers{Upstream: CircuitBreaker{OpenDuration: -time.Second}}.validate())
+}
+
+func TestCircuitBreakerStates(t *testing.T) {
+	t.Parallel()
+	cb, err := newCircuitBreaker(t.Name(), "upstream", CircuitBreaker{FailureThreshold: 2, OpenDuration: time.Minute, HalfOpenRequests: 2})
+	require.NoError(t, err)
+	now := time.Now()
+	send := func(at time.Time, result breakerResult) bool {
+		done, ok := cb.allow(at)
+		if ok {
+			done(result)
+		}
+		return ok
+	}
+
+	assert.True(t, send(now, breakerFailure))
+	assert.True(t, send(now, breakerSuccess), "a success resets the failure count")
+	assert.True(t, send(now, breakerFailure))
+	assert.Equal(t, breakerClosed, cb.state)
+	assert.True(t, send(now, breakerFailure))
+	assert.Equal(t, breakerOpen, cb.state)
+	assert.False(t, send(now.Add(30*time.Second), breakerSuccess), "open breakers fail fast")
+
+	// Half-open lets a limited number of probes through:
+	later := now.Add(2 * time.Minute)
+	probe1, ok := cb.allow(later)
+	require.True(t, ok)
+	assert.Equal(t, breakerHalfOpen, cb.state)
+	probe2, ok := cb.allow(later)
+	require.True(t, ok)
+	_, ok = cb.allow(later)
+	assert.False(t, ok)
+	probe1(breakerIgnored)
+	probe3, ok := cb.allow(later)
+	require.True(t, ok, "ignored probes free their slot")
+	probe2(breakerSuccess)
+	probe3(breakerFailure)
+	assert.Equal(t, breakerOpen, cb.state, "a failed probe opens the breaker again")
+
+	later = later.Add(2 * time.Minute)
+	assert.True(t, send(later, breakerSuccess))
+	assert.True(t, send(later, breakerSuccess))
+	assert.Equal(t, breakerClosed, cb.state)
+}
+
+func TestCircuitBreakerStaleResults(t *testing.T) {
+	t.Parallel()
+	cb, err := newCircuitBreaker(t.Name(), "upstream", CircuitBreaker{FailureThreshold: 1})
+	require.NoError(t, err)
+	now := time.Now()
+	slow, ok := cb.allow(now)
+	require.True(t, ok)
+	fail, ok := cb.allow(now)
+	require.True(t, ok)
+	fail(breakerFailure)
+	require.Equal(t, breakerOpen, cb.state)
+
+	probe, ok := cb.allow(now.Add(time.Hour))
+	require.True(t, ok)
+	slow(breakerSuccess)
+	assert.Equal(t, breakerHalfOpen, cb.state, "requests from before the breaker opened don't close it")
+	assert.Equal(t, 1, cb.probes)
+	probe(breakerSuccess)
+	assert.Equal(t, breakerClosed, cb.state)
+}
+
+func TestBreakerTransport(t *testing.T) {
+	t.Parallel()
+	cb, err := newCircuitBreaker(t.Name(), "upstream", CircuitBreaker{FailureThreshold: 2})
+	require.NoError(t, err)
+	upstream := &scriptedUpstream{script: []int{0, 503, 200}}
+	transport := &breakerTransport{breaker: cb, next: upstream}
+	do := func() (*http.Response, error) {
+		req, err := http.NewRequest("GET", "http://upstream/", nil)
+		require.NoError(t, err)
+		return transport.RoundTrip(req)
+	}
+
+	_, err = do()
+	assert.Error(t, err)
+	res, err := do()
+	require.NoError(t, err)
+	assert.Equal(t, 503, res.StatusCode)
+	_, err = do()
+	assert.ErrorIs(t, err, errCircuitOpen)
+	assert.Len(t, upstream.bodies, 2, "the upstream isn't asked while the breaker is open")
+}
+
+func TestBreakerErrorPage(t *testing.T) {
+	t.Parallel()
+	page := filepath.Join(t.TempDir(), "down.html")
+	require.NoError(t, os.WriteFile(page, []byte("<h1>Down for maintenance</h1>"), 0o600))
+	cb, err := newCircuitBreaker(t.Name(), "upstream", CircuitBreaker{FailureThreshold: 1, ErrorPageFile: page})
+	require.NoError(t, err)
+	s := &ValidTailnetSrv{TailnetSrv: TailnetSrv{Name: t.Name()}, upstreamBreaker: cb}
+
+	w := httptest.NewRecorder()
+	s.errorHandler(w, httptest.NewRequest("GET", "/", nil), errCircuitOpen)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, "text/html; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.Equal(t, "30", w.Header().Get("Retry-After"))
+	assert.Equal(t, "<h1>Down for maintenance</h1>", w.Body.String())
+
+	w = httptest.NewRecorder()
+	s.errorHandler(w, httptest.NewRequest("GET", "/", nil), errors.New("connection refused"))
+	assert.Equal(t, http.StatusBadGateway, w.Code)
+
+	_, err = newCircuitBreaker(t.Name(), "upstream", CircuitBreaker{FailureThreshold: 1, ErrorPageFile: filepath.Join(t.TempDir(), "missing.html")})
+	assert.Error(t, err)
+}
+
+func TestAuthCircuitBreaker(t *testing.T) {
+	t.Parallel()
+	var calls atomic.Int32
+	authServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer authServer.Close()
+
+	cb, err := newCircuitBreaker(t.Name(), "auth", CircuitBreaker{FailureThreshold: 2})
+	require.NoError(t, err)
+	s := &ValidTailnetSrv{
+		TailnetSrv: TailnetSrv{
+			Name:        t.Name(),
+			AuthURL:     authServer.URL,
+			AuthPath:    "/api/authz/forward-auth",
+			AuthTimeout: 5 * time.Second,
+		},
+		authBreaker: cb,
+	}
+	handler := s.authMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("requests must not pass a failing auth service")
+	}))
+	var codes []int
+	for range 3 {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		body, _ := io.ReadAll(w.Body)
+		codes = append(codes, w.Code)
+		if w.Code == http.StatusServiceUnavailable {
+			assert.Equal(t, "Service Unavailable", strings.TrimSpace(string(body)))
+		}
+	}
+	assert.Equal(t, []int{http.StatusInternalServerError, http.StatusInternalServerError, http.StatusServiceUnavailable}, codes)
+	assert.EqualValues(t, 2, calls.Load())
+}
@@ -0,0 +1,231 @@
+package tsnsrv
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/exp/slog"
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/tailcfg"
+)
+
+// Formats in which application capabilities are passed to the upstream.
+const (
+	// CapabilityFormatHeader sends the capabilities as a JSON object in
+	// the X-Tailscale-App-Capabilities header.
+	CapabilityFormatHeader = "header"
+	// CapabilityFormatSigned sends a JSON document with the
+	// capabilities and the requestor's identity, signed with
+	// HMAC-SHA256, in the X-Tailscale-App-Capabilities-Signed header.
+	CapabilityFormatSigned = "signed"
+)
+
+const (
+	capabilitiesHeader       = "X-Tailscale-App-Capabilities"
+	signedCapabilitiesHeader = "X-Tailscale-App-Capabilities-Signed"
+
+	// signedCapabilitiesLifetime is how long a signed document is valid.
+	signedCapabilitiesLifetime = 1 * time.Minute
+)
+
+var errCapabilityFormat = fmt.Errorf("capability format must be %q or %q", CapabilityFormatHeader, CapabilityFormatSigned)
+var errCapabilityTooLarge = errors.New("application capabilities exceed the size limit")
+var errCapabilityMalformed = errors.New("application capability is not valid JSON")
+
+type capabilityContextKey struct{}
+
+// CapabilityForwarding configures which of the requestor's application
+// capabilities (granted by the tailnet policy file) are passed to the
+// upstream, with their JSON values.
+type CapabilityForwarding struct {
+	// Names are the capabilities to forward. Nothing is forwarded if empty.
+	Names []string `yaml:"names,omitempty"`
+
+	// Format is CapabilityFormatHeader (the default) or CapabilityFormatSigned.
+	Format string `yaml:"format,omitempty"`
+
+	// SigningKeyFile contains the secret that signed documents are
+	// signed with; required with CapabilityFormatSigned.
+	SigningKeyFile string `yaml:"signingKeyFile,omitempty"`
+
+	// MaxSize limits the size of the header value in bytes (default 16384).
+	// Requests whose capabilities don't fit are rejected.
+	MaxSize int `yaml:"maxSize,omitempty"`
+}
+
+func (cf CapabilityForwarding) validate() error {
+	switch cf.Format {
+	case "", CapabilityFormatHeader:
+	case CapabilityFormatSigned:
+		if len(cf.Names) > 0 && cf.SigningKeyFile == "" {
+			return errors.New("signed capabilities require a signing key file")
+		}
+	default:
+		return fmt.Errorf("%w, got %q", errCapabilityFormat, cf.Format)
+	}
+	if cf.MaxSize < 0 {
+		return fmt.Errorf("capability size limit can not be negative, got %d", cf.MaxSize)
+	}
+	return nil
+}
+
+func (cf CapabilityForwarding) withDefaults() CapabilityForwarding {
+	if cf.Format == "" {
+		cf.Format = CapabilityFormatHeader
+	}
+	if cf.MaxSize == 0 {
+		cf.MaxSize = 16384
+	}
+	return cf
+}
+
+// capabilityNames collects the capabilities given on the commandline.
+type capabilityNames []string
+
+func (c *capabilityNames) String() string {
+	return strings.Join(*c, ", ")
+}
+
+func (c *capabilityNames) Set(value string) error {
+	*c = append(*c, value)
+	return nil
+}
+
+// readCapabilityKey reads the secret that signed capability documents are signed with.
+func readCapabilityKey(path string) ([]byte, error) {
+	return readSecretKey(path, "capability signing key", 32)
+}
+
+// readSecretKey reads a secret from a file, ignoring surrounding
+// whitespace, and checks that it's at least minLen bytes long.
+func readSecretKey(path string, what string, minLen int) ([]byte, error) {
+	key, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %w", what, err)
+	}
+	key = []byte(strings.TrimSpace(string(key)))
+	if len(key) < minLen {
+		return nil, fmt.Errorf("%s in %q must be at least %d bytes long", what, path, minLen)
+	}
+	return key, nil
+}
+
+// signedCapabilities is the document sent with CapabilityFormatSigned.
+type signedCapabilities struct {
+	Capabilities map[string][]json.RawMessage `json:"capabilities"`
+	User         string                       `json:"user,omitempty"`
+	Node         string                       `json:"node,omitempty"`
+	Service      string                       `json:"service"`
+	IssuedAt     int64                        `json:"iat"`
+	Expires      int64                        `json:"exp"`
+}
+
+// encodeCapabilities returns the header that carries the requestor's
+// forwarded capabilities, and its value.
+func (s *ValidTailnetSrv) encodeCapabilities(who *apitype.WhoIsResponse, now time.Time) (string, string, error) {
+	cf := s.Capabilities.withDefaults()
+	caps := make(map[string][]json.RawMessage)
+	if who != nil {
+		for _, name := range cf.Names {
+			values, ok := who.CapMap[tailcfg.PeerCapability(name)]
+			if !ok {
+				continue
+			}
+			raw := make([]json.RawMessage, 0, len(values))
+			for _, v := range values {
+				if !json.Valid([]byte(v)) {
+					return "", "", fmt.Errorf("%w: %s", errCapabilityMalformed, name)
+				}
+				raw = append(raw, json.RawMessage(v))
+			}
+			caps[name] = raw
+		}
+	}
+
+	var header, value string
+	switch cf.Format {
+	case CapabilityFormatSigned:
+		doc := signedCapabilities{
+			Capabilities: caps,
+			Service:      s.Name,
+			IssuedAt:     now.Unix(),
+			Expires:      now.Add(signedCapabilitiesLifetime).Unix(),
+		}
+		if who != nil && who.UserProfile != nil {
+			doc.User = who.UserProfile.LoginName
+		}
+		if who != nil && who.Node != nil {
+			doc.Node = who.Node.ComputedName
+		}
+		payload, err := json.Marshal(doc)
+		if err != nil {
+			return "", "", fmt.Errorf("%w: %w", errCapabilityMalformed, err)
+		}
+		mac := hmac.New(sha256.New, s.capabilityKey)
+		mac.Write(payload)
+		header = signedCapabilitiesHeader
+		value = base64.RawURLEncoding.EncodeToString(payload) + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+	default:
+		payload, err := json.Marshal(caps)
+		if err != nil {
+			return "", "", fmt.Errorf("%w: %w", errCapabilityMalformed, err)
+		}
+		header, value = capabilitiesHeader, string(payload)
+	}
+	if len(value) > cf.MaxSize {
+		return "", "", fmt.Errorf("%w: %d bytes, limit is %d", errCapabilityTooLarge, len(value), cf.MaxSize)
+	}
+	return header, value, nil
+}
+
+// forwardedCapability is a header computed by capabilityMiddleware, for
+// the rewrite to set on the upstream request.
+type forwardedCapability struct {
+	header, value string
+}
+
+// capabilityMiddleware looks up the requestor's application
+// capabilities and rejects requests whose capabilities can not be
+// forwarded.
+func (s *ValidTailnetSrv) capabilityMiddleware(next http.Handler) http.Handler {
+	if len(s.Capabilities.Names) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		who, err := s.whoisFor(r)
+		if err != nil {
+			who = nil
+		}
+		header, value, err := s.encodeCapabilities(who, time.Now())
+		if err != nil {
+			slog.Error("could not forward application capabilities",
+				"service", s.Name,
+				"remote_addr", r.RemoteAddr,
+				"url", r.URL,
+				"error", err,
+			)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		ctx := context.WithValue(r.Context(), capabilityContextKey{}, forwardedCapability{header, value})
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// setCapabilityHeader sets the header computed by capabilityMiddleware.
+func setCapabilityHeader(out *http.Request, in *http.Request) {
+	fc, ok := in.Context().Value(capabilityContextKey{}).(forwardedCapability)
+	if !ok {
+		return
+	}
+	out.Header.Set(fc.header, fc.value)
+}
@@ -0,0 +1,154 @@
+package tsnsrv
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/tailcfg"
+)
+
+func whoWithCaps(caps map[string][]string) *apitype.WhoIsResponse {
+	who := identity("alice@example.com", "laptop", nil)
+	for name, values := range caps {
+		for _, v := range values {
+			who.CapMap[tailcfg.PeerCapability(name)] = append(who.CapMap[tailcfg.PeerCapability(name)], tailcfg.RawMessage(v))
+		}
+	}
+	return who
+}
+
+func TestEncodeCapabilitiesHeader(t *testing.T) {
+	t.Parallel()
+	s := &ValidTailnetSrv{TailnetSrv: TailnetSrv{Name: "test", Capabilities: CapabilityForwarding{
+		Names: []string{"example.com/cap/app", "example.com/cap/missing"},
+	}}}
+	who := whoWithCaps(map[string][]string{
+		"example.com/cap/app":   {`{"role": "admin"}`, `{"role":"viewer"}`},
+		"example.com/cap/other": {`{"secret":true}`},
+	})
+	header, value, err := s.encodeCapabilities(who, time.Now())
+	require.NoError(t, err)
+	assert.Equal(t, "X-Tailscale-App-Capabilities", header)
+	assert.JSONEq(t, `{"example.com/cap/app":[{"role":"admin"},{"role":"viewer"}]}`, value)
+
+	_, value, err = s.encodeCapabilities(nil, time.Now())
+	require.NoError(t, err)
+	assert.Equal(t, "{}", value)
+}
+
+func TestEncodeCapabilitiesErrors(t *testing.T) {
+	t.Parallel()
+	s := &ValidTailnetSrv{TailnetSrv: TailnetSrv{Name: "test", Capabilities: CapabilityForwarding{
+		Names:   []string{"example.com/cap/app"},
+		MaxSize: 64,
+	}}}
+	_, _, err := s.encodeCapabilities(whoWithCaps(map[string][]string{"example.com/cap/app": {`{"role":`}}), time.Now())
+	assert.ErrorIs(t, err, errCapabilityMalformed)
+
+	big := `{"data":"` + strings.Repeat("x", 100) + `"}`
+	_, _, err = s.encodeCapabilities(whoWithCaps(map[string][]string{"example.com/cap/app": {big}}), time.Now())
+	assert.ErrorIs(t, err, errCapabilityTooLarge)
+}
+
+func TestEncodeCapabilitiesSigned(t *testing.T) {
+	t.Parallel()
+	key := []byte(strings.Repeat("k", 32))
+	s := &ValidTailnetSrv{
+		TailnetSrv: TailnetSrv{Name: "test", Capabilities: CapabilityForwarding{
+			Names:  []string{"example.com/cap/app"},
+			Format: CapabilityFormatSigned,
+		}},
+		capabilityKey: key,
+	}
+	now := time.Unix(1700000000, 0)
+	header, value, err := s.encodeCapabilities(whoWithCaps(map[string][]string{"example.com/cap/app": {`{"role":"admin"}`}}), now)
+	require.NoError(t, err)
+	assert.Equal(t, "X-Tailscale-App-Capabilities-Signed", header)
+
+	payload, sig, ok := strings.Cut(value, ".")
+	require.True(t, ok)
+	doc, err := base64.RawURLEncoding.DecodeString(payload)
+	require.NoError(t, err)
+	mac := hmac.New(sha256.New, key)
+	mac.Write(doc)
+	assert.Equal(t, base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), sig)
+
+	var decoded signedCapabilities
+	require.NoError(t, json.Unmarshal(doc, &decoded))
+	assert.Equal(t, "alice@example.com", decoded.User)
+	assert.Equal(t, "laptop", decoded.Node)
+	assert.Equal(t, "test", decoded.Service)
+	assert.Equal(t, now.Unix(), decoded.IssuedAt)
+	assert.Equal(t, now.Add(time.Minute).Unix(), decoded.Expires)
+	require.Len(t, decoded.Capabilities["example.com/cap/app"], 1)
+	assert.JSONEq(t, `{"role":"admin"}`, string(decoded.Capabilities["example.com/cap/app"][0]))
+}
+
+func TestReadCapabilityKey(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	short := filepath.Join(dir, "short")
+	require.NoError(t, os.WriteFile(short, []byte("too short\n"), 0o600))
+	_, err := readCapabilityKey(short)
+	assert.Error(t, err)
+
+	good := filepath.Join(dir, "good")
+	require.NoError(t, os.WriteFile(good, []byte(strings.Repeat("k", 32)+"\n"), 0o600))
+	key, err := readCapabilityKey(good)
+	require.NoError(t, err)
+	assert.Len(t, key, 32)
+}
+
+func TestCapabilityForwarding(t *testing.T) {
+	t.Parallel()
+	var got http.Header
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+	}))
+	t.Cleanup(upstream.Close)
+	dest, err := url.Parse(upstream.URL)
+	require.NoError(t, err)
+
+	s := &ValidTailnetSrv{
+		TailnetSrv: TailnetSrv{Name: "test", Capabilities: CapabilityForwarding{
+			Names:   []string{"example.com/cap/app"},
+			MaxSize: 100,
+		}},
+		DestURL: dest,
+		client: &mockLocalClient{whoIsFunc: func(ctx context.Context, addr string) (*apitype.WhoIsResponse, error) {
+			if addr == "100.100.100.2:1234" {
+				return whoWithCaps(map[string][]string{"example.com/cap/app": {`{"data":"` + strings.Repeat("x", 200) + `"}`}}), nil
+			}
+			return whoWithCaps(map[string][]string{"example.com/cap/app": {`{"role":"admin"}`}}), nil
+		}},
+	}
+	handler := s.mux(http.DefaultTransport, false)
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "100.100.100.1:1234"
+	req.Header.Set("X-Tailscale-App-Capabilities", `{"example.com/cap/app":[{"role":"owner"}]}`)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"example.com/cap/app":[{"role":"admin"}]}`, got.Get("X-Tailscale-App-Capabilities"))
+
+	req = httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "100.100.100.2:1234"
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+}
@@ -12,11 +12,14 @@ import (
 	"net"
 	"net/http"
 	"net/http/pprof"
+	"net/netip"
 	"net/url"
 	"os"
 	"path"
 	"slices"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/peterbourgon/ff/v3/ffcli"
@@ -60,6 +63,20 @@ func (pref *prefix) matches(reqURL *url.URL, isFunnel bool) (bool, strippedPrefi
 	return len(p) < len(reqURL.Path) && (reqURL.RawPath == "" || len(rp) < len(reqURL.RawPath)), strippedPrefixes{p, rp}
 }
 
+// covers returns whether an entry applies to a request's URL and
+// circumstance, judging only by the decoded path. Unlike matches, it
+// can't be sidestepped by percent-encoding part of the path, so
+// filters that must fail closed use it.
+func (pref *prefix) covers(reqURL *url.URL, isFunnel bool) bool {
+	if isFunnel && pref.matchIf == matchTsnetOnly {
+		return false
+	}
+	if !isFunnel && pref.matchIf == matchFunnelOnly {
+		return false
+	}
+	return pref.path != "" && strings.HasPrefix(reqURL.Path, pref.path)
+}
+
 type prefixes []prefix
 
 func (p *prefixes) String() string {
@@ -84,6 +101,12 @@ func (p *prefixes) String() string {
 }
 
 func (p *prefixes) Set(value string) error {
+	*p = append(*p, parsePrefix(value))
+	return nil
+}
+
+// parsePrefix parses a path prefix with an optional "tailnet:" or "funnel:" provenance.
+func parsePrefix(value string) prefix {
 	var pref prefix
 	switch {
 	case strings.HasPrefix(value, "tailnet:"):
@@ -95,9 +118,7 @@ func (p *prefixes) Set(value string) error {
 	default:
 		pref.path = value
 	}
-
-	*p = append(*p, pref)
-	return nil
+	return pref
 }
 
 type headers http.Header
@@ -167,6 +188,8 @@ func (s *serviceFlags) Set(value string) error {
 		AuthTimeout:             5 * time.Second,
 		WhoisTimeout:            1 * time.Second,
 		Timeout:                 1 * time.Minute,
+		ShutdownGracePeriod:     10 * time.Second,
+		StatusMetricsInterval:   30 * time.Second,
 	}
 
 	// Parse key=value pairs separated by commas
@@ -209,6 +232,45 @@ func (s *serviceFlags) setServiceField(svc *ServiceConfig, key, value string) er
 		svc.UpstreamTCPAddr = value
 	case "upstreamUnixAddr":
 		svc.UpstreamUnixAddr = value
+	case "upstreamTarget":
+		if _, err := parseTarget(value); err != nil {
+			return err
+		}
+		svc.UpstreamTargets = append(svc.UpstreamTargets, value)
+	case "loadBalancing":
+		svc.LoadBalancing = value
+	case "healthCheckPath":
+		svc.HealthCheck.Path = value
+	case "healthCheckStatus":
+		v, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid status code: %w", err)
+		}
+		svc.HealthCheck.ExpectedStatus = v
+	case "healthCheckInterval":
+		v, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("invalid duration: %w", err)
+		}
+		svc.HealthCheck.Interval = v
+	case "healthCheckTimeout":
+		v, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("invalid duration: %w", err)
+		}
+		svc.HealthCheck.Timeout = v
+	case "passiveHealthFailures":
+		v, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid number: %w", err)
+		}
+		svc.HealthCheck.PassiveFailures = v
+	case "passiveHealthEjectTime":
+		v, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("invalid duration: %w", err)
+		}
+		svc.HealthCheck.EjectTime = v
 
 	// Tailscale options
 	case "ephemeral":
@@ -270,6 +332,36 @@ func (s *serviceFlags) setServiceField(svc *ServiceConfig, key, value string) er
 			return err
 		}
 		svc.StripPrefix = v
+	case "route":
+		route, err := parseRouteSpec(value)
+		if err != nil {
+			return err
+		}
+		svc.Routes = append(svc.Routes, route)
+	case "webhook":
+		wc, err := parseWebhookSpec(value)
+		if err != nil {
+			return err
+		}
+		svc.Webhooks = append(svc.Webhooks, wc)
+	case "access":
+		rule, err := parseAccessRule(value)
+		if err != nil {
+			return err
+		}
+		svc.Access = append(svc.Access, rule)
+	case "forwardCapability":
+		svc.Capabilities.Names = append(svc.Capabilities.Names, value)
+	case "capabilityFormat":
+		svc.Capabilities.Format = value
+	case "capabilitySigningKeyFile":
+		svc.Capabilities.SigningKeyFile = value
+	case "capabilityMaxSize":
+		v, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid number: %w", err)
+		}
+		svc.Capabilities.MaxSize = v
 	case "upstreamHeader":
 		if svc.UpstreamHeaders == nil {
 			svc.UpstreamHeaders = make(map[string]string)
@@ -307,6 +399,18 @@ func (s *serviceFlags) setServiceField(svc *ServiceConfig, key, value string) er
 			return fmt.Errorf("parsing duration: %w", err)
 		}
 		svc.WhoisTimeout = d
+	case "whoisCacheTTL":
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("parsing duration: %w", err)
+		}
+		svc.WhoisCacheTTL = d
+	case "whoisNegativeCacheTTL":
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("parsing duration: %w", err)
+		}
+		svc.WhoisNegativeCacheTTL = d
 	case "suppressTailnetDialer":
 		v, err := parseBool(value)
 		if err != nil {
@@ -346,6 +450,232 @@ func (s *serviceFlags) setServiceField(svc *ServiceConfig, key, value string) er
 			return err
 		}
 		svc.AuthBypassForTailnet = v
+	case "authCacheTTL":
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("parsing duration: %w", err)
+		}
+		svc.AuthCache.TTL = d
+	case "authCacheMaxEntries":
+		v, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid number: %w", err)
+		}
+		svc.AuthCache.MaxEntries = v
+	case "authCacheKey":
+		svc.AuthCache.Key = append(svc.AuthCache.Key, value)
+	case "authCacheDenials":
+		v, err := parseBool(value)
+		if err != nil {
+			return err
+		}
+		svc.AuthCache.CacheDenials = v
+	case "oidcIssuer":
+		svc.OIDC.Issuer = value
+	case "oidcClientID":
+		svc.OIDC.ClientID = value
+	case "oidcClientSecretFile":
+		svc.OIDC.ClientSecretFile = value
+	case "oidcRedirectURL":
+		svc.OIDC.RedirectURL = value
+	case "oidcScope":
+		svc.OIDC.Scopes = append(svc.OIDC.Scopes, value)
+	case "oidcCookieKeyFile":
+		svc.OIDC.CookieKeyFile = value
+	case "oidcCookieName":
+		svc.OIDC.CookieName = value
+	case "oidcSessionLifetime":
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("parsing duration: %w", err)
+		}
+		svc.OIDC.SessionLifetime = d
+	case "oidcRequireClaim":
+		return setClaim(&svc.OIDC.RequiredClaims, value, "=")
+	case "oidcAllowedGroup":
+		svc.OIDC.AllowedGroups = append(svc.OIDC.AllowedGroups, value)
+	case "oidcGroupsClaim":
+		svc.OIDC.GroupsClaim = value
+	case "oidcClaimHeader":
+		return setClaim(&svc.OIDC.ClaimHeaders, value, ":")
+	case "jwtJWKSURL":
+		svc.JWTAuth.JWKSURL = value
+	case "jwtKeyFile":
+		svc.JWTAuth.KeyFile = value
+	case "jwtIssuer":
+		svc.JWTAuth.Issuer = value
+	case "jwtAudience":
+		svc.JWTAuth.Audiences = append(svc.JWTAuth.Audiences, value)
+	case "jwtRequireClaim":
+		return setClaim(&svc.JWTAuth.RequiredClaims, value, "=")
+	case "jwtClaimHeader":
+		return setClaim(&svc.JWTAuth.ClaimHeaders, value, ":")
+	case "jwtPrefix":
+		svc.JWTAuth.Prefixes = append(svc.JWTAuth.Prefixes, value)
+	case "htpasswdFile":
+		svc.BasicAuth.HtpasswdFile = value
+	case "basicAuthRealm":
+		svc.BasicAuth.Realm = value
+	case "basicAuthUserHeader":
+		svc.BasicAuth.UserHeader = value
+	case "rateLimitTailnet":
+		svc.RateLimit.Tailnet.Rate = value
+	case "rateLimitTailnetBurst":
+		v, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid number: %w", err)
+		}
+		svc.RateLimit.Tailnet.Burst = v
+	case "rateLimitFunnel":
+		svc.RateLimit.Funnel.Rate = value
+	case "rateLimitFunnelBurst":
+		v, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid number: %w", err)
+		}
+		svc.RateLimit.Funnel.Burst = v
+	case "rateLimitPrefix":
+		rule, err := parseRateLimitPrefix(value)
+		if err != nil {
+			return err
+		}
+		svc.RateLimit.Prefixes = append(svc.RateLimit.Prefixes, rule)
+	case "rateLimitMaxClients":
+		v, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid number: %w", err)
+		}
+		svc.RateLimit.MaxClients = v
+	case "maxConcurrentRequests":
+		v, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid number: %w", err)
+		}
+		svc.Concurrency.Tailnet.MaxConcurrentRequests = v
+	case "maxQueuedRequests":
+		v, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid number: %w", err)
+		}
+		svc.Concurrency.Tailnet.MaxQueuedRequests = v
+	case "queueTimeout":
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("parsing duration: %w", err)
+		}
+		svc.Concurrency.Tailnet.QueueTimeout = d
+	case "funnelMaxConcurrentRequests":
+		v, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid number: %w", err)
+		}
+		svc.Concurrency.Funnel.MaxConcurrentRequests = v
+	case "funnelMaxQueuedRequests":
+		v, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid number: %w", err)
+		}
+		svc.Concurrency.Funnel.MaxQueuedRequests = v
+	case "funnelQueueTimeout":
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("parsing duration: %w", err)
+		}
+		svc.Concurrency.Funnel.QueueTimeout = d
+	case "retries":
+		v, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid number: %w", err)
+		}
+		svc.Retries.MaxRetries = v
+	case "retryStatus":
+		v, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid number: %w", err)
+		}
+		svc.Retries.Statuses = append(svc.Retries.Statuses, v)
+	case "retryBackoff":
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("parsing duration: %w", err)
+		}
+		svc.Retries.Backoff = d
+	case "retryMaxBackoff":
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("parsing duration: %w", err)
+		}
+		svc.Retries.MaxBackoff = d
+	case "retryMaxBodySize":
+		v, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid number: %w", err)
+		}
+		svc.Retries.MaxBodySize = v
+	case "circuitBreakerFailures":
+		v, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid number: %w", err)
+		}
+		svc.CircuitBreakers.Upstream.FailureThreshold = v
+	case "circuitBreakerOpenDuration":
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("parsing duration: %w", err)
+		}
+		svc.CircuitBreakers.Upstream.OpenDuration = d
+	case "circuitBreakerHalfOpenRequests":
+		v, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid number: %w", err)
+		}
+		svc.CircuitBreakers.Upstream.HalfOpenRequests = v
+	case "circuitBreakerErrorPage":
+		svc.CircuitBreakers.Upstream.ErrorPageFile = value
+	case "authCircuitBreakerFailures":
+		v, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid number: %w", err)
+		}
+		svc.CircuitBreakers.Auth.FailureThreshold = v
+	case "authCircuitBreakerOpenDuration":
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("parsing duration: %w", err)
+		}
+		svc.CircuitBreakers.Auth.OpenDuration = d
+	case "authCircuitBreakerHalfOpenRequests":
+		v, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid number: %w", err)
+		}
+		svc.CircuitBreakers.Auth.HalfOpenRequests = v
+	case "authCircuitBreakerErrorPage":
+		svc.CircuitBreakers.Auth.ErrorPageFile = value
+
+	// Access log
+	case "accessLog":
+		svc.AccessLog.Path = value
+	case "accessLogFormat":
+		svc.AccessLog.Format = value
+	case "accessLogMaxSize":
+		v, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid number: %w", err)
+		}
+		svc.AccessLog.MaxSize = v
+	case "accessLogMaxAge":
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("parsing duration: %w", err)
+		}
+		svc.AccessLog.MaxAge = d
+	case "accessLogMaxBackups":
+		v, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid number: %w", err)
+		}
+		svc.AccessLog.MaxBackups = v
 
 	// Timeouts and performance
 	case "timeout":
@@ -360,6 +690,18 @@ func (s *serviceFlags) setServiceField(svc *ServiceConfig, key, value string) er
 			return fmt.Errorf("parsing duration: %w", err)
 		}
 		svc.ReadHeaderTimeout = d
+	case "shutdownGracePeriod":
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("parsing duration: %w", err)
+		}
+		svc.ShutdownGracePeriod = d
+	case "statusMetricsInterval":
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("parsing duration: %w", err)
+		}
+		svc.StatusMetricsInterval = d
 
 	// Debugging
 	case "tsnetVerbose":
@@ -389,6 +731,9 @@ func parseBool(s string) (bool, error) {
 
 type TailnetSrv struct {
 	UpstreamTCPAddr, UpstreamUnixAddr string
+	UpstreamTargets                   upstreamTargets
+	LoadBalancing                     string
+	HealthCheck                       HealthCheck
 	Ephemeral                         bool
 	Funnel, FunnelOnly                bool
 	ListenAddr                        string
@@ -400,11 +745,17 @@ type TailnetSrv struct {
 	Timeout                           time.Duration
 	AllowedPrefixes                   prefixes
 	StripPrefix                       bool
+	Routes                            routeFlags
+	Webhooks                          webhookFlags
+	Access                            accessRules
+	Capabilities                      CapabilityForwarding
 	StateDir                          string
 	AuthkeyPath                       string
 	Tags                              tags
 	InsecureHTTPS                     bool
 	WhoisTimeout                      time.Duration
+	WhoisCacheTTL                     time.Duration
+	WhoisNegativeCacheTTL             time.Duration
 	SuppressWhois                     bool
 	UpstreamHeaders                   headers
 	SuppressTailnetDialer             bool
@@ -417,6 +768,17 @@ type TailnetSrv struct {
 	AuthCopyHeaders                   headers
 	AuthInsecureHTTPS                 bool
 	AuthBypassForTailnet              bool
+	AuthCache                         AuthCache
+	OIDC                              OIDC
+	JWTAuth                           JWTAuth
+	BasicAuth                         BasicAuth
+	RateLimit                         RateLimit
+	Concurrency                       Concurrency
+	Retries                           Retries
+	CircuitBreakers                   CircuitBreakers
+	AccessLog                         AccessLog
+	ShutdownGracePeriod               time.Duration
+	StatusMetricsInterval             time.Duration
 }
 
 // ValidTailnetSrv is a TailnetSrv that has been constructed from validated CLI arguments.
@@ -425,19 +787,196 @@ type TailnetSrv struct {
 type ValidTailnetSrv struct {
 	TailnetSrv
 	DestURL *url.URL
+	routes  []route
+	targets []upstreamTarget
+	access  []accessRule
 	client  WhoIsClient
+	status  instanceStatus
+
+	// capabilityKey signs forwarded capabilities; read from
+	// Capabilities.SigningKeyFile when the service starts.
+	capabilityKey []byte
+
+	// identity mints identity tokens for the upstream, if configured
+	// for the process.
+	identity *IdentitySigner
+
+	// oidc logs users in, if the service is configured for it; set
+	// up when the service starts.
+	oidc *oidcProvider
+
+	// jwtAuth validates bearer tokens, if the service is configured
+	// for it; set up when the service starts.
+	jwtAuth *jwtValidator
+
+	// htpasswd holds the users of basic authentication, if the
+	// service is configured for it; loaded when the service starts.
+	htpasswd *htpasswd
+
+	// webhooks verify the signatures of webhook requests; loaded
+	// when the service starts.
+	webhooks []*webhook
+
+	// rateLimiter limits the requests of each client, if the service
+	// is configured for it; set up when the service starts.
+	rateLimiter *rateLimiter
+
+	// upstreamBreaker and authBreaker stop requests to a failing main
+	// upstream and auth service, if the service is configured for it;
+	// set up when the service starts.
+	upstreamBreaker *circuitBreaker
+	authBreaker     *circuitBreaker
+
+	// processAccessLog is the access log of the process, used unless
+	// the service configures its own.
+	processAccessLog *AccessLogger
+
+	// accessLogger logs the requests the service answered; set up
+	// when the service starts.
+	accessLogger *AccessLogger
+
+	// tracer records traces of requests, if configured for the
+	// process.
+	tracer *Tracer
+
+	whoisCache whoisCache
+	authCache  authCache
+
+	// routeTransport is used to reach route upstreams; when nil, routes
+	// share the transport of the main upstream.
+	routeTransport http.RoundTripper
+}
+
+// instanceStatus is what a service's Run reports about how far it got.
+type instanceStatus struct {
+	mu           sync.Mutex
+	up           bool
+	draining     bool
+	tailscaleIPs []netip.Addr
+	listeners    []string
+	upstreams    *balancer
+}
+
+func (st *instanceStatus) setUp(ips []netip.Addr) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.up = true
+	st.tailscaleIPs = ips
+}
+
+// setListening records that a listener ("tailnet" or "funnel") accepts
+// connections.
+func (st *instanceStatus) setListening(listener string) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.listeners = append(st.listeners, listener)
+}
+
+func (st *instanceStatus) setDraining() {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.draining = true
+}
+
+func (st *instanceStatus) setDown() {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.up = false
+	st.draining = false
+	st.tailscaleIPs = nil
+	st.listeners = nil
+	st.upstreams = nil
+}
+
+func (st *instanceStatus) setUpstreams(b *balancer) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.upstreams = b
+}
+
+func (st *instanceStatus) upstreamStatus() []UpstreamStatus {
+	st.mu.Lock()
+	b := st.upstreams
+	st.mu.Unlock()
+	if b == nil {
+		return nil
+	}
+	return b.status()
+}
+
+func (st *instanceStatus) isDraining() bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.draining
+}
+
+func (st *instanceStatus) isUp() bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.up
+}
+
+func (st *instanceStatus) addrs() []netip.Addr {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return slices.Clone(st.tailscaleIPs)
+}
+
+func (st *instanceStatus) listening() []string {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return slices.Clone(st.listeners)
+}
+
+// ProcessOptions holds settings that apply to the whole tsnsrv process
+// rather than to any individual service.
+type ProcessOptions struct {
+	// PrometheusAddr is the address to serve metrics and pprof on; empty disables it.
+	PrometheusAddr string
+
+	// ConfigPath is the configuration file the services were loaded from, if any.
+	ConfigPath string
+
+	// ConfigReloadInterval is how often ConfigPath is checked for changes. 0 disables
+	// polling; a SIGHUP always triggers a reload.
+	ConfigReloadInterval time.Duration
+
+	// Restart controls how the orchestrator deals with failing services.
+	Restart RestartPolicy
+
+	// AdminAddr is the address to serve the admin API on; empty
+	// disables it. Addresses without a host, like ":9098", only listen
+	// on the loopback interface.
+	AdminAddr string
+
+	// AdminTokenFile contains a bearer token that requests to the admin
+	// API must present. Empty allows all requests.
+	AdminTokenFile string
+
+	// Identity configures the signed identity tokens sent to upstreams.
+	Identity IdentityAssertion
+
+	// AccessLog configures the access log of services that don't
+	// configure their own.
+	AccessLog AccessLog
+
+	// Tracing configures exporting traces of requests.
+	Tracing Tracing
+
+	// Metrics configures how request metrics are exported.
+	Metrics Metrics
 }
 
 // TailnetSrvFromArgs constructs a validated tailnet service from commandline arguments.
 func TailnetSrvFromArgs(args []string) (*ValidTailnetSrv, string, *ffcli.Command, error) {
-	services, prometheusAddr, cmd, err := TailnetSrvsFromArgs(args)
+	services, opts, cmd, err := TailnetSrvsFromArgs(args)
 	if err != nil {
 		return nil, "", cmd, err
 	}
 	if len(services) != 1 {
 		return nil, "", cmd, fmt.Errorf("expected single service, got %d", len(services))
 	}
-	return services[0], prometheusAddr, cmd, nil
+	return services[0], opts.PrometheusAddr, cmd, nil
 }
 
 var errConfigAndCLI = errors.New("cannot use -config with other CLI flags; use either config file or CLI mode")
@@ -447,18 +986,59 @@ var errConfigAndCLI = errors.New("cannot use -config with other CLI flags; use e
 // 1. Single-service CLI mode (legacy): -name <name> <url>
 // 2. Multi-service config file mode: -config <file>
 // 3. Multi-service CLI mode: -service "key=val,..." [-service "key=val,..."]
-// Returns the services, the process-level prometheusAddr, the command, and any error.
-func TailnetSrvsFromArgs(args []string) ([]*ValidTailnetSrv, string, *ffcli.Command, error) {
+// Returns the services, the process-level options, the command, and any error.
+func TailnetSrvsFromArgs(args []string) ([]*ValidTailnetSrv, *ProcessOptions, *ffcli.Command, error) {
 	s := &TailnetSrv{}
-	var configPath string
+	opts := &ProcessOptions{}
 	var services serviceFlags
-	var prometheusAddr string
 
 	fs := flag.NewFlagSet("tsnsrv", flag.ExitOnError)
-	fs.StringVar(&configPath, "config", "", "Path to configuration file for multi-service mode")
+	fs.StringVar(&opts.ConfigPath, "config", "", "Path to configuration file for multi-service mode. All settings come from the file: no other flags except -configReloadInterval may be passed with it.")
+	fs.DurationVar(&opts.ConfigReloadInterval, "configReloadInterval", 5*time.Second, "How often to check the -config file for changes. 0 disables polling; SIGHUP always reloads.")
+	fs.StringVar(&opts.Restart.Policy, "restartPolicy", RestartSupervise, "What to do when a service fails: \"supervise\" restarts just that service with backoff, \"failFast\" stops all services.")
+	fs.DurationVar(&opts.Restart.InitialBackoff, "restartInitialBackoff", 1*time.Second, "Delay before restarting a failed service; doubles with every consecutive restart")
+	fs.DurationVar(&opts.Restart.MaxBackoff, "restartMaxBackoff", 1*time.Minute, "Maximum delay between restarts of a failed service")
+	fs.Float64Var(&opts.Restart.Jitter, "restartJitter", 0.2, "Randomize restart delays by up to this fraction")
+	fs.IntVar(&opts.Restart.MaxRestarts, "maxRestarts", 0, "Consecutive restarts after which a service is considered failed permanently. 0 means no limit.")
+	fs.DurationVar(&opts.Restart.StableAfter, "restartStableAfter", 5*time.Minute, "How long a service must stay up for its restart count to be reset")
+	fs.StringVar(&opts.AdminAddr, "adminAddr", "", "Serve the admin API from this address. Addresses without a host (like :9098) only listen on loopback. Empty disables the admin API.")
+	fs.StringVar(&opts.AdminTokenFile, "adminTokenFile", "", "File containing a bearer token that admin API requests must present")
+	fs.StringVar(&opts.Identity.KeyFile, "identityKeyFile", "", "Send upstreams a JWT asserting the requestor's identity, signed with this PEM-encoded RSA, ECDSA P-256 or Ed25519 private key")
+	fs.StringVar(&opts.Identity.Header, "identityHeader", "X-Tailscale-Identity-Token", "Header that carries the identity JWT")
+	fs.DurationVar(&opts.Identity.Lifetime, "identityLifetime", 1*time.Minute, "How long identity JWTs are valid")
+	fs.StringVar(&opts.Identity.Issuer, "identityIssuer", "tsnsrv", "Issuer (\"iss\" claim) of identity JWTs")
+	fs.StringVar(&opts.AccessLog.Path, "accessLog", "", "Log every answered request to this file (\"-\" for stdout)")
+	fs.StringVar(&opts.AccessLog.Format, "accessLogFormat", AccessLogJSON, "Format of -accessLog entries: \"json\", \"common\", \"combined\" or \"caddy\"")
+	fs.Int64Var(&opts.AccessLog.MaxSize, "accessLogMaxSize", 100<<20, "Rotate the -accessLog file when it grows beyond this many bytes")
+	fs.DurationVar(&opts.AccessLog.MaxAge, "accessLogMaxAge", 0, "Rotate the -accessLog file when it gets this old. 0 rotates only by size.")
+	fs.IntVar(&opts.AccessLog.MaxBackups, "accessLogMaxBackups", 10, "Number of rotated -accessLog files to keep")
+	fs.StringVar(&opts.Tracing.Endpoint, "tracingEndpoint", "", "Export traces of requests to this OTLP URL, e.g. http://localhost:4318/v1/traces, or http://localhost:4317 with -tracingProtocol=grpc")
+	fs.StringVar(&opts.Tracing.Protocol, "tracingProtocol", TracingHTTPJSON, "OTLP protocol to export traces with: \"http/json\", \"http/protobuf\" or \"grpc\"")
+	fs.Func("tracingHeader", "Header to send with trace exports: 'Header-Name: value'. Repeatable.", func(value string) error {
+		name, val, ok := strings.Cut(value, ": ")
+		if !ok {
+			return fmt.Errorf("%w: Invalid header format %#v", errHeaderFormat, value)
+		}
+		if opts.Tracing.Headers == nil {
+			opts.Tracing.Headers = map[string]string{}
+		}
+		opts.Tracing.Headers[name] = val
+		return nil
+	})
+	fs.Float64Var(&opts.Tracing.SampleRatio, "tracingSampleRatio", 1, "Fraction of new traces to record")
+	fs.BoolVar(&opts.Metrics.NativeHistograms, "nativeHistograms", false, "Also expose request duration and size histograms as Prometheus native histograms")
+	fs.BoolVar(&opts.Metrics.LegacySummaries, "legacySummaryMetrics", false, "Keep exporting the tsnsrv_request_duration_ns and tsnsrv_auth_duration_ns summaries")
 	fs.Var(&services, "service", "Service definition as key=value pairs (repeatable for multiple services)")
 	fs.StringVar(&s.UpstreamTCPAddr, "upstreamTCPAddr", "", "Proxy to an HTTP service listening on this TCP address")
 	fs.StringVar(&s.UpstreamUnixAddr, "upstreamUnixAddr", "", "Proxy to an HTTP service listening on this UNIX domain socket address")
+	fs.Var(&s.UpstreamTargets, "upstreamTarget", "Load balance over this upstream address ('tcp:host:port' or 'unix:/path'). Repeatable.")
+	fs.StringVar(&s.HealthCheck.Path, "healthCheckPath", "", "Check the health of the upstream (targets) by requesting this path")
+	fs.IntVar(&s.HealthCheck.ExpectedStatus, "healthCheckStatus", http.StatusOK, "Status code that healthy upstreams respond to -healthCheckPath with")
+	fs.DurationVar(&s.HealthCheck.Interval, "healthCheckInterval", 10*time.Second, "Time between health checks")
+	fs.DurationVar(&s.HealthCheck.Timeout, "healthCheckTimeout", 2*time.Second, "How long a health check may take")
+	fs.IntVar(&s.HealthCheck.PassiveFailures, "passiveHealthFailures", 0, "Stop sending requests to an upstream (target) after this many consecutive proxy errors. 0 disables.")
+	fs.DurationVar(&s.HealthCheck.EjectTime, "passiveHealthEjectTime", 30*time.Second, "How long to stop sending requests to an upstream after -passiveHealthFailures errors")
+	fs.StringVar(&s.LoadBalancing, "loadBalancing", LoadBalanceRoundRobin, "How to pick one of several -upstreamTarget addresses: \"roundRobin\", \"leastConn\" or \"userHash\" (sticky per Tailscale user).")
 	fs.BoolVar(&s.Ephemeral, "ephemeral", false, "Declare this service ephemeral")
 	fs.BoolVar(&s.Funnel, "funnel", false, "Expose a funnel service.")
 	fs.BoolVar(&s.FunnelOnly, "funnelOnly", false, "Expose a funnel service only (not exposed on the tailnet).")
@@ -471,13 +1051,22 @@ func TailnetSrvsFromArgs(args []string) ([]*ValidTailnetSrv, string, *ffcli.Comm
 	fs.DurationVar(&s.Timeout, "timeout", 1*time.Minute, "Timeout connecting to the tailnet")
 	fs.Var(&s.AllowedPrefixes, "prefix", "Allowed URL prefixes; if none is set, all prefixes are allowed")
 	fs.BoolVar(&s.StripPrefix, "stripPrefix", true, "Strip prefixes that matched; best set to false if allowing multiple prefixes")
+	fs.Var(&s.Routes, "route", "Send a path prefix to a separate upstream: '[funnel:|tailnet:]/prefix=URL[;stripPrefix=true][;upstreamHeader=Name: value]'. Repeatable.")
+	fs.Var(&s.Webhooks, "webhook", "Verify webhook signatures under a path prefix: '[funnel:|tailnet:]/prefix=github|gitlab|stripe|hmac;secretFile=PATH[;header=NAME][;algorithm=sha256][;encoding=hex][;signaturePrefix=PREFIX][;timestampHeader=NAME][;tolerance=5m][;maxBodySize=BYTES]'. Repeatable.")
+	fs.Var(&s.Access, "access", "Allow or deny requests by Tailscale identity: '[PREFIX=]allow|deny [user:LOGIN] [domain:DOMAIN] [tag:TAG] [node:NAME] [cap:CAPABILITY]...'. Repeatable; the first matching rule wins.")
+	fs.Var((*capabilityNames)(&s.Capabilities.Names), "forwardCapability", "Pass the JSON values of this application capability (from tailnet grants) to the upstream. Repeatable.")
+	fs.StringVar(&s.Capabilities.Format, "capabilityFormat", CapabilityFormatHeader, "How to pass -forwardCapability values: \"header\" (JSON in X-Tailscale-App-Capabilities) or \"signed\" (HMAC-signed document in X-Tailscale-App-Capabilities-Signed)")
+	fs.StringVar(&s.Capabilities.SigningKeyFile, "capabilitySigningKeyFile", "", "File containing the secret for -capabilityFormat=signed")
+	fs.IntVar(&s.Capabilities.MaxSize, "capabilityMaxSize", 16384, "Reject requests whose forwarded capabilities exceed this many bytes")
 	fs.StringVar(&s.StateDir, "stateDir", os.Getenv("TS_STATE_DIR"), "Directory containing the persistent tailscale status files. Can also be set by $TS_STATE_DIR; this option takes precedence.")
 	fs.StringVar(&s.AuthkeyPath, "authkeyPath", "", "File containing a tailscale auth key. Key is assumed to be in $TS_AUTHKEY in absence of this option.")
 	fs.Var(&s.Tags, "tag", "Tags to advertise to tailscale. Mandatory if using OAuth clients.")
 	fs.BoolVar(&s.InsecureHTTPS, "insecureHTTPS", false, "Disable TLS certificate validation on upstream")
 	fs.DurationVar(&s.WhoisTimeout, "whoisTimeout", 1*time.Second, "Maximum amount of time to spend looking up client identities")
+	fs.DurationVar(&s.WhoisCacheTTL, "whoisCacheTTL", 0, "Remember client identities for this long. 0 looks them up for every request.")
+	fs.DurationVar(&s.WhoisNegativeCacheTTL, "whoisNegativeCacheTTL", 0, "Remember failed identity lookups for this long")
 	fs.BoolVar(&s.SuppressWhois, "suppressWhois", false, "Do not set X-Tailscale-User-* headers in upstream requests")
-	fs.StringVar(&prometheusAddr, "prometheusAddr", ":9099", "Serve prometheus metrics from this address. Empty string to disable.")
+	fs.StringVar(&opts.PrometheusAddr, "prometheusAddr", ":9099", "Serve prometheus metrics from this address. Empty string to disable.")
 	fs.Var(&s.UpstreamHeaders, "upstreamHeader", "Additional headers (separated by ': ') on requests to upstream.")
 	fs.BoolVar(&s.SuppressTailnetDialer, "suppressTailnetDialer", false, "Whether to use the stdlib net.Dialer instead of a tailnet-enabled one")
 	fs.DurationVar(&s.ReadHeaderTimeout, "readHeaderTimeout", 0, "Amount of time to allow for reading HTTP request headers. 0 will disable the timeout but expose the service to the slowloris attack.")
@@ -489,6 +1078,89 @@ func TailnetSrvsFromArgs(args []string) ([]*ValidTailnetSrv, string, *ffcli.Comm
 	fs.Var(&s.AuthCopyHeaders, "authCopyHeader", "Headers to copy from auth response (separated by ': ')")
 	fs.BoolVar(&s.AuthInsecureHTTPS, "authInsecureHTTPS", false, "Disable TLS certificate validation for auth service")
 	fs.BoolVar(&s.AuthBypassForTailnet, "authBypassForTailnet", false, "Bypass forward auth for requests from Tailscale network (authenticated users)")
+	fs.DurationVar(&s.AuthCache.TTL, "authCacheTTL", 0, "Reuse successful forward auth decisions for this long. 0 disables the cache.")
+	fs.IntVar(&s.AuthCache.MaxEntries, "authCacheMaxEntries", 1000, "Maximum number of cached forward auth decisions")
+	fs.Func("authCacheKey", "Request attribute that auth decisions are cached by: cookie, cookie:NAME, authorization, host, method, path, path:DEPTH or query; can be given multiple times (default cookie, authorization, host, method, path and query)", func(value string) error {
+		s.AuthCache.Key = append(s.AuthCache.Key, value)
+		return nil
+	})
+	fs.BoolVar(&s.AuthCache.CacheDenials, "authCacheDenials", false, "Cache 401 and 403 responses of the auth service, too")
+	fs.StringVar(&s.OIDC.Issuer, "oidcIssuer", "", "Log users in with this OpenID Connect provider (issuer URL)")
+	fs.StringVar(&s.OIDC.ClientID, "oidcClientID", "", "Client ID of this service with the OIDC provider")
+	fs.StringVar(&s.OIDC.ClientSecretFile, "oidcClientSecretFile", "", "File containing the OIDC client secret")
+	fs.StringVar(&s.OIDC.RedirectURL, "oidcRedirectURL", "", "URL that the OIDC provider sends users back to (default "+OIDCCallbackPath+" on the requested host)")
+	fs.Func("oidcScope", "OIDC scope to request; can be given multiple times (default openid, profile, email)", func(value string) error {
+		s.OIDC.Scopes = append(s.OIDC.Scopes, value)
+		return nil
+	})
+	fs.StringVar(&s.OIDC.CookieKeyFile, "oidcCookieKeyFile", "", "File containing the secret that OIDC session cookies are encrypted with; random if unset")
+	fs.StringVar(&s.OIDC.CookieName, "oidcCookieName", "_tsnsrv_oidc", "Name of the OIDC session cookie")
+	fs.DurationVar(&s.OIDC.SessionLifetime, "oidcSessionLifetime", 24*time.Hour, "How long an OIDC login lasts")
+	fs.Func("oidcRequireClaim", "ID token claim that users must have, as 'claim=value'; can be given multiple times", func(value string) error {
+		return setClaim(&s.OIDC.RequiredClaims, value, "=")
+	})
+	fs.Func("oidcAllowedGroup", "Only let in OIDC users in this group; can be given multiple times", func(value string) error {
+		s.OIDC.AllowedGroups = append(s.OIDC.AllowedGroups, value)
+		return nil
+	})
+	fs.StringVar(&s.OIDC.GroupsClaim, "oidcGroupsClaim", "groups", "ID token claim that lists the user's groups")
+	fs.Func("oidcClaimHeader", "Pass an ID token claim to the upstream, as 'claim: Header-Name'; can be given multiple times", func(value string) error {
+		return setClaim(&s.OIDC.ClaimHeaders, value, ":")
+	})
+	fs.StringVar(&s.JWTAuth.JWKSURL, "jwtJWKSURL", "", "Require bearer JWTs signed with a key published at this JWKS URL")
+	fs.StringVar(&s.JWTAuth.KeyFile, "jwtKeyFile", "", "Require bearer JWTs signed with the key in this file (PEM public key or certificate, or JWKS)")
+	fs.StringVar(&s.JWTAuth.Issuer, "jwtIssuer", "", "Issuer that bearer JWTs must be from")
+	fs.Func("jwtAudience", "Audience that bearer JWTs must be for; can be given multiple times", func(value string) error {
+		s.JWTAuth.Audiences = append(s.JWTAuth.Audiences, value)
+		return nil
+	})
+	fs.Func("jwtRequireClaim", "Claim that bearer JWTs must have, as 'claim=value'; can be given multiple times", func(value string) error {
+		return setClaim(&s.JWTAuth.RequiredClaims, value, "=")
+	})
+	fs.Func("jwtClaimHeader", "Pass a bearer JWT claim to the upstream, as 'claim: Header-Name'; can be given multiple times", func(value string) error {
+		return setClaim(&s.JWTAuth.ClaimHeaders, value, ":")
+	})
+	fs.Func("jwtPrefix", "Only require bearer JWTs for this path prefix (with optional funnel: or tailnet: qualifier); can be given multiple times", func(value string) error {
+		s.JWTAuth.Prefixes = append(s.JWTAuth.Prefixes, value)
+		return nil
+	})
+	fs.StringVar(&s.BasicAuth.HtpasswdFile, "htpasswdFile", "", "Require a user name and password from this htpasswd file (bcrypt or argon2 hashes)")
+	fs.StringVar(&s.BasicAuth.Realm, "basicAuthRealm", "", "Realm that browsers show when asking for the password (default: the service name)")
+	fs.StringVar(&s.BasicAuth.UserHeader, "basicAuthUserHeader", "X-Forwarded-User", "Header that passes the authenticated user name to the upstream")
+	fs.StringVar(&s.RateLimit.Tailnet.Rate, "rateLimitTailnet", "", "Limit the requests of each Tailscale user to this rate, like 10/s, 100/m or 5/10s. Unlimited if empty.")
+	fs.IntVar(&s.RateLimit.Tailnet.Burst, "rateLimitTailnetBurst", 0, "How many requests a Tailscale user may make at once (default: the number of requests in -rateLimitTailnet)")
+	fs.StringVar(&s.RateLimit.Funnel.Rate, "rateLimitFunnel", "", "Limit the requests of each funnel client IP address to this rate, like 10/s, 100/m or 5/10s. Unlimited if empty.")
+	fs.IntVar(&s.RateLimit.Funnel.Burst, "rateLimitFunnelBurst", 0, "How many requests a funnel client may make at once (default: the number of requests in -rateLimitFunnel)")
+	fs.Func("rateLimitPrefix", "Use a separate rate limit under a path prefix: '[funnel:|tailnet:]/prefix=RATE[;burst=N]'. Repeatable; the longest matching prefix wins.", func(value string) error {
+		rule, err := parseRateLimitPrefix(value)
+		if err != nil {
+			return err
+		}
+		s.RateLimit.Prefixes = append(s.RateLimit.Prefixes, rule)
+		return nil
+	})
+	fs.IntVar(&s.RateLimit.MaxClients, "rateLimitMaxClients", 10000, "Maximum number of clients tracked per rate limit")
+	fs.IntVar(&s.Concurrency.Tailnet.MaxConcurrentRequests, "maxConcurrentRequests", 0, "Maximum number of tailnet requests proxied at once. 0 means no limit.")
+	fs.IntVar(&s.Concurrency.Tailnet.MaxQueuedRequests, "maxQueuedRequests", 0, "Number of tailnet requests that may wait for -maxConcurrentRequests; others get a 503")
+	fs.DurationVar(&s.Concurrency.Tailnet.QueueTimeout, "queueTimeout", 30*time.Second, "How long a tailnet request may wait in the queue")
+	fs.IntVar(&s.Concurrency.Funnel.MaxConcurrentRequests, "funnelMaxConcurrentRequests", 0, "Maximum number of funnel requests proxied at once. 0 means no limit.")
+	fs.IntVar(&s.Concurrency.Funnel.MaxQueuedRequests, "funnelMaxQueuedRequests", 0, "Number of funnel requests that may wait for -funnelMaxConcurrentRequests; others get a 503")
+	fs.DurationVar(&s.Concurrency.Funnel.QueueTimeout, "funnelQueueTimeout", 30*time.Second, "How long a funnel request may wait in the queue")
+	fs.IntVar(&s.Retries.MaxRetries, "retries", 0, "Retry idempotent requests (GET, HEAD, OPTIONS or with an Idempotency-Key) this often if the upstream can't be reached or responds with a -retryStatus. 0 disables retries.")
+	fs.Var((*retryStatuses)(&s.Retries.Statuses), "retryStatus", "Upstream response status to retry; can be given multiple times (default 502, 503 and 504)")
+	fs.DurationVar(&s.Retries.Backoff, "retryBackoff", 100*time.Millisecond, "Delay before the first retry; doubles with every further retry")
+	fs.DurationVar(&s.Retries.MaxBackoff, "retryMaxBackoff", 2*time.Second, "Longest delay between retries")
+	fs.Int64Var(&s.Retries.MaxBodySize, "retryMaxBodySize", 1<<20, "Don't retry requests with bodies larger than this many bytes")
+	fs.IntVar(&s.CircuitBreakers.Upstream.FailureThreshold, "circuitBreakerFailures", 0, "Stop sending requests to the upstream after this many failed in a row (connection errors, 502, 503 and 504). 0 disables the circuit breaker.")
+	fs.DurationVar(&s.CircuitBreakers.Upstream.OpenDuration, "circuitBreakerOpenDuration", 30*time.Second, "How long the upstream circuit breaker stays open before probing the upstream again")
+	fs.IntVar(&s.CircuitBreakers.Upstream.HalfOpenRequests, "circuitBreakerHalfOpenRequests", 1, "Number of probe requests that must succeed to close the upstream circuit breaker")
+	fs.StringVar(&s.CircuitBreakers.Upstream.ErrorPageFile, "circuitBreakerErrorPage", "", "HTML file served with a 503 while the upstream circuit breaker is open")
+	fs.IntVar(&s.CircuitBreakers.Auth.FailureThreshold, "authCircuitBreakerFailures", 0, "Stop sending requests to the auth service after this many failed in a row (connection errors and 5xx responses). 0 disables the circuit breaker.")
+	fs.DurationVar(&s.CircuitBreakers.Auth.OpenDuration, "authCircuitBreakerOpenDuration", 30*time.Second, "How long the auth circuit breaker stays open before probing the auth service again")
+	fs.IntVar(&s.CircuitBreakers.Auth.HalfOpenRequests, "authCircuitBreakerHalfOpenRequests", 1, "Number of probe requests that must succeed to close the auth circuit breaker")
+	fs.StringVar(&s.CircuitBreakers.Auth.ErrorPageFile, "authCircuitBreakerErrorPage", "", "HTML file served with a 503 while the auth circuit breaker is open")
+	fs.DurationVar(&s.ShutdownGracePeriod, "shutdownGracePeriod", 10*time.Second, "How long to let in-flight requests finish when shutting down")
+	fs.DurationVar(&s.StatusMetricsInterval, "statusMetricsInterval", 30*time.Second, "How often to export the status of the tailscale node as metrics. 0 disables.")
 
 	root := &ffcli.Command{
 		ShortUsage: fmt.Sprintf("%s [-config <file>] OR [-service \"key=val,...\"] OR [-name <serviceName> [flags] <toURL>]", path.Base(args[0])),
@@ -496,70 +1168,98 @@ func TailnetSrvsFromArgs(args []string) ([]*ValidTailnetSrv, string, *ffcli.Comm
 		Exec:       func(context.Context, []string) error { return nil },
 	}
 	if err := root.Parse(args[1:]); err != nil {
-		return nil, "", root, fmt.Errorf("could not parse args: %w", err)
+		return nil, nil, root, fmt.Errorf("could not parse args: %w", err)
 	}
 
 	// Determine which mode we're in
-	hasConfigFile := configPath != ""
+	hasConfigFile := opts.ConfigPath != ""
 	hasServiceFlags := len(services) > 0
 	hasLegacyFlags := s.Name != "" || len(root.FlagSet.Args()) > 0
 
 	// Check for invalid mode combinations
 	if hasConfigFile && hasServiceFlags {
-		return nil, "", root, errors.New("cannot use both -config and -service flags; choose one mode")
+		return nil, nil, root, errors.New("cannot use both -config and -service flags; choose one mode")
 	}
 	if hasConfigFile && hasLegacyFlags {
-		return nil, "", root, errConfigAndCLI
+		return nil, nil, root, errConfigAndCLI
+	}
+	if hasConfigFile {
+		// The config file sets everything else, which would silently
+		// override the flags:
+		var ignored []string
+		fs.Visit(func(f *flag.Flag) {
+			if f.Name != "config" && f.Name != "configReloadInterval" {
+				ignored = append(ignored, "-"+f.Name)
+			}
+		})
+		if len(ignored) > 0 {
+			return nil, nil, root, fmt.Errorf("%w: %s", errConfigAndCLI, strings.Join(ignored, ", "))
+		}
 	}
 	if hasServiceFlags && hasLegacyFlags {
-		return nil, "", root, errors.New("cannot mix -service flag with legacy single-service flags; use -service for all services")
+		return nil, nil, root, errors.New("cannot mix -service flag with legacy single-service flags; use -service for all services")
+	}
+
+	if err := opts.Restart.validate(); err != nil {
+		return nil, nil, root, err
 	}
 
 	// Mode 1: Config file mode
 	if hasConfigFile {
-		cfg, err := LoadConfig(configPath)
+		cfg, err := LoadConfig(opts.ConfigPath)
 		if err != nil {
-			return nil, "", root, fmt.Errorf("loading config file: %w", err)
+			return nil, nil, root, fmt.Errorf("loading config file: %w", err)
 		}
 
 		// Use default PrometheusAddr if not specified
-		configPrometheusAddr := cfg.PrometheusAddr
-		if configPrometheusAddr == "" {
-			configPrometheusAddr = ":9099"
+		opts.PrometheusAddr = cfg.PrometheusAddr
+		if opts.PrometheusAddr == "" {
+			opts.PrometheusAddr = ":9099"
 		}
-
-		var validServices []*ValidTailnetSrv
-		for i, svcCfg := range cfg.Services {
-			ts := svcCfg.ToTailnetSrv()
-			valid, err := ts.validate([]string{svcCfg.Upstream})
-			if err != nil {
-				return nil, "", root, fmt.Errorf("validating service %d (%s): %w", i, svcCfg.Name, err)
-			}
-			validServices = append(validServices, valid)
+		opts.Restart = cfg.Restart
+		opts.AdminAddr = cfg.AdminAddr
+		opts.AdminTokenFile = cfg.AdminTokenFile
+		opts.Identity = cfg.Identity
+		opts.AccessLog = cfg.AccessLog
+		opts.Tracing = cfg.Tracing
+		opts.Metrics = cfg.Metrics
+
+		validServices, err := ServicesFromConfig(cfg.Services)
+		if err != nil {
+			return nil, nil, root, err
 		}
-		return validServices, configPrometheusAddr, root, nil
+		return validServices, opts, root, nil
 	}
 
 	// Mode 2: Multi-service CLI mode
 	if hasServiceFlags {
-		var validServices []*ValidTailnetSrv
-		for i, svcCfg := range services {
-			ts := svcCfg.ToTailnetSrv()
-			valid, err := ts.validate([]string{svcCfg.Upstream})
-			if err != nil {
-				return nil, "", root, fmt.Errorf("validating service %d (%s): %w", i, svcCfg.Name, err)
-			}
-			validServices = append(validServices, valid)
+		validServices, err := ServicesFromConfig(services)
+		if err != nil {
+			return nil, nil, root, err
 		}
-		return validServices, prometheusAddr, root, nil
+		return validServices, opts, root, nil
 	}
 
 	// Mode 3: Legacy single-service CLI mode
 	valid, err := s.validate(root.FlagSet.Args())
 	if err != nil {
-		return nil, "", root, fmt.Errorf("failed to validate args: %w", err)
+		return nil, nil, root, fmt.Errorf("failed to validate args: %w", err)
+	}
+	return []*ValidTailnetSrv{valid}, opts, root, nil
+}
+
+// ServicesFromConfig converts and validates a list of service configurations.
+func ServicesFromConfig(configs []ServiceConfig) ([]*ValidTailnetSrv, error) {
+	var validServices []*ValidTailnetSrv
+	for i, svcCfg := range configs {
+		ts := svcCfg.ToTailnetSrv()
+		valid, err := ts.validate([]string{svcCfg.Upstream})
+		if err != nil {
+			return nil, fmt.Errorf("validating service %d (%s): %w", i, svcCfg.Name, err)
+		}
+		validServices = append(validServices, valid)
 	}
-	return []*ValidTailnetSrv{valid}, prometheusAddr, root, nil
+	return validServices, nil
 }
 
 var errNameRequired = errors.New("tsnsrv needs a -name")
@@ -587,9 +1287,53 @@ func (s *TailnetSrv) validate(args []string) (*ValidTailnetSrv, error) {
 	if s.UpstreamTCPAddr != "" && s.UpstreamUnixAddr != "" {
 		errs = append(errs, errOnlyOneAddrType)
 	}
+	if len(s.UpstreamTargets) > 0 && (s.UpstreamTCPAddr != "" || s.UpstreamUnixAddr != "") {
+		errs = append(errs, errTargetsAndAddr)
+	}
+	switch s.LoadBalancing {
+	case "", LoadBalanceRoundRobin, LoadBalanceLeastConn, LoadBalanceUserHash:
+	default:
+		errs = append(errs, fmt.Errorf("%w, got %q", errLoadBalancing, s.LoadBalancing))
+	}
 	if !s.Funnel && s.FunnelOnly {
 		errs = append(errs, errFunnelRequired)
 	}
+	if err := s.HealthCheck.validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := s.Capabilities.validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := s.AuthCache.validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := s.OIDC.validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if s.OIDC.enabled() && s.AuthURL != "" {
+		errs = append(errs, errOIDCAndAuthURL)
+	}
+	if err := s.JWTAuth.validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := s.Webhooks.validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := s.RateLimit.validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := s.Concurrency.validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := s.Retries.validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := s.CircuitBreakers.validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := s.AccessLog.validate(); err != nil {
+		errs = append(errs, err)
+	}
 
 	if len(args) != 1 {
 		return nil, errors.Join(append(errs, errNoDestURL)...)
@@ -598,11 +1342,23 @@ func (s *TailnetSrv) validate(args []string) (*ValidTailnetSrv, error) {
 	if err != nil {
 		errs = append(errs, fmt.Errorf("invalid destination URL %#v: %w", args[0], err))
 	}
+	routes, err := s.Routes.parse()
+	if err != nil {
+		errs = append(errs, err)
+	}
+	targets, err := s.UpstreamTargets.parse()
+	if err != nil {
+		errs = append(errs, err)
+	}
+	access, err := s.Access.parse()
+	if err != nil {
+		errs = append(errs, err)
+	}
 	if len(errs) > 0 {
 		return nil, errors.Join(errs...)
 	}
 
-	valid := ValidTailnetSrv{TailnetSrv: *s, DestURL: destURL}
+	valid := ValidTailnetSrv{TailnetSrv: *s, DestURL: destURL, routes: routes, targets: targets, access: access}
 	return &valid, nil
 }
 
@@ -653,6 +1409,23 @@ func (s *ValidTailnetSrv) mintAuthKey(ctx context.Context, authkey string) (stri
 	return created.Key, nil
 }
 
+// upstreamTransport returns a transport for talking to upstreams, dialing with dial.
+func (s *ValidTailnetSrv) upstreamTransport(dial dialFunc) *http.Transport {
+	transport := &http.Transport{DialContext: dial}
+	transport.TLSClientConfig = &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+	if s.InsecureHTTPS {
+		transport.TLSClientConfig.InsecureSkipVerify = true // #nosec This is explicitly requested by the user
+	}
+	if s.UpstreamAllowInsecureCiphers {
+		for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+			transport.TLSClientConfig.CipherSuites = append(transport.TLSClientConfig.CipherSuites, suite.ID)
+		}
+	}
+	return transport
+}
+
 func (s *ValidTailnetSrv) Run(ctx context.Context) error {
 	// Disable Tailscale port listing to reduce CPU usage by ~50%.
 	// Port listing polls /proc/net/tcp* and /proc/[pid]/ every 1 second on Linux,
@@ -680,55 +1453,141 @@ func (s *ValidTailnetSrv) Run(ctx context.Context) error {
 				"error", err)
 		}
 	}
-	ctx, cancel := context.WithTimeout(ctx, s.Timeout)
+	if len(s.Capabilities.Names) > 0 && s.Capabilities.Format == CapabilityFormatSigned {
+		var err error
+		s.capabilityKey, err = readCapabilityKey(s.Capabilities.SigningKeyFile)
+		if err != nil {
+			return err
+		}
+	}
+	if s.OIDC.enabled() {
+		var err error
+		s.oidc, err = newOIDCProvider(s.OIDC)
+		if err != nil {
+			return err
+		}
+	}
+	if s.JWTAuth.enabled() {
+		var err error
+		s.jwtAuth, err = newJWTValidator(s.JWTAuth)
+		if err != nil {
+			return err
+		}
+	}
+	if s.BasicAuth.enabled() {
+		var err error
+		s.htpasswd, err = loadHtpasswd(s.BasicAuth.HtpasswdFile)
+		if err != nil {
+			return err
+		}
+	}
+	if len(s.Webhooks) > 0 {
+		var err error
+		s.webhooks, err = s.Webhooks.load()
+		if err != nil {
+			return err
+		}
+	}
+	if s.RateLimit.enabled() {
+		s.rateLimiter = newRateLimiter(s.RateLimit)
+	}
+	s.accessLogger = s.processAccessLog
+	if s.AccessLog.enabled() {
+		accessLogger, err := NewAccessLogger(s.AccessLog)
+		if err != nil {
+			return err
+		}
+		defer accessLogger.Close()
+		s.accessLogger = accessLogger
+	}
+	if s.CircuitBreakers.Upstream.enabled() {
+		var err error
+		s.upstreamBreaker, err = newCircuitBreaker(s.Name, "upstream", s.CircuitBreakers.Upstream)
+		if err != nil {
+			return err
+		}
+	}
+	if s.CircuitBreakers.Auth.enabled() && s.AuthURL != "" {
+		var err error
+		s.authBreaker, err = newCircuitBreaker(s.Name, "auth", s.CircuitBreakers.Auth)
+		if err != nil {
+			return err
+		}
+	}
+	s.whoisCache.reset()
+	s.authCache.reset()
+	defer srv.Close()
+	defer s.status.setDown()
+	upCtx, cancel := context.WithTimeout(ctx, s.Timeout)
 	defer cancel()
-	status, err := srv.Up(ctx)
+	status, err := srv.Up(upCtx)
 	if err != nil {
 		return fmt.Errorf("could not connect to tailnet: %w", err)
 	}
+	s.status.setUp(status.TailscaleIPs)
 	s.client, err = srv.LocalClient()
 	if err != nil {
-		if slices.ContainsFunc(s.AllowedPrefixes, func(p prefix) bool { return p.matchIf != matchEither }) {
-			return fmt.Errorf("-prefix rules with a provenance (tailnet: or funnel:) require that a local tailscale client is available: %w", err)
+		if slices.ContainsFunc(s.AllowedPrefixes, func(p prefix) bool { return p.matchIf != matchEither }) ||
+			slices.ContainsFunc(s.routes, func(r route) bool { return r.matchIf != matchEither }) {
+			return fmt.Errorf("-prefix and -route rules with a provenance (tailnet: or funnel:) require that a local tailscale client is available: %w", err)
+		}
+		if len(s.access) > 0 {
+			return fmt.Errorf("-access rules require that a local tailscale client is available: %w", err)
 		}
 		slog.Warn("could not get a local tailscale client. Whois headers will not work.",
 			"error", err,
 		)
 	}
-	dial := srv.Dial
+	if lc, ok := s.client.(nodeStatusClient); ok && err == nil && s.StatusMetricsInterval > 0 {
+		statusCtx, stopStatus := context.WithCancel(ctx)
+		defer stopStatus()
+		go s.monitorNodeStatus(statusCtx, lc)
+	}
+	var dial dialFunc = srv.Dial
 	if s.SuppressTailnetDialer {
 		d := net.Dialer{}
 		dial = d.DialContext
 	}
-	if s.UpstreamTCPAddr != "" {
-		dialOrig := dial
-		dial = func(ctx context.Context, _, _ string) (net.Conn, error) {
-			conn, err := dialOrig(ctx, "tcp", s.UpstreamTCPAddr)
-			if err != nil {
-				return nil, fmt.Errorf("connecting to tcp %v: %w", s.UpstreamTCPAddr, err)
-			}
-			return conn, nil
-		}
-	} else if s.UpstreamUnixAddr != "" {
-		dial = func(ctx context.Context, _, _ string) (net.Conn, error) {
-			d := net.Dialer{}
-			conn, err := d.DialContext(ctx, "unix", s.UpstreamUnixAddr)
-			if err != nil {
-				return nil, fmt.Errorf("connecting to unix %v: %w", s.UpstreamUnixAddr, err)
-			}
-			return conn, nil
-		}
+	if len(s.routes) > 0 {
+		// Routes name their upstream by URL, so they dial it as given.
+		s.routeTransport = s.upstreamTransport(dial)
 	}
-	transport := &http.Transport{DialContext: dial}
-	transport.TLSClientConfig = &tls.Config{
-		MinVersion: tls.VersionTLS12,
+	targets := s.targets
+	if len(targets) == 0 && s.HealthCheck.enabled() {
+		targets = []upstreamTarget{s.defaultTarget()}
 	}
-	if s.InsecureHTTPS {
-		transport.TLSClientConfig.InsecureSkipVerify = true // #nosec This is explicitly requested by the user
+	var transport http.RoundTripper
+	switch {
+	case len(targets) > 0:
+		b := newBalancer(s.Name, s.LoadBalancing, s.HealthCheck, targets, func(target upstreamTarget) http.RoundTripper {
+			return s.upstreamTransport(dialTo(dial, target))
+		})
+		monitorCtx, stopMonitor := context.WithCancel(ctx)
+		defer stopMonitor()
+		go b.monitor(monitorCtx, s.DestURL)
+		s.status.setUpstreams(b)
+		transport = b
+	case s.UpstreamTCPAddr != "":
+		transport = s.upstreamTransport(dialTo(dial, upstreamTarget{"tcp", s.UpstreamTCPAddr}))
+	case s.UpstreamUnixAddr != "":
+		transport = s.upstreamTransport(dialTo(dial, upstreamTarget{"unix", s.UpstreamUnixAddr}))
+	default:
+		transport = s.upstreamTransport(dial)
 	}
-	if s.UpstreamAllowInsecureCiphers {
-		for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
-			transport.TLSClientConfig.CipherSuites = append(transport.TLSClientConfig.CipherSuites, suite.ID)
+	if s.Retries.enabled() {
+		transport = newRetryTransport(s.Name, s.Retries, transport)
+		if s.routeTransport != nil {
+			s.routeTransport = newRetryTransport(s.Name, s.Retries, s.routeTransport)
+		}
+	}
+	if s.upstreamBreaker != nil {
+		// Outside of the retries, so an open breaker skips them too.
+		transport = &breakerTransport{breaker: s.upstreamBreaker, next: transport}
+	}
+	if s.tracer != nil {
+		transport = &tracingTransport{service: s.Name, tracer: s.tracer, next: transport}
+		if s.routeTransport != nil {
+			s.routeTransport = &tracingTransport{service: s.Name, tracer: s.tracer, next: s.routeTransport}
 		}
 	}
 
@@ -738,21 +1597,25 @@ func (s *ValidTailnetSrv) Run(ctx context.Context) error {
 		"listenAddr", s.ListenAddr,
 		"tags", s.Tags,
 		"prefixes", s.AllowedPrefixes,
+		"routes", s.Routes,
+		"access", s.Access,
 		"destURL", s.DestURL,
+		"upstreamTargets", s.UpstreamTargets,
 		"plaintext", s.ServePlaintext,
 		"funnel", s.Funnel,
 		"funnelOnly", s.FunnelOnly,
 	)
+	var inflight inflightRequests
 	tailnetServer := http.Server{
-		Handler:           s.mux(transport, false),
+		Handler:           inflight.track(s.mux(transport, false)),
 		ReadHeaderTimeout: s.ReadHeaderTimeout,
 	}
 	funnelServer := http.Server{
-		Handler:           s.mux(transport, true),
+		Handler:           inflight.track(s.mux(transport, true)),
 		ReadHeaderTimeout: s.ReadHeaderTimeout,
 	}
 
-	serveResults := make(chan error)
+	serveResults := make(chan error, 2)
 	if s.Funnel {
 		go func() {
 			serveResults <- fmt.Errorf("on the funnel for %v: %w", srv, func() error {
@@ -760,46 +1623,82 @@ func (s *ValidTailnetSrv) Run(ctx context.Context) error {
 				if err != nil {
 					return fmt.Errorf("creating funnel listener for %v: %w", srv, err)
 				}
+				s.status.setListening("funnel")
 				return funnelServer.Serve(listener)
 			}())
 		}()
 	}
-	if s.FunnelOnly {
-		return fmt.Errorf("while serving: %w", <-serveResults)
-	}
+	if !s.FunnelOnly {
+		go func() {
+			serveResults <- fmt.Errorf("on the tailnet for %v: %w", srv, func() error {
+				if s.certificateFile != "" || s.keyFile != "" {
+					listener, err := srv.Listen("tcp", s.ListenAddr)
+					if err != nil {
+						return fmt.Errorf("creating custom-cert TLS listener on the tailnet: %w", err)
+					}
+					s.status.setListening("tailnet")
+					return tailnetServer.ServeTLS(listener, s.certificateFile, s.keyFile)
+				}
 
-	go func() {
-		serveResults <- fmt.Errorf("on the tailnet for %v: %w", srv, func() error {
-			if s.certificateFile != "" || s.keyFile != "" {
-				listener, err := srv.Listen("tcp", s.ListenAddr)
+				listen := func() (net.Listener, error) { return srv.ListenTLS("tcp", s.ListenAddr) }
+				if s.ServePlaintext {
+					listen = func() (net.Listener, error) { return srv.Listen("tcp", s.ListenAddr) }
+				}
+				listener, err := listen()
 				if err != nil {
-					return fmt.Errorf("creating custom-cert TLS listener on the tailnet: %w", err)
+					return fmt.Errorf("creating listener on the tailnet: %w", err)
 				}
-				return tailnetServer.ServeTLS(listener, s.certificateFile, s.keyFile)
-			}
+				s.status.setListening("tailnet")
+				return tailnetServer.Serve(listener)
+			}())
+		}()
+	}
 
-			listen := func() (net.Listener, error) { return srv.ListenTLS("tcp", s.ListenAddr) }
-			if s.ServePlaintext {
-				listen = func() (net.Listener, error) { return srv.Listen("tcp", s.ListenAddr) }
-			}
-			listener, err := listen()
-			if err != nil {
-				return fmt.Errorf("creating listener on the tailnet: %w", err)
-			}
-			return tailnetServer.Serve(listener)
-		}())
-	}()
-	return fmt.Errorf("while serving: %w", <-serveResults)
+	select {
+	case err := <-serveResults:
+		return fmt.Errorf("while serving: %w", err)
+	case <-ctx.Done():
+	}
+
+	// Stopped from the outside (by a signal, a config reload or the
+	// admin API): let in-flight requests finish, then take the node
+	// offline.
+	s.status.setDraining()
+	s.drain(&inflight, &tailnetServer, &funnelServer)
+	if s.Ephemeral {
+		s.logout(srv)
+	}
+	return fmt.Errorf("while serving: %w", ctx.Err())
 }
 
 // StartPrometheusServer starts the Prometheus metrics and pprof HTTP server on the given address.
 // This should be called once at the process level, not per-service.
+// If extra is non-nil, it serves all other paths on the same listener (e.g. the admin API).
 // Returns an error if the server fails to start, otherwise runs in the background.
-func StartPrometheusServer(ctx context.Context, addr string) error {
+func StartPrometheusServer(ctx context.Context, addr string, extra http.Handler) error {
 	if addr == "" {
 		return nil
 	}
+	return serveInBackground(ctx, "Prometheus/pprof", addr, metricsMux(extra))
+}
+
+// ProcessHandler returns the endpoints that are served next to the
+// metrics: the health checks of the orchestrator's services and, if
+// identity is set, the keys that verify identity tokens. The admin API
+// is not among them; it has a listener of its own.
+func ProcessHandler(o *Orchestrator, identity *IdentitySigner) http.Handler {
+	mux := http.NewServeMux()
+	if identity != nil {
+		mux.Handle(JWKSPath, identity.JWKSHandler())
+	}
+	health := HealthHandler(o)
+	for _, path := range []string{"/healthz", "/healthz/", "/readyz", "/readyz/"} {
+		mux.Handle(path, health)
+	}
+	return mux
+}
 
+func metricsMux(extra http.Handler) *http.ServeMux {
 	mux := http.NewServeMux()
 	mux.Handle("/metrics", promhttp.Handler())
 
@@ -810,20 +1709,28 @@ func StartPrometheusServer(ctx context.Context, addr string) error {
 	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
 	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
 
+	if extra != nil {
+		mux.Handle("/", extra)
+	}
+	return mux
+}
+
+// serveInBackground serves handler on addr until ctx is canceled.
+func serveInBackground(ctx context.Context, what, addr string, handler http.Handler) error {
 	listener, err := net.Listen("tcp", addr)
 	if err != nil {
-		return fmt.Errorf("could not listen on prometheus address %v: %w", addr, err)
+		return fmt.Errorf("could not listen on %s address %v: %w", what, addr, err)
 	}
 
 	server := &http.Server{
-		Handler:           mux,
+		Handler:           handler,
 		ReadHeaderTimeout: 1 * time.Second,
 	}
 
 	go func() {
-		slog.Info("Prometheus/pprof server listening", "addr", addr)
+		slog.Info("Server listening", "server", what, "addr", addr)
 		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
-			slog.Error("Prometheus server failed", "error", err)
+			slog.Error("Server failed", "server", what, "error", err)
 		}
 	}()
 
@@ -833,7 +1740,7 @@ func StartPrometheusServer(ctx context.Context, addr string) error {
 		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 		defer cancel()
 		if err := server.Shutdown(shutdownCtx); err != nil {
-			slog.Error("Error shutting down prometheus server", "error", err)
+			slog.Error("Error shutting down server", "server", what, "error", err)
 		}
 	}()
 
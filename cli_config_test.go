@@ -4,6 +4,7 @@ import (
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -76,6 +77,40 @@ services:
 	assert.Contains(t, err.Error(), "cannot use -config with other CLI flags")
 }
 
+func TestTailnetSrvsFromArgs_ConfigAndProcessFlagsError(t *testing.T) {
+	configYAML := `
+restart:
+  policy: failFast
+services:
+  - name: service1
+    upstream: http://localhost:8080
+`
+
+	tmpDir := t.TempDir()
+	configPath := filepath.Join(tmpDir, "config.yaml")
+	err := os.WriteFile(configPath, []byte(configYAML), 0600)
+	require.NoError(t, err)
+
+	// Flags that the config file would override are rejected:
+	_, _, _, err = TailnetSrvsFromArgs([]string{
+		"tsnsrv",
+		"-config", configPath,
+		"-restartPolicy", "supervise",
+		"-prometheusAddr", ":9100",
+	})
+	require.ErrorIs(t, err, errConfigAndCLI)
+	assert.Contains(t, err.Error(), "-prometheusAddr, -restartPolicy")
+
+	_, opts, _, err := TailnetSrvsFromArgs([]string{
+		"tsnsrv",
+		"-config", configPath,
+		"-configReloadInterval", "1m",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, RestartFailFast, opts.Restart.Policy)
+	assert.Equal(t, time.Minute, opts.ConfigReloadInterval)
+}
+
 func TestTailnetSrvFromArgs_BackwardCompatibility(t *testing.T) {
 	// Test that the original function still works
 	service, _, cmd, err := TailnetSrvFromArgs([]string{
@@ -156,6 +156,19 @@ func TestServiceFlagParsing(t *testing.T) {
 				assert.Equal(t, "/var/run/app.sock", svc.UpstreamUnixAddr)
 			},
 		},
+		{
+			name:      "upstream targets",
+			flagValue: "name=test,upstream=http://localhost:80,upstreamTarget=tcp:10.0.0.1:8080,upstreamTarget=unix:/var/run/app.sock,loadBalancing=leastConn",
+			validate: func(t *testing.T, svc ServiceConfig) {
+				assert.Equal(t, []string{"tcp:10.0.0.1:8080", "unix:/var/run/app.sock"}, svc.UpstreamTargets)
+				assert.Equal(t, "leastConn", svc.LoadBalancing)
+			},
+		},
+		{
+			name:        "invalid upstream target",
+			flagValue:   "name=test,upstream=http://localhost:80,upstreamTarget=nope",
+			expectError: true,
+		},
 	}
 
 	for _, tt := range tests {
@@ -5,27 +5,85 @@ import (
 	"errors"
 	"log"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/boinkor-net/tsnsrv"
 	"github.com/peterbourgon/ff/v3/ffcli"
 )
 
 func main() {
-	services, prometheusAddr, cmd, err := tsnsrv.TailnetSrvsFromArgs(os.Args)
+	services, opts, cmd, err := tsnsrv.TailnetSrvsFromArgs(os.Args)
 	if err != nil {
 		log.Fatalf("Invalid CLI usage. Errors:\n%v\n\n%v", errors.Unwrap(err), ffcli.DefaultUsageFunc(cmd))
 	}
 
-	ctx := context.Background()
+	// Drain and stop all services on SIGTERM/SIGINT. Once the first
+	// signal arrived, a second one terminates the process right away.
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		log.Printf("Received shutdown signal, stopping services")
+		stop()
+	}()
 
-	// Start prometheus/pprof server once at process level
-	if err := tsnsrv.StartPrometheusServer(ctx, prometheusAddr); err != nil {
+	// Use orchestrator for both single and multi-service modes
+	orchestrator := tsnsrv.NewOrchestrator(services)
+	orchestrator.Restart = opts.Restart
+	identity, err := tsnsrv.NewIdentitySigner(opts.Identity)
+	if err != nil {
+		log.Fatalf("Failed to load identity key: %v", err)
+	}
+	orchestrator.Identity = identity
+	accessLog, err := tsnsrv.NewAccessLogger(opts.AccessLog)
+	if err != nil {
+		log.Fatalf("Failed to open access log: %v", err)
+	}
+	defer accessLog.Close()
+	orchestrator.AccessLog = accessLog
+	tracer, err := tsnsrv.NewTracer(opts.Tracing)
+	if err != nil {
+		log.Fatalf("Failed to set up tracing: %v", err)
+	}
+	defer tracer.Close()
+	orchestrator.Tracer = tracer
+	if err := tsnsrv.ConfigureMetrics(opts.Metrics); err != nil {
+		log.Fatalf("Failed to set up metrics: %v", err)
+	}
+
+	// The process-level servers outlive the signal: while services
+	// drain, /readyz keeps answering that they aren't ready, and
+	// metrics keep being scraped.
+	serverCtx, stopServers := context.WithCancel(context.Background())
+	defer stopServers()
+
+	// The admin API can stop services, so it is only served when
+	// asked for, on a listener of its own.
+	if opts.AdminAddr != "" {
+		if err := tsnsrv.StartAdminServer(serverCtx, opts.AdminAddr, opts.AdminTokenFile, orchestrator); err != nil {
+			log.Fatalf("Failed to start admin server: %v", err)
+		}
+	}
+
+	// Start prometheus/pprof server once at process level; upstreams
+	// verify identity tokens with the keys served next to the metrics.
+	if err := tsnsrv.StartPrometheusServer(serverCtx, opts.PrometheusAddr, tsnsrv.ProcessHandler(orchestrator, identity)); err != nil {
 		log.Fatalf("Failed to start prometheus server: %v", err)
 	}
 
-	// Use orchestrator for both single and multi-service modes
-	orchestrator := tsnsrv.NewOrchestrator(services)
+	// Pick up changes to the config file without restarting unchanged services
+	if opts.ConfigPath != "" {
+		reloader := &tsnsrv.ConfigReloader{
+			Path:         opts.ConfigPath,
+			Interval:     opts.ConfigReloadInterval,
+			Orchestrator: orchestrator,
+		}
+		go reloader.Run(ctx)
+	}
+
 	if err := orchestrator.Run(ctx); err != nil {
 		log.Fatal(err)
 	}
+	log.Printf("All services stopped")
 }
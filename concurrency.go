@@ -0,0 +1,201 @@
+package tsnsrv
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"golang.org/x/exp/slog"
+)
+
+var (
+	concurrencyInFlight = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tsnsrv_concurrency_in_flight_requests",
+		Help: "Requests being proxied under a concurrency limit, by listener (tailnet, funnel)",
+	}, []string{"service_name", "listener"})
+	concurrencyQueued = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tsnsrv_concurrency_queued_requests",
+		Help: "Requests waiting for a concurrency limit, by listener (tailnet, funnel)",
+	}, []string{"service_name", "listener"})
+	concurrencyRejections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "tsnsrv_concurrency_rejected_requests_total",
+		Help: "Requests rejected by a concurrency limit, by listener and reason (queue_full, timeout)",
+	}, []string{"service_name", "listener", "reason"})
+)
+
+var (
+	errQueueFull    = errors.New("request queue is full")
+	errQueueTimeout = errors.New("timed out waiting in the request queue")
+)
+
+// Concurrency limits how many requests a service proxies at once. The
+// tailnet and funnel listeners have separate budgets.
+type Concurrency struct {
+	Tailnet ConcurrencyLimit `yaml:"tailnet,omitempty"`
+	Funnel  ConcurrencyLimit `yaml:"funnel,omitempty"`
+}
+
+// ConcurrencyLimit is the request budget of one listener.
+type ConcurrencyLimit struct {
+	// MaxConcurrentRequests is how many requests are proxied at once.
+	// 0 means no limit.
+	MaxConcurrentRequests int `yaml:"maxConcurrentRequests,omitempty"`
+
+	// MaxQueuedRequests is how many requests may wait, in order of
+	// arrival, for one of the others to finish. Requests beyond that
+	// are rejected right away; with 0, no requests wait.
+	MaxQueuedRequests int `yaml:"maxQueuedRequests,omitempty"`
+
+	// QueueTimeout is how long a request may wait in the queue before
+	// it's rejected (default 30s).
+	QueueTimeout time.Duration `yaml:"queueTimeout,omitempty"`
+}
+
+func (cl ConcurrencyLimit) enabled() bool {
+	return cl.MaxConcurrentRequests > 0
+}
+
+func (cl ConcurrencyLimit) withDefaults() ConcurrencyLimit {
+	if cl.QueueTimeout == 0 {
+		cl.QueueTimeout = 30 * time.Second
+	}
+	return cl
+}
+
+func (c Concurrency) validate() error {
+	var errs []error
+	for name, cl := range map[string]ConcurrencyLimit{"tailnet": c.Tailnet, "funnel": c.Funnel} {
+		if cl.MaxConcurrentRequests < 0 || cl.MaxQueuedRequests < 0 || cl.QueueTimeout < 0 {
+			errs = append(errs, fmt.Errorf("%s concurrency settings can not be negative", name))
+		}
+		if !cl.enabled() && cl.MaxQueuedRequests > 0 {
+			errs = append(errs, fmt.Errorf("%s requests can only be queued with a concurrency limit", name))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// concurrencyLimiter is a semaphore whose waiters get their turn in
+// the order they arrived.
+type concurrencyLimiter struct {
+	limit            ConcurrencyLimit
+	inFlight, queued prometheus.Gauge
+
+	mu      sync.Mutex
+	active  int
+	waiters list.List // of chan struct{}
+}
+
+func newConcurrencyLimiter(limit ConcurrencyLimit, service, listener string) *concurrencyLimiter {
+	labels := prometheus.Labels{"service_name": service, "listener": listener}
+	return &concurrencyLimiter{
+		limit:    limit.withDefaults(),
+		inFlight: concurrencyInFlight.With(labels),
+		queued:   concurrencyQueued.With(labels),
+	}
+}
+
+// acquire waits for a slot, and returns an error if none became
+// available in time. Callers must release slots they acquired.
+func (l *concurrencyLimiter) acquire(ctx context.Context) error {
+	l.mu.Lock()
+	if l.active < l.limit.MaxConcurrentRequests && l.waiters.Len() == 0 {
+		l.active++
+		l.inFlight.Inc()
+		l.mu.Unlock()
+		return nil
+	}
+	if l.waiters.Len() >= l.limit.MaxQueuedRequests {
+		l.mu.Unlock()
+		return errQueueFull
+	}
+	turn := make(chan struct{})
+	elt := l.waiters.PushBack(turn)
+	l.queued.Inc()
+	l.mu.Unlock()
+
+	timer := time.NewTimer(l.limit.QueueTimeout)
+	defer timer.Stop()
+	var err error
+	select {
+	case <-turn:
+		return nil
+	case <-timer.C:
+		err = errQueueTimeout
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	select {
+	case <-turn:
+		// release handed us the slot while we gave up; pass it on.
+		l.releaseLocked()
+	default:
+		l.waiters.Remove(elt)
+		l.queued.Dec()
+	}
+	return err
+}
+
+// release gives the slot to the next waiter, if there is one.
+func (l *concurrencyLimiter) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.releaseLocked()
+}
+
+func (l *concurrencyLimiter) releaseLocked() {
+	if front := l.waiters.Front(); front != nil {
+		l.waiters.Remove(front)
+		l.queued.Dec()
+		close(front.Value.(chan struct{}))
+		return
+	}
+	l.active--
+	l.inFlight.Dec()
+}
+
+// concurrencyMiddleware limits how many requests on the listener are
+// passed on at once.
+func (s *ValidTailnetSrv) concurrencyMiddleware(forFunnel bool, next http.Handler) http.Handler {
+	limit, listener := s.Concurrency.Tailnet, "tailnet"
+	if forFunnel {
+		limit, listener = s.Concurrency.Funnel, "funnel"
+	}
+	if !limit.enabled() {
+		return next
+	}
+	l := newConcurrencyLimiter(limit, s.Name, listener)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := l.acquire(r.Context()); err != nil {
+			reason := "timeout"
+			switch {
+			case errors.Is(err, errQueueFull):
+				reason = "queue_full"
+			case r.Context().Err() != nil:
+				// The client went away; nobody to respond to.
+				return
+			}
+			concurrencyRejections.With(prometheus.Labels{"service_name": s.Name, "listener": listener, "reason": reason}).Inc()
+			slog.Info("too many concurrent requests",
+				"service", s.Name,
+				"listener", listener,
+				"remote_addr", r.RemoteAddr,
+				"url", r.URL,
+				"error", err,
+			)
+			http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		defer l.release()
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,113 @@
+package tsnsrv
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConcurrencyValidate(t *testing.T) {
+	t.Parallel()
+	assert.NoError(t, Concurrency{}.validate())
+	assert.NoError(t, Concurrency{Funnel: ConcurrencyLimit{MaxConcurrentRequests: 2, MaxQueuedRequests: 10}}.validate())
+	assert.Error(t, Concurrency{Tailnet: ConcurrencyLimit{MaxConcurrentRequests: -1}}.validate())
+	assert.Error(t, Concurrency{Funnel: ConcurrencyLimit{MaxQueuedRequests: 10}}.validate())
+}
+
+// waitForQueue waits until n requests wait for l.
+func waitForQueue(t *testing.T, l *concurrencyLimiter, n int) {
+	t.Helper()
+	require.Eventually(t, func() bool {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		return l.waiters.Len() == n
+	}, 5*time.Second, time.Millisecond)
+}
+
+func TestConcurrencyLimiterFIFO(t *testing.T) {
+	t.Parallel()
+	l := newConcurrencyLimiter(ConcurrencyLimit{MaxConcurrentRequests: 1, MaxQueuedRequests: 3}, t.Name(), "tailnet")
+	ctx := context.Background()
+	require.NoError(t, l.acquire(ctx))
+
+	var mu sync.Mutex
+	var order []int
+	var wg sync.WaitGroup
+	for i := range 3 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, l.acquire(ctx))
+			mu.Lock()
+			order = append(order, i)
+			mu.Unlock()
+			l.release()
+		}()
+		waitForQueue(t, l, i+1)
+	}
+	assert.ErrorIs(t, l.acquire(ctx), errQueueFull)
+
+	l.release()
+	wg.Wait()
+	assert.Equal(t, []int{0, 1, 2}, order)
+	assert.Equal(t, 0, l.active)
+}
+
+func TestConcurrencyLimiterTimeout(t *testing.T) {
+	t.Parallel()
+	l := newConcurrencyLimiter(ConcurrencyLimit{MaxConcurrentRequests: 1, MaxQueuedRequests: 1, QueueTimeout: 10 * time.Millisecond}, t.Name(), "tailnet")
+	require.NoError(t, l.acquire(context.Background()))
+	assert.ErrorIs(t, l.acquire(context.Background()), errQueueTimeout)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.ErrorIs(t, l.acquire(ctx), context.Canceled)
+
+	waitForQueue(t, l, 0)
+	l.release()
+	assert.Equal(t, 0, l.active, "requests that gave up don't hold on to slots")
+	require.NoError(t, l.acquire(context.Background()))
+}
+
+func TestConcurrencyMiddleware(t *testing.T) {
+	t.Parallel()
+	s := &ValidTailnetSrv{TailnetSrv: TailnetSrv{Name: t.Name(), Concurrency: Concurrency{
+		Funnel: ConcurrencyLimit{MaxConcurrentRequests: 1},
+	}}}
+	release := make(chan struct{})
+	started := make(chan struct{})
+	handler := s.concurrencyMiddleware(true, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+	}))
+
+	done := make(chan int)
+	go func() {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		done <- w.Code
+	}()
+	<-started
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+
+	close(release)
+	assert.Equal(t, http.StatusOK, <-done)
+
+	go func() { <-started }()
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// The tailnet listener has no limit:
+	tailnet := s.concurrencyMiddleware(false, http.NotFoundHandler())
+	assert.IsType(t, http.NotFoundHandler(), tailnet)
+}
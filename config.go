@@ -11,8 +11,15 @@ import (
 
 // Config represents a multi-service configuration file
 type Config struct {
-	PrometheusAddr string          `yaml:"prometheusAddr,omitempty"`
-	Services       []ServiceConfig `yaml:"services"`
+	PrometheusAddr string            `yaml:"prometheusAddr,omitempty"`
+	AdminAddr      string            `yaml:"adminAddr,omitempty"`
+	AdminTokenFile string            `yaml:"adminTokenFile,omitempty"`
+	Restart        RestartPolicy     `yaml:"restart,omitempty"`
+	Identity       IdentityAssertion `yaml:"identity,omitempty"`
+	AccessLog      AccessLog         `yaml:"accessLog,omitempty"`
+	Tracing        Tracing           `yaml:"tracing,omitempty"`
+	Metrics        Metrics           `yaml:"metrics,omitempty"`
+	Services       []ServiceConfig   `yaml:"services"`
 }
 
 // ServiceConfig represents configuration for a single service
@@ -22,8 +29,11 @@ type ServiceConfig struct {
 	Upstream string `yaml:"upstream"`
 
 	// Connection options
-	UpstreamTCPAddr  string `yaml:"upstreamTCPAddr,omitempty"`
-	UpstreamUnixAddr string `yaml:"upstreamUnixAddr,omitempty"`
+	UpstreamTCPAddr  string      `yaml:"upstreamTCPAddr,omitempty"`
+	UpstreamUnixAddr string      `yaml:"upstreamUnixAddr,omitempty"`
+	UpstreamTargets  []string    `yaml:"upstreamTargets,omitempty"`
+	LoadBalancing    string      `yaml:"loadBalancing,omitempty"`
+	HealthCheck      HealthCheck `yaml:"healthCheck,omitempty"`
 
 	// Tailscale options
 	Ephemeral  bool     `yaml:"ephemeral,omitempty"`
@@ -46,6 +56,14 @@ type ServiceConfig struct {
 	Prefixes                []string          `yaml:"prefixes,omitempty"`
 	StripPrefix             bool              `yaml:"stripPrefix,omitempty"`
 	UpstreamHeaders         map[string]string `yaml:"upstreamHeaders,omitempty"`
+	Routes                  []RouteConfig     `yaml:"routes,omitempty"`
+	Webhooks                []WebhookConfig   `yaml:"webhooks,omitempty"`
+
+	// Access control
+	Access []AccessRule `yaml:"access,omitempty"`
+
+	// Application capabilities to pass to the upstream
+	Capabilities CapabilityForwarding `yaml:"capabilities,omitempty"`
 
 	// Security options
 	InsecureHTTPS                bool `yaml:"insecureHTTPS,omitempty"`
@@ -54,6 +72,8 @@ type ServiceConfig struct {
 	// WhoIs options
 	SuppressWhois         bool          `yaml:"suppressWhois,omitempty"`
 	WhoisTimeout          time.Duration `yaml:"whoisTimeout,omitempty"`
+	WhoisCacheTTL         time.Duration `yaml:"whoisCacheTTL,omitempty"`
+	WhoisNegativeCacheTTL time.Duration `yaml:"whoisNegativeCacheTTL,omitempty"`
 	SuppressTailnetDialer bool          `yaml:"suppressTailnetDialer,omitempty"`
 
 	// Forward auth options
@@ -63,10 +83,39 @@ type ServiceConfig struct {
 	AuthCopyHeaders     map[string]string `yaml:"authCopyHeaders,omitempty"`
 	AuthInsecureHTTPS   bool              `yaml:"authInsecureHTTPS,omitempty"`
 	AuthBypassForTailnet bool             `yaml:"authBypassForTailnet,omitempty"`
+	AuthCache            AuthCache         `yaml:"authCache,omitempty"`
+
+	// OpenID Connect login
+	OIDC OIDC `yaml:"oidc,omitempty"`
+
+	// Bearer JWT validation
+	JWTAuth JWTAuth `yaml:"jwtAuth,omitempty"`
+
+	// HTTP Basic authentication
+	BasicAuth BasicAuth `yaml:"basicAuth,omitempty"`
+
+	// Rate limiting
+	RateLimit RateLimit `yaml:"rateLimit,omitempty"`
+
+	// Concurrency limits
+	Concurrency Concurrency `yaml:"concurrency,omitempty"`
+
+	// Upstream retries
+	Retries Retries `yaml:"retries,omitempty"`
+
+	// Circuit breakers
+	CircuitBreakers CircuitBreakers `yaml:"circuitBreaker,omitempty"`
+
+	// Access log
+	AccessLog AccessLog `yaml:"accessLog,omitempty"`
 
 	// Timeouts and performance
-	Timeout           time.Duration `yaml:"timeout,omitempty"`
-	ReadHeaderTimeout time.Duration `yaml:"readHeaderTimeout,omitempty"`
+	Timeout             time.Duration `yaml:"timeout,omitempty"`
+	ReadHeaderTimeout   time.Duration `yaml:"readHeaderTimeout,omitempty"`
+	ShutdownGracePeriod time.Duration `yaml:"shutdownGracePeriod,omitempty"`
+
+	// Metrics
+	StatusMetricsInterval time.Duration `yaml:"statusMetricsInterval,omitempty"`
 
 	// Debugging
 	TsnetVerbose bool `yaml:"tsnetVerbose,omitempty"`
@@ -106,6 +155,10 @@ func (c *Config) Validate() error {
 	names := make(map[string]bool)
 	var errs []error
 
+	if err := c.Restart.validate(); err != nil {
+		errs = append(errs, err)
+	}
+
 	for i, svc := range c.Services {
 		if svc.Name == "" {
 			errs = append(errs, fmt.Errorf("service %d: %w", i, errNameRequired))
@@ -136,6 +189,10 @@ func (c *Config) Validate() error {
 			errs = append(errs, fmt.Errorf("service %s: %w", svc.Name, errOnlyOneAddrType))
 		}
 
+		if len(svc.UpstreamTargets) > 0 && (svc.UpstreamTCPAddr != "" || svc.UpstreamUnixAddr != "") {
+			errs = append(errs, fmt.Errorf("service %s: %w", svc.Name, errTargetsAndAddr))
+		}
+
 		if !svc.Funnel && svc.FunnelOnly {
 			errs = append(errs, fmt.Errorf("service %s: %w", svc.Name, errFunnelRequired))
 		}
@@ -161,6 +218,10 @@ func (sc *ServiceConfig) ToTailnetSrv() *TailnetSrv {
 		Name:                         sc.Name,
 		UpstreamTCPAddr:              sc.UpstreamTCPAddr,
 		UpstreamUnixAddr:             sc.UpstreamUnixAddr,
+		UpstreamTargets:              sc.UpstreamTargets,
+		LoadBalancing:                sc.LoadBalancing,
+		HealthCheck:                  sc.HealthCheck,
+		Capabilities:                 sc.Capabilities,
 		Ephemeral:                    sc.Ephemeral,
 		Funnel:                       sc.Funnel,
 		FunnelOnly:                   sc.FunnelOnly,
@@ -173,6 +234,8 @@ func (sc *ServiceConfig) ToTailnetSrv() *TailnetSrv {
 		AuthkeyPath:                  sc.AuthkeyPath,
 		InsecureHTTPS:                sc.InsecureHTTPS,
 		WhoisTimeout:                 sc.WhoisTimeout,
+		WhoisCacheTTL:                sc.WhoisCacheTTL,
+		WhoisNegativeCacheTTL:        sc.WhoisNegativeCacheTTL,
 		SuppressWhois:                sc.SuppressWhois,
 		SuppressTailnetDialer:        sc.SuppressTailnetDialer,
 		ReadHeaderTimeout:            sc.ReadHeaderTimeout,
@@ -183,7 +246,18 @@ func (sc *ServiceConfig) ToTailnetSrv() *TailnetSrv {
 		AuthTimeout:                  sc.AuthTimeout,
 		AuthInsecureHTTPS:            sc.AuthInsecureHTTPS,
 		AuthBypassForTailnet:         sc.AuthBypassForTailnet,
+		AuthCache:                    sc.AuthCache,
+		OIDC:                         sc.OIDC,
+		JWTAuth:                      sc.JWTAuth,
+		BasicAuth:                    sc.BasicAuth,
+		RateLimit:                    sc.RateLimit,
+		Concurrency:                  sc.Concurrency,
+		Retries:                      sc.Retries,
+		CircuitBreakers:              sc.CircuitBreakers,
+		AccessLog:                    sc.AccessLog,
 		Timeout:                      sc.Timeout,
+		ShutdownGracePeriod:          sc.ShutdownGracePeriod,
+		StatusMetricsInterval:        sc.StatusMetricsInterval,
 	}
 
 	// Set defaults
@@ -202,6 +276,12 @@ func (sc *ServiceConfig) ToTailnetSrv() *TailnetSrv {
 	if ts.Timeout == 0 {
 		ts.Timeout = 1 * time.Minute
 	}
+	if ts.ShutdownGracePeriod == 0 {
+		ts.ShutdownGracePeriod = 10 * time.Second
+	}
+	if ts.StatusMetricsInterval == 0 {
+		ts.StatusMetricsInterval = 30 * time.Second
+	}
 	ts.RecommendedProxyHeaders = sc.RecommendedProxyHeaders
 	// Default to true if not explicitly set to false
 	if sc.RecommendedProxyHeaders {
@@ -223,6 +303,11 @@ func (sc *ServiceConfig) ToTailnetSrv() *TailnetSrv {
 		ts.AllowedPrefixes.Set(prefix)
 	}
 
+	// Routes are parsed and checked in validate
+	ts.Routes = append(ts.Routes, sc.Routes...)
+	ts.Webhooks = append(ts.Webhooks, sc.Webhooks...)
+	ts.Access = append(ts.Access, sc.Access...)
+
 	// Convert upstream headers
 	if sc.UpstreamHeaders != nil {
 		ts.UpstreamHeaders = make(headers)
@@ -0,0 +1,212 @@
+package tsnsrv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"golang.org/x/exp/slog"
+)
+
+var upstreamHealthy = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "tsnsrv_upstream_healthy",
+	Help: "Whether an upstream target receives requests (1) or is skipped as unhealthy (0)",
+}, []string{"service_name", "target"})
+
+var errNoHealthyUpstream = errors.New("no healthy upstream target")
+
+// HealthCheck configures how a service decides whether its upstream
+// targets can receive requests.
+type HealthCheck struct {
+	// Path enables active health checks: every Interval, each target
+	// is sent a GET request for this path.
+	Path string `yaml:"path,omitempty"`
+
+	// ExpectedStatus is the status code that a healthy target
+	// responds to the check with (default 200).
+	ExpectedStatus int `yaml:"expectedStatus,omitempty"`
+
+	// Interval is the time between active checks (default 10s).
+	Interval time.Duration `yaml:"interval,omitempty"`
+
+	// Timeout is how long a check may take before the target is
+	// considered unhealthy (default 2s).
+	Timeout time.Duration `yaml:"timeout,omitempty"`
+
+	// PassiveFailures enables passive health checking: a target that
+	// fails this many proxied requests in a row is skipped for
+	// EjectTime. 0 disables it.
+	PassiveFailures int `yaml:"passiveFailures,omitempty"`
+
+	// EjectTime is how long a target is skipped after failing too
+	// many requests (default 30s).
+	EjectTime time.Duration `yaml:"ejectTime,omitempty"`
+}
+
+func (hc HealthCheck) enabled() bool {
+	return hc.Path != "" || hc.PassiveFailures > 0
+}
+
+func (hc HealthCheck) validate() error {
+	var errs []error
+	if hc.Path != "" && !strings.HasPrefix(hc.Path, "/") {
+		errs = append(errs, fmt.Errorf("health check path must start with '/', got %q", hc.Path))
+	}
+	if hc.ExpectedStatus != 0 && (hc.ExpectedStatus < 100 || hc.ExpectedStatus > 599) {
+		errs = append(errs, fmt.Errorf("health check status must be a valid HTTP status, got %d", hc.ExpectedStatus))
+	}
+	if hc.Interval < 0 || hc.Timeout < 0 || hc.EjectTime < 0 || hc.PassiveFailures < 0 {
+		errs = append(errs, errors.New("health check settings can not be negative"))
+	}
+	return errors.Join(errs...)
+}
+
+func (hc HealthCheck) withDefaults() HealthCheck {
+	if hc.ExpectedStatus == 0 {
+		hc.ExpectedStatus = http.StatusOK
+	}
+	if hc.Interval == 0 {
+		hc.Interval = 10 * time.Second
+	}
+	if hc.Timeout == 0 {
+		hc.Timeout = 2 * time.Second
+	}
+	if hc.EjectTime == 0 {
+		hc.EjectTime = 30 * time.Second
+	}
+	return hc
+}
+
+// UpstreamStatus is the health of one of a service's upstream targets.
+type UpstreamStatus struct {
+	Target   string `json:"target"`
+	Healthy  bool   `json:"healthy"`
+	InFlight int64  `json:"inFlight"`
+}
+
+// defaultTarget is the address that requests to the destination URL
+// connect to, for health checking services without -upstreamTarget.
+func (s *ValidTailnetSrv) defaultTarget() upstreamTarget {
+	switch {
+	case s.UpstreamTCPAddr != "":
+		return upstreamTarget{"tcp", s.UpstreamTCPAddr}
+	case s.UpstreamUnixAddr != "":
+		return upstreamTarget{"unix", s.UpstreamUnixAddr}
+	}
+	port := s.DestURL.Port()
+	if port == "" {
+		port = "80"
+		if s.DestURL.Scheme == "https" {
+			port = "443"
+		}
+	}
+	return upstreamTarget{"tcp", net.JoinHostPort(s.DestURL.Hostname(), port)}
+}
+
+// monitor runs active health checks against the destination URL (if
+// enabled) and keeps the health gauges up to date until ctx is done.
+func (b *balancer) monitor(ctx context.Context, dest *url.URL) {
+	defer upstreamHealthy.DeletePartialMatch(prometheus.Labels{"service_name": b.service})
+	ticker := time.NewTicker(b.health.Interval)
+	defer ticker.Stop()
+	for {
+		if b.health.Path != "" {
+			for _, be := range b.backends {
+				b.setHealthy(be, b.check(ctx, be, dest))
+			}
+		}
+		b.updateGauges()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// check sends a health check request to a backend.
+func (b *balancer) check(ctx context.Context, be *backend, dest *url.URL) error {
+	ctx, cancel := context.WithTimeout(ctx, b.health.Timeout)
+	defer cancel()
+	checkURL := url.URL{Scheme: dest.Scheme, Host: dest.Host, Path: b.health.Path}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, checkURL.String(), nil)
+	if err != nil {
+		return err
+	}
+	res, err := be.transport.RoundTrip(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(res.Body, 64*1024))
+	if res.StatusCode != b.health.ExpectedStatus {
+		return fmt.Errorf("health check returned status %d, expected %d", res.StatusCode, b.health.ExpectedStatus)
+	}
+	return nil
+}
+
+func (b *balancer) setHealthy(be *backend, err error) {
+	healthy := err == nil
+	if be.healthy.Swap(healthy) == healthy {
+		return
+	}
+	if healthy {
+		slog.Info("Upstream target is healthy again", "service", b.service, "target", be.target)
+	} else {
+		slog.Warn("Upstream target failed its health check", "service", b.service, "target", be.target, "error", err)
+	}
+}
+
+// observe records the outcome of a proxied request for passive health
+// checking, ejecting the backend after too many failures in a row.
+func (b *balancer) observe(be *backend, err error) {
+	if err == nil {
+		be.failures.Store(0)
+		return
+	}
+	if b.health.PassiveFailures == 0 || be.failures.Add(1) < int64(b.health.PassiveFailures) {
+		return
+	}
+	be.failures.Store(0)
+	be.ejectedUntil.Store(time.Now().Add(b.health.EjectTime).UnixNano())
+	slog.Warn("Ejecting upstream target after consecutive errors",
+		"service", b.service,
+		"target", be.target,
+		"failures", b.health.PassiveFailures,
+		"eject_time", b.health.EjectTime,
+		"error", err,
+	)
+	b.updateGauges()
+}
+
+func (b *balancer) updateGauges() {
+	now := time.Now()
+	for _, be := range b.backends {
+		value := 0.0
+		if be.available(now) {
+			value = 1
+		}
+		upstreamHealthy.With(prometheus.Labels{"service_name": b.service, "target": be.target.String()}).Set(value)
+	}
+}
+
+func (b *balancer) status() []UpstreamStatus {
+	now := time.Now()
+	statuses := make([]UpstreamStatus, 0, len(b.backends))
+	for _, be := range b.backends {
+		statuses = append(statuses, UpstreamStatus{
+			Target:   be.target.String(),
+			Healthy:  be.available(now),
+			InFlight: be.active.Load(),
+		})
+	}
+	return statuses
+}
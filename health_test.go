@@ -0,0 +1,97 @@
+package tsnsrv
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHealthCheckValidate(t *testing.T) {
+	t.Parallel()
+	assert.NoError(t, HealthCheck{}.validate())
+	assert.NoError(t, HealthCheck{Path: "/healthz", ExpectedStatus: 204, PassiveFailures: 3}.validate())
+	assert.Error(t, HealthCheck{Path: "healthz"}.validate())
+	assert.Error(t, HealthCheck{ExpectedStatus: 1000}.validate())
+	assert.Error(t, HealthCheck{Interval: -time.Second}.validate())
+}
+
+func TestActiveHealthCheck(t *testing.T) {
+	var failing atomic.Bool
+	flaky := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/healthz" && failing.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("flaky"))
+	}))
+	t.Cleanup(flaky.Close)
+	targets := append(serveTargets(t), upstreamTarget{"tcp", flaky.Listener.Addr().String()})
+
+	b := newTestBalancer(LoadBalanceRoundRobin, HealthCheck{Path: "/healthz", Interval: 10 * time.Millisecond}, targets)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go b.monitor(ctx, &url.URL{Scheme: "http", Host: "upstream"})
+
+	failing.Store(true)
+	require.Eventually(t, func() bool { return !b.status()[2].Healthy }, 5*time.Second, 5*time.Millisecond)
+	client := &http.Client{Transport: b}
+	for range 6 {
+		assert.NotEqual(t, "flaky", get(t, client, context.Background()))
+	}
+
+	failing.Store(false)
+	require.Eventually(t, func() bool { return b.status()[2].Healthy }, 5*time.Second, 5*time.Millisecond)
+}
+
+func TestPassiveHealthCheck(t *testing.T) {
+	t.Parallel()
+	// A target that nothing listens on:
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	dead := upstreamTarget{"tcp", l.Addr().String()}
+	l.Close()
+
+	targets := append(serveTargets(t)[:1], dead)
+	b := newTestBalancer(LoadBalanceRoundRobin, HealthCheck{PassiveFailures: 2, EjectTime: time.Hour}, targets)
+	client := &http.Client{Transport: b}
+
+	failed := 0
+	for range 10 {
+		req, err := http.NewRequest("GET", "http://upstream/", nil)
+		require.NoError(t, err)
+		resp, err := client.Do(req)
+		if err != nil {
+			failed++
+			continue
+		}
+		resp.Body.Close()
+	}
+	assert.Equal(t, 2, failed, "the dead target is ejected after two errors")
+
+	status := b.status()
+	assert.True(t, status[0].Healthy)
+	assert.False(t, status[1].Healthy)
+}
+
+func TestNoHealthyUpstream(t *testing.T) {
+	t.Parallel()
+	b := newTestBalancer(LoadBalanceRoundRobin, HealthCheck{PassiveFailures: 1}, serveTargets(t))
+	for _, be := range b.backends {
+		be.healthy.Store(false)
+	}
+	upstream, err := url.Parse("http://upstream")
+	require.NoError(t, err)
+	s := &ValidTailnetSrv{TailnetSrv: TailnetSrv{Name: "test", SuppressWhois: true}, DestURL: upstream}
+
+	w := httptest.NewRecorder()
+	s.mux(b, false).ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+}
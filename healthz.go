@@ -0,0 +1,160 @@
+package tsnsrv
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// ReadinessCheck is the outcome of one of the checks that decide
+// whether a service is ready.
+type ReadinessCheck struct {
+	Name   string `json:"name"`
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// ServiceHealth tells whether a service is alive and ready to serve
+// requests.
+type ServiceHealth struct {
+	Name  string       `json:"name"`
+	State ServiceState `json:"state"`
+
+	// Live is false if the service failed permanently.
+	Live bool `json:"live"`
+
+	// Ready is true if all Checks passed.
+	Ready  bool             `json:"ready"`
+	Checks []ReadinessCheck `json:"checks"`
+}
+
+// ProcessHealth is the health of all services of a process.
+type ProcessHealth struct {
+	Live     bool            `json:"live"`
+	Ready    bool            `json:"ready"`
+	Services []ServiceHealth `json:"services"`
+}
+
+// serviceHealth checks the readiness of a service from its status:
+// its tailscale node is up, its listeners accept connections, and one
+// of its upstreams is healthy, if their health is checked.
+func serviceHealth(status ServiceStatus) ServiceHealth {
+	h := ServiceHealth{
+		Name:  status.Name,
+		State: status.State,
+		Live:  status.State != StateFailed,
+	}
+	check := func(name string, ok bool, detail string) {
+		h.Checks = append(h.Checks, ReadinessCheck{Name: name, OK: ok, Detail: detail})
+	}
+
+	up := status.State == StateUp
+	check("state", up, string(status.State))
+	if !up {
+		// Draining, restarting or not running; the rest doesn't matter.
+		return h
+	}
+
+	check("tailscale", len(status.TailscaleIPs) > 0, fmt.Sprint(status.TailscaleIPs))
+
+	var want, missing []string
+	if !status.FunnelOnly {
+		want = append(want, "tailnet")
+	}
+	if status.Funnel {
+		want = append(want, "funnel")
+	}
+	for _, listener := range want {
+		if !slices.Contains(status.Listeners, listener) {
+			missing = append(missing, listener)
+		}
+	}
+	if len(missing) > 0 {
+		check("listeners", false, "not listening on "+strings.Join(missing, ", "))
+	} else {
+		check("listeners", true, strings.Join(want, ", "))
+	}
+
+	if len(status.Upstreams) > 0 {
+		healthy := 0
+		for _, u := range status.Upstreams {
+			if u.Healthy {
+				healthy++
+			}
+		}
+		check("upstreams", healthy > 0, fmt.Sprintf("%d of %d healthy", healthy, len(status.Upstreams)))
+	}
+
+	h.Ready = !slices.ContainsFunc(h.Checks, func(c ReadinessCheck) bool { return !c.OK })
+	return h
+}
+
+// Health returns the health of all configured services.
+func (o *Orchestrator) Health() ProcessHealth {
+	ph := ProcessHealth{Live: true, Ready: true}
+	for _, status := range o.Status() {
+		h := serviceHealth(status)
+		ph.Live = ph.Live && h.Live
+		ph.Ready = ph.Ready && h.Ready
+		ph.Services = append(ph.Services, h)
+	}
+	return ph
+}
+
+// HealthHandler returns the health endpoints of an Orchestrator:
+//
+//	GET /healthz         200 unless a service failed permanently
+//	GET /healthz/{name}  200 unless the service failed permanently
+//	GET /readyz          200 if all services are ready
+//	GET /readyz/{name}   200 if the service is ready
+//
+// Unhealthy responses have status 503. Add ?verbose to get the checks
+// as JSON.
+func HealthHandler(o *Orchestrator) http.Handler {
+	mux := http.NewServeMux()
+	respond := func(w http.ResponseWriter, r *http.Request, ok bool, detail any) {
+		status := http.StatusOK
+		if !ok {
+			status = http.StatusServiceUnavailable
+		}
+		if r.URL.Query().Has("verbose") {
+			writeJSON(w, status, detail)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(status)
+		if ok {
+			fmt.Fprintln(w, "ok")
+		} else {
+			fmt.Fprintln(w, "unavailable")
+		}
+	}
+	service := func(w http.ResponseWriter, r *http.Request) (ServiceHealth, bool) {
+		status, err := o.ServiceStatus(r.PathValue("name"))
+		if err != nil {
+			writeAdminError(w, err)
+			return ServiceHealth{}, false
+		}
+		return serviceHealth(status), true
+	}
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		h := o.Health()
+		respond(w, r, h.Live, h)
+	})
+	mux.HandleFunc("GET /readyz", func(w http.ResponseWriter, r *http.Request) {
+		h := o.Health()
+		respond(w, r, h.Ready, h)
+	})
+	mux.HandleFunc("GET /healthz/{name}", func(w http.ResponseWriter, r *http.Request) {
+		if h, ok := service(w, r); ok {
+			respond(w, r, h.Live, h)
+		}
+	})
+	mux.HandleFunc("GET /readyz/{name}", func(w http.ResponseWriter, r *http.Request) {
+		if h, ok := service(w, r); ok {
+			respond(w, r, h.Ready, h)
+		}
+	})
+	return mux
+}
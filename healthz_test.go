@@ -0,0 +1,195 @@
+package tsnsrv
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServiceHealth(t *testing.T) {
+	t.Parallel()
+	ips := []netip.Addr{netip.MustParseAddr("100.64.0.1")}
+	for _, elt := range []struct {
+		name   string
+		status ServiceStatus
+		live   bool
+		ready  bool
+		failed string
+	}{
+		{name: "up", status: ServiceStatus{State: StateUp, TailscaleIPs: ips, Listeners: []string{"tailnet"}}, live: true, ready: true},
+		{name: "starting", status: ServiceStatus{State: StateStarting}, live: true, failed: "state"},
+		{name: "draining", status: ServiceStatus{State: StateDraining, TailscaleIPs: ips, Listeners: []string{"tailnet"}}, live: true, failed: "state"},
+		{name: "restarting", status: ServiceStatus{State: StateRestarting}, live: true, failed: "state"},
+		{name: "failed", status: ServiceStatus{State: StateFailed}, failed: "state"},
+		{name: "not listening yet", status: ServiceStatus{State: StateUp, TailscaleIPs: ips}, live: true, failed: "listeners"},
+		{
+			name:   "funnel not listening",
+			status: ServiceStatus{State: StateUp, Funnel: true, TailscaleIPs: ips, Listeners: []string{"tailnet"}},
+			live:   true, failed: "listeners",
+		},
+		{
+			name:   "funnel only",
+			status: ServiceStatus{State: StateUp, Funnel: true, FunnelOnly: true, TailscaleIPs: ips, Listeners: []string{"funnel"}},
+			live:   true, ready: true,
+		},
+		{
+			name: "no healthy upstream",
+			status: ServiceStatus{State: StateUp, TailscaleIPs: ips, Listeners: []string{"tailnet"}, Upstreams: []UpstreamStatus{
+				{Target: "tcp:10.0.0.1:80"}, {Target: "tcp:10.0.0.2:80"},
+			}},
+			live: true, failed: "upstreams",
+		},
+		{
+			name: "one healthy upstream",
+			status: ServiceStatus{State: StateUp, TailscaleIPs: ips, Listeners: []string{"tailnet"}, Upstreams: []UpstreamStatus{
+				{Target: "tcp:10.0.0.1:80"}, {Target: "tcp:10.0.0.2:80", Healthy: true},
+			}},
+			live: true, ready: true,
+		},
+	} {
+		t.Run(elt.name, func(t *testing.T) {
+			h := serviceHealth(elt.status)
+			assert.Equal(t, elt.live, h.Live)
+			assert.Equal(t, elt.ready, h.Ready)
+			for _, c := range h.Checks {
+				assert.Equal(t, c.Name != elt.failed, c.OK, "%s: %s", c.Name, c.Detail)
+			}
+		})
+	}
+}
+
+func TestHealthHandler(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	release := make(chan struct{})
+	o := NewOrchestrator([]*ValidTailnetSrv{
+		{TailnetSrv: TailnetSrv{Name: "service1"}},
+		{TailnetSrv: TailnetSrv{Name: "service2"}},
+	})
+	o.run = func(ctx context.Context, s *ValidTailnetSrv) error {
+		if s.Name == "service2" {
+			// Comes up only when the test says so:
+			select {
+			case <-release:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		s.status.setUp([]netip.Addr{netip.MustParseAddr("100.64.0.1")})
+		s.status.setListening("tailnet")
+		defer s.status.setDown()
+		<-ctx.Done()
+		s.status.setDraining()
+		return ctx.Err()
+	}
+	result := make(chan error)
+	go func() { result <- o.Run(ctx) }()
+
+	srv := httptest.NewServer(HealthHandler(o))
+	t.Cleanup(srv.Close)
+	get := func(path string) (int, string) {
+		resp, err := srv.Client().Get(srv.URL + path)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp.StatusCode, strings.TrimSpace(string(body))
+	}
+
+	require.Eventually(t, func() bool {
+		code, _ := get("/readyz/service1")
+		return code == http.StatusOK
+	}, 5*time.Second, time.Millisecond)
+	code, body := get("/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, code, "service2 isn't up yet")
+	assert.Equal(t, "unavailable", body)
+	code, body = get("/healthz")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "ok", body)
+	code, _ = get("/readyz/nope")
+	assert.Equal(t, http.StatusNotFound, code)
+
+	code, body = get("/readyz?verbose")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	var health ProcessHealth
+	require.NoError(t, json.Unmarshal([]byte(body), &health))
+	assert.True(t, health.Live)
+	require.Len(t, health.Services, 2)
+	assert.True(t, health.Services[0].Ready)
+	assert.Equal(t, StateStarting, health.Services[1].State)
+
+	close(release)
+	require.Eventually(t, func() bool {
+		code, _ := get("/readyz")
+		return code == http.StatusOK
+	}, 5*time.Second, time.Millisecond)
+
+	require.NoError(t, o.StopService("service1"))
+	code, body = get("/readyz/service1?verbose")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	var sh ServiceHealth
+	require.NoError(t, json.Unmarshal([]byte(body), &sh))
+	assert.Equal(t, StateStopped, sh.State)
+	assert.False(t, sh.Ready)
+
+	cancel()
+	require.NoError(t, <-result)
+}
+
+func TestReadyzWhileDraining(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	drained := make(chan struct{})
+	o := NewOrchestrator([]*ValidTailnetSrv{{TailnetSrv: TailnetSrv{Name: "service1"}}})
+	o.run = func(ctx context.Context, s *ValidTailnetSrv) error {
+		s.status.setUp([]netip.Addr{netip.MustParseAddr("100.64.0.1")})
+		s.status.setListening("tailnet")
+		defer s.status.setDown()
+		<-ctx.Done()
+		s.status.setDraining()
+		<-drained
+		return ctx.Err()
+	}
+	result := make(chan error)
+	go func() { result <- o.Run(ctx) }()
+
+	// Like the process-level server, this one isn't stopped along
+	// with the services:
+	srv := httptest.NewServer(ProcessHandler(o, nil))
+	t.Cleanup(srv.Close)
+	readyz := func() (int, ServiceHealth) {
+		resp, err := srv.Client().Get(srv.URL + "/readyz/service1?verbose")
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		var h ServiceHealth
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&h))
+		return resp.StatusCode, h
+	}
+	require.Eventually(t, func() bool {
+		code, _ := readyz()
+		return code == http.StatusOK
+	}, 5*time.Second, time.Millisecond)
+
+	cancel()
+	require.Eventually(t, func() bool {
+		code, h := readyz()
+		return code == http.StatusServiceUnavailable && h.State == StateDraining
+	}, 5*time.Second, time.Millisecond, "draining services aren't ready")
+
+	close(drained)
+	require.NoError(t, <-result)
+	code, h := readyz()
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, StateStopped, h.State)
+}
@@ -0,0 +1,260 @@
+package tsnsrv
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/exp/slog"
+)
+
+var basicAuthResults = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "tsnsrv_basic_auth_total",
+	Help: "HTTP Basic authentication attempts by result (success, failure, bypassed)",
+}, []string{"service_name", "result"})
+
+var errHtpasswdHash = errors.New("unsupported password hash; use bcrypt or argon2")
+
+const (
+	// htpasswdCheckInterval is how often the file is checked for changes.
+	htpasswdCheckInterval = 1 * time.Second
+
+	// verifiedCacheSize bounds the number of remembered good passwords.
+	verifiedCacheSize = 1024
+)
+
+// BasicAuth configures a service to require a user name and password
+// from an htpasswd file.
+type BasicAuth struct {
+	// HtpasswdFile contains "user:hash" lines, with bcrypt or argon2
+	// hashes. Basic authentication is disabled if empty.
+	HtpasswdFile string `yaml:"htpasswdFile,omitempty"`
+
+	// Realm is shown by browsers when asking for the password
+	// (default: the service name).
+	Realm string `yaml:"realm,omitempty"`
+
+	// UserHeader is the request header that passes the authenticated
+	// user name to the upstream (default "X-Forwarded-User").
+	UserHeader string `yaml:"userHeader,omitempty"`
+}
+
+func (ba BasicAuth) enabled() bool {
+	return ba.HtpasswdFile != ""
+}
+
+func (ba BasicAuth) withDefaults(service string) BasicAuth {
+	if ba.Realm == "" {
+		ba.Realm = service
+	}
+	if ba.UserHeader == "" {
+		ba.UserHeader = "X-Forwarded-User"
+	}
+	return ba
+}
+
+// htpasswd is an htpasswd file, reloaded when it changes.
+type htpasswd struct {
+	path string
+
+	mu       sync.Mutex
+	users    map[string]string
+	modTime  time.Time
+	size     int64
+	checked  time.Time
+	verified map[[sha256.Size]byte]struct{}
+}
+
+// loadHtpasswd reads an htpasswd file.
+func loadHtpasswd(path string) (*htpasswd, error) {
+	h := &htpasswd{path: path}
+	if err := h.reloadLocked(time.Now()); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+func parseHtpasswd(data []byte) (map[string]string, error) {
+	users := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		user, hash, ok := strings.Cut(text, ":")
+		if !ok || user == "" {
+			return nil, fmt.Errorf("line %d: expected 'user:hash'", line)
+		}
+		if !strings.HasPrefix(hash, "$2") && !strings.HasPrefix(hash, "$argon2") {
+			return nil, fmt.Errorf("line %d (user %q): %w", line, user, errHtpasswdHash)
+		}
+		users[user] = hash
+	}
+	return users, scanner.Err()
+}
+
+// reloadLocked reads the file if it changed since it was last read.
+func (h *htpasswd) reloadLocked(now time.Time) error {
+	h.checked = now
+	info, err := os.Stat(h.path)
+	if err != nil {
+		return fmt.Errorf("reading htpasswd file: %w", err)
+	}
+	if h.users != nil && info.ModTime().Equal(h.modTime) && info.Size() == h.size {
+		return nil
+	}
+	data, err := os.ReadFile(h.path)
+	if err != nil {
+		return fmt.Errorf("reading htpasswd file: %w", err)
+	}
+	users, err := parseHtpasswd(data)
+	if err != nil {
+		return fmt.Errorf("%s: %w", h.path, err)
+	}
+	h.users, h.modTime, h.size = users, info.ModTime(), info.Size()
+	h.verified = nil
+	return nil
+}
+
+// hashFor returns the hash of user's password, reloading the file if
+// it changed. A broken file keeps the previous users.
+func (h *htpasswd) hashFor(user string) (string, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if now := time.Now(); now.Sub(h.checked) >= htpasswdCheckInterval {
+		if err := h.reloadLocked(now); err != nil {
+			slog.Error("could not reload htpasswd file, keeping the previous users", "path", h.path, "error", err)
+		}
+	}
+	hash, ok := h.users[user]
+	return hash, ok
+}
+
+// dummyHash is compared against for unknown users, so that they take
+// as long to reject as wrong passwords.
+var dummyHash = sync.OnceValue(func() string {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("tsnsrv"), bcrypt.DefaultCost)
+	return string(hash)
+})
+
+// authenticate checks a user name and password.
+func (h *htpasswd) authenticate(user, password string) bool {
+	hash, ok := h.hashFor(user)
+	if !ok {
+		checkPassword(dummyHash(), password)
+		return false
+	}
+	// Password hashes are slow on purpose; don't pay for that with
+	// every request of a logged-in browser.
+	key := sha256.Sum256([]byte(user + "\x00" + password + "\x00" + hash))
+	h.mu.Lock()
+	_, known := h.verified[key]
+	h.mu.Unlock()
+	if known {
+		return true
+	}
+	if !checkPassword(hash, password) {
+		return false
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.verified == nil || len(h.verified) >= verifiedCacheSize {
+		h.verified = make(map[[sha256.Size]byte]struct{})
+	}
+	h.verified[key] = struct{}{}
+	return true
+}
+
+// checkPassword compares a password against a bcrypt or argon2 hash.
+func checkPassword(hash, password string) bool {
+	if strings.HasPrefix(hash, "$2") {
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	}
+	return checkArgon2(hash, password)
+}
+
+// checkArgon2 compares a password against a hash in the PHC string
+// format, like $argon2id$v=19$m=65536,t=3,p=4$salt$hash.
+func checkArgon2(hash, password string) bool {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[2] != fmt.Sprintf("v=%d", argon2.Version) {
+		return false
+	}
+	var memory, iterations uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &iterations, &threads); err != nil {
+		return false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false
+	}
+	want, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(want) == 0 {
+		return false
+	}
+	var got []byte
+	switch parts[1] {
+	case "argon2id":
+		got = argon2.IDKey([]byte(password), salt, iterations, memory, threads, uint32(len(want)))
+	case "argon2i":
+		got = argon2.Key([]byte(password), salt, iterations, memory, threads, uint32(len(want)))
+	default:
+		return false
+	}
+	return subtle.ConstantTimeCompare(got, want) == 1
+}
+
+// basicAuthMiddleware asks for a user name and password from the
+// htpasswd file, and passes the user name to the upstream.
+func (s *ValidTailnetSrv) basicAuthMiddleware(next http.Handler) http.Handler {
+	if s.htpasswd == nil {
+		return next
+	}
+	ba := s.BasicAuth.withDefaults(s.Name)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Header.Del(ba.UserHeader)
+		result := func(result string) {
+			basicAuthResults.With(prometheus.Labels{"service_name": s.Name, "result": result}).Inc()
+		}
+		if _, ok := s.bypassesAuth(r); ok {
+			result("bypassed")
+			next.ServeHTTP(w, r)
+			return
+		}
+		user, password, ok := r.BasicAuth()
+		if ok && s.htpasswd.authenticate(user, password) {
+			result("success")
+			// The upstream has no business with the password:
+			r.Header.Del("Authorization")
+			r.Header.Set(ba.UserHeader, user)
+			next.ServeHTTP(w, r)
+			return
+		}
+		if ok {
+			result("failure")
+			slog.Info("basic auth failed",
+				"service", s.Name,
+				"user", user,
+				"remote_addr", r.RemoteAddr,
+				"url", r.URL,
+			)
+		}
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q, charset=\"UTF-8\"", ba.Realm))
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	})
+}
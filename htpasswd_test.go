@@ -0,0 +1,158 @@
+package tsnsrv
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"tailscale.com/client/tailscale/apitype"
+)
+
+func bcryptHash(t *testing.T, password string) string {
+	t.Helper()
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	require.NoError(t, err)
+	return string(hash)
+}
+
+func argon2Hash(password string) string {
+	salt := []byte("saltsaltsaltsalt")
+	key := argon2.IDKey([]byte(password), salt, 1, 1024, 1, 32)
+	return fmt.Sprintf("$argon2id$v=%d$m=1024,t=1,p=1$%s$%s", argon2.Version,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))
+}
+
+func writeHtpasswd(t *testing.T, path string, lines ...string) {
+	t.Helper()
+	var content string
+	for _, line := range lines {
+		content += line + "\n"
+	}
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+}
+
+func TestParseHtpasswd(t *testing.T) {
+	t.Parallel()
+	users, err := parseHtpasswd([]byte("# admins\nalice:$2y$05$abc\n\nbob:$argon2id$v=19$m=1024,t=1,p=1$c2FsdA$aGFzaA\n"))
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"alice": "$2y$05$abc", "bob": "$argon2id$v=19$m=1024,t=1,p=1$c2FsdA$aGFzaA"}, users)
+
+	_, err = parseHtpasswd([]byte("alice:$apr1$salt$hash\n"))
+	assert.ErrorIs(t, err, errHtpasswdHash)
+	_, err = parseHtpasswd([]byte("alice:plaintext\n"))
+	assert.ErrorIs(t, err, errHtpasswdHash)
+	_, err = parseHtpasswd([]byte("just-a-name\n"))
+	assert.Error(t, err)
+}
+
+func TestCheckPassword(t *testing.T) {
+	t.Parallel()
+	for name, hash := range map[string]string{"bcrypt": bcryptHash(t, "hunter2"), "argon2id": argon2Hash("hunter2")} {
+		assert.True(t, checkPassword(hash, "hunter2"), name)
+		assert.False(t, checkPassword(hash, "hunter3"), name)
+	}
+	assert.False(t, checkPassword("$argon2id$v=19$m=1024,t=1,p=1$bad", "hunter2"))
+}
+
+func TestBasicAuthMiddleware(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	writeHtpasswd(t, path, "alice:"+bcryptHash(t, "hunter2"), "bob:"+argon2Hash("correct horse"))
+	h, err := loadHtpasswd(path)
+	require.NoError(t, err)
+
+	s := &ValidTailnetSrv{
+		TailnetSrv: TailnetSrv{Name: "tools", BasicAuth: BasicAuth{HtpasswdFile: path}},
+		htpasswd:   h,
+	}
+	var got http.Header
+	handler := s.basicAuthMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+	}))
+	do := func(user, password string) *httptest.ResponseRecorder {
+		got = nil
+		req := httptest.NewRequest("GET", "/", nil)
+		if user != "" {
+			req.SetBasicAuth(user, password)
+		}
+		req.Header.Set("X-Forwarded-User", "mallory")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	w := do("alice", "hunter2")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "alice", got.Get("X-Forwarded-User"))
+	assert.Empty(t, got.Get("Authorization"), "the password isn't passed on")
+
+	w = do("bob", "correct horse")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "bob", got.Get("X-Forwarded-User"))
+
+	for _, creds := range [][2]string{{"alice", "wrong"}, {"carol", "hunter2"}, {"", ""}} {
+		w = do(creds[0], creds[1])
+		assert.Equal(t, http.StatusUnauthorized, w.Code, creds)
+		assert.Equal(t, `Basic realm="tools", charset="UTF-8"`, w.Header().Get("WWW-Authenticate"))
+		assert.Nil(t, got)
+	}
+
+	// Changes to the file are picked up:
+	writeHtpasswd(t, path, "carol:"+bcryptHash(t, "hunter2"))
+	require.NoError(t, os.Chtimes(path, time.Now(), time.Now().Add(time.Second)))
+	h.mu.Lock()
+	h.checked = time.Time{}
+	h.mu.Unlock()
+	assert.Equal(t, http.StatusOK, do("carol", "hunter2").Code)
+	assert.Equal(t, http.StatusUnauthorized, do("alice", "hunter2").Code)
+
+	// ...but a broken file doesn't lock everyone out:
+	writeHtpasswd(t, path, "carol:plaintext")
+	require.NoError(t, os.Chtimes(path, time.Now(), time.Now().Add(2*time.Second)))
+	h.mu.Lock()
+	h.checked = time.Time{}
+	h.mu.Unlock()
+	assert.Equal(t, http.StatusOK, do("carol", "hunter2").Code)
+}
+
+func TestBasicAuthBypassForTailnet(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	writeHtpasswd(t, path, "alice:"+bcryptHash(t, "hunter2"))
+	h, err := loadHtpasswd(path)
+	require.NoError(t, err)
+
+	s := &ValidTailnetSrv{
+		TailnetSrv: TailnetSrv{Name: "tools", BasicAuth: BasicAuth{HtpasswdFile: path}, AuthBypassForTailnet: true},
+		htpasswd:   h,
+		client: &mockLocalClient{whoIsFunc: func(ctx context.Context, addr string) (*apitype.WhoIsResponse, error) {
+			if addr == "100.100.100.1:1234" {
+				return identity("alice@example.com", "laptop", nil), nil
+			}
+			return nil, assert.AnError
+		}},
+	}
+	handler := s.basicAuthMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "100.100.100.1:1234"
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	req = httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "203.0.113.1:1234"
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
@@ -0,0 +1,265 @@
+package tsnsrv
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"slices"
+	"time"
+
+	"golang.org/x/exp/slog"
+	"tailscale.com/client/tailscale/apitype"
+)
+
+// JWKSPath is where the public keys for verifying identity assertions
+// are served.
+const JWKSPath = "/.well-known/jwks.json"
+
+var errIdentityKey = errors.New("identity key must be a PEM-encoded RSA, ECDSA P-256 or Ed25519 private key")
+
+// IdentityAssertion configures the signed JWT that tsnsrv sends to
+// upstreams to assert the requestor's identity.
+type IdentityAssertion struct {
+	// KeyFile contains the PEM-encoded private key that tokens are
+	// signed with. No tokens are sent if empty.
+	KeyFile string `yaml:"keyFile,omitempty"`
+
+	// Header is the request header that carries the token
+	// (default "X-Tailscale-Identity-Token").
+	Header string `yaml:"header,omitempty"`
+
+	// Lifetime is how long a token is valid (default 1m).
+	Lifetime time.Duration `yaml:"lifetime,omitempty"`
+
+	// Issuer is the token's "iss" claim (default "tsnsrv").
+	Issuer string `yaml:"issuer,omitempty"`
+}
+
+func (ia IdentityAssertion) withDefaults() IdentityAssertion {
+	if ia.Header == "" {
+		ia.Header = "X-Tailscale-Identity-Token"
+	}
+	if ia.Lifetime == 0 {
+		ia.Lifetime = 1 * time.Minute
+	}
+	if ia.Issuer == "" {
+		ia.Issuer = "tsnsrv"
+	}
+	return ia
+}
+
+// IdentitySigner mints identity assertion tokens.
+type IdentitySigner struct {
+	config IdentityAssertion
+	key    crypto.Signer
+	alg    string
+	jwk    map[string]string
+}
+
+// NewIdentitySigner loads the signing key of an identity assertion
+// configuration. It returns nil if no key file is configured.
+func NewIdentitySigner(ia IdentityAssertion) (*IdentitySigner, error) {
+	if ia.KeyFile == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(ia.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("reading identity key: %w", err)
+	}
+	key, err := parseSigningKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", ia.KeyFile, err)
+	}
+	return newIdentitySigner(ia, key)
+}
+
+func newIdentitySigner(ia IdentityAssertion, key crypto.Signer) (*IdentitySigner, error) {
+	s := &IdentitySigner{config: ia.withDefaults(), key: key}
+	switch pub := key.Public().(type) {
+	case *rsa.PublicKey:
+		s.alg = "RS256"
+		s.jwk = map[string]string{
+			"kty": "RSA",
+			"n":   b64(pub.N.Bytes()),
+			"e":   b64(big.NewInt(int64(pub.E)).Bytes()),
+		}
+	case *ecdsa.PublicKey:
+		if pub.Curve != elliptic.P256() {
+			return nil, errIdentityKey
+		}
+		s.alg = "ES256"
+		s.jwk = map[string]string{
+			"kty": "EC",
+			"crv": "P-256",
+			"x":   b64(pub.X.FillBytes(make([]byte, 32))),
+			"y":   b64(pub.Y.FillBytes(make([]byte, 32))),
+		}
+	case ed25519.PublicKey:
+		s.alg = "EdDSA"
+		s.jwk = map[string]string{
+			"kty": "OKP",
+			"crv": "Ed25519",
+			"x":   b64(pub),
+		}
+	default:
+		return nil, errIdentityKey
+	}
+	// The key ID is the RFC 7638 thumbprint; json.Marshal sorts the
+	// members as the RFC requires.
+	thumbprint, err := json.Marshal(s.jwk)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(thumbprint)
+	s.jwk["kid"] = b64(sum[:])
+	s.jwk["alg"] = s.alg
+	s.jwk["use"] = "sig"
+	return s, nil
+}
+
+func parseSigningKey(data []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errIdentityKey
+	}
+	var key any
+	var err error
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errIdentityKey, err)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, errIdentityKey
+	}
+	return signer, nil
+}
+
+func b64(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// identityClaims are the claims of an identity assertion token.
+type identityClaims struct {
+	Issuer    string   `json:"iss"`
+	Subject   string   `json:"sub"`
+	Audience  string   `json:"aud"`
+	IssuedAt  int64    `json:"iat"`
+	NotBefore int64    `json:"nbf"`
+	Expires   int64    `json:"exp"`
+	Login     string   `json:"login,omitempty"`
+	Name      string   `json:"name,omitempty"`
+	NodeID    string   `json:"node_id,omitempty"`
+	Node      string   `json:"node,omitempty"`
+	Tags      []string `json:"tags,omitempty"`
+	Caps      []string `json:"caps,omitempty"`
+}
+
+// Token returns a JWT asserting who's identity to the named service.
+func (s *IdentitySigner) Token(service string, who *apitype.WhoIsResponse, now time.Time) (string, error) {
+	claims := identityClaims{
+		Issuer:    s.config.Issuer,
+		Audience:  service,
+		IssuedAt:  now.Unix(),
+		NotBefore: now.Unix(),
+		Expires:   now.Add(s.config.Lifetime).Unix(),
+	}
+	if who.UserProfile != nil {
+		claims.Subject = who.UserProfile.ID.String()
+		claims.Login = who.UserProfile.LoginName
+		claims.Name = who.UserProfile.DisplayName
+	}
+	if who.Node != nil {
+		claims.NodeID = who.Node.ID.String()
+		claims.Node = who.Node.ComputedName
+		claims.Tags = who.Node.Tags
+	}
+	for c := range who.CapMap {
+		claims.Caps = append(claims.Caps, string(c))
+	}
+	slices.Sort(claims.Caps)
+
+	header, err := json.Marshal(map[string]string{"alg": s.alg, "typ": "JWT", "kid": s.jwk["kid"]})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signingInput := b64(header) + "." + b64(payload)
+	sig, err := s.sign([]byte(signingInput))
+	if err != nil {
+		return "", fmt.Errorf("signing identity token: %w", err)
+	}
+	return signingInput + "." + b64(sig), nil
+}
+
+func (s *IdentitySigner) sign(data []byte) ([]byte, error) {
+	if s.alg == "EdDSA" {
+		return s.key.Sign(rand.Reader, data, crypto.Hash(0))
+	}
+	digest := sha256.Sum256(data)
+	if key, ok := s.key.(*ecdsa.PrivateKey); ok {
+		// JWS wants the raw r||s form, not ASN.1:
+		r, sig, err := ecdsa.Sign(rand.Reader, key, digest[:])
+		if err != nil {
+			return nil, err
+		}
+		return append(r.FillBytes(make([]byte, 32)), sig.FillBytes(make([]byte, 32))...), nil
+	}
+	return s.key.Sign(rand.Reader, digest[:], crypto.SHA256)
+}
+
+// JWKSHandler serves the public key that tokens can be verified with, as a JSON Web Key Set.
+func (s *IdentitySigner) JWKSHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=300")
+		writeJSON(w, http.StatusOK, map[string][]map[string]string{"keys": {s.jwk}})
+	})
+}
+
+// header is the request header that tokens are sent in.
+func (s *IdentitySigner) header() string {
+	return s.config.Header
+}
+
+// setIdentityToken replaces any token the client sent with one for
+// the requestor, if their identity is known.
+func (s *ValidTailnetSrv) setIdentityToken(out *http.Request, who *apitype.WhoIsResponse) {
+	if s.identity == nil {
+		return
+	}
+	out.Header.Del(s.identity.header())
+	if who == nil {
+		return
+	}
+	token, err := s.identity.Token(s.Name, who, time.Now())
+	if err != nil {
+		// Shouldn't happen with a key that could be loaded; the
+		// upstream sees a request without identity.
+		slog.Error("could not mint identity token", "service", s.Name, "error", err)
+		return
+	}
+	out.Header.Set(s.identity.header(), token)
+}
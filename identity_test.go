@@ -0,0 +1,175 @@
+package tsnsrv
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"tailscale.com/client/tailscale/apitype"
+)
+
+// verifyToken checks a token's signature against the key published
+// in the signer's JWKS, and returns its claims.
+func verifyToken(t *testing.T, signer *IdentitySigner, token string) identityClaims {
+	t.Helper()
+	w := httptest.NewRecorder()
+	signer.JWKSHandler().ServeHTTP(w, httptest.NewRequest("GET", JWKSPath, nil))
+	var jwks struct{ Keys []map[string]string }
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &jwks))
+	require.Len(t, jwks.Keys, 1)
+	jwk := jwks.Keys[0]
+
+	parts := strings.Split(token, ".")
+	require.Len(t, parts, 3)
+	dec := func(s string) []byte {
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		require.NoError(t, err)
+		return b
+	}
+	var header map[string]string
+	require.NoError(t, json.Unmarshal(dec(parts[0]), &header))
+	assert.Equal(t, jwk["kid"], header["kid"])
+	assert.Equal(t, jwk["alg"], header["alg"])
+
+	signed := []byte(parts[0] + "." + parts[1])
+	digest := sha256.Sum256(signed)
+	sig := dec(parts[2])
+	switch jwk["kty"] {
+	case "RSA":
+		pub := &rsa.PublicKey{N: new(big.Int).SetBytes(dec(jwk["n"])), E: int(new(big.Int).SetBytes(dec(jwk["e"])).Int64())}
+		require.NoError(t, rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], sig))
+	case "EC":
+		pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(dec(jwk["x"])), Y: new(big.Int).SetBytes(dec(jwk["y"]))}
+		require.Len(t, sig, 64)
+		require.True(t, ecdsa.Verify(pub, digest[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])))
+	case "OKP":
+		require.True(t, ed25519.Verify(ed25519.PublicKey(dec(jwk["x"])), signed, sig))
+	default:
+		t.Fatalf("unexpected key type %q", jwk["kty"])
+	}
+
+	var claims identityClaims
+	require.NoError(t, json.Unmarshal(dec(parts[1]), &claims))
+	return claims
+}
+
+func TestIdentitySigner(t *testing.T) {
+	t.Parallel()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	now := time.Unix(1700000000, 0)
+	who := identity("alice@example.com", "laptop", []string{"tag:ops"}, "example.com/cap/b", "example.com/cap/a")
+	for alg, key := range map[string]crypto.Signer{"RS256": rsaKey, "ES256": ecKey, "EdDSA": edKey} {
+		t.Run(alg, func(t *testing.T) {
+			signer, err := newIdentitySigner(IdentityAssertion{}, key)
+			require.NoError(t, err)
+			token, err := signer.Token("my-app", who, now)
+			require.NoError(t, err)
+			claims := verifyToken(t, signer, token)
+			assert.Equal(t, identityClaims{
+				Issuer:    "tsnsrv",
+				Subject:   "userid:1",
+				Audience:  "my-app",
+				IssuedAt:  now.Unix(),
+				NotBefore: now.Unix(),
+				Expires:   now.Add(time.Minute).Unix(),
+				Login:     "alice@example.com",
+				NodeID:    "nodeid:0",
+				Node:      "laptop",
+				Tags:      []string{"tag:ops"},
+				Caps:      []string{"example.com/cap/a", "example.com/cap/b"},
+			}, claims)
+		})
+	}
+}
+
+func TestNewIdentitySigner(t *testing.T) {
+	t.Parallel()
+	signer, err := NewIdentitySigner(IdentityAssertion{})
+	require.NoError(t, err)
+	assert.Nil(t, signer)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+	path := filepath.Join(t.TempDir(), "identity.pem")
+	require.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600))
+	signer, err = NewIdentitySigner(IdentityAssertion{KeyFile: path})
+	require.NoError(t, err)
+	assert.Equal(t, "ES256", signer.alg)
+
+	p384, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	require.NoError(t, err)
+	_, err = newIdentitySigner(IdentityAssertion{}, p384)
+	assert.ErrorIs(t, err, errIdentityKey)
+
+	require.NoError(t, os.WriteFile(path, []byte("not a key"), 0o600))
+	_, err = NewIdentitySigner(IdentityAssertion{KeyFile: path})
+	assert.ErrorIs(t, err, errIdentityKey)
+}
+
+func TestIdentityTokenForwarding(t *testing.T) {
+	t.Parallel()
+	var got http.Header
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+	}))
+	t.Cleanup(upstream.Close)
+	dest, err := url.Parse(upstream.URL)
+	require.NoError(t, err)
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	signer, err := newIdentitySigner(IdentityAssertion{Header: "X-Identity"}, key)
+	require.NoError(t, err)
+	s := &ValidTailnetSrv{
+		TailnetSrv: TailnetSrv{Name: "my-app"},
+		DestURL:    dest,
+		identity:   signer,
+		client: &mockLocalClient{whoIsFunc: func(ctx context.Context, addr string) (*apitype.WhoIsResponse, error) {
+			return identity("alice@example.com", "laptop", nil), nil
+		}},
+	}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-Identity", "forged")
+	w := httptest.NewRecorder()
+	s.mux(http.DefaultTransport, false).ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	claims := verifyToken(t, signer, got.Get("X-Identity"))
+	assert.Equal(t, "alice@example.com", claims.Login)
+	assert.Equal(t, "my-app", claims.Audience)
+
+	// Without an identity, forged tokens are removed:
+	s.SuppressWhois = true
+	w = httptest.NewRecorder()
+	s.mux(http.DefaultTransport, false).ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Empty(t, got.Get("X-Identity"))
+}
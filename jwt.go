@@ -0,0 +1,401 @@
+package tsnsrv
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"math/big"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"tailscale.com/util/singleflight"
+)
+
+var (
+	errJWTFormat    = errors.New("malformed JWT")
+	errJWTSignature = errors.New("JWT signature is invalid")
+	errJWTAlgorithm = errors.New("unsupported JWT algorithm")
+	errJWTExpired   = errors.New("JWT is expired or not yet valid")
+	errJWKUnknown   = errors.New("no key to verify the JWT with")
+)
+
+// jwtLeeway is how much clock skew is tolerated when checking a JWT's times.
+const jwtLeeway = 1 * time.Minute
+
+// jwtHeader is the JOSE header of a JWT.
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid,omitempty"`
+	Typ string `json:"typ,omitempty"`
+}
+
+// jwt is a parsed, but not yet verified, JWT in compact serialization.
+type jwt struct {
+	header       jwtHeader
+	claims       map[string]any
+	signingInput []byte
+	signature    []byte
+}
+
+func parseJWT(token string) (*jwt, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errJWTFormat
+	}
+	var t jwt
+	for i, dest := range []any{&t.header, &t.claims} {
+		data, err := base64.RawURLEncoding.DecodeString(parts[i])
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", errJWTFormat, err)
+		}
+		if err := json.Unmarshal(data, dest); err != nil {
+			return nil, fmt.Errorf("%w: %w", errJWTFormat, err)
+		}
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errJWTFormat, err)
+	}
+	t.signingInput = []byte(parts[0] + "." + parts[1])
+	t.signature = sig
+	return &t, nil
+}
+
+// verify checks the JWT's signature with key, which must match the
+// algorithm in the header.
+func (t *jwt) verify(key crypto.PublicKey) error {
+	var h hash.Hash
+	var ch crypto.Hash
+	switch t.header.Alg {
+	case "RS256", "ES256", "PS256":
+		h, ch = sha256.New(), crypto.SHA256
+	case "RS384", "ES384", "PS384":
+		h, ch = sha512.New384(), crypto.SHA384
+	case "RS512", "ES512", "PS512":
+		h, ch = sha512.New(), crypto.SHA512
+	case "EdDSA":
+		k, ok := key.(ed25519.PublicKey)
+		if !ok {
+			return fmt.Errorf("%w: key type doesn't match %s", errJWTSignature, t.header.Alg)
+		}
+		if !ed25519.Verify(k, t.signingInput, t.signature) {
+			return errJWTSignature
+		}
+		return nil
+	default:
+		return fmt.Errorf("%w: %q", errJWTAlgorithm, t.header.Alg)
+	}
+	h.Write(t.signingInput)
+	digest := h.Sum(nil)
+
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		var err error
+		switch t.header.Alg[:2] {
+		case "RS":
+			err = rsa.VerifyPKCS1v15(k, ch, digest, t.signature)
+		case "PS":
+			err = rsa.VerifyPSS(k, ch, digest, t.signature, nil)
+		default:
+			return fmt.Errorf("%w: key type doesn't match %s", errJWTSignature, t.header.Alg)
+		}
+		if err != nil {
+			return errJWTSignature
+		}
+		return nil
+	case *ecdsa.PublicKey:
+		if t.header.Alg[:2] != "ES" || k.Curve.Params().Name != ecdsaCurves[t.header.Alg] {
+			return fmt.Errorf("%w: key type doesn't match %s", errJWTSignature, t.header.Alg)
+		}
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if len(t.signature) != 2*size {
+			return errJWTSignature
+		}
+		r := new(big.Int).SetBytes(t.signature[:size])
+		s := new(big.Int).SetBytes(t.signature[size:])
+		if !ecdsa.Verify(k, digest, r, s) {
+			return errJWTSignature
+		}
+		return nil
+	default:
+		return fmt.Errorf("%w: key type doesn't match %s", errJWTSignature, t.header.Alg)
+	}
+}
+
+// ecdsaCurves are the curves that the ECDSA algorithms sign with.
+var ecdsaCurves = map[string]string{
+	"ES256": "P-256",
+	"ES384": "P-384",
+	"ES512": "P-521",
+}
+
+// checkTimes checks the exp and nbf claims, if present.
+func (t *jwt) checkTimes(now time.Time) error {
+	if exp, ok := t.claims["exp"].(float64); ok && now.After(time.Unix(int64(exp), 0).Add(jwtLeeway)) {
+		return errJWTExpired
+	}
+	if nbf, ok := t.claims["nbf"].(float64); ok && now.Before(time.Unix(int64(nbf), 0).Add(-jwtLeeway)) {
+		return errJWTExpired
+	}
+	return nil
+}
+
+// claimString returns the string value of a claim.
+func claimString(claims map[string]any, name string) string {
+	s, _ := claims[name].(string)
+	return s
+}
+
+// claimStrings returns the value of a claim that is a string or a list
+// of strings, like "aud" or "groups".
+func claimStrings(claims map[string]any, name string) []string {
+	switch v := claims[name].(type) {
+	case string:
+		return []string{v}
+	case []any:
+		var values []string
+		for _, elt := range v {
+			if s, ok := elt.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+// claimMatches returns whether a claim is value, or contains value if
+// it's a list. Non-string values are compared in their JSON form.
+func claimMatches(claims map[string]any, name, value string) bool {
+	switch v := claims[name].(type) {
+	case nil:
+		return false
+	case string, []any:
+		return slices.Contains(claimStrings(claims, name), value)
+	default:
+		data, err := json.Marshal(v)
+		return err == nil && string(data) == value
+	}
+}
+
+// claimHeaderValue returns a claim in the form it's passed to upstreams
+// in: strings as they are, lists joined with commas, and anything else
+// as JSON.
+func claimHeaderValue(claims map[string]any, name string) (string, bool) {
+	switch v := claims[name].(type) {
+	case nil:
+		return "", false
+	case string:
+		return v, true
+	case []any:
+		return strings.Join(claimStrings(claims, name), ", "), true
+	default:
+		data, err := json.Marshal(v)
+		return string(data), err == nil
+	}
+}
+
+// jwk is a JSON Web Key, as far as verifying signatures goes.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid,omitempty"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	decode := func(s string) *big.Int {
+		data, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil {
+			return nil
+		}
+		return new(big.Int).SetBytes(data)
+	}
+	switch k.Kty {
+	case "RSA":
+		n, e := decode(k.N), decode(k.E)
+		if n == nil || e == nil || !e.IsInt64() {
+			return nil, fmt.Errorf("invalid RSA key %q", k.Kid)
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q in key %q", k.Crv, k.Kid)
+		}
+		x, y := decode(k.X), decode(k.Y)
+		if x == nil || y == nil {
+			return nil, fmt.Errorf("invalid EC key %q", k.Kid)
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "OKP":
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if k.Crv != "Ed25519" || err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid OKP key %q", k.Kid)
+		}
+		return ed25519.PublicKey(x), nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+	}
+}
+
+// publicJWK is a signature key, and the algorithm it is restricted to
+// if its JWK names one.
+type publicJWK struct {
+	key crypto.PublicKey
+	alg string
+}
+
+// forToken returns the key if t may be verified with it.
+func (k publicJWK) forToken(t *jwt) (crypto.PublicKey, error) {
+	if k.alg != "" && k.alg != t.header.Alg {
+		return nil, fmt.Errorf("%w: key ID %q is for %s, not %q", errJWTAlgorithm, t.header.Kid, k.alg, t.header.Alg)
+	}
+	return k.key, nil
+}
+
+// jwkSet is a JSON Web Key Set fetched from a URL. Keys are refetched
+// when a token names a key that isn't known yet, at most once per
+// jwksRefreshInterval.
+type jwkSet struct {
+	url    string
+	client *http.Client
+
+	// fetches makes concurrent lookups of unknown keys share one fetch.
+	fetches singleflight.Group[string, map[string]publicJWK]
+
+	mu      sync.Mutex
+	keys    map[string]publicJWK
+	fetched time.Time
+}
+
+const (
+	jwksRefreshInterval = 1 * time.Minute
+	jwksFetchTimeout    = 10 * time.Second
+)
+
+func newJWKSet(url string, client *http.Client) *jwkSet {
+	return &jwkSet{url: url, client: client}
+}
+
+// key returns the key for verifying t.
+func (s *jwkSet) key(ctx context.Context, t *jwt) (crypto.PublicKey, error) {
+	s.mu.Lock()
+	key, ok := lookupKey(s.keys, t.header.Kid)
+	recent := time.Since(s.fetched) < jwksRefreshInterval
+	s.mu.Unlock()
+	if ok {
+		return key.forToken(t)
+	}
+	if recent {
+		return nil, fmt.Errorf("%w: key ID %q", errJWKUnknown, t.header.Kid)
+	}
+
+	var keys map[string]publicJWK
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case res := <-s.fetches.DoChan(s.url, s.fetch):
+		if res.Err != nil {
+			return nil, res.Err
+		}
+		keys = res.Val
+	}
+	if key, ok := lookupKey(keys, t.header.Kid); ok {
+		return key.forToken(t)
+	}
+	return nil, fmt.Errorf("%w: key ID %q", errJWKUnknown, t.header.Kid)
+}
+
+// lookupKey finds the key with the given ID. A set of one key is used
+// for tokens that don't name their key, and a key without an ID for
+// any token.
+func lookupKey(keys map[string]publicJWK, kid string) (publicJWK, bool) {
+	if len(keys) == 1 {
+		for id, key := range keys {
+			if kid == "" || id == "" {
+				return key, true
+			}
+		}
+	}
+	key, ok := keys[kid]
+	return key, ok
+}
+
+// fetch gets the key set, and remembers it if that worked. The fetch
+// doesn't depend on the request that triggered it, which may be
+// canceled while others still wait for the result.
+func (s *jwkSet) fetch() (map[string]publicJWK, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), jwksFetchTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("fetching JWKS: %w", err)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("fetching JWKS: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching JWKS from %s: status %d", s.url, resp.StatusCode)
+	}
+	keys, err := decodeJWKS(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("decoding JWKS from %s: %w", s.url, err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys = keys
+	s.fetched = time.Now()
+	return keys, nil
+}
+
+// decodeJWKS returns the signature keys in a JSON Web Key Set.
+func decodeJWKS(r io.Reader) (map[string]publicJWK, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.NewDecoder(r).Decode(&set); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]publicJWK)
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			// Skip keys we can't use, like ones for other algorithms.
+			continue
+		}
+		keys[k.Kid] = publicJWK{key: key, alg: k.Alg}
+	}
+	return keys, nil
+}
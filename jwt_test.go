@@ -0,0 +1,229 @@
+package tsnsrv
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// signJWT makes a JWT with the given claims, signed by signer.
+func signJWT(t *testing.T, signer *IdentitySigner, claims map[string]any) string {
+	t.Helper()
+	header, err := json.Marshal(map[string]string{"alg": signer.alg, "typ": "JWT", "kid": signer.jwk["kid"]})
+	require.NoError(t, err)
+	payload, err := json.Marshal(claims)
+	require.NoError(t, err)
+	input := b64(header) + "." + b64(payload)
+	sig, err := signer.sign([]byte(input))
+	require.NoError(t, err)
+	return input + "." + b64(sig)
+}
+
+func testSigners(t *testing.T) map[string]*IdentitySigner {
+	t.Helper()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	signers := make(map[string]*IdentitySigner)
+	for name, key := range map[string]crypto.Signer{"rsa": rsaKey, "ecdsa": ecKey, "ed25519": edKey} {
+		signer, err := newIdentitySigner(IdentityAssertion{}, key)
+		require.NoError(t, err)
+		signers[name] = signer
+	}
+	return signers
+}
+
+func TestJWTVerify(t *testing.T) {
+	t.Parallel()
+	signers := testSigners(t)
+	for name, signer := range signers {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			var k jwk
+			data, err := json.Marshal(signer.jwk)
+			require.NoError(t, err)
+			require.NoError(t, json.Unmarshal(data, &k))
+			key, err := k.publicKey()
+			require.NoError(t, err)
+
+			token := signJWT(t, signer, map[string]any{"sub": "alice", "exp": time.Now().Add(time.Minute).Unix()})
+			parsed, err := parseJWT(token)
+			require.NoError(t, err)
+			require.NoError(t, parsed.verify(key))
+			require.NoError(t, parsed.checkTimes(time.Now()))
+			assert.Equal(t, "alice", claimString(parsed.claims, "sub"))
+			assert.ErrorIs(t, parsed.checkTimes(time.Now().Add(time.Hour)), errJWTExpired)
+
+			tampered, err := parseJWT(token)
+			require.NoError(t, err)
+			tampered.signingInput[len(tampered.signingInput)-1] ^= 1
+			assert.Error(t, tampered.verify(key))
+
+			// A key of another type never verifies the token:
+			for other, otherSigner := range signers {
+				if other != name {
+					assert.Error(t, parsed.verify(otherSigner.key.Public()))
+				}
+			}
+		})
+	}
+}
+
+func TestJWTKeyAlgorithm(t *testing.T) {
+	t.Parallel()
+	signers := testSigners(t)
+	parsed, err := parseJWT(signJWT(t, signers["ecdsa"], map[string]any{"sub": "alice"}))
+	require.NoError(t, err)
+	p384, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	require.NoError(t, err)
+	assert.ErrorIs(t, parsed.verify(p384.Public()), errJWTSignature, "ES256 needs a P-256 key")
+
+	// A JWK that names its algorithm only verifies tokens of that algorithm:
+	signer := signers["rsa"]
+	parsed, err = parseJWT(signJWT(t, signer, map[string]any{"sub": "alice"}))
+	require.NoError(t, err)
+	keys := staticKeys{signer.jwk["kid"]: {key: signer.key.Public(), alg: "RS512"}}
+	_, err = keys.key(context.Background(), parsed)
+	assert.ErrorIs(t, err, errJWTAlgorithm)
+	keys = staticKeys{signer.jwk["kid"]: {key: signer.key.Public(), alg: "RS256"}}
+	_, err = keys.key(context.Background(), parsed)
+	assert.NoError(t, err)
+}
+
+func TestJWTRejectsNone(t *testing.T) {
+	t.Parallel()
+	token := b64([]byte(`{"alg":"none"}`)) + "." + b64([]byte(`{"sub":"alice"}`)) + "."
+	parsed, err := parseJWT(token)
+	require.NoError(t, err)
+	assert.ErrorIs(t, parsed.verify(nil), errJWTAlgorithm)
+}
+
+func TestClaimMatches(t *testing.T) {
+	t.Parallel()
+	var claims map[string]any
+	require.NoError(t, json.Unmarshal([]byte(`{"email":"a@example.com","groups":["admins","ops"],"email_verified":true}`), &claims))
+	assert.True(t, claimMatches(claims, "email", "a@example.com"))
+	assert.True(t, claimMatches(claims, "groups", "ops"))
+	assert.False(t, claimMatches(claims, "groups", "dev"))
+	assert.True(t, claimMatches(claims, "email_verified", "true"))
+	assert.False(t, claimMatches(claims, "missing", "x"))
+}
+
+func TestJWKSetRefetch(t *testing.T) {
+	t.Parallel()
+	signers := testSigners(t)
+	var current atomic.Pointer[IdentitySigner]
+	current.Store(signers["rsa"])
+	var fetches atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		current.Load().JWKSHandler().ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+
+	set := newJWKSet(server.URL, server.Client())
+	parsed, err := parseJWT(signJWT(t, signers["rsa"], map[string]any{"sub": "alice"}))
+	require.NoError(t, err)
+	_, err = set.key(context.Background(), parsed)
+	require.NoError(t, err)
+	_, err = set.key(context.Background(), parsed)
+	require.NoError(t, err)
+	assert.Equal(t, int32(1), fetches.Load())
+
+	// Unknown keys are looked up again, but not too often:
+	current.Store(signers["ecdsa"])
+	parsed, err = parseJWT(signJWT(t, signers["ecdsa"], map[string]any{"sub": "alice"}))
+	require.NoError(t, err)
+	_, err = set.key(context.Background(), parsed)
+	assert.ErrorIs(t, err, errJWKUnknown)
+	assert.Equal(t, int32(1), fetches.Load())
+
+	set.fetched = time.Time{}
+	_, err = set.key(context.Background(), parsed)
+	require.NoError(t, err)
+	assert.Equal(t, int32(2), fetches.Load())
+}
+
+func TestJWKSetFetchFailure(t *testing.T) {
+	t.Parallel()
+	signer := testSigners(t)["rsa"]
+	var failing atomic.Bool
+	failing.Store(true)
+	var fetches atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		if failing.Load() {
+			http.Error(w, "oops", http.StatusInternalServerError)
+			return
+		}
+		signer.JWKSHandler().ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+
+	set := newJWKSet(server.URL, server.Client())
+	parsed, err := parseJWT(signJWT(t, signer, map[string]any{"sub": "alice"}))
+	require.NoError(t, err)
+	_, err = set.key(context.Background(), parsed)
+	require.Error(t, err)
+
+	// Failed fetches don't count against the refresh interval:
+	failing.Store(false)
+	_, err = set.key(context.Background(), parsed)
+	require.NoError(t, err)
+	assert.Equal(t, int32(2), fetches.Load())
+}
+
+func TestJWKSetFetchOutlivesRequest(t *testing.T) {
+	t.Parallel()
+	signer := testSigners(t)["rsa"]
+	release := make(chan struct{})
+	var fetches atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		<-release
+		signer.JWKSHandler().ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+
+	set := newJWKSet(server.URL, server.Client())
+	parsed, err := parseJWT(signJWT(t, signer, map[string]any{"sub": "alice"}))
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error)
+	go func() {
+		_, err := set.key(ctx, parsed)
+		result <- err
+	}()
+	waiting := make(chan error)
+	go func() {
+		_, err := set.key(context.Background(), parsed)
+		waiting <- err
+	}()
+	require.Eventually(t, func() bool { return fetches.Load() == 1 }, 5*time.Second, time.Millisecond)
+	cancel()
+	assert.ErrorIs(t, <-result, context.Canceled)
+
+	close(release)
+	require.NoError(t, <-waiting, "the fetch isn't canceled with the request that started it")
+	_, err = set.key(context.Background(), parsed)
+	require.NoError(t, err)
+	assert.Equal(t, int32(1), fetches.Load(), "concurrent lookups share one fetch")
+}
@@ -0,0 +1,304 @@
+package tsnsrv
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"golang.org/x/exp/slog"
+)
+
+var jwtAuthResults = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "tsnsrv_jwt_auth_total",
+	Help: "Bearer token checks by result (valid, missing, invalid, forbidden)",
+}, []string{"service_name", "result"})
+
+var (
+	errJWTAuthKeys     = errors.New("JWT validation takes either a JWKS URL or a key file, not both")
+	errJWTAuthIssuer   = errors.New("JWT validation requires an issuer")
+	errJWTAuthAudience = errors.New("JWT validation requires at least one audience")
+	errJWTKeyFile      = errors.New("JWT key file must contain a PEM-encoded public key or certificate, or a JSON Web Key Set")
+)
+
+// JWTAuth configures a service to only let in requests that carry a
+// valid JWT in their "Authorization: Bearer" header.
+type JWTAuth struct {
+	// JWKSURL is where the keys that tokens are signed with are
+	// published. Exactly one of JWKSURL and KeyFile enables JWT
+	// validation.
+	JWKSURL string `yaml:"jwksURL,omitempty"`
+
+	// KeyFile contains the key that tokens are signed with: a
+	// PEM-encoded public key or certificate, or a JSON Web Key Set.
+	KeyFile string `yaml:"keyFile,omitempty"`
+
+	// Issuer is the "iss" claim that tokens must have.
+	Issuer string `yaml:"issuer,omitempty"`
+
+	// Audiences are accepted values of the "aud" claim; tokens must
+	// be for one of them.
+	Audiences []string `yaml:"audiences,omitempty"`
+
+	// RequiredClaims must all be present in the token with the given
+	// values (or contain them, for list claims).
+	RequiredClaims map[string]string `yaml:"requiredClaims,omitempty"`
+
+	// ClaimHeaders passes claims to the upstream: it maps claim names
+	// to the header they're sent in.
+	ClaimHeaders map[string]string `yaml:"claimHeaders,omitempty"`
+
+	// Prefixes limits validation to requests under these path
+	// prefixes, which can be limited to funnel or tailnet requests
+	// like with -prefix. All requests are validated if empty.
+	Prefixes []string `yaml:"prefixes,omitempty"`
+}
+
+func (ja JWTAuth) enabled() bool {
+	return ja.JWKSURL != "" || ja.KeyFile != ""
+}
+
+func (ja JWTAuth) validate() error {
+	if !ja.enabled() {
+		return nil
+	}
+	var errs []error
+	if ja.JWKSURL != "" && ja.KeyFile != "" {
+		errs = append(errs, errJWTAuthKeys)
+	}
+	if ja.JWKSURL != "" {
+		if u, err := url.Parse(ja.JWKSURL); err != nil || u.Scheme == "" || u.Host == "" {
+			errs = append(errs, fmt.Errorf("JWKS URL must be an absolute URL, got %q", ja.JWKSURL))
+		}
+	}
+	if ja.Issuer == "" {
+		errs = append(errs, errJWTAuthIssuer)
+	}
+	if len(ja.Audiences) == 0 {
+		errs = append(errs, errJWTAuthAudience)
+	}
+	for _, p := range ja.Prefixes {
+		if !strings.HasPrefix(parsePrefix(p).path, "/") {
+			errs = append(errs, fmt.Errorf("JWT validation prefix must start with '/', got %q", p))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// jwtKeySource finds the key that a token is signed with.
+type jwtKeySource interface {
+	key(ctx context.Context, t *jwt) (crypto.PublicKey, error)
+}
+
+// staticKeys are keys read from a file.
+type staticKeys map[string]publicJWK
+
+func (k staticKeys) key(ctx context.Context, t *jwt) (crypto.PublicKey, error) {
+	if key, ok := lookupKey(k, t.header.Kid); ok {
+		return key.forToken(t)
+	}
+	return nil, fmt.Errorf("%w: key ID %q", errJWKUnknown, t.header.Kid)
+}
+
+// readJWTKeyFile reads the keys that tokens are signed with.
+func readJWTKeyFile(path string) (staticKeys, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading JWT key file: %w", err)
+	}
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '{' {
+		keys, err := decodeJWKS(bytes.NewReader(trimmed))
+		if err != nil || len(keys) == 0 {
+			return nil, fmt.Errorf("%s: %w", path, errJWTKeyFile)
+		}
+		return keys, nil
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: %w", path, errJWTKeyFile)
+	}
+	var key any
+	switch block.Type {
+	case "CERTIFICATE":
+		var cert *x509.Certificate
+		cert, err = x509.ParseCertificate(block.Bytes)
+		if err == nil {
+			key = cert.PublicKey
+		}
+	case "RSA PUBLIC KEY":
+		key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKIXPublicKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w: %w", path, errJWTKeyFile, err)
+	}
+	return staticKeys{"": {key: key}}, nil
+}
+
+// jwtValidator is the JWT validation of a service.
+type jwtValidator struct {
+	config   JWTAuth
+	keys     jwtKeySource
+	prefixes []prefix
+}
+
+// newJWTValidator reads the keys of a JWT validation configuration.
+func newJWTValidator(config JWTAuth) (*jwtValidator, error) {
+	v := &jwtValidator{config: config}
+	if config.KeyFile != "" {
+		keys, err := readJWTKeyFile(config.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		v.keys = keys
+	} else {
+		v.keys = newJWKSet(config.JWKSURL, &http.Client{Timeout: 10 * time.Second})
+	}
+	for _, p := range config.Prefixes {
+		v.prefixes = append(v.prefixes, parsePrefix(p))
+	}
+	return v, nil
+}
+
+// applies returns whether requests to reqURL must carry a token.
+func (v *jwtValidator) applies(reqURL *url.URL, forFunnel bool) bool {
+	if len(v.prefixes) == 0 {
+		return true
+	}
+	return slices.ContainsFunc(v.prefixes, func(p prefix) bool {
+		return p.covers(reqURL, forFunnel)
+	})
+}
+
+// jwtForbidden is returned by validate if a token is valid, but lacks
+// required claims.
+type jwtForbidden struct {
+	claim, value string
+}
+
+func (e *jwtForbidden) Error() string {
+	return fmt.Sprintf("claim %q is not %q", e.claim, e.value)
+}
+
+// validate checks a token, and returns its claims.
+func (v *jwtValidator) validate(ctx context.Context, token string, now time.Time) (map[string]any, error) {
+	t, err := parseJWT(token)
+	if err != nil {
+		return nil, err
+	}
+	key, err := v.keys.key(ctx, t)
+	if err != nil {
+		return nil, err
+	}
+	if err := t.verify(key); err != nil {
+		return nil, err
+	}
+	if _, ok := t.claims["exp"].(float64); !ok {
+		return nil, fmt.Errorf("%w: token doesn't expire", errJWTExpired)
+	}
+	if err := t.checkTimes(now); err != nil {
+		return nil, err
+	}
+	if iss := claimString(t.claims, "iss"); iss != v.config.Issuer {
+		return nil, fmt.Errorf("token is from issuer %q", iss)
+	}
+	if !slices.ContainsFunc(claimStrings(t.claims, "aud"), func(aud string) bool { return slices.Contains(v.config.Audiences, aud) }) {
+		return nil, errors.New("token is not for this service")
+	}
+	for name, value := range v.config.RequiredClaims {
+		if !claimMatches(t.claims, name, value) {
+			return t.claims, &jwtForbidden{name, value}
+		}
+	}
+	return t.claims, nil
+}
+
+// setHeaders passes the configured claims to the upstream.
+func (v *jwtValidator) setHeaders(h http.Header, claims map[string]any) {
+	for name, header := range v.config.ClaimHeaders {
+		if value, ok := claimHeaderValue(claims, name); ok {
+			h.Set(header, value)
+		}
+	}
+}
+
+// bearerToken returns the token in r's Authorization header.
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	token = strings.TrimSpace(token)
+	return token, token != ""
+}
+
+// jwtMiddleware rejects requests without a valid bearer token.
+func (s *ValidTailnetSrv) jwtMiddleware(forFunnel bool, next http.Handler) http.Handler {
+	v := s.jwtAuth
+	if v == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Only tsnsrv may set the claim headers:
+		for _, header := range v.config.ClaimHeaders {
+			r.Header.Del(header)
+		}
+		if !v.applies(r.URL, forFunnel) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		result := func(result string) {
+			jwtAuthResults.With(prometheus.Labels{"service_name": s.Name, "result": result}).Inc()
+		}
+
+		token, ok := bearerToken(r)
+		if !ok {
+			result("missing")
+			w.Header().Set("WWW-Authenticate", `Bearer realm="`+s.Name+`"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		claims, err := v.validate(r.Context(), token, time.Now())
+		var forbidden *jwtForbidden
+		switch {
+		case errors.As(err, &forbidden):
+			result("forbidden")
+			slog.Info("bearer token lacks required claims",
+				"service", s.Name,
+				"subject", claimString(claims, "sub"),
+				"remote_addr", r.RemoteAddr,
+				"url", r.URL,
+				"error", err,
+			)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="`+s.Name+`", error="insufficient_scope"`)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		case err != nil:
+			result("invalid")
+			slog.Info("invalid bearer token",
+				"service", s.Name,
+				"remote_addr", r.RemoteAddr,
+				"url", r.URL,
+				"error", err,
+			)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="`+s.Name+`", error="invalid_token"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		result("valid")
+		v.setHeaders(r.Header, claims)
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,166 @@
+package tsnsrv
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJWTAuthValidate(t *testing.T) {
+	t.Parallel()
+	valid := JWTAuth{JWKSURL: "https://ci.example.com/jwks", Issuer: "https://ci.example.com", Audiences: []string{"deploy"}}
+	assert.NoError(t, valid.validate())
+	assert.NoError(t, JWTAuth{}.validate())
+
+	both := valid
+	both.KeyFile = "/etc/key.pem"
+	assert.ErrorIs(t, both.validate(), errJWTAuthKeys)
+
+	noIssuer := valid
+	noIssuer.Issuer = ""
+	assert.ErrorIs(t, noIssuer.validate(), errJWTAuthIssuer)
+
+	noAudience := valid
+	noAudience.Audiences = nil
+	assert.ErrorIs(t, noAudience.validate(), errJWTAuthAudience)
+
+	badPrefix := valid
+	badPrefix.Prefixes = []string{"funnel:hooks"}
+	assert.Error(t, badPrefix.validate())
+}
+
+func TestJWTMiddleware(t *testing.T) {
+	t.Parallel()
+	signers := testSigners(t)
+	signer := signers["rsa"]
+
+	// Serve the key from a JWKS URL, and write it to a PEM file:
+	jwks := httptest.NewServer(signer.JWKSHandler())
+	t.Cleanup(jwks.Close)
+	der, err := x509.MarshalPKIXPublicKey(signer.key.Public())
+	require.NoError(t, err)
+	keyFile := filepath.Join(t.TempDir(), "key.pem")
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0o600))
+
+	config := JWTAuth{
+		Issuer:         "https://ci.example.com",
+		Audiences:      []string{"deploy"},
+		RequiredClaims: map[string]string{"repository": "example/app"},
+		ClaimHeaders:   map[string]string{"sub": "X-CI-Subject", "repository": "X-CI-Repository"},
+		Prefixes:       []string{"funnel:/hooks"},
+	}
+	claims := func(overrides map[string]any) map[string]any {
+		c := map[string]any{
+			"iss":        "https://ci.example.com",
+			"aud":        "deploy",
+			"sub":        "repo:example/app:ref:refs/heads/main",
+			"repository": "example/app",
+			"exp":        time.Now().Add(5 * time.Minute).Unix(),
+		}
+		for k, v := range overrides {
+			if v == nil {
+				delete(c, k)
+			} else {
+				c[k] = v
+			}
+		}
+		return c
+	}
+
+	for name, keys := range map[string]JWTAuth{"jwks": {JWKSURL: jwks.URL}, "keyFile": {KeyFile: keyFile}} {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			cfg := config
+			cfg.JWKSURL, cfg.KeyFile = keys.JWKSURL, keys.KeyFile
+			require.NoError(t, cfg.validate())
+			s := &ValidTailnetSrv{TailnetSrv: TailnetSrv{Name: "test", JWTAuth: cfg}}
+			var err error
+			s.jwtAuth, err = newJWTValidator(cfg)
+			require.NoError(t, err)
+
+			var got http.Header
+			handler := s.jwtMiddleware(true, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = r.Header.Clone()
+			}))
+			do := func(path, token string) *httptest.ResponseRecorder {
+				got = nil
+				req := httptest.NewRequest("POST", path, nil)
+				if token != "" {
+					req.Header.Set("Authorization", "Bearer "+token)
+				}
+				req.Header.Set("X-CI-Repository", "spoofed")
+				w := httptest.NewRecorder()
+				handler.ServeHTTP(w, req)
+				return w
+			}
+
+			w := do("/hooks/deploy", signJWT(t, signer, claims(nil)))
+			require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+			assert.Equal(t, "repo:example/app:ref:refs/heads/main", got.Get("X-CI-Subject"))
+			assert.Equal(t, "example/app", got.Get("X-CI-Repository"))
+
+			w = do("/hooks/deploy", "")
+			assert.Equal(t, http.StatusUnauthorized, w.Code)
+			assert.Equal(t, `Bearer realm="test"`, w.Header().Get("WWW-Authenticate"))
+
+			// Encoding the path doesn't get around the prefix:
+			for _, path := range []string{"/%68ooks/deploy", "/hooks%2Fdeploy"} {
+				w = do(path, "")
+				assert.Equal(t, http.StatusUnauthorized, w.Code, path)
+				assert.Nil(t, got, path)
+			}
+
+			for desc, token := range map[string]string{
+				"expired":        signJWT(t, signer, claims(map[string]any{"exp": time.Now().Add(-time.Hour).Unix()})),
+				"no expiry":      signJWT(t, signer, claims(map[string]any{"exp": nil})),
+				"wrong issuer":   signJWT(t, signer, claims(map[string]any{"iss": "https://evil.example.com"})),
+				"wrong audience": signJWT(t, signer, claims(map[string]any{"aud": []string{"other"}})),
+				"wrong signer":   signJWT(t, signers["ecdsa"], claims(nil)),
+				"not a JWT":      "hunter2",
+			} {
+				w = do("/hooks/deploy", token)
+				assert.Equal(t, http.StatusUnauthorized, w.Code, desc)
+				assert.Contains(t, w.Header().Get("WWW-Authenticate"), `error="invalid_token"`, desc)
+				assert.Nil(t, got, desc)
+			}
+
+			w = do("/hooks/deploy", signJWT(t, signer, claims(map[string]any{"repository": "example/other"})))
+			assert.Equal(t, http.StatusForbidden, w.Code)
+
+			// Paths outside the prefixes don't need a token, but can't
+			// fake the claim headers either:
+			w = do("/status", "")
+			assert.Equal(t, http.StatusOK, w.Code)
+			assert.Empty(t, got.Get("X-CI-Repository"))
+		})
+	}
+}
+
+func TestJWTMiddlewareTailnetPrefix(t *testing.T) {
+	t.Parallel()
+	signer := testSigners(t)["ed25519"]
+	jwks := httptest.NewServer(signer.JWKSHandler())
+	t.Cleanup(jwks.Close)
+	cfg := JWTAuth{JWKSURL: jwks.URL, Issuer: "iss", Audiences: []string{"aud"}, Prefixes: []string{"funnel:/hooks"}}
+	s := &ValidTailnetSrv{TailnetSrv: TailnetSrv{Name: "test", JWTAuth: cfg}}
+	var err error
+	s.jwtAuth, err = newJWTValidator(cfg)
+	require.NoError(t, err)
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	w := httptest.NewRecorder()
+	s.jwtMiddleware(false, next).ServeHTTP(w, httptest.NewRequest("POST", "/hooks/deploy", nil))
+	assert.Equal(t, http.StatusOK, w.Code, "funnel: prefixes don't apply to tailnet requests")
+
+	w = httptest.NewRecorder()
+	s.jwtMiddleware(true, next).ServeHTTP(w, httptest.NewRequest("POST", "/hooks/deploy", nil))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
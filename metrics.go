@@ -0,0 +1,207 @@
+package tsnsrv
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Metrics configures how request metrics are exported.
+type Metrics struct {
+	// NativeHistograms additionally exposes the duration and size
+	// histograms as Prometheus native histograms, to scrapers that
+	// ask for the protobuf format.
+	NativeHistograms bool `yaml:"nativeHistograms,omitempty"`
+
+	// LegacySummaries keeps exporting the tsnsrv_request_duration_ns
+	// and tsnsrv_auth_duration_ns summaries of earlier versions.
+	LegacySummaries bool `yaml:"legacySummaries,omitempty"`
+}
+
+var requestsInFlight = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "tsnsrv_requests_in_flight",
+	Help: "Requests being served, by listener (tailnet, funnel)",
+}, []string{"service_name", "listener"})
+
+// requestHistograms are the histograms that can be exposed as native
+// histograms.
+type requestHistograms struct {
+	duration     *prometheus.HistogramVec
+	requestSize  *prometheus.HistogramVec
+	responseSize *prometheus.HistogramVec
+	authDuration *prometheus.HistogramVec
+	native       bool
+}
+
+func newRequestHistograms(native bool) *requestHistograms {
+	opts := func(name, help string, buckets []float64) prometheus.HistogramOpts {
+		o := prometheus.HistogramOpts{Name: name, Help: help, Buckets: buckets}
+		if native {
+			o.NativeHistogramBucketFactor = 1.1
+			o.NativeHistogramMaxBucketNumber = 100
+			o.NativeHistogramMinResetDuration = time.Hour
+		}
+		return o
+	}
+	durationBuckets := []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60}
+	sizeBuckets := prometheus.ExponentialBuckets(64, 4, 10)
+	labels := []string{"service_name", "listener", "method", "prefix"}
+	return &requestHistograms{
+		duration: prometheus.NewHistogramVec(opts(
+			"tsnsrv_request_duration_seconds",
+			"Duration of requests served, by listener, method, matched prefix and status code class",
+			durationBuckets,
+		), append(labels, "status_code_class")),
+		requestSize: prometheus.NewHistogramVec(opts(
+			"tsnsrv_request_size_bytes",
+			"Size of the request bodies read, by listener, method and matched prefix",
+			sizeBuckets,
+		), labels),
+		responseSize: prometheus.NewHistogramVec(opts(
+			"tsnsrv_response_size_bytes",
+			"Size of the response bodies written, by listener, method and matched prefix",
+			sizeBuckets,
+		), labels),
+		authDuration: prometheus.NewHistogramVec(opts(
+			"tsnsrv_auth_duration_seconds",
+			"Duration of authorization requests",
+			durationBuckets,
+		), []string{"service_name"}),
+		native: native,
+	}
+}
+
+func (h *requestHistograms) collectors() []prometheus.Collector {
+	return []prometheus.Collector{h.duration, h.requestSize, h.responseSize, h.authDuration}
+}
+
+var (
+	histograms      atomic.Pointer[requestHistograms]
+	legacySummaries atomic.Bool
+)
+
+func init() {
+	h := newRequestHistograms(false)
+	prometheus.MustRegister(h.collectors()...)
+	histograms.Store(h)
+}
+
+// ConfigureMetrics sets up the request metrics of the process. It
+// must be called before any service starts.
+func ConfigureMetrics(m Metrics) error {
+	return configureMetrics(prometheus.DefaultRegisterer, m)
+}
+
+func configureMetrics(reg prometheus.Registerer, m Metrics) error {
+	old := histograms.Load()
+	if old.native != m.NativeHistograms {
+		h := newRequestHistograms(m.NativeHistograms)
+		for _, c := range old.collectors() {
+			reg.Unregister(c)
+		}
+		for _, c := range h.collectors() {
+			if err := reg.Register(c); err != nil {
+				return fmt.Errorf("registering request histograms: %w", err)
+			}
+		}
+		histograms.Store(h)
+	}
+	if m.LegacySummaries && !legacySummaries.Load() {
+		for _, c := range []prometheus.Collector{requestDurations, authDurations} {
+			if err := reg.Register(c); err != nil {
+				return fmt.Errorf("registering legacy summaries: %w", err)
+			}
+		}
+	} else if !m.LegacySummaries && legacySummaries.Load() {
+		reg.Unregister(requestDurations)
+		reg.Unregister(authDurations)
+	}
+	legacySummaries.Store(m.LegacySummaries)
+	return nil
+}
+
+// observeAuthDuration records how long an authorization request took.
+func observeAuthDuration(service string, elapsed time.Duration) {
+	histograms.Load().authDuration.With(prometheus.Labels{"service_name": service}).Observe(elapsed.Seconds())
+	if legacySummaries.Load() {
+		authDurations.With(prometheus.Labels{"service_name": service}).Observe(float64(elapsed))
+	}
+}
+
+// methodClass bounds the method label to the standard methods.
+func methodClass(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodOptions, http.MethodConnect, http.MethodTrace:
+		return method
+	}
+	return "other"
+}
+
+// metricsRecordKey finds the metricsRecord of a request.
+type metricsRecordKey struct{}
+
+// metricsRecord collects the labels that are only known once a request
+// was routed.
+type metricsRecord struct {
+	prefix string
+}
+
+// recordPrefix remembers which configured prefix or route served a
+// request.
+func recordPrefix(r *http.Request, prefix string) {
+	if rec, ok := r.Context().Value(metricsRecordKey{}).(*metricsRecord); ok {
+		rec.prefix = prefix
+	}
+}
+
+// metricsMiddleware records the duration, sizes and outcome of every
+// request, however it was answered.
+func (s *ValidTailnetSrv) metricsMiddleware(forFunnel bool, next http.Handler) http.Handler {
+	listener := "tailnet"
+	if forFunnel {
+		listener = "funnel"
+	}
+	inFlight := requestsInFlight.With(prometheus.Labels{"service_name": s.Name, "listener": listener})
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		inFlight.Inc()
+		rec := &metricsRecord{}
+		sw := &statusWriter{ResponseWriter: w}
+		var body *countingBody
+		r2 := r.WithContext(context.WithValue(r.Context(), metricsRecordKey{}, rec))
+		if r.Body != nil && r.Body != http.NoBody {
+			body = &countingBody{ReadCloser: r.Body}
+			r2.Body = body
+		}
+		defer func() {
+			inFlight.Dec()
+			status := sw.status
+			if status == 0 {
+				// Nothing was written; net/http sends a 200.
+				status = http.StatusOK
+			}
+			labels := prometheus.Labels{
+				"service_name": s.Name,
+				"listener":     listener,
+				"method":       methodClass(r.Method),
+				"prefix":       rec.prefix,
+			}
+			var read int64
+			if body != nil {
+				read = body.n
+			}
+			h := histograms.Load()
+			h.requestSize.With(labels).Observe(float64(read))
+			h.responseSize.With(labels).Observe(float64(sw.size))
+			labels["status_code_class"] = fmt.Sprintf("%dxx", status/100)
+			h.duration.With(labels).Observe(time.Since(start).Seconds())
+		}()
+		next.ServeHTTP(sw, r2)
+	})
+}
@@ -0,0 +1,131 @@
+package tsnsrv
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// histogramSample returns the observations of one histogram series.
+func histogramSample(t *testing.T, vec *prometheus.HistogramVec, labels prometheus.Labels) *dto.Histogram {
+	t.Helper()
+	obs, err := vec.GetMetricWith(labels)
+	require.NoError(t, err)
+	var m dto.Metric
+	require.NoError(t, obs.(prometheus.Metric).Write(&m))
+	return m.GetHistogram()
+}
+
+func TestMetricsMiddleware(t *testing.T) {
+	t.Parallel()
+	dest, err := url.Parse("http://upstream")
+	require.NoError(t, err)
+	routes, err := routeFlags{{Prefix: "/api", Upstream: "http://api"}}.parse()
+	require.NoError(t, err)
+	s := &ValidTailnetSrv{
+		TailnetSrv: TailnetSrv{
+			Name:            t.Name(),
+			SuppressWhois:   true,
+			AllowedPrefixes: prefixes{parsePrefix("/app"), parsePrefix("/api")},
+		},
+		DestURL: dest,
+		routes:  routes,
+	}
+	handler := s.mux(roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		if req.URL.Path == "/app/down" {
+			return nil, errors.New("connection refused")
+		}
+		if req.Body != nil {
+			io.Copy(io.Discard, req.Body)
+		}
+		return &http.Response{StatusCode: 201, Body: io.NopCloser(strings.NewReader("created")), Request: req}, nil
+	}), true)
+
+	h := histograms.Load()
+	labels := func(method, prefix string) prometheus.Labels {
+		return prometheus.Labels{"service_name": s.Name, "listener": "funnel", "method": method, "prefix": prefix}
+	}
+	count := func(method, prefix, class string) uint64 {
+		l := labels(method, prefix)
+		l["status_code_class"] = class
+		return histogramSample(t, h.duration, l).GetSampleCount()
+	}
+	size := func(vec *prometheus.HistogramVec) float64 {
+		return histogramSample(t, vec, labels("POST", "/app")).GetSampleSum()
+	}
+	// The histograms are global and outlive this test (e.g. with
+	// -count), so only look at what these requests add to them:
+	created, failed, routed := count("POST", "/app", "2xx"), count("GET", "/app", "5xx"), count("GET", "/api", "2xx")
+	denied, grouped := count("GET", "", "4xx"), count("other", "", "4xx")
+	requestSize, responseSize := size(h.requestSize), size(h.responseSize)
+
+	for _, req := range []*http.Request{
+		httptest.NewRequest("POST", "/app/items", strings.NewReader("name=x")),
+		httptest.NewRequest("GET", "/app/down", nil),
+		httptest.NewRequest("GET", "/api/users", nil),
+		httptest.NewRequest("GET", "/elsewhere", nil),
+		httptest.NewRequest("PROPFIND", "/elsewhere", nil),
+	} {
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	assert.EqualValues(t, 1, count("POST", "/app", "2xx")-created)
+	assert.EqualValues(t, len("name=x"), size(h.requestSize)-requestSize)
+	assert.EqualValues(t, len("created"), size(h.responseSize)-responseSize)
+	assert.EqualValues(t, 1, count("GET", "/app", "5xx")-failed, "proxy errors are counted")
+	assert.EqualValues(t, 1, count("GET", "/api", "2xx")-routed, "routes are labeled with their prefix")
+	assert.EqualValues(t, 1, count("GET", "", "4xx")-denied, "prefix denials are counted")
+	assert.EqualValues(t, 1, count("other", "", "4xx")-grouped, "unknown methods are grouped")
+
+	var inFlight dto.Metric
+	require.NoError(t, requestsInFlight.With(prometheus.Labels{"service_name": s.Name, "listener": "funnel"}).Write(&inFlight))
+	assert.EqualValues(t, 0, inFlight.GetGauge().GetValue())
+}
+
+func TestConfigureMetrics(t *testing.T) {
+	// Not parallel: this swaps the process's histograms.
+	old := histograms.Load()
+	t.Cleanup(func() {
+		histograms.Store(old)
+		legacySummaries.Store(false)
+	})
+	reg := prometheus.NewRegistry()
+	require.NoError(t, reg.Register(old.duration))
+
+	require.NoError(t, configureMetrics(reg, Metrics{NativeHistograms: true, LegacySummaries: true}))
+	h := histograms.Load()
+	assert.NotSame(t, old, h)
+	assert.True(t, h.native)
+	h.duration.With(prometheus.Labels{"service_name": t.Name(), "listener": "tailnet", "method": "GET", "prefix": "", "status_code_class": "2xx"}).Observe(0.25)
+	observeAuthDuration(t.Name(), 10*time.Millisecond)
+
+	families, err := reg.Gather()
+	require.NoError(t, err)
+	names := map[string]*dto.MetricFamily{}
+	for _, mf := range families {
+		names[mf.GetName()] = mf
+	}
+	assert.Contains(t, names, "tsnsrv_auth_duration_ns", "legacy summaries are exported")
+	require.Contains(t, names, "tsnsrv_request_duration_seconds")
+	hist := names["tsnsrv_request_duration_seconds"].GetMetric()[0].GetHistogram()
+	assert.NotEmpty(t, hist.GetPositiveSpan(), "native buckets are exposed")
+	assert.NotEmpty(t, hist.GetBucket(), "classic buckets are still exposed")
+
+	require.NoError(t, configureMetrics(reg, Metrics{}))
+	families, err = reg.Gather()
+	require.NoError(t, err)
+	for _, mf := range families {
+		assert.NotEqual(t, "tsnsrv_auth_duration_ns", mf.GetName())
+	}
+	assert.False(t, histograms.Load().native)
+}
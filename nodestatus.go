@@ -0,0 +1,151 @@
+package tsnsrv
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"golang.org/x/exp/slog"
+	"tailscale.com/ipn"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/tailcfg"
+)
+
+var (
+	nodeBackendState = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tsnsrv_tailscale_backend_state",
+		Help: "Whether the service's tailscale node is in a backend state (1) or not (0)",
+	}, []string{"service_name", "state"})
+	nodeKeyExpiry = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tsnsrv_tailscale_key_expiry_timestamp_seconds",
+		Help: "When the node key of the service's tailscale node expires; absent if it doesn't",
+	}, []string{"service_name"})
+	nodePeers = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tsnsrv_tailscale_recent_peers",
+		Help: "Peers the service's tailscale node recently talked to, by connection (direct, peer_relay, derp)",
+	}, []string{"service_name", "connection"})
+	nodeHealthWarnings = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tsnsrv_tailscale_health_warnings",
+		Help: "Number of health problems the service's tailscale node reports",
+	}, []string{"service_name"})
+	nodeFunnelEnabled = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tsnsrv_tailscale_funnel_enabled",
+		Help: "Whether the service serves funnel and its tailscale node is allowed to",
+	}, []string{"service_name"})
+	nodeInfo = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tsnsrv_tailscale_node_info",
+		Help: "The DNS name and tailscale IPs of the service's tailscale node",
+	}, []string{"service_name", "dns_name", "ipv4", "ipv6"})
+)
+
+// recentPeer is how long after the last WireGuard handshake a peer
+// counts as recently active. Active sessions handshake every two
+// minutes.
+const recentPeer = 3 * time.Minute
+
+// nodeStatusClient is the part of the tailscale LocalClient that
+// reports the node's status.
+type nodeStatusClient interface {
+	Status(ctx context.Context) (*ipnstate.Status, error)
+}
+
+// monitorNodeStatus exports the status of the service's tailscale node
+// every StatusMetricsInterval, until ctx is canceled.
+func (s *ValidTailnetSrv) monitorNodeStatus(ctx context.Context, client nodeStatusClient) {
+	labels := prometheus.Labels{"service_name": s.Name}
+	defer func() {
+		for _, vec := range []*prometheus.GaugeVec{nodeBackendState, nodeKeyExpiry, nodePeers, nodeHealthWarnings, nodeFunnelEnabled, nodeInfo} {
+			vec.DeletePartialMatch(labels)
+		}
+	}()
+	ticker := time.NewTicker(s.StatusMetricsInterval)
+	defer ticker.Stop()
+	for {
+		statusCtx, cancel := context.WithTimeout(ctx, s.StatusMetricsInterval)
+		st, err := client.Status(statusCtx)
+		cancel()
+		switch {
+		case err == nil:
+			s.exportNodeStatus(st, time.Now())
+		case ctx.Err() == nil:
+			slog.Warn("could not get the tailscale node status",
+				"service", s.Name,
+				"error", err,
+			)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// exportNodeStatus sets the node status metrics of the service.
+func (s *ValidTailnetSrv) exportNodeStatus(st *ipnstate.Status, now time.Time) {
+	labels := prometheus.Labels{"service_name": s.Name}
+
+	known := false
+	for state := ipn.NoState; state <= ipn.Running; state++ {
+		value := 0.0
+		if state.String() == st.BackendState {
+			value = 1
+			known = true
+		}
+		nodeBackendState.With(prometheus.Labels{"service_name": s.Name, "state": state.String()}).Set(value)
+	}
+	if !known && st.BackendState != "" {
+		nodeBackendState.With(prometheus.Labels{"service_name": s.Name, "state": st.BackendState}).Set(1)
+	}
+
+	nodeHealthWarnings.With(labels).Set(float64(len(st.Health)))
+
+	funnel := 0.0
+	var dnsName string
+	if self := st.Self; self != nil {
+		if self.KeyExpiry != nil {
+			nodeKeyExpiry.With(labels).Set(float64(self.KeyExpiry.Unix()))
+		} else {
+			nodeKeyExpiry.Delete(labels)
+		}
+		if s.Funnel && self.HasCap(tailcfg.NodeAttrFunnel) {
+			funnel = 1
+		}
+		dnsName = strings.TrimSuffix(self.DNSName, ".")
+	}
+	nodeFunnelEnabled.With(labels).Set(funnel)
+
+	peers := map[string]int{"direct": 0, "peer_relay": 0, "derp": 0}
+	for _, peer := range st.Peer {
+		if now.Sub(peer.LastHandshake) > recentPeer {
+			continue
+		}
+		switch {
+		case peer.CurAddr != "":
+			peers["direct"]++
+		case peer.PeerRelay != "":
+			peers["peer_relay"]++
+		case peer.Relay != "":
+			peers["derp"]++
+		}
+	}
+	for connection, n := range peers {
+		nodePeers.With(prometheus.Labels{"service_name": s.Name, "connection": connection}).Set(float64(n))
+	}
+
+	var ipv4, ipv6 string
+	for _, ip := range st.TailscaleIPs {
+		switch {
+		case ip.Is4() && ipv4 == "":
+			ipv4 = ip.String()
+		case ip.Is6() && ipv6 == "":
+			ipv6 = ip.String()
+		}
+	}
+	info := prometheus.Labels{"service_name": s.Name, "dns_name": dnsName, "ipv4": ipv4, "ipv6": ipv6}
+	// Only the current addresses are exported:
+	nodeInfo.DeletePartialMatch(labels)
+	nodeInfo.With(info).Set(1)
+}
@@ -0,0 +1,142 @@
+package tsnsrv
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
+)
+
+func gaugeValue(t *testing.T, vec *prometheus.GaugeVec, labels prometheus.Labels) float64 {
+	t.Helper()
+	var m dto.Metric
+	require.NoError(t, vec.With(labels).Write(&m))
+	return m.GetGauge().GetValue()
+}
+
+func testNodeStatus(now time.Time) *ipnstate.Status {
+	expiry := now.Add(48 * time.Hour)
+	peer := func(curAddr, relay string, lastHandshake time.Time) *ipnstate.PeerStatus {
+		return &ipnstate.PeerStatus{CurAddr: curAddr, Relay: relay, LastHandshake: lastHandshake}
+	}
+	return &ipnstate.Status{
+		BackendState: "Running",
+		TailscaleIPs: []netip.Addr{netip.MustParseAddr("100.64.0.1"), netip.MustParseAddr("fd7a:115c:a1e0::1")},
+		Health:       []string{"not connected to home DERP region 1"},
+		Self: &ipnstate.PeerStatus{
+			DNSName:   "app.example.ts.net.",
+			KeyExpiry: &expiry,
+			CapMap:    tailcfg.NodeCapMap{tailcfg.NodeAttrFunnel: nil},
+		},
+		Peer: map[key.NodePublic]*ipnstate.PeerStatus{
+			key.NewNode().Public(): peer("192.0.2.1:41641", "fra", now.Add(-time.Minute)),
+			key.NewNode().Public(): peer("", "fra", now.Add(-30*time.Second)),
+			key.NewNode().Public(): peer("", "nyc", now.Add(-time.Second)),
+			key.NewNode().Public(): peer("192.0.2.2:41641", "fra", now.Add(-time.Hour)),
+		},
+	}
+}
+
+func TestExportNodeStatus(t *testing.T) {
+	t.Parallel()
+	now := time.Now()
+	s := &ValidTailnetSrv{TailnetSrv: TailnetSrv{Name: t.Name(), Funnel: true}}
+	st := testNodeStatus(now)
+	s.exportNodeStatus(st, now)
+
+	labels := prometheus.Labels{"service_name": s.Name}
+	state := func(state string) float64 {
+		return gaugeValue(t, nodeBackendState, prometheus.Labels{"service_name": s.Name, "state": state})
+	}
+	peers := func(connection string) float64 {
+		return gaugeValue(t, nodePeers, prometheus.Labels{"service_name": s.Name, "connection": connection})
+	}
+	assert.EqualValues(t, 1, state("Running"))
+	assert.EqualValues(t, 0, state("NeedsLogin"))
+	assert.EqualValues(t, st.Self.KeyExpiry.Unix(), gaugeValue(t, nodeKeyExpiry, labels))
+	assert.EqualValues(t, 1, gaugeValue(t, nodeHealthWarnings, labels))
+	assert.EqualValues(t, 1, gaugeValue(t, nodeFunnelEnabled, labels))
+	assert.EqualValues(t, 1, peers("direct"))
+	assert.EqualValues(t, 2, peers("derp"), "peers without a recent handshake aren't counted")
+	assert.EqualValues(t, 0, peers("peer_relay"))
+	assert.EqualValues(t, 1, gaugeValue(t, nodeInfo, prometheus.Labels{
+		"service_name": s.Name, "dns_name": "app.example.ts.net", "ipv4": "100.64.0.1", "ipv6": "fd7a:115c:a1e0::1",
+	}))
+
+	// A logged out node without key expiry:
+	st.BackendState = "NeedsLogin"
+	st.Self.KeyExpiry = nil
+	st.TailscaleIPs = nil
+	s.Funnel = false
+	s.exportNodeStatus(st, now)
+	assert.EqualValues(t, 0, state("Running"))
+	assert.EqualValues(t, 1, state("NeedsLogin"))
+	assert.EqualValues(t, 0, gaugeValue(t, nodeFunnelEnabled, labels))
+	assert.Equal(t, 0, testCollect(t, nodeKeyExpiry, labels), "nodes without key expiry have no expiry metric")
+	assert.Equal(t, 1, testCollect(t, nodeInfo, labels), "only the current addresses are exported")
+}
+
+// testCollect counts the series of a vector that match labels.
+func testCollect(t *testing.T, vec *prometheus.GaugeVec, labels prometheus.Labels) int {
+	t.Helper()
+	ch := make(chan prometheus.Metric, 100)
+	vec.Collect(ch)
+	close(ch)
+	n := 0
+	for metric := range ch {
+		var m dto.Metric
+		require.NoError(t, metric.Write(&m))
+		matches := true
+		for _, lp := range m.GetLabel() {
+			if v, ok := labels[lp.GetName()]; ok && v != lp.GetValue() {
+				matches = false
+			}
+		}
+		if matches {
+			n++
+		}
+	}
+	return n
+}
+
+type fakeStatusClient struct {
+	statuses chan *ipnstate.Status
+}
+
+func (c *fakeStatusClient) Status(ctx context.Context) (*ipnstate.Status, error) {
+	select {
+	case st := <-c.statuses:
+		return st, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func TestMonitorNodeStatus(t *testing.T) {
+	t.Parallel()
+	s := &ValidTailnetSrv{TailnetSrv: TailnetSrv{Name: t.Name(), StatusMetricsInterval: time.Millisecond}}
+	client := &fakeStatusClient{statuses: make(chan *ipnstate.Status)}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.monitorNodeStatus(ctx, client)
+	}()
+	labels := prometheus.Labels{"service_name": s.Name}
+
+	client.statuses <- testNodeStatus(time.Now())
+	client.statuses <- testNodeStatus(time.Now()) // The first one was exported.
+	assert.Equal(t, 1, testCollect(t, nodeHealthWarnings, labels))
+
+	cancel()
+	<-done
+	assert.Equal(t, 0, testCollect(t, nodeHealthWarnings, labels), "metrics of stopped services are removed")
+}
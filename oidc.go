@@ -0,0 +1,640 @@
+package tsnsrv
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"golang.org/x/exp/slog"
+)
+
+var oidcLogins = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "tsnsrv_oidc_logins_total",
+	Help: "OpenID Connect logins by result (success, denied, error)",
+}, []string{"service_name", "result"})
+
+// Paths that the OIDC login handles itself, on every host of a service.
+const (
+	OIDCCallbackPath = "/.tsnsrv/oidc/callback"
+	OIDCLogoutPath   = "/.tsnsrv/oidc/logout"
+)
+
+// Headers that pass the logged-in user's claims to the upstream.
+const (
+	oidcHeaderPrefix  = "X-Oidc-"
+	oidcSubjectHeader = "X-OIDC-Subject"
+	oidcEmailHeader   = "X-OIDC-Email"
+	oidcNameHeader    = "X-OIDC-Name"
+	oidcGroupsHeader  = "X-OIDC-Groups"
+)
+
+// oidcStateLifetime is how long a user may take to log in.
+const oidcStateLifetime = 10 * time.Minute
+
+var (
+	errOIDCClientID   = errors.New("OIDC login requires a client ID")
+	errOIDCAndAuthURL = errors.New("OIDC login and forward auth (authURL) can't be combined")
+	errOIDCState      = errors.New("OIDC login state is missing or doesn't match")
+	errOIDCProvider   = errors.New("OIDC provider misbehaved")
+)
+
+// OIDC configures a service to log users in with an OpenID Connect
+// provider, using the authorization code flow.
+type OIDC struct {
+	// Issuer is the provider's issuer URL; its configuration is
+	// discovered from /.well-known/openid-configuration. OIDC login is
+	// disabled if empty.
+	Issuer string `yaml:"issuer,omitempty"`
+
+	// ClientID and ClientSecretFile are the credentials of this
+	// service with the provider. Without a secret, the service logs
+	// in as a public client (with PKCE).
+	ClientID         string `yaml:"clientID,omitempty"`
+	ClientSecretFile string `yaml:"clientSecretFile,omitempty"`
+
+	// RedirectURL is where the provider sends users back to (default
+	// OIDCCallbackPath on the requested host).
+	RedirectURL string `yaml:"redirectURL,omitempty"`
+
+	// Scopes to request (default "openid", "profile", "email"). "openid"
+	// is always requested.
+	Scopes []string `yaml:"scopes,omitempty"`
+
+	// CookieKeyFile contains the secret that session cookies are
+	// encrypted with. If empty, a random key is used, and users have to
+	// log in again whenever the service restarts.
+	CookieKeyFile string `yaml:"cookieKeyFile,omitempty"`
+
+	// CookieName is the name of the session cookie (default "_tsnsrv_oidc").
+	CookieName string `yaml:"cookieName,omitempty"`
+
+	// SessionLifetime is how long a login lasts (default 24h).
+	SessionLifetime time.Duration `yaml:"sessionLifetime,omitempty"`
+
+	// RequiredClaims must all be present in the ID token with the
+	// given values (or contain them, for list claims).
+	RequiredClaims map[string]string `yaml:"requiredClaims,omitempty"`
+
+	// AllowedGroups lets in only users who are in one of these groups.
+	AllowedGroups []string `yaml:"allowedGroups,omitempty"`
+
+	// GroupsClaim is the claim that lists a user's groups (default "groups").
+	GroupsClaim string `yaml:"groupsClaim,omitempty"`
+
+	// ClaimHeaders passes more claims to the upstream: it maps claim
+	// names to the header they're sent in.
+	ClaimHeaders map[string]string `yaml:"claimHeaders,omitempty"`
+}
+
+func (o OIDC) enabled() bool {
+	return o.Issuer != ""
+}
+
+func (o OIDC) validate() error {
+	if !o.enabled() {
+		return nil
+	}
+	var errs []error
+	if u, err := url.Parse(o.Issuer); err != nil || u.Scheme == "" || u.Host == "" {
+		errs = append(errs, fmt.Errorf("OIDC issuer must be an absolute URL, got %q", o.Issuer))
+	}
+	if o.ClientID == "" {
+		errs = append(errs, errOIDCClientID)
+	}
+	if o.RedirectURL != "" {
+		if u, err := url.Parse(o.RedirectURL); err != nil || u.Scheme == "" || u.Host == "" {
+			errs = append(errs, fmt.Errorf("OIDC redirect URL must be an absolute URL, got %q", o.RedirectURL))
+		}
+	}
+	if o.SessionLifetime < 0 {
+		errs = append(errs, fmt.Errorf("OIDC session lifetime can not be negative, got %v", o.SessionLifetime))
+	}
+	return errors.Join(errs...)
+}
+
+func (o OIDC) withDefaults() OIDC {
+	if len(o.Scopes) == 0 {
+		o.Scopes = []string{"openid", "profile", "email"}
+	} else if !slices.Contains(o.Scopes, "openid") {
+		o.Scopes = append([]string{"openid"}, o.Scopes...)
+	}
+	if o.CookieName == "" {
+		o.CookieName = "_tsnsrv_oidc"
+	}
+	if o.SessionLifetime == 0 {
+		o.SessionLifetime = 24 * time.Hour
+	}
+	if o.GroupsClaim == "" {
+		o.GroupsClaim = "groups"
+	}
+	return o
+}
+
+// callbackPath is the path that the provider redirects users back to.
+func (o OIDC) callbackPath() string {
+	if o.RedirectURL != "" {
+		if u, err := url.Parse(o.RedirectURL); err == nil {
+			return u.Path
+		}
+	}
+	return OIDCCallbackPath
+}
+
+// oidcProvider is the relying party state of a service.
+type oidcProvider struct {
+	config       OIDC
+	clientSecret string
+	sealer       cipher.AEAD
+	client       *http.Client
+
+	mu        sync.Mutex
+	discovery *oidcDiscovery
+	keys      *jwkSet
+}
+
+// oidcDiscovery is the part of the provider configuration that we use.
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// newOIDCProvider reads the secrets of an OIDC configuration. The
+// provider itself is only contacted once the first user logs in.
+func newOIDCProvider(config OIDC) (*oidcProvider, error) {
+	p := &oidcProvider{
+		config: config.withDefaults(),
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+	if config.ClientSecretFile != "" {
+		secret, err := readSecretKey(config.ClientSecretFile, "OIDC client secret", 1)
+		if err != nil {
+			return nil, err
+		}
+		p.clientSecret = string(secret)
+	}
+	var key [32]byte
+	if config.CookieKeyFile != "" {
+		secret, err := readSecretKey(config.CookieKeyFile, "OIDC cookie key", 32)
+		if err != nil {
+			return nil, err
+		}
+		key = sha256.Sum256(secret)
+	} else if _, err := rand.Read(key[:]); err != nil {
+		return nil, fmt.Errorf("generating OIDC cookie key: %w", err)
+	}
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	p.sealer, err = cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// discover fetches the provider configuration, once it's needed.
+func (p *oidcProvider) discover(ctx context.Context) (*oidcDiscovery, *jwkSet, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.discovery != nil {
+		return p.discovery, p.keys, nil
+	}
+	wellKnown := strings.TrimSuffix(p.config.Issuer, "/") + "/.well-known/openid-configuration"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, wellKnown, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, nil, fmt.Errorf("fetching OIDC configuration: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("%w: fetching %s: status %d", errOIDCProvider, wellKnown, resp.StatusCode)
+	}
+	var d oidcDiscovery
+	if err := json.NewDecoder(resp.Body).Decode(&d); err != nil {
+		return nil, nil, fmt.Errorf("%w: decoding configuration: %w", errOIDCProvider, err)
+	}
+	if d.Issuer != p.config.Issuer {
+		return nil, nil, fmt.Errorf("%w: configuration is for issuer %q", errOIDCProvider, d.Issuer)
+	}
+	if d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JWKSURI == "" {
+		return nil, nil, fmt.Errorf("%w: configuration lacks endpoints", errOIDCProvider)
+	}
+	p.discovery = &d
+	p.keys = newJWKSet(d.JWKSURI, p.client)
+	return p.discovery, p.keys, nil
+}
+
+// oidcSession is the content of the session cookie.
+type oidcSession struct {
+	Subject string            `json:"sub"`
+	Email   string            `json:"email,omitempty"`
+	Name    string            `json:"name,omitempty"`
+	Groups  []string          `json:"groups,omitempty"`
+	Claims  map[string]string `json:"claims,omitempty"`
+	Expires int64             `json:"exp"`
+}
+
+// oidcState is the content of the cookie that carries a login attempt.
+type oidcState struct {
+	State    string `json:"state"`
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"`
+	ReturnTo string `json:"return_to"`
+	Expires  int64  `json:"exp"`
+}
+
+func (p *oidcProvider) stateCookieName() string {
+	return p.config.CookieName + "_state"
+}
+
+// seal encrypts v for a cookie called name; the name is authenticated
+// too, so that cookies can't be swapped for each other.
+func (p *oidcProvider) seal(name string, v any) (string, error) {
+	plaintext, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, p.sealer.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(p.sealer.Seal(nonce, nonce, plaintext, []byte(name))), nil
+}
+
+func (p *oidcProvider) open(r *http.Request, name string, v any) bool {
+	cookie, err := r.Cookie(name)
+	if err != nil {
+		return false
+	}
+	data, err := base64.RawURLEncoding.DecodeString(cookie.Value)
+	if err != nil || len(data) < p.sealer.NonceSize() {
+		return false
+	}
+	nonce, ciphertext := data[:p.sealer.NonceSize()], data[p.sealer.NonceSize():]
+	plaintext, err := p.sealer.Open(nil, nonce, ciphertext, []byte(name))
+	if err != nil {
+		return false
+	}
+	return json.Unmarshal(plaintext, v) == nil
+}
+
+func (p *oidcProvider) setCookie(w http.ResponseWriter, r *http.Request, name, value string, expires time.Time) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/",
+		Expires:  expires,
+		MaxAge:   int(time.Until(expires).Seconds()),
+		Secure:   r.TLS != nil,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func (p *oidcProvider) clearCookie(w http.ResponseWriter, r *http.Request, name string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Path:     "/",
+		MaxAge:   -1,
+		Secure:   r.TLS != nil,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func (p *oidcProvider) redirectURL(r *http.Request) string {
+	if p.config.RedirectURL != "" {
+		return p.config.RedirectURL
+	}
+	scheme := "https"
+	if r.TLS == nil {
+		scheme = "http"
+	}
+	return (&url.URL{Scheme: scheme, Host: r.Host, Path: OIDCCallbackPath}).String()
+}
+
+func randomToken() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// login sends the user to the provider, to come back to the current URL.
+func (p *oidcProvider) login(w http.ResponseWriter, r *http.Request) error {
+	d, _, err := p.discover(r.Context())
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	st := oidcState{
+		State:    randomToken(),
+		Nonce:    randomToken(),
+		Verifier: randomToken(),
+		ReturnTo: r.URL.RequestURI(),
+		Expires:  now.Add(oidcStateLifetime).Unix(),
+	}
+	sealed, err := p.seal(p.stateCookieName(), st)
+	if err != nil {
+		return err
+	}
+	p.setCookie(w, r, p.stateCookieName(), sealed, now.Add(oidcStateLifetime))
+
+	challenge := sha256.Sum256([]byte(st.Verifier))
+	authURL, err := url.Parse(d.AuthorizationEndpoint)
+	if err != nil {
+		return fmt.Errorf("%w: invalid authorization endpoint: %w", errOIDCProvider, err)
+	}
+	q := authURL.Query()
+	q.Set("response_type", "code")
+	q.Set("client_id", p.config.ClientID)
+	q.Set("redirect_uri", p.redirectURL(r))
+	q.Set("scope", strings.Join(p.config.Scopes, " "))
+	q.Set("state", st.State)
+	q.Set("nonce", st.Nonce)
+	q.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	q.Set("code_challenge_method", "S256")
+	authURL.RawQuery = q.Encode()
+	http.Redirect(w, r, authURL.String(), http.StatusFound)
+	return nil
+}
+
+// oidcDenied is returned by callback if the user logged in, but isn't let in.
+type oidcDenied struct {
+	subject, reason string
+}
+
+func (e *oidcDenied) Error() string {
+	return fmt.Sprintf("user %q denied: %s", e.subject, e.reason)
+}
+
+// callback completes a login: it exchanges the code for an ID token,
+// checks it, and starts a session.
+func (p *oidcProvider) callback(w http.ResponseWriter, r *http.Request) error {
+	var st oidcState
+	if !p.open(r, p.stateCookieName(), &st) || time.Now().Unix() > st.Expires {
+		return errOIDCState
+	}
+	if subtle.ConstantTimeCompare([]byte(r.URL.Query().Get("state")), []byte(st.State)) != 1 {
+		return errOIDCState
+	}
+	p.clearCookie(w, r, p.stateCookieName())
+	if e := r.URL.Query().Get("error"); e != "" {
+		return fmt.Errorf("%w: login failed: %s %s", errOIDCProvider, e, r.URL.Query().Get("error_description"))
+	}
+
+	d, keys, err := p.discover(r.Context())
+	if err != nil {
+		return err
+	}
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {r.URL.Query().Get("code")},
+		"redirect_uri":  {p.redirectURL(r)},
+		"code_verifier": {st.Verifier},
+	}
+	if p.clientSecret == "" {
+		form.Set("client_id", p.config.ClientID)
+	}
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodPost, d.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.clientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.config.ClientID), url.QueryEscape(p.clientSecret))
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("exchanging OIDC code: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%w: token endpoint returned status %d: %s", errOIDCProvider, resp.StatusCode, body)
+	}
+	var tokens struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tokens); err != nil || tokens.IDToken == "" {
+		return fmt.Errorf("%w: token response lacks an ID token", errOIDCProvider)
+	}
+
+	claims, err := p.verifyIDToken(r.Context(), keys, tokens.IDToken, st.Nonce)
+	if err != nil {
+		return err
+	}
+	session, err := p.authorize(claims)
+	if err != nil {
+		return err
+	}
+	expires := time.Now().Add(p.config.SessionLifetime)
+	session.Expires = expires.Unix()
+	sealed, err := p.seal(p.config.CookieName, session)
+	if err != nil {
+		return err
+	}
+	p.setCookie(w, r, p.config.CookieName, sealed, expires)
+	http.Redirect(w, r, safeReturnTo(st.ReturnTo), http.StatusFound)
+	return nil
+}
+
+// safeReturnTo makes sure that a login only ever returns to the same host.
+func safeReturnTo(returnTo string) string {
+	if !strings.HasPrefix(returnTo, "/") || strings.HasPrefix(returnTo, "//") || strings.HasPrefix(returnTo, "/\\") {
+		return "/"
+	}
+	return returnTo
+}
+
+func (p *oidcProvider) verifyIDToken(ctx context.Context, keys *jwkSet, token, nonce string) (map[string]any, error) {
+	t, err := parseJWT(token)
+	if err != nil {
+		return nil, err
+	}
+	key, err := keys.key(ctx, t)
+	if err != nil {
+		return nil, err
+	}
+	if err := t.verify(key); err != nil {
+		return nil, err
+	}
+	if err := t.checkTimes(time.Now()); err != nil {
+		return nil, err
+	}
+	if claimString(t.claims, "iss") != p.config.Issuer {
+		return nil, fmt.Errorf("%w: ID token is from issuer %q", errOIDCProvider, claimString(t.claims, "iss"))
+	}
+	if !slices.Contains(claimStrings(t.claims, "aud"), p.config.ClientID) {
+		return nil, fmt.Errorf("%w: ID token is not for this client", errOIDCProvider)
+	}
+	if _, ok := t.claims["exp"].(float64); !ok {
+		return nil, fmt.Errorf("%w: ID token doesn't expire", errOIDCProvider)
+	}
+	if subtle.ConstantTimeCompare([]byte(claimString(t.claims, "nonce")), []byte(nonce)) != 1 {
+		return nil, fmt.Errorf("%w: ID token nonce doesn't match", errOIDCProvider)
+	}
+	return t.claims, nil
+}
+
+// authorize checks the claims of an ID token against the configured
+// requirements, and returns the session for them.
+func (p *oidcProvider) authorize(claims map[string]any) (*oidcSession, error) {
+	session := &oidcSession{
+		Subject: claimString(claims, "sub"),
+		Email:   claimString(claims, "email"),
+		Name:    claimString(claims, "name"),
+		Groups:  claimStrings(claims, p.config.GroupsClaim),
+	}
+	if session.Subject == "" {
+		return nil, fmt.Errorf("%w: ID token lacks a subject", errOIDCProvider)
+	}
+	for name, value := range p.config.RequiredClaims {
+		if !claimMatches(claims, name, value) {
+			return nil, &oidcDenied{session.Subject, fmt.Sprintf("claim %q is not %q", name, value)}
+		}
+	}
+	if len(p.config.AllowedGroups) > 0 &&
+		!slices.ContainsFunc(session.Groups, func(g string) bool { return slices.Contains(p.config.AllowedGroups, g) }) {
+		return nil, &oidcDenied{session.Subject, "not in an allowed group"}
+	}
+	for name := range p.config.ClaimHeaders {
+		value, ok := claimHeaderValue(claims, name)
+		if !ok {
+			continue
+		}
+		if session.Claims == nil {
+			session.Claims = make(map[string]string)
+		}
+		session.Claims[name] = value
+	}
+	return session, nil
+}
+
+// setHeaders passes the session's user to the upstream.
+func (p *oidcProvider) setHeaders(h http.Header, session *oidcSession) {
+	h.Set(oidcSubjectHeader, session.Subject)
+	if session.Email != "" {
+		h.Set(oidcEmailHeader, session.Email)
+	}
+	if session.Name != "" {
+		h.Set(oidcNameHeader, session.Name)
+	}
+	if len(session.Groups) > 0 {
+		h.Set(oidcGroupsHeader, strings.Join(session.Groups, ", "))
+	}
+	for claim, value := range session.Claims {
+		h.Set(p.config.ClaimHeaders[claim], value)
+	}
+}
+
+// stripHeaders removes headers that only the OIDC login may set.
+func (p *oidcProvider) stripHeaders(h http.Header) {
+	for name := range h {
+		if strings.HasPrefix(name, oidcHeaderPrefix) {
+			h.Del(name)
+		}
+	}
+	for _, header := range p.config.ClaimHeaders {
+		h.Del(header)
+	}
+}
+
+// oidcMiddleware lets only users through who logged in with the
+// service's OIDC provider, and sends everyone else to log in.
+func (s *ValidTailnetSrv) oidcMiddleware(next http.Handler) http.Handler {
+	p := s.oidc
+	if p == nil {
+		return next
+	}
+	callbackPath := p.config.callbackPath()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p.stripHeaders(r.Header)
+
+		switch r.URL.Path {
+		case callbackPath:
+			err := p.callback(w, r)
+			var denied *oidcDenied
+			switch {
+			case err == nil:
+				oidcLogins.With(prometheus.Labels{"service_name": s.Name, "result": "success"}).Inc()
+			case errors.As(err, &denied):
+				oidcLogins.With(prometheus.Labels{"service_name": s.Name, "result": "denied"}).Inc()
+				slog.Info("OIDC login denied", "service", s.Name, "remote_addr", r.RemoteAddr, "error", err)
+				http.Error(w, "Forbidden", http.StatusForbidden)
+			case errors.Is(err, errOIDCState):
+				oidcLogins.With(prometheus.Labels{"service_name": s.Name, "result": "error"}).Inc()
+				http.Error(w, "Login expired, please try again", http.StatusBadRequest)
+			default:
+				oidcLogins.With(prometheus.Labels{"service_name": s.Name, "result": "error"}).Inc()
+				slog.Warn("OIDC login failed", "service", s.Name, "remote_addr", r.RemoteAddr, "error", err)
+				http.Error(w, "Authentication provider unavailable", http.StatusBadGateway)
+			}
+			return
+		case OIDCLogoutPath:
+			p.clearCookie(w, r, p.config.CookieName)
+			http.Redirect(w, r, "/", http.StatusFound)
+			return
+		}
+
+		if login, ok := s.bypassesAuth(r); ok {
+			slog.Debug("OIDC login bypassed", "service", s.Name, "user", login, "url", r.URL)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		var session oidcSession
+		if p.open(r, p.config.CookieName, &session) && time.Now().Unix() < session.Expires {
+			p.setHeaders(r.Header, &session)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// Only send browsers navigating to a page to log in; API calls
+		// and form submissions can't come back from there.
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if err := p.login(w, r); err != nil {
+			slog.Warn("could not start OIDC login", "service", s.Name, "error", err)
+			http.Error(w, "Authentication provider unavailable", http.StatusBadGateway)
+		}
+	})
+}
+
+// setClaim adds a "name<sep>value" pair given on the commandline to m.
+func setClaim(m *map[string]string, pair string, sep string) error {
+	name, value, ok := strings.Cut(pair, sep)
+	name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+	if !ok || name == "" || value == "" {
+		return fmt.Errorf("%q must be of the form 'claim%svalue'", pair, sep)
+	}
+	if *m == nil {
+		*m = make(map[string]string)
+	}
+	(*m)[name] = value
+	return nil
+}
@@ -0,0 +1,270 @@
+package tsnsrv
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"tailscale.com/client/tailscale/apitype"
+)
+
+// mockOIDCProvider is a minimal OpenID Connect provider that issues ID
+// tokens for whatever claims the test sets.
+type mockOIDCProvider struct {
+	*httptest.Server
+	signer *IdentitySigner
+
+	mu        sync.Mutex
+	claims    map[string]any
+	nonce     string
+	challenge string
+}
+
+func newMockOIDCProvider(t *testing.T) *mockOIDCProvider {
+	t.Helper()
+	p := &mockOIDCProvider{signer: testSigners(t)["ecdsa"]}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]string{
+			"issuer":                 p.URL,
+			"authorization_endpoint": p.URL + "/authorize",
+			"token_endpoint":         p.URL + "/token",
+			"jwks_uri":               p.URL + "/jwks",
+		})
+	})
+	mux.Handle("GET /jwks", p.signer.JWKSHandler())
+	mux.HandleFunc("POST /token", func(w http.ResponseWriter, r *http.Request) {
+		user, pass, _ := r.BasicAuth()
+		verifier := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		if user != "tsnsrv" || pass != "s3cret" || r.PostFormValue("code") != "good-code" ||
+			base64.RawURLEncoding.EncodeToString(verifier[:]) != p.challenge {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+			return
+		}
+		claims := map[string]any{
+			"iss":   p.URL,
+			"aud":   "tsnsrv",
+			"exp":   time.Now().Add(time.Minute).Unix(),
+			"iat":   time.Now().Unix(),
+			"nonce": p.nonce,
+		}
+		for k, v := range p.claims {
+			claims[k] = v
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"id_token": signJWT(t, p.signer, claims), "token_type": "Bearer"})
+	})
+	p.Server = httptest.NewServer(mux)
+	t.Cleanup(p.Close)
+	return p
+}
+
+// oidcClient is a browser that logs in to a service.
+type oidcClient struct {
+	t       *testing.T
+	handler http.Handler
+	cookies map[string]*http.Cookie
+}
+
+func (c *oidcClient) get(target string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", target, nil)
+	req.RemoteAddr = "203.0.113.1:1234"
+	for _, cookie := range c.cookies {
+		req.AddCookie(cookie)
+	}
+	w := httptest.NewRecorder()
+	c.handler.ServeHTTP(w, req)
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.MaxAge < 0 {
+			delete(c.cookies, cookie.Name)
+		} else {
+			c.cookies[cookie.Name] = cookie
+		}
+	}
+	return w
+}
+
+// login follows the redirect to the provider, and comes back with code.
+func (c *oidcClient) login(provider *mockOIDCProvider, target, code string) *httptest.ResponseRecorder {
+	w := c.get(target)
+	require.Equal(c.t, http.StatusFound, w.Code)
+	authURL, err := url.Parse(w.Header().Get("Location"))
+	require.NoError(c.t, err)
+	require.Equal(c.t, provider.URL+"/authorize", authURL.Scheme+"://"+authURL.Host+authURL.Path)
+	q := authURL.Query()
+	assert.Equal(c.t, "tsnsrv", q.Get("client_id"))
+	assert.Equal(c.t, "S256", q.Get("code_challenge_method"))
+	provider.mu.Lock()
+	provider.nonce = q.Get("nonce")
+	provider.challenge = q.Get("code_challenge")
+	provider.mu.Unlock()
+
+	redirect, err := url.Parse(q.Get("redirect_uri"))
+	require.NoError(c.t, err)
+	return c.get(redirect.Path + "?" + url.Values{"code": {code}, "state": {q.Get("state")}}.Encode())
+}
+
+func newOIDCService(t *testing.T, provider *mockOIDCProvider, config OIDC) (*ValidTailnetSrv, *oidcClient, *http.Header) {
+	t.Helper()
+	dir := t.TempDir()
+	secretFile := filepath.Join(dir, "secret")
+	require.NoError(t, os.WriteFile(secretFile, []byte("s3cret\n"), 0o600))
+	config.Issuer = provider.URL
+	config.ClientID = "tsnsrv"
+	config.ClientSecretFile = secretFile
+	require.NoError(t, config.validate())
+
+	s := &ValidTailnetSrv{TailnetSrv: TailnetSrv{Name: "test", OIDC: config}}
+	var err error
+	s.oidc, err = newOIDCProvider(config)
+	require.NoError(t, err)
+	var got http.Header
+	handler := s.oidcMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+		w.Write([]byte("upstream"))
+	}))
+	return s, &oidcClient{t: t, handler: handler, cookies: make(map[string]*http.Cookie)}, &got
+}
+
+func TestOIDCLogin(t *testing.T) {
+	t.Parallel()
+	provider := newMockOIDCProvider(t)
+	provider.claims = map[string]any{
+		"sub":    "alice-id",
+		"email":  "alice@example.com",
+		"name":   "Alice",
+		"groups": []string{"admins", "ops"},
+		"tenant": "example",
+	}
+	_, client, got := newOIDCService(t, provider, OIDC{
+		RequiredClaims: map[string]string{"tenant": "example"},
+		AllowedGroups:  []string{"ops"},
+		ClaimHeaders:   map[string]string{"tenant": "X-Tenant"},
+	})
+
+	w := client.login(provider, "/app/page?x=1", "good-code")
+	require.Equal(t, http.StatusFound, w.Code, w.Body.String())
+	assert.Equal(t, "/app/page?x=1", w.Header().Get("Location"))
+	assert.Contains(t, client.cookies, "_tsnsrv_oidc")
+	assert.NotContains(t, client.cookies, "_tsnsrv_oidc_state")
+
+	req := httptest.NewRequest("GET", "/app/page", nil)
+	req.AddCookie(client.cookies["_tsnsrv_oidc"])
+	req.Header.Set("X-OIDC-Email", "mallory@example.com")
+	req.Header.Set("X-Tenant", "other")
+	w = httptest.NewRecorder()
+	client.handler.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "alice-id", got.Get("X-OIDC-Subject"))
+	assert.Equal(t, "alice@example.com", got.Get("X-OIDC-Email"))
+	assert.Equal(t, "Alice", got.Get("X-OIDC-Name"))
+	assert.Equal(t, "admins, ops", got.Get("X-OIDC-Groups"))
+	assert.Equal(t, "example", got.Get("X-Tenant"))
+
+	w = client.get(OIDCLogoutPath)
+	assert.Equal(t, http.StatusFound, w.Code)
+	assert.NotContains(t, client.cookies, "_tsnsrv_oidc")
+	assert.Equal(t, http.StatusFound, client.get("/app/page").Code, "logged out users have to log in again")
+}
+
+func TestOIDCDenied(t *testing.T) {
+	t.Parallel()
+	provider := newMockOIDCProvider(t)
+	provider.claims = map[string]any{"sub": "bob-id", "groups": []string{"dev"}}
+	_, client, _ := newOIDCService(t, provider, OIDC{AllowedGroups: []string{"ops"}})
+
+	w := client.login(provider, "/", "good-code")
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.NotContains(t, client.cookies, "_tsnsrv_oidc")
+}
+
+func TestOIDCFailures(t *testing.T) {
+	t.Parallel()
+	provider := newMockOIDCProvider(t)
+	provider.claims = map[string]any{"sub": "alice-id"}
+	_, client, _ := newOIDCService(t, provider, OIDC{})
+
+	t.Run("bad code", func(t *testing.T) {
+		w := client.login(provider, "/", "bad-code")
+		assert.Equal(t, http.StatusBadGateway, w.Code)
+	})
+	t.Run("forged state", func(t *testing.T) {
+		w := client.get("/")
+		require.Equal(t, http.StatusFound, w.Code)
+		w = client.get(OIDCCallbackPath + "?code=good-code&state=forged")
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+	t.Run("wrong nonce", func(t *testing.T) {
+		w := client.get("/")
+		require.Equal(t, http.StatusFound, w.Code)
+		authURL, err := url.Parse(w.Header().Get("Location"))
+		require.NoError(t, err)
+		provider.mu.Lock()
+		provider.nonce = "replayed"
+		provider.challenge = authURL.Query().Get("code_challenge")
+		provider.mu.Unlock()
+		w = client.get(OIDCCallbackPath + "?code=good-code&state=" + url.QueryEscape(authURL.Query().Get("state")))
+		assert.Equal(t, http.StatusBadGateway, w.Code)
+		assert.NotContains(t, client.cookies, "_tsnsrv_oidc")
+	})
+	t.Run("forged session", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.AddCookie(&http.Cookie{Name: "_tsnsrv_oidc", Value: base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"alice-id","exp":99999999999}`))})
+		w := httptest.NewRecorder()
+		client.handler.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusFound, w.Code)
+	})
+	t.Run("non-GET requests", func(t *testing.T) {
+		req := httptest.NewRequest("POST", "/", nil)
+		w := httptest.NewRecorder()
+		client.handler.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+	})
+}
+
+func TestOIDCReturnTo(t *testing.T) {
+	t.Parallel()
+	for returnTo, want := range map[string]string{
+		"/app?x=1":                  "/app?x=1",
+		"//evil.example.com":        "/",
+		"/\\evil.example.com":       "/",
+		"https://evil.example.com/": "/",
+	} {
+		assert.Equal(t, want, safeReturnTo(returnTo), returnTo)
+	}
+}
+
+func TestOIDCBypassForTailnet(t *testing.T) {
+	t.Parallel()
+	provider := newMockOIDCProvider(t)
+	s, client, got := newOIDCService(t, provider, OIDC{})
+	s.AuthBypassForTailnet = true
+	s.client = &mockLocalClient{whoIsFunc: func(ctx context.Context, addr string) (*apitype.WhoIsResponse, error) {
+		if addr == "100.100.100.1:1234" {
+			return identity("alice@example.com", "laptop", nil), nil
+		}
+		return nil, assert.AnError
+	}}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "100.100.100.1:1234"
+	req.Header.Set("X-OIDC-Subject", "spoofed")
+	w := httptest.NewRecorder()
+	client.handler.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Empty(t, got.Get("X-OIDC-Subject"))
+
+	// Funnel users still have to log in:
+	assert.Equal(t, http.StatusFound, client.get("/").Code)
+}
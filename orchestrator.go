@@ -4,6 +4,8 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"net/netip"
+	"reflect"
 	"sync"
 
 	"golang.org/x/exp/slog"
@@ -25,9 +27,88 @@ func (e *ServiceError) Unwrap() error {
 
 // Orchestrator manages multiple tsnsrv services running concurrently
 type Orchestrator struct {
+	// Restart controls how failing services are dealt with.
+	Restart RestartPolicy
+
+	// Identity signs the identity tokens that services send to their
+	// upstreams; nil if they don't send any.
+	Identity *IdentitySigner
+
+	// AccessLog logs the requests of services that don't have an
+	// access log of their own; nil if they don't log requests.
+	AccessLog *AccessLogger
+
+	// Tracer records traces of the requests of all services; nil if
+	// tracing is disabled.
+	Tracer *Tracer
+
+	// run runs a single service; tests replace it.
+	run func(context.Context, *ValidTailnetSrv) error
+
+	// reloadMu serializes calls to Reload.
+	reloadMu sync.Mutex
+
+	mu       sync.Mutex
 	services []*ValidTailnetSrv
+	handles  map[string]*serviceHandle
+	live     int
+	exits    chan serviceExit
+	ctx      context.Context
+
+	// held is the set of services stopped through StopService. Run
+	// keeps waiting for them to be started again until its context is
+	// canceled.
+	held map[string]bool
+}
+
+// ServiceState describes where a service is in its lifecycle.
+type ServiceState string
+
+const (
+	StateStarting   ServiceState = "starting"
+	StateUp         ServiceState = "up"
+	StateDraining   ServiceState = "draining"
+	StateRestarting ServiceState = "restarting"
+	StateFailed     ServiceState = "failed"
+	StateStopped    ServiceState = "stopped"
+)
+
+var (
+	errUnknownService    = errors.New("no such service")
+	errServiceRunning    = errors.New("service is already running")
+	errServiceNotRunning = errors.New("service is not running")
+)
+
+// serviceHandle tracks the most recent instance of a service. It is
+// kept around after the instance exited, to remember how it ended.
+type serviceHandle struct {
+	srv    *ValidTailnetSrv
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	// Protected by Orchestrator.mu:
+	state    ServiceState
+	lastErr  error
+	restarts int
 }
 
+// running returns whether the instance hasn't exited yet.
+func (h *serviceHandle) running() bool {
+	select {
+	case <-h.done:
+		return false
+	default:
+		return true
+	}
+}
+
+type serviceExit struct {
+	handle *serviceHandle
+	err    error
+}
+
+var errNotRunning = errors.New("orchestrator is not running")
+
 // NewOrchestrator creates an orchestrator for the given services
 func NewOrchestrator(services []*ValidTailnetSrv) *Orchestrator {
 	return &Orchestrator{
@@ -35,59 +116,93 @@ func NewOrchestrator(services []*ValidTailnetSrv) *Orchestrator {
 	}
 }
 
-// Run starts all services concurrently and waits for all to complete or for the first error.
-// If any service fails, the context is canceled to signal other services to stop.
-// Returns the first error encountered, or nil if all services complete successfully.
+// Run starts all services concurrently and waits until all of them have stopped.
+//
+// Under the default RestartSupervise policy, a failing service is
+// restarted on its own and the others keep running; once a service has
+// used up its restart budget it is marked as failed permanently. Under
+// RestartFailFast, the first failing service causes the context to be
+// canceled, stopping all other services.
+//
+// Returns the errors of all services that failed for good, or nil if
+// all of them were stopped normally.
 func (o *Orchestrator) Run(ctx context.Context) error {
 	if len(o.services) == 0 {
 		return errors.New("no services to run")
 	}
-
-	// Single service optimization - run directly
-	if len(o.services) == 1 {
-		return o.services[0].Run(ctx)
+	if err := o.Restart.validate(); err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
 	}
 
-	// Multi-service mode
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
-	var wg sync.WaitGroup
-	errChan := make(chan *ServiceError, len(o.services))
-
-	// Start all services concurrently
+	o.mu.Lock()
+	o.ctx = ctx
+	o.handles = make(map[string]*serviceHandle, len(o.services))
+	o.held = make(map[string]bool)
+	o.exits = make(chan serviceExit)
 	for _, svc := range o.services {
-		wg.Add(1)
-		go func(s *ValidTailnetSrv) {
-			defer wg.Done()
-			slog.Info("Starting service", "name", s.Name)
-			if err := s.Run(ctx); err != nil {
-				// Check if this is a context cancellation (expected during shutdown)
-				if errors.Is(err, context.Canceled) {
-					slog.Info("Service stopped", "name", s.Name)
-					return
-				}
-				slog.Error("Service failed", "name", s.Name, "error", err)
-				errChan <- &ServiceError{
-					ServiceName: s.Name,
-					Err:         err,
-				}
-				// Cancel context to stop other services
-				cancel()
-			}
-		}(svc)
-	}
-
-	// Wait for first error or all services to complete
-	go func() {
-		wg.Wait()
-		close(errChan)
-	}()
+		o.startLocked(svc)
+	}
+	o.mu.Unlock()
 
-	// Collect all errors
+	// Collect exits until no service instance is left running. Services
+	// added by Reload in the meantime are accounted for in o.live.
 	var errs []error
-	for err := range errChan {
-		errs = append(errs, err)
+	canceled := ctx.Done()
+	for {
+		o.mu.Lock()
+		if o.live == 0 && (len(o.held) == 0 || ctx.Err() != nil) {
+			o.ctx = nil
+			o.mu.Unlock()
+			break
+		}
+		o.mu.Unlock()
+
+		var exit serviceExit
+		select {
+		case exit = <-o.exits:
+		case <-canceled:
+			canceled = nil
+			continue
+		}
+		o.mu.Lock()
+		o.live--
+		if exit.handle == nil {
+			// A Reload finished and released its hold on Run.
+			o.mu.Unlock()
+			continue
+		}
+		s := exit.handle.srv
+		stopped := exit.err == nil || errors.Is(exit.err, context.Canceled)
+		if stopped {
+			exit.handle.state = StateStopped
+		} else {
+			exit.handle.state = StateFailed
+			exit.handle.lastErr = exit.err
+		}
+		o.mu.Unlock()
+		close(exit.handle.done)
+
+		if stopped {
+			slog.Info("Service stopped", "name", s.Name)
+			continue
+		}
+		errs = append(errs, &ServiceError{
+			ServiceName: s.Name,
+			Err:         exit.err,
+		})
+		if o.Restart.Policy == RestartFailFast {
+			slog.Error("Service failed", "name", s.Name, "error", exit.err)
+			// Cancel context to stop other services
+			cancel()
+		} else {
+			slog.Error("Service failed permanently", "name", s.Name, "error", exit.err)
+		}
 	}
 
 	if len(errs) > 0 {
@@ -97,6 +212,341 @@ func (o *Orchestrator) Run(ctx context.Context) error {
 	return nil
 }
 
+// startLocked launches a service instance. o.mu must be held.
+func (o *Orchestrator) startLocked(s *ValidTailnetSrv) {
+	ctx, cancel := context.WithCancel(o.ctx)
+	s.identity = o.Identity
+	s.processAccessLog = o.AccessLog
+	s.tracer = o.Tracer
+	h := &serviceHandle{
+		srv:    s,
+		cancel: cancel,
+		done:   make(chan struct{}),
+		state:  StateStarting,
+	}
+	o.handles[s.Name] = h
+	o.live++
+	go func() {
+		err := o.supervise(ctx, h)
+		cancel()
+		o.exits <- serviceExit{handle: h, err: err}
+	}()
+}
+
+func (o *Orchestrator) runService(ctx context.Context, s *ValidTailnetSrv) error {
+	if o.run != nil {
+		return o.run(ctx, s)
+	}
+	return s.Run(ctx)
+}
+
+func (o *Orchestrator) setState(h *serviceHandle, state ServiceState, err error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	h.state = state
+	if err != nil {
+		h.lastErr = err
+	}
+}
+
+func (o *Orchestrator) recordRestart(h *serviceHandle, err error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	h.state = StateRestarting
+	h.lastErr = err
+	h.restarts++
+}
+
+// ServiceState returns the current state of the named service.
+func (o *Orchestrator) ServiceState(name string) (ServiceState, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	h, ok := o.handles[name]
+	if !ok {
+		return "", false
+	}
+	return h.stateLocked(), true
+}
+
+// stateLocked returns the instance's state, taking into account whether
+// the service has finished coming up. Orchestrator.mu must be held.
+func (h *serviceHandle) stateLocked() ServiceState {
+	if h.state == StateStarting {
+		switch {
+		case h.srv.status.isDraining():
+			return StateDraining
+		case h.srv.status.isUp():
+			return StateUp
+		}
+	}
+	return h.state
+}
+
+// ServiceStatus is a snapshot of a service's state, as reported by Orchestrator.Status.
+type ServiceStatus struct {
+	Name         string           `json:"name"`
+	State        ServiceState     `json:"state"`
+	TailscaleIPs []netip.Addr     `json:"tailscaleIPs,omitempty"`
+	ListenAddr   string           `json:"listenAddr"`
+	Listeners    []string         `json:"listeners,omitempty"`
+	Funnel       bool             `json:"funnel"`
+	FunnelOnly   bool             `json:"funnelOnly"`
+	Restarts     int              `json:"restarts"`
+	LastError    string           `json:"lastError,omitempty"`
+	Upstreams    []UpstreamStatus `json:"upstreams,omitempty"`
+}
+
+// Status returns the status of all configured services, in configuration order.
+func (o *Orchestrator) Status() []ServiceStatus {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	statuses := make([]ServiceStatus, 0, len(o.services))
+	for _, s := range o.services {
+		statuses = append(statuses, o.statusLocked(s))
+	}
+	return statuses
+}
+
+// ServiceStatus returns the status of the named service.
+func (o *Orchestrator) ServiceStatus(name string) (ServiceStatus, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	s := o.serviceLocked(name)
+	if s == nil {
+		return ServiceStatus{}, fmt.Errorf("%w: %q", errUnknownService, name)
+	}
+	return o.statusLocked(s), nil
+}
+
+func (o *Orchestrator) statusLocked(s *ValidTailnetSrv) ServiceStatus {
+	status := ServiceStatus{
+		Name:       s.Name,
+		State:      StateStopped,
+		ListenAddr: s.ListenAddr,
+		Funnel:     s.Funnel,
+		FunnelOnly: s.FunnelOnly,
+	}
+	if h, ok := o.handles[s.Name]; ok && h.srv == s {
+		status.State = h.stateLocked()
+		status.Restarts = h.restarts
+		if h.lastErr != nil {
+			status.LastError = h.lastErr.Error()
+		}
+		if status.State == StateUp || status.State == StateDraining {
+			status.TailscaleIPs = s.status.addrs()
+			status.Listeners = s.status.listening()
+			status.Upstreams = s.status.upstreamStatus()
+		}
+	}
+	return status
+}
+
+func (o *Orchestrator) serviceLocked(name string) *ValidTailnetSrv {
+	for _, s := range o.services {
+		if s.Name == name {
+			return s
+		}
+	}
+	return nil
+}
+
+// StopService stops the named service. It stays stopped until it is
+// started again with StartService or RestartService.
+func (o *Orchestrator) StopService(name string) error {
+	o.reloadMu.Lock()
+	defer o.reloadMu.Unlock()
+
+	o.mu.Lock()
+	if o.serviceLocked(name) == nil {
+		o.mu.Unlock()
+		return fmt.Errorf("%w: %q", errUnknownService, name)
+	}
+	h, ok := o.handles[name]
+	if !ok || !h.running() {
+		o.mu.Unlock()
+		return fmt.Errorf("%w: %q", errServiceNotRunning, name)
+	}
+	o.held[name] = true
+	o.mu.Unlock()
+
+	slog.Info("Stopping service on request", "name", name)
+	o.stop(h)
+	return nil
+}
+
+// StartService starts the named service if it isn't running; this
+// includes services that failed permanently.
+func (o *Orchestrator) StartService(name string) error {
+	o.reloadMu.Lock()
+	defer o.reloadMu.Unlock()
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.startServiceLocked(name)
+}
+
+func (o *Orchestrator) startServiceLocked(name string) error {
+	s := o.serviceLocked(name)
+	if s == nil {
+		return fmt.Errorf("%w: %q", errUnknownService, name)
+	}
+	if o.ctx == nil || o.ctx.Err() != nil {
+		return errNotRunning
+	}
+	if h, ok := o.handles[name]; ok && h.running() {
+		return fmt.Errorf("%w: %q", errServiceRunning, name)
+	}
+	slog.Info("Starting service on request", "name", name)
+	delete(o.held, name)
+	o.startLocked(s)
+	return nil
+}
+
+// RestartService stops the named service (if it is running) and starts it again.
+func (o *Orchestrator) RestartService(name string) error {
+	o.reloadMu.Lock()
+	defer o.reloadMu.Unlock()
+
+	o.mu.Lock()
+	if o.serviceLocked(name) == nil {
+		o.mu.Unlock()
+		return fmt.Errorf("%w: %q", errUnknownService, name)
+	}
+	if o.ctx == nil || o.ctx.Err() != nil {
+		o.mu.Unlock()
+		return errNotRunning
+	}
+	h, ok := o.handles[name]
+	// Keep Run from returning while the service is down.
+	o.held[name] = true
+	o.mu.Unlock()
+
+	if ok {
+		o.stop(h)
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	delete(o.held, name)
+	return o.startServiceLocked(name)
+}
+
+// stop cancels a running service instance and waits until it has exited.
+func (o *Orchestrator) stop(h *serviceHandle) {
+	h.cancel()
+	<-h.done
+}
+
+// Reload replaces the set of services managed by the orchestrator.
+//
+// Services are matched up by name: new services are started, services
+// that are no longer present are stopped, and services whose
+// configuration changed are restarted. Services whose configuration is
+// unchanged keep running undisturbed.
+//
+// If the orchestrator isn't running, Reload returns errNotRunning and
+// keeps the current services.
+func (o *Orchestrator) Reload(services []*ValidTailnetSrv) error {
+	if len(services) == 0 {
+		return errNoServices
+	}
+	o.reloadMu.Lock()
+	defer o.reloadMu.Unlock()
+
+	o.mu.Lock()
+	if o.ctx == nil || o.ctx.Err() != nil {
+		o.mu.Unlock()
+		return errNotRunning
+	}
+	plan := planReload(o.services, services)
+	o.services = plan.services
+	// Keep Run from returning while services are swapped out, even if
+	// every running instance gets stopped along the way.
+	o.live++
+	defer func() { o.exits <- serviceExit{} }()
+	var stopping []*serviceHandle
+	for _, name := range append(plan.removed, plan.changed...) {
+		if h, ok := o.handles[name]; ok {
+			stopping = append(stopping, h)
+		}
+	}
+	o.mu.Unlock()
+
+	slog.Info("Reloading services",
+		"added", plan.added,
+		"removed", plan.removed,
+		"changed", plan.changed,
+	)
+
+	// Stop old instances first: a restarted service reuses its
+	// hostname and state directory, which can't be shared.
+	for _, h := range stopping {
+		o.stop(h)
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for _, h := range stopping {
+		if o.handles[h.srv.Name] == h {
+			delete(o.handles, h.srv.Name)
+		}
+	}
+	for _, name := range plan.removed {
+		delete(o.held, name)
+	}
+	if o.ctx.Err() != nil {
+		// Shutting down; the new services took the place of the
+		// old ones, but there's no point in starting them.
+		return nil
+	}
+	for _, s := range plan.services {
+		if _, ok := o.handles[s.Name]; !ok {
+			o.startLocked(s)
+		}
+	}
+	return nil
+}
+
+// reloadPlan describes how to get from one set of services to another.
+type reloadPlan struct {
+	// services is the new set, reusing the old instance for unchanged services.
+	services []*ValidTailnetSrv
+
+	added, removed, changed []string
+}
+
+func planReload(current, next []*ValidTailnetSrv) reloadPlan {
+	var plan reloadPlan
+	byName := make(map[string]*ValidTailnetSrv, len(current))
+	for _, s := range current {
+		byName[s.Name] = s
+	}
+	for _, s := range next {
+		old, ok := byName[s.Name]
+		switch {
+		case !ok:
+			plan.added = append(plan.added, s.Name)
+		case old.sameConfig(s):
+			s = old
+		default:
+			plan.changed = append(plan.changed, s.Name)
+		}
+		delete(byName, s.Name)
+		plan.services = append(plan.services, s)
+	}
+	for _, s := range current {
+		if _, ok := byName[s.Name]; ok {
+			plan.removed = append(plan.removed, s.Name)
+		}
+	}
+	return plan
+}
+
+// sameConfig returns whether two services were constructed from identical configuration.
+func (s *ValidTailnetSrv) sameConfig(other *ValidTailnetSrv) bool {
+	return reflect.DeepEqual(s.TailnetSrv, other.TailnetSrv) && reflect.DeepEqual(s.DestURL, other.DestURL)
+}
+
 // RunSingle is a convenience function for running a single service
 func RunSingle(ctx context.Context, service *ValidTailnetSrv) error {
 	return service.Run(ctx)
@@ -3,6 +3,8 @@ package tsnsrv
 import (
 	"context"
 	"errors"
+	"maps"
+	"sync"
 	"testing"
 	"time"
 
@@ -100,3 +102,115 @@ func TestConvenienceFunctions(t *testing.T) {
 	err = RunMultiple(ctx, []*ValidTailnetSrv{service})
 	require.Error(t, err) // Expected - no real server
 }
+
+func TestPlanReload(t *testing.T) {
+	mustService := func(name, upstream string, funnel bool) *ValidTailnetSrv {
+		svcs, err := ServicesFromConfig([]ServiceConfig{{Name: name, Upstream: upstream, Funnel: funnel}})
+		require.NoError(t, err)
+		return svcs[0]
+	}
+	unchanged := mustService("unchanged", "http://localhost:8080", false)
+	changed := mustService("changed", "http://localhost:8081", false)
+	removed := mustService("removed", "http://localhost:8082", false)
+
+	next := []*ValidTailnetSrv{
+		mustService("unchanged", "http://localhost:8080", false),
+		mustService("changed", "http://localhost:8081", true),
+		mustService("added", "http://localhost:8083", false),
+	}
+	plan := planReload([]*ValidTailnetSrv{unchanged, changed, removed}, next)
+
+	assert.Equal(t, []string{"added"}, plan.added)
+	assert.Equal(t, []string{"removed"}, plan.removed)
+	assert.Equal(t, []string{"changed"}, plan.changed)
+
+	require.Len(t, plan.services, 3)
+	assert.Same(t, unchanged, plan.services[0], "unchanged services keep their running instance")
+	assert.Same(t, next[1], plan.services[1])
+	assert.Same(t, next[2], plan.services[2])
+}
+
+func TestOrchestrator_ReloadWhenNotRunning(t *testing.T) {
+	o := NewOrchestrator([]*ValidTailnetSrv{
+		{TailnetSrv: TailnetSrv{Name: "service1"}},
+	})
+
+	err := o.Reload([]*ValidTailnetSrv{
+		{TailnetSrv: TailnetSrv{Name: "service2"}},
+	})
+	require.ErrorIs(t, err, errNotRunning)
+	require.Len(t, o.services, 1)
+	assert.Equal(t, "service1", o.services[0].Name, "rejected reloads change nothing")
+
+	require.ErrorIs(t, o.Reload(nil), errNoServices)
+}
+
+func TestOrchestrator_Reload(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var mu sync.Mutex
+	starts := make(map[string]int)
+	running := make(map[string]int)
+	o := NewOrchestrator([]*ValidTailnetSrv{
+		{TailnetSrv: TailnetSrv{Name: "unchanged"}},
+		{TailnetSrv: TailnetSrv{Name: "changed"}},
+		{TailnetSrv: TailnetSrv{Name: "removed"}},
+	})
+	o.run = func(ctx context.Context, s *ValidTailnetSrv) error {
+		mu.Lock()
+		starts[s.Name]++
+		running[s.Name]++
+		mu.Unlock()
+		<-ctx.Done()
+		mu.Lock()
+		running[s.Name]--
+		mu.Unlock()
+		return ctx.Err()
+	}
+	counts := func() (map[string]int, map[string]int) {
+		mu.Lock()
+		defer mu.Unlock()
+		return maps.Clone(starts), maps.Clone(running)
+	}
+	result := make(chan error)
+	go func() { result <- o.Run(ctx) }()
+	require.Eventually(t, func() bool {
+		_, r := counts()
+		return len(r) == 3
+	}, 5*time.Second, time.Millisecond)
+
+	require.NoError(t, o.Reload([]*ValidTailnetSrv{
+		{TailnetSrv: TailnetSrv{Name: "unchanged"}},
+		{TailnetSrv: TailnetSrv{Name: "changed", ListenAddr: ":8443"}},
+		{TailnetSrv: TailnetSrv{Name: "added"}},
+	}))
+	require.Eventually(t, func() bool {
+		_, r := counts()
+		return r["added"] == 1 && r["changed"] == 1
+	}, 5*time.Second, time.Millisecond)
+	s, r := counts()
+	assert.Equal(t, map[string]int{"unchanged": 1, "changed": 2, "removed": 1, "added": 1}, s)
+	assert.Equal(t, map[string]int{"unchanged": 1, "changed": 1, "removed": 0, "added": 1}, r)
+
+	names := func() []string {
+		var names []string
+		for _, status := range o.Status() {
+			names = append(names, status.Name)
+		}
+		return names
+	}
+	assert.Equal(t, []string{"unchanged", "changed", "added"}, names())
+	o.mu.Lock()
+	assert.Equal(t, 3, o.live, "only running instances keep Run going")
+	assert.Len(t, o.handles, 3)
+	o.mu.Unlock()
+
+	cancel()
+	require.NoError(t, <-result)
+	_, r = counts()
+	assert.Equal(t, map[string]int{"unchanged": 0, "changed": 0, "removed": 0, "added": 0}, r)
+	o.mu.Lock()
+	assert.Equal(t, 0, o.live)
+	o.mu.Unlock()
+}
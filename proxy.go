@@ -3,6 +3,7 @@ package tsnsrv
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"net"
@@ -28,7 +29,9 @@ type contextKey struct{}
 var proxyContextKey = contextKey{}
 
 var (
-	requestDurations = promauto.NewSummaryVec(prometheus.SummaryOpts{
+	// requestDurations and authDurations are only registered with
+	// Metrics.LegacySummaries; the histograms replace them.
+	requestDurations = prometheus.NewSummaryVec(prometheus.SummaryOpts{
 		Name:       "tsnsrv_request_duration_ns",
 		Help:       "Duration of requests served",
 		Objectives: map[float64]float64{0.5: 0.05, 0.9: 0.01, 0.99: 0.001},
@@ -45,7 +48,7 @@ var (
 		Name: "tsnsrv_auth_requests_total",
 		Help: "Total number of authorization requests",
 	}, []string{"service_name", "status"})
-	authDurations = promauto.NewSummaryVec(prometheus.SummaryOpts{
+	authDurations = prometheus.NewSummaryVec(prometheus.SummaryOpts{
 		Name:       "tsnsrv_auth_duration_ns",
 		Help:       "Duration of authorization requests",
 		Objectives: map[float64]float64{0.5: 0.05, 0.9: 0.01, 0.99: 0.001},
@@ -58,11 +61,14 @@ type proxyContext struct {
 	originalURL  *url.URL
 	rewrittenURL *url.URL
 	serviceName  string
+	retries      int
 }
 
 func (c *proxyContext) observeResponse(res *http.Response) {
 	elapsed := time.Since(c.start)
-	requestDurations.With(prometheus.Labels{"service_name": c.serviceName}).Observe(float64(elapsed))
+	if legacySummaries.Load() {
+		requestDurations.With(prometheus.Labels{"service_name": c.serviceName}).Observe(float64(elapsed))
+	}
 
 	statusClass := fmt.Sprintf("%dxx", res.StatusCode/100)
 	responseStatusClasses.With(prometheus.Labels{
@@ -85,6 +91,7 @@ func (c *proxyContext) observeResponse(res *http.Response) {
 		"origin_node", node,
 		"duration", elapsed,
 		"http_status", res.StatusCode,
+		"retries", c.retries,
 	)
 }
 
@@ -97,18 +104,33 @@ func (s *ValidTailnetSrv) modifyResponse(res *http.Response) error {
 }
 
 func (s *ValidTailnetSrv) errorHandler(rw http.ResponseWriter, _ *http.Request, err error) {
+	if errors.Is(err, errCircuitOpen) && s.upstreamBreaker != nil {
+		proxyErrors.With(prometheus.Labels{"service_name": s.Name}).Inc()
+		s.upstreamBreaker.serveOpen(rw)
+		return
+	}
 	slog.Warn("proxy error",
 		"service", s.Name,
 		"error", err,
 	)
 	proxyErrors.With(prometheus.Labels{"service_name": s.Name}).Inc()
+	if errors.Is(err, errNoHealthyUpstream) {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
 	rw.WriteHeader(http.StatusBadGateway)
 }
 
 func (s *ValidTailnetSrv) rewrite(r *httputil.ProxyRequest) {
-	r.SetURL(s.DestURL)
+	s.rewriteTo(r, s.DestURL, nil)
+}
+
+// rewriteTo points a proxied request at dest, adding the service's
+// upstream headers followed by extraHeaders.
+func (s *ValidTailnetSrv) rewriteTo(r *httputil.ProxyRequest, dest *url.URL, extraHeaders headers) {
+	r.SetURL(dest)
 	if r.In.URL.Path == "" {
-		r.Out.URL.Path = s.DestURL.Path
+		r.Out.URL.Path = dest.Path
 	}
 
 	r.SetXForwarded()
@@ -135,15 +157,22 @@ func (s *ValidTailnetSrv) rewrite(r *httputil.ProxyRequest) {
 	for h, vals := range s.UpstreamHeaders {
 		r.Out.Header[h] = vals
 	}
+	for h, vals := range extraHeaders {
+		r.Out.Header[h] = vals
+	}
 
 	who := s.setWhoisHeaders(r)
-	r.Out = r.Out.WithContext(context.WithValue(r.Out.Context(), proxyContextKey, &proxyContext{
+	setCapabilityHeader(r.Out, r.In)
+	s.setIdentityToken(r.Out, who)
+	p := &proxyContext{
 		start:        time.Now(),
 		originalURL:  r.In.URL,
 		rewrittenURL: r.Out.URL,
 		who:          who,
 		serviceName:  s.Name,
-	}))
+	}
+	recordProxyContext(r.In, p)
+	r.Out = r.Out.WithContext(context.WithValue(r.Out.Context(), proxyContextKey, p))
 }
 
 // Clean up and set user/node identity headers:.
@@ -158,13 +187,7 @@ func (s *ValidTailnetSrv) setWhoisHeaders(r *httputil.ProxyRequest) *apitype.Who
 		return nil
 	}
 
-	ctx := r.In.Context()
-	if s.WhoisTimeout > 0 {
-		var cancel func()
-		ctx, cancel = context.WithTimeout(ctx, s.WhoisTimeout)
-		defer cancel()
-	}
-	who, err := s.client.WhoIs(ctx, r.In.RemoteAddr)
+	who, err := s.whoisFor(r.In)
 	if err != nil {
 		slog.Warn("could not look up requestor identity",
 			"error", err,
@@ -208,6 +231,19 @@ func (s *ValidTailnetSrv) setWhoisHeaders(r *httputil.ProxyRequest) *apitype.Who
 	return who
 }
 
+// bypassesAuth returns whether r comes from an authenticated Tailscale
+// user who may skip authentication, and their login name.
+func (s *ValidTailnetSrv) bypassesAuth(r *http.Request) (string, bool) {
+	if !s.AuthBypassForTailnet || s.SuppressWhois || s.client == nil {
+		return "", false
+	}
+	who, err := s.whoisFor(r)
+	if err != nil || who.UserProfile.ID == 0 || who.UserProfile.LoginName == "tagged-devices" {
+		return "", false
+	}
+	return who.UserProfile.LoginName, true
+}
+
 // authMiddleware handles forward authentication by making a request to the auth service
 func (s *ValidTailnetSrv) authMiddleware(next http.Handler) http.Handler {
 	if s.AuthURL == "" {
@@ -233,27 +269,29 @@ func (s *ValidTailnetSrv) authMiddleware(next http.Handler) http.Handler {
 		Transport: transport,
 		Timeout:   s.AuthTimeout,
 	}
+	cache := s.AuthCache.withDefaults()
 
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Check if we should bypass auth for Tailscale users
-		if s.AuthBypassForTailnet && !s.SuppressWhois && s.client != nil {
-			ctx := r.Context()
-			if s.WhoisTimeout > 0 {
-				var cancel func()
-				ctx, cancel = context.WithTimeout(ctx, s.WhoisTimeout)
-				defer cancel()
-			}
-			who, err := s.client.WhoIs(ctx, r.RemoteAddr)
-			if err == nil && who.UserProfile.ID != 0 && who.UserProfile.LoginName != "tagged-devices" {
-				// Request is from authenticated Tailscale user, bypass auth
-				slog.Info("auth bypassed",
-					"service", s.Name,
-					"user", who.UserProfile.LoginName,
-					"remote_addr", r.RemoteAddr,
-					"url", r.URL,
-					"reason", "tailscale_user",
-				)
-				next.ServeHTTP(w, r)
+		if login, ok := s.bypassesAuth(r); ok {
+			slog.Info("auth bypassed",
+				"service", s.Name,
+				"user", login,
+				"remote_addr", r.RemoteAddr,
+				"url", r.URL,
+				"reason", "tailscale_user",
+			)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		cacheKey, cacheable := "", false
+		if cache.enabled() {
+			cacheKey, cacheable = cache.key(r)
+		}
+		if cacheable {
+			if decision, ok := s.authCache.get(s.Name, cacheKey, time.Now()); ok {
+				s.replayAuthDecision(w, r, next, decision)
 				return
 			}
 		}
@@ -292,10 +330,42 @@ func (s *ValidTailnetSrv) authMiddleware(next http.Handler) http.Handler {
 		}
 
 		// Make auth request
+		var breakerDone func(breakerResult)
+		if s.authBreaker != nil {
+			var allowed bool
+			breakerDone, allowed = s.authBreaker.allow(start)
+			if !allowed {
+				authRequests.With(prometheus.Labels{
+					"service_name": s.Name,
+					"status":       "circuit_open",
+				}).Inc()
+				s.authBreaker.serveOpen(w)
+				return
+			}
+		}
+		_, authSpan := s.tracer.start(r.Context(), s.Name, "forward_auth", spanKindClient)
+		authSpan.setAttr("server.address", authURL.Host)
+		authSpan.setAttr("url.full", authReq.URL.String())
+		authSpan.inject(authReq.Header)
 		authResp, err := client.Do(authReq)
 		if err != nil {
-			elapsed := time.Since(start)
-			authDurations.With(prometheus.Labels{"service_name": s.Name}).Observe(float64(elapsed))
+			authSpan.setError(err)
+		} else {
+			authSpan.setAttr("http.response.status_code", authResp.StatusCode)
+		}
+		authSpan.finish()
+		if breakerDone != nil {
+			switch {
+			case r.Context().Err() != nil:
+				breakerDone(breakerIgnored)
+			case err != nil || authResp.StatusCode >= 500:
+				breakerDone(breakerFailure)
+			default:
+				breakerDone(breakerSuccess)
+			}
+		}
+		if err != nil {
+			observeAuthDuration(s.Name, time.Since(start))
 			authRequests.With(prometheus.Labels{
 				"service_name": s.Name,
 				"status":       "error",
@@ -307,7 +377,7 @@ func (s *ValidTailnetSrv) authMiddleware(next http.Handler) http.Handler {
 		defer authResp.Body.Close()
 
 		elapsed := time.Since(start)
-		authDurations.With(prometheus.Labels{"service_name": s.Name}).Observe(float64(elapsed))
+		observeAuthDuration(s.Name, elapsed)
 		statusClass := fmt.Sprintf("%dxx", authResp.StatusCode/100)
 		authRequests.With(prometheus.Labels{
 			"service_name": s.Name,
@@ -318,12 +388,17 @@ func (s *ValidTailnetSrv) authMiddleware(next http.Handler) http.Handler {
 		if authResp.StatusCode >= 200 && authResp.StatusCode < 300 {
 			// Copy configured headers from auth response to original request
 			var copiedHeaders []string
+			copied := make(http.Header)
 			for headerName := range s.AuthCopyHeaders {
 				if value := authResp.Header.Get(headerName); value != "" {
 					r.Header.Set(headerName, value)
+					copied.Set(headerName, value)
 					copiedHeaders = append(copiedHeaders, headerName)
 				}
 			}
+			if cacheable {
+				s.authCache.put(s.Name, cacheKey, authDecision{status: authResp.StatusCode, header: copied}, time.Now().Add(cache.TTL), cache.MaxEntries)
+			}
 
 			slog.Info("auth granted",
 				"service", s.Name,
@@ -350,6 +425,21 @@ func (s *ValidTailnetSrv) authMiddleware(next http.Handler) http.Handler {
 		for name, values := range authResp.Header {
 			w.Header()[name] = values
 		}
+
+		if cacheable && cache.CacheDenials && (authResp.StatusCode == http.StatusUnauthorized || authResp.StatusCode == http.StatusForbidden) {
+			body, err := io.ReadAll(io.LimitReader(authResp.Body, authDenialBodyLimit+1))
+			if err == nil && len(body) <= authDenialBodyLimit {
+				s.authCache.put(s.Name, cacheKey, authDecision{
+					status: authResp.StatusCode,
+					header: authResp.Header.Clone(),
+					body:   body,
+				}, time.Now().Add(cache.TTL), cache.MaxEntries)
+			}
+			w.WriteHeader(authResp.StatusCode)
+			w.Write(body)
+			io.Copy(w, authResp.Body)
+			return
+		}
 		w.WriteHeader(authResp.StatusCode)
 
 		// Copy body from auth response
@@ -357,6 +447,35 @@ func (s *ValidTailnetSrv) authMiddleware(next http.Handler) http.Handler {
 	})
 }
 
+// replayAuthDecision handles a request like the cached decision of the
+// auth service says.
+func (s *ValidTailnetSrv) replayAuthDecision(w http.ResponseWriter, r *http.Request, next http.Handler, decision authDecision) {
+	if decision.granted() {
+		for name, values := range decision.header {
+			r.Header[name] = values
+		}
+		slog.Debug("auth granted from cache",
+			"service", s.Name,
+			"status", decision.status,
+			"remote_addr", r.RemoteAddr,
+			"url", r.URL,
+		)
+		next.ServeHTTP(w, r)
+		return
+	}
+	slog.Info("auth denied from cache",
+		"service", s.Name,
+		"status", decision.status,
+		"remote_addr", r.RemoteAddr,
+		"url", r.URL,
+	)
+	for name, values := range decision.header {
+		w.Header()[name] = values
+	}
+	w.WriteHeader(decision.status)
+	w.Write(decision.body)
+}
+
 // matchPrefixes acts like the http.StripPrefix middleware, except
 // that it checks against several allowed prefixes (an empty list
 // means that all prefixes are allowed); if no prefixes match, it
@@ -368,6 +487,7 @@ func matchPrefixes(prefixes []prefix, strip bool, forFunnel bool, handler http.H
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		for _, prefix := range prefixes {
 			if ok, stripData := prefix.matches(r.URL, forFunnel); ok {
+				recordPrefix(r, prefix.path)
 				r2 := new(http.Request)
 				*r2 = *r
 				if strip {
@@ -397,8 +517,13 @@ func (s *ValidTailnetSrv) mux(transport http.RoundTripper, forFunnel bool) http.
 		Transport:      transport,
 	}
 	handler := matchPrefixes(s.AllowedPrefixes, s.StripPrefix, forFunnel, proxy)
-	authHandler := s.authMiddleware(handler)
+	handler = s.routeHandler(transport, forFunnel, handler)
+	// Routes are only reachable under the allowed prefixes, too:
+	handler = matchPrefixes(s.AllowedPrefixes, false, forFunnel, handler)
+	handler = s.concurrencyMiddleware(forFunnel, handler)
+	authHandler := s.jwtMiddleware(forFunnel, s.oidcMiddleware(s.basicAuthMiddleware(s.authMiddleware(s.capabilityMiddleware(handler)))))
 	mux := http.NewServeMux()
-	mux.Handle("/", authHandler)
+	handler = s.rateLimitMiddleware(forFunnel, s.accessMiddleware(forFunnel, s.webhookMiddleware(forFunnel, authHandler)))
+	mux.Handle("/", withRequestIdentity(s.metricsMiddleware(forFunnel, s.tracingMiddleware(forFunnel, s.accessLogMiddleware(forFunnel, handler)))))
 	return mux
 }
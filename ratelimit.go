@@ -0,0 +1,331 @@
+package tsnsrv
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"golang.org/x/exp/slog"
+)
+
+var rateLimitRejections = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "tsnsrv_rate_limited_requests_total",
+	Help: "Requests rejected for exceeding a rate limit, by limit (tailnet, funnel or a prefix)",
+}, []string{"service_name", "limit"})
+
+var errRateFormat = errors.New("rate must be 'REQUESTS/PERIOD', like 10/s, 100/m, 1000/h or 5/10s")
+
+// RateLimit limits how many requests each client can make: tailnet
+// clients are told apart by their Tailscale identity, and funnel
+// clients by their IP address.
+type RateLimit struct {
+	// Tailnet limits the requests of each Tailscale user (or tagged
+	// node). Unlimited if its rate is empty.
+	Tailnet RateLimitRule `yaml:"tailnet,omitempty"`
+
+	// Funnel limits the requests of each client IP address on the
+	// funnel. Unlimited if its rate is empty.
+	Funnel RateLimitRule `yaml:"funnel,omitempty"`
+
+	// Prefixes override the limits for requests under a path prefix,
+	// which can be limited to funnel or tailnet requests like with
+	// -prefix. The longest matching prefix wins.
+	Prefixes []RateLimitRule `yaml:"prefixes,omitempty"`
+
+	// MaxClients bounds the number of clients tracked per limit
+	// (default 10000). Clients that haven't made requests in a while
+	// are forgotten first.
+	MaxClients int `yaml:"maxClients,omitempty"`
+}
+
+// RateLimitRule is a token bucket: clients may make Burst requests at
+// once, and get Rate more over time.
+type RateLimitRule struct {
+	// Prefix is the path prefix the rule applies to; only used in
+	// RateLimit.Prefixes.
+	Prefix string `yaml:"prefix,omitempty"`
+
+	// Rate is how many requests a client may make per period, like
+	// "10/s", "100/m" or "5/10s".
+	Rate string `yaml:"rate,omitempty"`
+
+	// Burst is how many requests a client may make at once (default:
+	// the number of requests in Rate, rounded up, and at least 1).
+	Burst int `yaml:"burst,omitempty"`
+}
+
+func (rl RateLimit) enabled() bool {
+	return rl.Tailnet.Rate != "" || rl.Funnel.Rate != "" || len(rl.Prefixes) > 0
+}
+
+func (rl RateLimit) validate() error {
+	var errs []error
+	for name, rule := range map[string]RateLimitRule{"tailnet": rl.Tailnet, "funnel": rl.Funnel} {
+		if rule.Prefix != "" {
+			errs = append(errs, fmt.Errorf("the %s rate limit can not have a prefix", name))
+		}
+		if rule.Rate == "" && rule.Burst != 0 {
+			errs = append(errs, fmt.Errorf("the %s rate limit has a burst, but no rate", name))
+		}
+	}
+	for _, rule := range append([]RateLimitRule{rl.Tailnet, rl.Funnel}, rl.Prefixes...) {
+		if rule.Rate == "" && rule.Prefix == "" {
+			continue
+		}
+		if _, _, err := parseRate(rule.Rate); err != nil {
+			errs = append(errs, err)
+		}
+		if rule.Burst < 0 {
+			errs = append(errs, fmt.Errorf("rate limit burst can not be negative, got %d", rule.Burst))
+		}
+	}
+	for _, rule := range rl.Prefixes {
+		if !strings.HasPrefix(parsePrefix(rule.Prefix).path, "/") {
+			errs = append(errs, fmt.Errorf("rate limit prefix must start with '/', got %q", rule.Prefix))
+		}
+	}
+	if rl.MaxClients < 0 {
+		errs = append(errs, fmt.Errorf("rate limit maxClients can not be negative, got %d", rl.MaxClients))
+	}
+	return errors.Join(errs...)
+}
+
+// parseRate parses a rate like "100/m" into the number of requests and
+// the period they're spread over.
+func parseRate(value string) (float64, time.Duration, error) {
+	count, period, ok := strings.Cut(value, "/")
+	if !ok {
+		return 0, 0, fmt.Errorf("%w, got %q", errRateFormat, value)
+	}
+	n, err := strconv.ParseFloat(count, 64)
+	if err != nil || n <= 0 || math.IsInf(n, 0) {
+		return 0, 0, fmt.Errorf("%w, got %q", errRateFormat, value)
+	}
+	var d time.Duration
+	switch period {
+	case "s":
+		d = time.Second
+	case "m":
+		d = time.Minute
+	case "h":
+		d = time.Hour
+	default:
+		d, err = time.ParseDuration(period)
+		if err != nil || d <= 0 {
+			return 0, 0, fmt.Errorf("%w, got %q", errRateFormat, value)
+		}
+	}
+	return n, d, nil
+}
+
+// parseRateLimitPrefix parses the commandline form of a prefix rule:
+//
+//	[funnel:|tailnet:]/prefix=RATE[;burst=N]
+func parseRateLimitPrefix(value string) (RateLimitRule, error) {
+	spec, options, _ := strings.Cut(value, ";")
+	prefix, rate, ok := strings.Cut(spec, "=")
+	if !ok || prefix == "" || rate == "" {
+		return RateLimitRule{}, fmt.Errorf("rate limit prefix format must be '[funnel:|tailnet:]/prefix=RATE[;burst=N]', got %q", value)
+	}
+	rule := RateLimitRule{Prefix: prefix, Rate: rate}
+	for option := range strings.SplitSeq(options, ";") {
+		if option == "" {
+			continue
+		}
+		key, val, _ := strings.Cut(option, "=")
+		if key != "burst" {
+			return RateLimitRule{}, fmt.Errorf("unknown rate limit option: %q", key)
+		}
+		n, err := strconv.Atoi(val)
+		if err != nil {
+			return RateLimitRule{}, fmt.Errorf("invalid number: %w", err)
+		}
+		rule.Burst = n
+	}
+	return rule, nil
+}
+
+// tokenBucket is the state of one client under one limit.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// clientLimit is a rate limit, and the buckets of the clients it has
+// seen.
+type clientLimit struct {
+	name       string
+	prefix     *prefix
+	perSecond  float64
+	burst      float64
+	maxClients int
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+func newClientLimit(name string, rule RateLimitRule, maxClients int) *clientLimit {
+	n, period, _ := parseRate(rule.Rate)
+	burst := float64(rule.Burst)
+	if burst == 0 {
+		burst = max(1, math.Ceil(n))
+	}
+	l := &clientLimit{
+		name:       name,
+		perSecond:  n / period.Seconds(),
+		burst:      burst,
+		maxClients: maxClients,
+		buckets:    make(map[string]*tokenBucket),
+	}
+	if rule.Prefix != "" {
+		p := parsePrefix(rule.Prefix)
+		l.prefix = &p
+	}
+	return l
+}
+
+// take uses up one of the client's requests. If none are left, it
+// returns how long until the next one is available.
+func (l *clientLimit) take(client string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b, ok := l.buckets[client]
+	if !ok {
+		if len(l.buckets) >= l.maxClients {
+			l.evictLocked(now)
+		}
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[client] = b
+	}
+	b.tokens = min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.perSecond)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / l.perSecond * float64(time.Second))
+}
+
+// evictLocked makes room for a new client. Clients whose buckets have
+// refilled are no different from new ones, so they go first.
+func (l *clientLimit) evictLocked(now time.Time) {
+	if now.Sub(l.lastSweep) >= time.Second {
+		l.lastSweep = now
+		for client, b := range l.buckets {
+			if b.tokens+now.Sub(b.last).Seconds()*l.perSecond >= l.burst {
+				delete(l.buckets, client)
+			}
+		}
+	}
+	for client := range l.buckets {
+		if len(l.buckets) < l.maxClients {
+			break
+		}
+		delete(l.buckets, client)
+	}
+}
+
+// rateLimiter holds the rate limits of a service.
+type rateLimiter struct {
+	tailnet, funnel *clientLimit
+	prefixes        []*clientLimit
+}
+
+func newRateLimiter(config RateLimit) *rateLimiter {
+	maxClients := cmp.Or(config.MaxClients, 10000)
+	rl := &rateLimiter{}
+	if config.Tailnet.Rate != "" {
+		rl.tailnet = newClientLimit("tailnet", config.Tailnet, maxClients)
+	}
+	if config.Funnel.Rate != "" {
+		rl.funnel = newClientLimit("funnel", config.Funnel, maxClients)
+	}
+	for _, rule := range config.Prefixes {
+		rl.prefixes = append(rl.prefixes, newClientLimit(rule.Prefix, rule, maxClients))
+	}
+	// The most specific prefix wins:
+	slices.SortStableFunc(rl.prefixes, func(a, b *clientLimit) int {
+		return cmp.Compare(len(b.prefix.path), len(a.prefix.path))
+	})
+	return rl
+}
+
+// limitFor returns the limit that applies to a request, or nil if it
+// isn't limited.
+func (rl *rateLimiter) limitFor(r *http.Request, forFunnel bool) *clientLimit {
+	for _, l := range rl.prefixes {
+		if l.prefix.covers(r.URL, forFunnel) {
+			return l
+		}
+	}
+	if forFunnel {
+		return rl.funnel
+	}
+	return rl.tailnet
+}
+
+// rateLimitClient returns who a request counts against: the Tailscale
+// user or tagged node on the tailnet, and the client IP otherwise.
+func (s *ValidTailnetSrv) rateLimitClient(r *http.Request, forFunnel bool) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	if forFunnel {
+		return "ip:" + ip
+	}
+	who, err := s.whoisFor(r)
+	switch {
+	case err != nil || who == nil:
+		return "ip:" + ip
+	case who.Node != nil && who.Node.IsTagged():
+		// Tagged nodes all share one user profile.
+		return "node:" + string(who.Node.StableID)
+	case who.UserProfile != nil:
+		return "user:" + who.UserProfile.LoginName
+	default:
+		return "ip:" + ip
+	}
+}
+
+// rateLimitMiddleware rejects requests of clients that exceed their
+// rate limit.
+func (s *ValidTailnetSrv) rateLimitMiddleware(forFunnel bool, next http.Handler) http.Handler {
+	rl := s.rateLimiter
+	if rl == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		l := rl.limitFor(r, forFunnel)
+		if l == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		client := s.rateLimitClient(r, forFunnel)
+		ok, wait := l.take(client, time.Now())
+		if ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		rateLimitRejections.With(prometheus.Labels{"service_name": s.Name, "limit": l.name}).Inc()
+		slog.Debug("rate limited",
+			"service", s.Name,
+			"limit", l.name,
+			"client", client,
+			"url", r.URL,
+		)
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+	})
+}
@@ -0,0 +1,151 @@
+package tsnsrv
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/tailcfg"
+)
+
+func TestParseRate(t *testing.T) {
+	t.Parallel()
+	for value, expected := range map[string]time.Duration{
+		"10/s":  100 * time.Millisecond,
+		"60/m":  time.Second,
+		"2/h":   30 * time.Minute,
+		"5/10s": 2 * time.Second,
+		"0.5/s": 2 * time.Second,
+	} {
+		n, period, err := parseRate(value)
+		require.NoError(t, err, value)
+		assert.Equal(t, expected, time.Duration(float64(period)/n), value)
+	}
+	for _, value := range []string{"", "10", "10/d", "x/s", "0/s", "-1/s", "10/-1s"} {
+		_, _, err := parseRate(value)
+		assert.ErrorIs(t, err, errRateFormat, value)
+	}
+}
+
+func TestRateLimitValidate(t *testing.T) {
+	t.Parallel()
+	assert.NoError(t, RateLimit{}.validate())
+	assert.NoError(t, RateLimit{
+		Tailnet:  RateLimitRule{Rate: "100/m"},
+		Funnel:   RateLimitRule{Rate: "10/s", Burst: 20},
+		Prefixes: []RateLimitRule{{Prefix: "funnel:/login", Rate: "5/m"}},
+	}.validate())
+
+	assert.Error(t, RateLimit{Funnel: RateLimitRule{Rate: "fast"}}.validate())
+	assert.Error(t, RateLimit{Funnel: RateLimitRule{Burst: 5}}.validate())
+	assert.Error(t, RateLimit{Funnel: RateLimitRule{Rate: "1/s", Burst: -1}}.validate())
+	assert.Error(t, RateLimit{Tailnet: RateLimitRule{Prefix: "/x", Rate: "1/s"}}.validate())
+	assert.Error(t, RateLimit{Prefixes: []RateLimitRule{{Prefix: "login", Rate: "1/s"}}}.validate())
+	assert.Error(t, RateLimit{Prefixes: []RateLimitRule{{Prefix: "/login"}}}.validate())
+}
+
+func TestParseRateLimitPrefix(t *testing.T) {
+	t.Parallel()
+	rule, err := parseRateLimitPrefix("funnel:/login=5/m;burst=2")
+	require.NoError(t, err)
+	assert.Equal(t, RateLimitRule{Prefix: "funnel:/login", Rate: "5/m", Burst: 2}, rule)
+
+	for _, value := range []string{"/login", "=5/m", "/login=5/m;burst=many", "/login=5/m;bogus=1"} {
+		_, err := parseRateLimitPrefix(value)
+		assert.Error(t, err, value)
+	}
+}
+
+func TestClientLimitTake(t *testing.T) {
+	t.Parallel()
+	l := newClientLimit("test", RateLimitRule{Rate: "2/s", Burst: 3}, 10)
+	now := time.Now()
+	for i := range 3 {
+		ok, _ := l.take("a", now)
+		assert.True(t, ok, "request %d is within the burst", i)
+	}
+	ok, wait := l.take("a", now)
+	assert.False(t, ok)
+	assert.Equal(t, 500*time.Millisecond, wait)
+
+	ok, _ = l.take("b", now)
+	assert.True(t, ok, "clients have separate buckets")
+
+	ok, _ = l.take("a", now.Add(500*time.Millisecond))
+	assert.True(t, ok, "tokens refill over time")
+	ok, _ = l.take("a", now.Add(500*time.Millisecond))
+	assert.False(t, ok)
+}
+
+func TestClientLimitEviction(t *testing.T) {
+	t.Parallel()
+	l := newClientLimit("test", RateLimitRule{Rate: "1/s", Burst: 1}, 2)
+	now := time.Now()
+	l.take("a", now)
+	l.take("b", now.Add(900*time.Millisecond))
+	l.take("c", now.Add(1100*time.Millisecond))
+	assert.Len(t, l.buckets, 2)
+	assert.NotContains(t, l.buckets, "a", "refilled buckets are evicted first")
+	assert.Contains(t, l.buckets, "b")
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	t.Parallel()
+	cfg := RateLimit{
+		Tailnet:  RateLimitRule{Rate: "2/m"},
+		Funnel:   RateLimitRule{Rate: "1/m"},
+		Prefixes: []RateLimitRule{{Prefix: "funnel:/static", Rate: "100/s"}, {Prefix: "/login", Rate: "1/h"}},
+	}
+	require.NoError(t, cfg.validate())
+	s := &ValidTailnetSrv{
+		TailnetSrv:  TailnetSrv{Name: "test", RateLimit: cfg},
+		rateLimiter: newRateLimiter(cfg),
+		client: &mockLocalClient{whoIsFunc: func(ctx context.Context, addr string) (*apitype.WhoIsResponse, error) {
+			switch addr {
+			case "100.100.100.1:1234", "100.100.100.2:1234":
+				return identity("alice@example.com", "laptop", nil), nil
+			case "100.100.100.3:1234":
+				who := identity("tagged-devices", "ci-runner", []string{"tag:ci"})
+				who.Node.StableID = tailcfg.StableNodeID("n1234")
+				return who, nil
+			}
+			return nil, assert.AnError
+		}},
+	}
+	do := func(forFunnel bool, remoteAddr, path string) *httptest.ResponseRecorder {
+		handler := withRequestIdentity(s.rateLimitMiddleware(forFunnel, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+		req := httptest.NewRequest("GET", path, nil)
+		req.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	// Tailnet users are limited across all their nodes:
+	assert.Equal(t, http.StatusOK, do(false, "100.100.100.1:1234", "/").Code)
+	assert.Equal(t, http.StatusOK, do(false, "100.100.100.2:1234", "/").Code)
+	w := do(false, "100.100.100.1:1234", "/")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "30", w.Header().Get("Retry-After"))
+	assert.Equal(t, http.StatusOK, do(false, "100.100.100.3:1234", "/").Code, "tagged nodes have their own limit")
+
+	// Funnel clients are limited by IP:
+	assert.Equal(t, http.StatusOK, do(true, "203.0.113.1:1234", "/").Code)
+	assert.Equal(t, http.StatusOK, do(true, "203.0.113.2:1234", "/").Code)
+	w = do(true, "203.0.113.1:4321", "/")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "60", w.Header().Get("Retry-After"))
+
+	// Prefixes override the limits:
+	assert.Equal(t, http.StatusOK, do(true, "203.0.113.1:1234", "/static/app.js").Code)
+	assert.Equal(t, http.StatusOK, do(false, "100.100.100.4:1234", "/login").Code)
+	assert.Equal(t, http.StatusTooManyRequests, do(false, "100.100.100.4:1234", "/login").Code)
+	assert.Equal(t, http.StatusTooManyRequests, do(false, "100.100.100.4:1234", "/%6Cogin").Code, "encoded paths count against the prefix")
+	assert.Equal(t, http.StatusOK, do(false, "100.100.100.4:1234", "/").Code, "the prefix has its own buckets")
+	assert.Equal(t, http.StatusOK, do(false, "100.100.100.4:1234", "/static").Code, "funnel: prefixes don't apply on the tailnet")
+}
@@ -0,0 +1,100 @@
+package tsnsrv
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+// ConfigReloader watches a configuration file and applies changes to the
+// services of a running Orchestrator.
+//
+// The file is reloaded when its contents change (checked every
+// Interval) and whenever the process receives SIGHUP. A configuration
+// that fails to load or validate is rejected, and the services that are
+// already running are left alone.
+type ConfigReloader struct {
+	Path         string
+	Interval     time.Duration
+	Orchestrator *Orchestrator
+
+	lastSum []byte
+}
+
+// Run watches for changes until ctx is canceled.
+func (r *ConfigReloader) Run(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	// Remember what the file looked like when the services were loaded, so
+	// the first poll doesn't trigger a reload.
+	if data, err := os.ReadFile(r.Path); err == nil {
+		sum := sha256.Sum256(data)
+		r.lastSum = sum[:]
+	}
+
+	var tick <-chan time.Time
+	if r.Interval > 0 {
+		ticker := time.NewTicker(r.Interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			slog.Info("Received SIGHUP, reloading configuration", "path", r.Path)
+			r.reload(true)
+		case <-tick:
+			r.reload(false)
+		}
+	}
+}
+
+// reload re-reads the configuration file and hands the resulting
+// services to the orchestrator. Unless force is set, nothing happens if
+// the file's contents are the same as last time.
+func (r *ConfigReloader) reload(force bool) {
+	data, err := os.ReadFile(r.Path)
+	if err != nil {
+		slog.Warn("Could not read configuration file", "path", r.Path, "error", err)
+		return
+	}
+	sum := sha256.Sum256(data)
+	if !force && bytes.Equal(sum[:], r.lastSum) {
+		return
+	}
+	r.lastSum = sum[:]
+
+	if err := r.apply(); err != nil {
+		slog.Error("Rejected new configuration, keeping the running services",
+			"path", r.Path,
+			"error", err,
+		)
+	}
+}
+
+func (r *ConfigReloader) apply() error {
+	cfg, err := LoadConfig(r.Path)
+	if err != nil {
+		return err
+	}
+	services, err := ServicesFromConfig(cfg.Services)
+	if err != nil {
+		return err
+	}
+	if err := r.Orchestrator.Reload(services); err != nil {
+		return fmt.Errorf("applying configuration: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package tsnsrv
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfigReloader(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "config.yaml")
+	writeConfig := func(yaml string) {
+		require.NoError(t, os.WriteFile(configPath, []byte(yaml), 0600))
+	}
+	writeConfig(`
+services:
+  - name: service1
+    upstream: http://localhost:8080
+`)
+	cfg, err := LoadConfig(configPath)
+	require.NoError(t, err)
+	services, err := ServicesFromConfig(cfg.Services)
+	require.NoError(t, err)
+
+	o := NewOrchestrator(services)
+	started := make(chan string)
+	o.run = func(ctx context.Context, s *ValidTailnetSrv) error {
+		started <- s.Name
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error)
+	go func() { result <- o.Run(ctx) }()
+	t.Cleanup(func() {
+		cancel()
+		require.NoError(t, <-result)
+	})
+	assert.Equal(t, "service1", <-started)
+	r := &ConfigReloader{Path: configPath, Orchestrator: o}
+
+	// An invalid configuration leaves the old set in place:
+	writeConfig(`
+services:
+  - name: service1
+    upstream: http://localhost:8080
+    plaintext: true
+    funnel: true
+`)
+	r.reload(false)
+	require.Len(t, o.services, 1)
+	assert.Same(t, services[0], o.services[0])
+
+	// A valid one gets handed to the orchestrator:
+	writeConfig(`
+services:
+  - name: service1
+    upstream: http://localhost:8080
+  - name: service2
+    upstream: http://localhost:8081
+`)
+	r.reload(false)
+	assert.Equal(t, "service2", <-started)
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	require.Len(t, o.services, 2)
+	assert.Same(t, services[0], o.services[0], "unchanged service must not be replaced")
+	assert.Equal(t, "service2", o.services[1].Name)
+}
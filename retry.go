@@ -0,0 +1,223 @@
+package tsnsrv
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"golang.org/x/exp/slog"
+)
+
+var upstreamRetries = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "tsnsrv_upstream_retries_total",
+	Help: "Requests retried against the upstream, by reason (error, or the status code)",
+}, []string{"service_name", "reason"})
+
+// Retries configures retrying idempotent requests that fail to reach
+// the upstream, or that it answers with a temporary error.
+type Retries struct {
+	// MaxRetries is how often a request may be retried. 0 disables
+	// retries.
+	MaxRetries int `yaml:"maxRetries,omitempty"`
+
+	// Statuses are the response status codes that are retried
+	// (default 502, 503 and 504).
+	Statuses []int `yaml:"statuses,omitempty"`
+
+	// Backoff is the delay before the first retry; it doubles with
+	// every further retry (default 100ms).
+	Backoff time.Duration `yaml:"backoff,omitempty"`
+
+	// MaxBackoff is the longest delay between retries (default 2s).
+	MaxBackoff time.Duration `yaml:"maxBackoff,omitempty"`
+
+	// MaxBodySize is the largest request body that is kept around to
+	// be sent again, in bytes (default 1MiB). Requests with larger
+	// bodies are not retried.
+	MaxBodySize int64 `yaml:"maxBodySize,omitempty"`
+}
+
+func (rc Retries) enabled() bool {
+	return rc.MaxRetries > 0
+}
+
+func (rc Retries) validate() error {
+	var errs []error
+	if rc.MaxRetries < 0 || rc.Backoff < 0 || rc.MaxBackoff < 0 || rc.MaxBodySize < 0 {
+		errs = append(errs, errors.New("retry settings can not be negative"))
+	}
+	for _, status := range rc.Statuses {
+		if status < 100 || status > 599 {
+			errs = append(errs, fmt.Errorf("retry status must be a valid HTTP status, got %d", status))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (rc Retries) withDefaults() Retries {
+	if len(rc.Statuses) == 0 {
+		rc.Statuses = []int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout}
+	}
+	if rc.Backoff == 0 {
+		rc.Backoff = 100 * time.Millisecond
+	}
+	if rc.MaxBackoff == 0 {
+		rc.MaxBackoff = 2 * time.Second
+	}
+	if rc.MaxBodySize == 0 {
+		rc.MaxBodySize = 1 << 20
+	}
+	return rc
+}
+
+// retryStatuses collects -retryStatus flags.
+type retryStatuses []int
+
+func (rs *retryStatuses) String() string {
+	return fmt.Sprint(*rs)
+}
+
+func (rs *retryStatuses) Set(value string) error {
+	status, err := strconv.Atoi(value)
+	if err != nil {
+		return fmt.Errorf("invalid status code: %w", err)
+	}
+	*rs = append(*rs, status)
+	return nil
+}
+
+// isIdempotent returns whether req may safely be sent more than once.
+func isIdempotent(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	return req.Header.Get("Idempotency-Key") != ""
+}
+
+type retryAttemptKey struct{}
+
+// retryAttempt is what the attempts of a request have in common.
+type retryAttempt struct {
+	// tried are the load balancer backends that the request was
+	// sent to.
+	tried []*backend
+}
+
+func retryAttemptFor(req *http.Request) *retryAttempt {
+	attempt, _ := req.Context().Value(retryAttemptKey{}).(*retryAttempt)
+	return attempt
+}
+
+// triedBackends returns the backends that earlier attempts of req
+// were sent to.
+func triedBackends(req *http.Request) []*backend {
+	if attempt := retryAttemptFor(req); attempt != nil {
+		return attempt.tried
+	}
+	return nil
+}
+
+// retryTransport retries idempotent requests that fail on the
+// upstream transport, or that get a retryable status.
+type retryTransport struct {
+	service string
+	config  Retries
+	next    http.RoundTripper
+}
+
+func newRetryTransport(service string, config Retries, next http.RoundTripper) *retryTransport {
+	return &retryTransport{service: service, config: config.withDefaults(), next: next}
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !isIdempotent(req) {
+		return t.next.RoundTrip(req)
+	}
+	var body []byte
+	if req.Body != nil && req.Body != http.NoBody {
+		var err error
+		body, err = io.ReadAll(io.LimitReader(req.Body, t.config.MaxBodySize+1))
+		if err != nil {
+			return nil, err
+		}
+		if int64(len(body)) > t.config.MaxBodySize {
+			// Too large to keep around; send it once.
+			req.Body = readCloser{io.MultiReader(bytes.NewReader(body), req.Body), req.Body}
+			return t.next.RoundTrip(req)
+		}
+		req.Body.Close()
+	}
+
+	attempt := &retryAttempt{}
+	req = req.WithContext(context.WithValue(req.Context(), retryAttemptKey{}, attempt))
+	p, _ := req.Context().Value(proxyContextKey).(*proxyContext)
+	backoff := t.config.Backoff
+	for retries := 0; ; retries++ {
+		if body != nil {
+			req.Body = io.NopCloser(bytes.NewReader(body))
+		}
+		res, err := t.next.RoundTrip(req)
+		reason := "error"
+		if err == nil {
+			if !slices.Contains(t.config.Statuses, res.StatusCode) {
+				return res, nil
+			}
+			reason = strconv.Itoa(res.StatusCode)
+		}
+		if retries >= t.config.MaxRetries || !t.retryable(req, err) {
+			if err != nil && retries > 0 {
+				err = fmt.Errorf("after %d retries: %w", retries, err)
+			}
+			return res, err
+		}
+		if res != nil {
+			// Let the connection be reused:
+			io.Copy(io.Discard, io.LimitReader(res.Body, 64<<10))
+			res.Body.Close()
+		}
+
+		upstreamRetries.With(prometheus.Labels{"service_name": t.service, "reason": reason}).Inc()
+		slog.Debug("retrying upstream request",
+			"service", t.service,
+			"url", req.URL,
+			"reason", reason,
+			"error", err,
+			"retry", retries+1,
+		)
+		if p != nil {
+			p.retries++
+		}
+		timer := time.NewTimer(backoff)
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		case <-timer.C:
+		}
+		backoff = min(2*backoff, t.config.MaxBackoff)
+	}
+}
+
+// retryable returns whether a failed attempt should be retried.
+func (t *retryTransport) retryable(req *http.Request, err error) bool {
+	if req.Context().Err() != nil {
+		return false
+	}
+	// With no healthy upstream, retrying won't help:
+	return !errors.Is(err, errNoHealthyUpstream)
+}
+
+// readCloser reads from one reader, and closes another.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
@@ -0,0 +1,168 @@
+package tsnsrv
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// scriptedUpstream responds to each request with the next status in
+// its script, where 0 means a connection error.
+type scriptedUpstream struct {
+	mu     sync.Mutex
+	script []int
+	bodies []string
+}
+
+func (u *scriptedUpstream) RoundTrip(req *http.Request) (*http.Response, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	var body string
+	if req.Body != nil {
+		data, _ := io.ReadAll(req.Body)
+		body = string(data)
+	}
+	u.bodies = append(u.bodies, body)
+	status := u.script[0]
+	u.script = u.script[1:]
+	if status == 0 {
+		return nil, &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+	}
+	return &http.Response{StatusCode: status, Body: io.NopCloser(strings.NewReader("")), Request: req}, nil
+}
+
+func TestRetriesValidate(t *testing.T) {
+	t.Parallel()
+	assert.NoError(t, Retries{}.validate())
+	assert.NoError(t, Retries{MaxRetries: 2, Statuses: []int{429, 503}}.validate())
+	assert.Error(t, Retries{MaxRetries: -1}.validate())
+	assert.Error(t, Retries{MaxRetries: 1, Statuses: []int{1000}}.validate())
+}
+
+func TestIsIdempotent(t *testing.T) {
+	t.Parallel()
+	for method, expected := range map[string]bool{"GET": true, "HEAD": true, "OPTIONS": true, "POST": false, "PUT": false, "DELETE": false} {
+		req, err := http.NewRequest(method, "http://upstream/", nil)
+		require.NoError(t, err)
+		assert.Equal(t, expected, isIdempotent(req), method)
+	}
+	req, err := http.NewRequest("POST", "http://upstream/", nil)
+	require.NoError(t, err)
+	req.Header.Set("Idempotency-Key", "8e03978e-40d5-43e8-bc93-6894a57f9324")
+	assert.True(t, isIdempotent(req))
+}
+
+func TestRetryTransport(t *testing.T) {
+	t.Parallel()
+	config := Retries{MaxRetries: 2, Backoff: time.Millisecond}
+	do := func(upstream *scriptedUpstream, method, body string, header http.Header) (*http.Response, error) {
+		req, err := http.NewRequest(method, "http://upstream/", strings.NewReader(body))
+		require.NoError(t, err)
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		p := &proxyContext{}
+		req = req.WithContext(context.WithValue(req.Context(), proxyContextKey, p))
+		res, err := newRetryTransport("test", config, upstream).RoundTrip(req)
+		if err == nil {
+			assert.Equal(t, len(upstream.bodies)-1, p.retries, "retries are counted for the access log")
+		}
+		return res, err
+	}
+
+	upstream := &scriptedUpstream{script: []int{0, 503, 200}}
+	res, err := do(upstream, "GET", "", nil)
+	require.NoError(t, err)
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Empty(t, upstream.script)
+
+	upstream = &scriptedUpstream{script: []int{502, 502, 502, 200}}
+	res, err = do(upstream, "GET", "", nil)
+	require.NoError(t, err)
+	assert.Equal(t, 502, res.StatusCode, "the last response is passed on when the retries run out")
+	assert.Len(t, upstream.bodies, 3)
+
+	upstream = &scriptedUpstream{script: []int{0, 0, 0}}
+	_, err = do(upstream, "HEAD", "", nil)
+	assert.ErrorContains(t, err, "after 2 retries")
+
+	upstream = &scriptedUpstream{script: []int{500, 200}}
+	res, err = do(upstream, "GET", "", nil)
+	require.NoError(t, err)
+	assert.Equal(t, 500, res.StatusCode, "other statuses aren't retried")
+
+	upstream = &scriptedUpstream{script: []int{503, 200}}
+	res, err = do(upstream, "POST", "order", nil)
+	require.NoError(t, err)
+	assert.Equal(t, 503, res.StatusCode, "non-idempotent requests aren't retried")
+
+	upstream = &scriptedUpstream{script: []int{0, 503, 200}}
+	res, err = do(upstream, "POST", "order", http.Header{"Idempotency-Key": {"abc"}})
+	require.NoError(t, err)
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, []string{"order", "order", "order"}, upstream.bodies, "the body is sent again")
+
+	config.MaxBodySize = 4
+	upstream = &scriptedUpstream{script: []int{503, 200}}
+	res, err = do(upstream, "POST", "too long", http.Header{"Idempotency-Key": {"abc"}})
+	require.NoError(t, err)
+	assert.Equal(t, 503, res.StatusCode, "requests with large bodies aren't retried")
+	assert.Equal(t, []string{"too long"}, upstream.bodies)
+}
+
+func TestRetryTransportCanceled(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	upstream := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		cancel()
+		return nil, errors.New("connection reset by peer")
+	})
+	req, err := http.NewRequestWithContext(ctx, "GET", "http://upstream/", nil)
+	require.NoError(t, err)
+	_, err = newRetryTransport("test", Retries{MaxRetries: 5, Backoff: time.Hour}, upstream).RoundTrip(req)
+	assert.Error(t, err)
+}
+
+func TestRetryOtherTarget(t *testing.T) {
+	t.Parallel()
+	calls := map[string]int{}
+	var mu sync.Mutex
+	targets := []upstreamTarget{{"tcp", "broken:80"}, {"tcp", "working:80"}}
+	b := newBalancer("test", LoadBalanceUserHash, HealthCheck{}, targets, func(target upstreamTarget) http.RoundTripper {
+		return roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			mu.Lock()
+			calls[target.address]++
+			mu.Unlock()
+			if target.address == "broken:80" {
+				return nil, errors.New("connection refused")
+			}
+			return &http.Response{StatusCode: 200, Body: io.NopCloser(strings.NewReader("")), Request: req}, nil
+		})
+	})
+	transport := newRetryTransport("test", Retries{MaxRetries: 3, Backoff: time.Millisecond}, b)
+	for range 10 {
+		req, err := http.NewRequest("GET", "http://upstream/", nil)
+		require.NoError(t, err)
+		res, err := transport.RoundTrip(req)
+		require.NoError(t, err)
+		assert.Equal(t, 200, res.StatusCode)
+		res.Body.Close()
+	}
+	assert.Equal(t, 10, calls["working:80"])
+	assert.LessOrEqual(t, calls["broken:80"], 10, "each request tries the broken target at most once")
+}
@@ -0,0 +1,170 @@
+package tsnsrv
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// RouteConfig sends requests under a path prefix to a separate upstream.
+// Like the main upstream, a route only receives requests that the
+// service's Prefixes allow.
+type RouteConfig struct {
+	// Prefix is the path prefix to match, optionally restricted with a
+	// "funnel:" or "tailnet:" provenance like the entries in Prefixes.
+	Prefix   string `yaml:"prefix"`
+	Upstream string `yaml:"upstream"`
+
+	StripPrefix     bool              `yaml:"stripPrefix,omitempty"`
+	UpstreamHeaders map[string]string `yaml:"upstreamHeaders,omitempty"`
+}
+
+var errRouteFormat = errors.New("route format must be '[funnel:|tailnet:]/prefix=URL[;stripPrefix=bool][;upstreamHeader=Name: value]'")
+
+// parseRouteSpec parses the commandline form of a route:
+//
+//	[funnel:|tailnet:]/prefix=URL[;stripPrefix=bool][;upstreamHeader=Name: value]
+func parseRouteSpec(value string) (RouteConfig, error) {
+	spec, options, _ := strings.Cut(value, ";")
+	prefix, upstream, ok := strings.Cut(spec, "=")
+	if !ok || prefix == "" || upstream == "" {
+		return RouteConfig{}, fmt.Errorf("%w: got %q", errRouteFormat, value)
+	}
+	rc := RouteConfig{Prefix: prefix, Upstream: upstream}
+	for option := range strings.SplitSeq(options, ";") {
+		if option == "" {
+			continue
+		}
+		key, val, ok := strings.Cut(option, "=")
+		if !ok {
+			return RouteConfig{}, fmt.Errorf("%w: invalid option %q", errRouteFormat, option)
+		}
+		switch key {
+		case "stripPrefix":
+			v, err := parseBool(val)
+			if err != nil {
+				return RouteConfig{}, err
+			}
+			rc.StripPrefix = v
+		case "upstreamHeader":
+			name, hval, ok := strings.Cut(val, ":")
+			if !ok {
+				return RouteConfig{}, fmt.Errorf("header format must be 'Name:Value', got %q", val)
+			}
+			if rc.UpstreamHeaders == nil {
+				rc.UpstreamHeaders = make(map[string]string)
+			}
+			rc.UpstreamHeaders[strings.TrimSpace(name)] = strings.TrimSpace(hval)
+		default:
+			return RouteConfig{}, fmt.Errorf("unknown route option: %q", key)
+		}
+	}
+	return rc, nil
+}
+
+// routeFlags collects routes given on the commandline.
+type routeFlags []RouteConfig
+
+func (r *routeFlags) String() string {
+	var coll []string
+	for _, rc := range *r {
+		coll = append(coll, fmt.Sprintf("%s=%s", rc.Prefix, rc.Upstream))
+	}
+	return strings.Join(coll, ", ")
+}
+
+func (r *routeFlags) Set(value string) error {
+	rc, err := parseRouteSpec(value)
+	if err != nil {
+		return err
+	}
+	*r = append(*r, rc)
+	return nil
+}
+
+// parse validates the routes and orders them for matching.
+func (r routeFlags) parse() ([]route, error) {
+	var errs []error
+	var parsed []route
+	for _, rc := range r {
+		dest, err := url.Parse(rc.Upstream)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("route %s: invalid upstream URL %#v: %w", rc.Prefix, rc.Upstream, err))
+			continue
+		}
+		pref := parsePrefix(rc.Prefix)
+		if !strings.HasPrefix(pref.path, "/") {
+			errs = append(errs, fmt.Errorf("route %s: prefix must start with '/'", rc.Prefix))
+			continue
+		}
+		rt := route{prefix: pref, destURL: dest, stripPrefix: rc.StripPrefix}
+		for name, value := range rc.UpstreamHeaders {
+			rt.headers.Set(fmt.Sprintf("%s: %s", name, value))
+		}
+		parsed = append(parsed, rt)
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	// The most specific route wins:
+	slices.SortStableFunc(parsed, func(a, b route) int {
+		return cmp.Compare(len(b.path), len(a.path))
+	})
+	return parsed, nil
+}
+
+// route is a validated RouteConfig.
+type route struct {
+	prefix
+	destURL     *url.URL
+	stripPrefix bool
+	headers     headers
+}
+
+// routeHandler dispatches requests that match one of the service's
+// routes to that route's upstream, and all others to fallback.
+func (s *ValidTailnetSrv) routeHandler(transport http.RoundTripper, forFunnel bool, fallback http.Handler) http.Handler {
+	if len(s.routes) == 0 {
+		return fallback
+	}
+	if s.routeTransport != nil {
+		transport = s.routeTransport
+	}
+	proxies := make([]http.Handler, len(s.routes))
+	for i, rt := range s.routes {
+		proxies[i] = &httputil.ReverseProxy{
+			Rewrite: func(r *httputil.ProxyRequest) {
+				s.rewriteTo(r, rt.destURL, rt.headers)
+			},
+			ModifyResponse: s.modifyResponse,
+			ErrorHandler:   s.errorHandler,
+			Transport:      transport,
+		}
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for i, rt := range s.routes {
+			ok, stripData := rt.matches(r.URL, forFunnel)
+			if !ok {
+				continue
+			}
+			recordPrefix(r, rt.path)
+			if rt.stripPrefix {
+				r2 := new(http.Request)
+				*r2 = *r
+				r2.URL = new(url.URL)
+				*r2.URL = *r.URL
+				r2.URL.Path = stripData.path
+				r2.URL.RawPath = stripData.rawPath
+				r = r2
+			}
+			proxies[i].ServeHTTP(w, r)
+			return
+		}
+		fallback.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,168 @@
+package tsnsrv
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRouteSpec(t *testing.T) {
+	t.Parallel()
+	for _, elt := range []struct {
+		spec     string
+		expected RouteConfig
+		err      bool
+	}{
+		{spec: "/api=http://127.0.0.1:8080", expected: RouteConfig{Prefix: "/api", Upstream: "http://127.0.0.1:8080"}},
+		{spec: "funnel:/hooks=http://hooks:9000/in;stripPrefix=true", expected: RouteConfig{
+			Prefix: "funnel:/hooks", Upstream: "http://hooks:9000/in", StripPrefix: true,
+		}},
+		{spec: "/api=http://api;upstreamHeader=X-Api: yes;upstreamHeader=X-Other:no", expected: RouteConfig{
+			Prefix: "/api", Upstream: "http://api",
+			UpstreamHeaders: map[string]string{"X-Api": "yes", "X-Other": "no"},
+		}},
+		{spec: "/api", err: true},
+		{spec: "=http://api", err: true},
+		{spec: "/api=http://api;bogus=1", err: true},
+		{spec: "/api=http://api;stripPrefix=maybe", err: true},
+		{spec: "/api=http://api;upstreamHeader=nocolon", err: true},
+	} {
+		t.Run(elt.spec, func(t *testing.T) {
+			rc, err := parseRouteSpec(elt.spec)
+			if elt.err {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, elt.expected, rc)
+		})
+	}
+}
+
+func TestRouteFlagsParse(t *testing.T) {
+	t.Parallel()
+	routes, err := routeFlags{
+		{Prefix: "/api", Upstream: "http://api"},
+		{Prefix: "/api/v2", Upstream: "http://api2"},
+	}.parse()
+	require.NoError(t, err)
+	require.Len(t, routes, 2)
+	assert.Equal(t, "/api/v2", routes[0].path, "longest prefix is matched first")
+
+	_, err = routeFlags{{Prefix: "api", Upstream: "http://api"}}.parse()
+	assert.Error(t, err)
+}
+
+func TestRouteHandler(t *testing.T) {
+	upstream := func(name string) *url.URL {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Upstream", name)
+			w.Header().Set("X-Path", r.URL.Path)
+			w.Header().Set("X-Route-Header", r.Header.Get("X-Route"))
+		}))
+		t.Cleanup(srv.Close)
+		u, err := url.Parse(srv.URL)
+		require.NoError(t, err)
+		return u
+	}
+	main := upstream("main")
+	api := upstream("api")
+	hooks := upstream("hooks")
+
+	routes, err := routeFlags{
+		{Prefix: "/api", Upstream: api.String(), UpstreamHeaders: map[string]string{"X-Route": "api"}},
+		{Prefix: "funnel:/hooks", Upstream: hooks.String() + "/incoming", StripPrefix: true},
+	}.parse()
+	require.NoError(t, err)
+	s := &ValidTailnetSrv{
+		TailnetSrv: TailnetSrv{SuppressWhois: true},
+		DestURL:    main,
+		routes:     routes,
+	}
+
+	for _, elt := range []struct {
+		name      string
+		path      string
+		forFunnel bool
+		upstream  string
+		path2     string
+		header    string
+	}{
+		{name: "default", path: "/other", upstream: "main", path2: "/other"},
+		{name: "api route", path: "/api/users", upstream: "api", path2: "/api/users", header: "api"},
+		{name: "api route via funnel", path: "/api/users", forFunnel: true, upstream: "api", path2: "/api/users", header: "api"},
+		{name: "funnel-only route", path: "/hooks/gh", forFunnel: true, upstream: "hooks", path2: "/incoming/gh"},
+		{name: "funnel-only route on tailnet", path: "/hooks/gh", upstream: "main", path2: "/hooks/gh"},
+	} {
+		t.Run(elt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			s.mux(http.DefaultTransport, elt.forFunnel).ServeHTTP(w, httptest.NewRequest("GET", elt.path, nil))
+			resp := w.Result()
+			io.Copy(io.Discard, resp.Body)
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			assert.Equal(t, elt.upstream, resp.Header.Get("X-Upstream"))
+			assert.Equal(t, elt.path2, resp.Header.Get("X-Path"))
+			assert.Equal(t, elt.header, resp.Header.Get("X-Route-Header"))
+		})
+	}
+}
+
+func TestRouteHandlerAllowedPrefixes(t *testing.T) {
+	t.Parallel()
+	upstream := func(name string) *url.URL {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Upstream", name)
+			w.Header().Set("X-Path", r.URL.Path)
+		}))
+		t.Cleanup(srv.Close)
+		u, err := url.Parse(srv.URL)
+		require.NoError(t, err)
+		return u
+	}
+	main := upstream("main")
+	api := upstream("api")
+	hooks := upstream("hooks")
+
+	routes, err := routeFlags{
+		{Prefix: "/api", Upstream: api.String()},
+		{Prefix: "/hooks", Upstream: hooks.String()},
+	}.parse()
+	require.NoError(t, err)
+	s := &ValidTailnetSrv{
+		TailnetSrv: TailnetSrv{
+			SuppressWhois:   true,
+			StripPrefix:     true,
+			AllowedPrefixes: prefixes{parsePrefix("/app"), parsePrefix("/api")},
+		},
+		DestURL: main,
+		routes:  routes,
+	}
+
+	for _, elt := range []struct {
+		name     string
+		path     string
+		status   int
+		upstream string
+		path2    string
+	}{
+		{name: "allowed main path", path: "/app/x", status: http.StatusOK, upstream: "main", path2: "/x"},
+		{name: "allowed route", path: "/api/users", status: http.StatusOK, upstream: "api", path2: "/api/users"},
+		{name: "route outside the allowed prefixes", path: "/hooks/gh", status: http.StatusNotFound},
+		{name: "path outside the allowed prefixes", path: "/other", status: http.StatusNotFound},
+	} {
+		t.Run(elt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			s.mux(http.DefaultTransport, false).ServeHTTP(w, httptest.NewRequest("GET", elt.path, nil))
+			resp := w.Result()
+			io.Copy(io.Discard, resp.Body)
+			assert.Equal(t, elt.status, resp.StatusCode)
+			assert.Equal(t, elt.upstream, resp.Header.Get("X-Upstream"))
+			assert.Equal(t, elt.path2, resp.Header.Get("X-Path"))
+		})
+	}
+}
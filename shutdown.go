@@ -0,0 +1,93 @@
+package tsnsrv
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/exp/slog"
+	"tailscale.com/tsnet"
+)
+
+// inflightRequests counts requests that are being handled, including
+// upgraded connections (e.g. websockets) that http.Server.Shutdown
+// doesn't wait for.
+type inflightRequests struct {
+	count atomic.Int64
+}
+
+func (in *inflightRequests) track(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		in.count.Add(1)
+		defer in.count.Add(-1)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// wait blocks until no requests are in flight or ctx is done.
+func (in *inflightRequests) wait(ctx context.Context) error {
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for in.count.Load() > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+// drain stops the servers from accepting new connections and gives
+// in-flight requests up to ShutdownGracePeriod to complete, after
+// which all remaining connections are closed.
+func (s *ValidTailnetSrv) drain(inflight *inflightRequests, servers ...*http.Server) {
+	slog.Info("Shutting down, draining connections",
+		"name", s.Name,
+		"in_flight", inflight.count.Load(),
+		"grace_period", s.ShutdownGracePeriod,
+	)
+	ctx, cancel := context.WithTimeout(context.Background(), s.ShutdownGracePeriod)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, server := range servers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := server.Shutdown(ctx); err != nil {
+				slog.Warn("could not shut down server gracefully", "name", s.Name, "error", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if err := inflight.wait(ctx); err != nil {
+		slog.Warn("Grace period expired, closing remaining connections",
+			"name", s.Name,
+			"in_flight", inflight.count.Load(),
+		)
+	}
+	for _, server := range servers {
+		server.Close()
+	}
+}
+
+// logout removes an ephemeral node from the tailnet right away,
+// instead of leaving it to expire.
+func (s *ValidTailnetSrv) logout(srv *tsnet.Server) {
+	lc, err := srv.LocalClient()
+	if err != nil {
+		slog.Warn("could not log out ephemeral node", "name", s.Name, "error", err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := lc.Logout(ctx); err != nil {
+		slog.Warn("could not log out ephemeral node", "name", s.Name, "error", err)
+		return
+	}
+	slog.Info("Logged out ephemeral node", "name", s.Name)
+}
@@ -0,0 +1,74 @@
+package tsnsrv
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// serveSlowly starts a server whose handler takes the given time to respond.
+func serveSlowly(t *testing.T, inflight *inflightRequests, delay time.Duration) (*http.Server, string, chan struct{}) {
+	started := make(chan struct{}, 1)
+	server := &http.Server{
+		Handler: inflight.track(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			started <- struct{}{}
+			time.Sleep(delay)
+			w.Write([]byte("done"))
+		})),
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go server.Serve(listener)
+	return server, "http://" + listener.Addr().String(), started
+}
+
+func TestDrainWaitsForInflightRequests(t *testing.T) {
+	var inflight inflightRequests
+	server, url, started := serveSlowly(t, &inflight, 200*time.Millisecond)
+
+	type result struct {
+		body string
+		err  error
+	}
+	results := make(chan result)
+	go func() {
+		resp, err := http.Get(url)
+		if err != nil {
+			results <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		results <- result{string(body), err}
+	}()
+	<-started
+
+	s := &ValidTailnetSrv{TailnetSrv: TailnetSrv{Name: "test", ShutdownGracePeriod: 5 * time.Second}}
+	s.drain(&inflight, server)
+
+	res := <-results
+	require.NoError(t, res.err)
+	assert.Equal(t, "done", res.body)
+	assert.Equal(t, int64(0), inflight.count.Load())
+
+	_, err := http.Get(url)
+	assert.Error(t, err, "no new connections are accepted after draining")
+}
+
+func TestDrainGivesUpAfterGracePeriod(t *testing.T) {
+	var inflight inflightRequests
+	server, url, started := serveSlowly(t, &inflight, 10*time.Second)
+
+	go http.Get(url)
+	<-started
+
+	s := &ValidTailnetSrv{TailnetSrv: TailnetSrv{Name: "test", ShutdownGracePeriod: 100 * time.Millisecond}}
+	start := time.Now()
+	s.drain(&inflight, server)
+	assert.Less(t, time.Since(start), 5*time.Second)
+}
@@ -0,0 +1,133 @@
+package tsnsrv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+const (
+	// RestartSupervise restarts a failed service with exponential
+	// backoff, leaving all other services running.
+	RestartSupervise = "supervise"
+
+	// RestartFailFast stops all services as soon as one of them fails.
+	RestartFailFast = "failFast"
+)
+
+var errRestartPolicy = errors.New("restart policy must be \"supervise\" or \"failFast\"")
+
+// RestartPolicy controls what the Orchestrator does when a service fails.
+type RestartPolicy struct {
+	// Policy is either RestartSupervise (the default) or RestartFailFast.
+	Policy string `yaml:"policy,omitempty"`
+
+	// InitialBackoff is the delay before the first restart (default 1s);
+	// it doubles with every consecutive restart.
+	InitialBackoff time.Duration `yaml:"initialBackoff,omitempty"`
+
+	// MaxBackoff caps the delay between restarts (default 1m).
+	MaxBackoff time.Duration `yaml:"maxBackoff,omitempty"`
+
+	// Jitter randomizes each delay by up to this fraction of it (default 0.2).
+	Jitter float64 `yaml:"jitter,omitempty"`
+
+	// MaxRestarts is the number of consecutive restarts after which a
+	// service is considered failed permanently. 0 means no limit.
+	MaxRestarts int `yaml:"maxRestarts,omitempty"`
+
+	// StableAfter is how long a service has to stay up for its restart
+	// count and backoff to be reset (default 5m).
+	StableAfter time.Duration `yaml:"stableAfter,omitempty"`
+}
+
+func (p RestartPolicy) validate() error {
+	switch p.Policy {
+	case "", RestartSupervise, RestartFailFast:
+	default:
+		return fmt.Errorf("%w, got %q", errRestartPolicy, p.Policy)
+	}
+	if p.Jitter < 0 || p.Jitter > 1 {
+		return fmt.Errorf("restart jitter must be between 0 and 1, got %v", p.Jitter)
+	}
+	return nil
+}
+
+func (p RestartPolicy) withDefaults() RestartPolicy {
+	if p.Policy == "" {
+		p.Policy = RestartSupervise
+	}
+	if p.InitialBackoff == 0 {
+		p.InitialBackoff = 1 * time.Second
+	}
+	if p.MaxBackoff == 0 {
+		p.MaxBackoff = 1 * time.Minute
+	}
+	if p.Jitter == 0 {
+		p.Jitter = 0.2
+	}
+	if p.StableAfter == 0 {
+		p.StableAfter = 5 * time.Minute
+	}
+	return p
+}
+
+// backoff returns the delay before restarting a service that has
+// already been restarted the given number of times in a row.
+func (p RestartPolicy) backoff(restarts int) time.Duration {
+	d := p.InitialBackoff
+	for i := 0; i < restarts && d < p.MaxBackoff; i++ {
+		d *= 2
+	}
+	d = min(d, p.MaxBackoff)
+	if p.Jitter > 0 {
+		d += time.Duration((rand.Float64()*2 - 1) * p.Jitter * float64(d))
+	}
+	return d
+}
+
+// supervise runs a service until ctx is canceled, restarting it after
+// failures as the restart policy allows. It returns the error that made
+// it give up on the service.
+func (o *Orchestrator) supervise(ctx context.Context, h *serviceHandle) error {
+	policy := o.Restart.withDefaults()
+	s := h.srv
+	restarts := 0
+	for {
+		slog.Info("Starting service", "name", s.Name)
+		o.setState(h, StateStarting, nil)
+		started := time.Now()
+		err := o.runService(ctx, s)
+		if err == nil || errors.Is(err, context.Canceled) || ctx.Err() != nil || policy.Policy == RestartFailFast {
+			return err
+		}
+
+		if time.Since(started) >= policy.StableAfter {
+			restarts = 0
+		}
+		if policy.MaxRestarts > 0 && restarts >= policy.MaxRestarts {
+			return fmt.Errorf("giving up after %d restarts: %w", restarts, err)
+		}
+		delay := policy.backoff(restarts)
+		restarts++
+		o.recordRestart(h, err)
+		slog.Warn("Service failed, restarting",
+			"name", s.Name,
+			"error", err,
+			"restarts", restarts,
+			"backoff", delay,
+		)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package tsnsrv
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRestartPolicyBackoff(t *testing.T) {
+	p := RestartPolicy{
+		InitialBackoff: 100 * time.Millisecond,
+		MaxBackoff:     1 * time.Second,
+	}
+	assert.Equal(t, 100*time.Millisecond, p.backoff(0))
+	assert.Equal(t, 200*time.Millisecond, p.backoff(1))
+	assert.Equal(t, 800*time.Millisecond, p.backoff(3))
+	assert.Equal(t, 1*time.Second, p.backoff(4))
+	assert.Equal(t, 1*time.Second, p.backoff(100))
+
+	p.Jitter = 0.5
+	for range 100 {
+		d := p.backoff(1)
+		assert.GreaterOrEqual(t, d, 100*time.Millisecond)
+		assert.LessOrEqual(t, d, 300*time.Millisecond)
+	}
+}
+
+func TestRestartPolicyValidate(t *testing.T) {
+	require.NoError(t, RestartPolicy{}.validate())
+	require.NoError(t, RestartPolicy{Policy: RestartFailFast}.validate())
+	require.ErrorIs(t, RestartPolicy{Policy: "sometimes"}.validate(), errRestartPolicy)
+	require.Error(t, RestartPolicy{Jitter: 2}.validate())
+}
+
+var errFlaky = errors.New("flaky upstream")
+
+func TestOrchestrator_SuperviseRestartsFailingService(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var flakyRuns atomic.Int32
+	o := NewOrchestrator([]*ValidTailnetSrv{
+		{TailnetSrv: TailnetSrv{Name: "flaky"}},
+		{TailnetSrv: TailnetSrv{Name: "steady"}},
+	})
+	o.Restart = RestartPolicy{
+		InitialBackoff: time.Millisecond,
+		MaxBackoff:     5 * time.Millisecond,
+		MaxRestarts:    3,
+	}
+	o.run = func(ctx context.Context, s *ValidTailnetSrv) error {
+		if s.Name == "flaky" {
+			flakyRuns.Add(1)
+			return errFlaky
+		}
+		<-ctx.Done()
+		return ctx.Err()
+	}
+
+	result := make(chan error)
+	go func() { result <- o.Run(ctx) }()
+
+	require.Eventually(t, func() bool {
+		state, _ := o.ServiceState("flaky")
+		return state == StateFailed
+	}, 5*time.Second, time.Millisecond)
+	assert.Equal(t, int32(4), flakyRuns.Load(), "one initial run plus three restarts")
+
+	state, ok := o.ServiceState("steady")
+	require.True(t, ok)
+	assert.Equal(t, StateStarting, state, "other services keep running")
+
+	cancel()
+	err := <-result
+	require.Error(t, err)
+	var svcErr *ServiceError
+	require.ErrorAs(t, err, &svcErr)
+	assert.Equal(t, "flaky", svcErr.ServiceName)
+	assert.ErrorIs(t, err, errFlaky)
+}
+
+func TestOrchestrator_FailFast(t *testing.T) {
+	var flakyRuns atomic.Int32
+	o := NewOrchestrator([]*ValidTailnetSrv{
+		{TailnetSrv: TailnetSrv{Name: "flaky"}},
+		{TailnetSrv: TailnetSrv{Name: "steady"}},
+	})
+	o.Restart = RestartPolicy{Policy: RestartFailFast}
+	o.run = func(ctx context.Context, s *ValidTailnetSrv) error {
+		if s.Name == "flaky" {
+			flakyRuns.Add(1)
+			return errFlaky
+		}
+		<-ctx.Done()
+		return ctx.Err()
+	}
+
+	err := o.Run(context.Background())
+	require.ErrorIs(t, err, errFlaky)
+	assert.Equal(t, int32(1), flakyRuns.Load())
+	state, _ := o.ServiceState("steady")
+	assert.Equal(t, StateStopped, state)
+}
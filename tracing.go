@@ -0,0 +1,732 @@
+package tsnsrv
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"golang.org/x/exp/slog"
+	"tailscale.com/client/tailscale/apitype"
+)
+
+var droppedSpans = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "tsnsrv_trace_spans_dropped_total",
+	Help: "Trace spans that could not be exported, by reason (queue_full, export_failed)",
+}, []string{"reason"})
+
+// OTLP protocols that traces can be exported with.
+const (
+	TracingHTTPJSON     = "http/json"
+	TracingHTTPProtobuf = "http/protobuf"
+	TracingGRPC         = "grpc"
+)
+
+// Tracing configures exporting traces of requests over OTLP.
+type Tracing struct {
+	// Endpoint is the URL that traces are exported to. Over HTTP,
+	// that's e.g. http://localhost:4318/v1/traces; a URL without a
+	// path gets /v1/traces appended. Over gRPC, it's the collector's
+	// address, e.g. http://localhost:4317. Empty disables tracing.
+	Endpoint string `yaml:"endpoint,omitempty"`
+
+	// Protocol is how traces are exported: TracingHTTPJSON (the
+	// default), TracingHTTPProtobuf or TracingGRPC.
+	Protocol string `yaml:"protocol,omitempty"`
+
+	// Headers are sent with each export request, e.g. to
+	// authenticate with the collector.
+	Headers map[string]string `yaml:"headers,omitempty"`
+
+	// SampleRatio is the fraction of new traces that are recorded
+	// (default 1). Requests from the tailnet that carry a traceparent
+	// follow its sampling decision.
+	SampleRatio float64 `yaml:"sampleRatio,omitempty"`
+
+	// BatchTimeout is how long spans are collected before they are
+	// exported (default 5s).
+	BatchTimeout time.Duration `yaml:"batchTimeout,omitempty"`
+
+	// ExportTimeout limits each export request (default 10s).
+	ExportTimeout time.Duration `yaml:"exportTimeout,omitempty"`
+}
+
+func (tc Tracing) enabled() bool {
+	return tc.Endpoint != ""
+}
+
+func (tc Tracing) validate() error {
+	var errs []error
+	if tc.enabled() {
+		u, err := url.Parse(tc.Endpoint)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("tracing endpoint must be an http(s) URL, got %q", tc.Endpoint))
+		}
+	}
+	switch tc.Protocol {
+	case "", TracingHTTPJSON, TracingHTTPProtobuf, TracingGRPC:
+	default:
+		errs = append(errs, fmt.Errorf("tracing protocol must be %q, %q or %q, got %q", TracingHTTPJSON, TracingHTTPProtobuf, TracingGRPC, tc.Protocol))
+	}
+	if tc.SampleRatio < 0 || tc.SampleRatio > 1 {
+		errs = append(errs, errors.New("tracing sample ratio must be between 0 and 1"))
+	}
+	if tc.BatchTimeout < 0 || tc.ExportTimeout < 0 {
+		errs = append(errs, errors.New("tracing timeouts can not be negative"))
+	}
+	return errors.Join(errs...)
+}
+
+// otlpGRPCMethod is the path that OTLP/gRPC exports are sent to.
+const otlpGRPCMethod = "/opentelemetry.proto.collector.trace.v1.TraceService/Export"
+
+func (tc Tracing) withDefaults() Tracing {
+	if tc.Protocol == "" {
+		tc.Protocol = TracingHTTPJSON
+	}
+	if u, err := url.Parse(tc.Endpoint); err == nil {
+		switch {
+		case tc.Protocol == TracingGRPC:
+			u.Path = strings.TrimSuffix(u.Path, "/") + otlpGRPCMethod
+		case u.Path == "" || u.Path == "/":
+			u.Path = "/v1/traces"
+		}
+		tc.Endpoint = u.String()
+	}
+	if tc.SampleRatio == 0 {
+		tc.SampleRatio = 1
+	}
+	if tc.BatchTimeout == 0 {
+		tc.BatchTimeout = 5 * time.Second
+	}
+	if tc.ExportTimeout == 0 {
+		tc.ExportTimeout = 10 * time.Second
+	}
+	return tc
+}
+
+// Span kinds, as OTLP numbers them.
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+	spanKindClient   = 3
+)
+
+// maxQueuedSpans is how many spans wait for export before new ones
+// are dropped.
+const maxQueuedSpans = 4096
+
+type traceID [16]byte
+type spanID [8]byte
+
+// spanContext identifies a span across processes, as in the W3C
+// traceparent header.
+type spanContext struct {
+	traceID traceID
+	spanID  spanID
+	sampled bool
+}
+
+func (sc spanContext) traceparent() string {
+	flags := "00"
+	if sc.sampled {
+		flags = "01"
+	}
+	return "00-" + hex.EncodeToString(sc.traceID[:]) + "-" + hex.EncodeToString(sc.spanID[:]) + "-" + flags
+}
+
+// parseTraceparent parses a W3C traceparent header.
+func parseTraceparent(value string) (spanContext, bool) {
+	var sc spanContext
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return sc, false
+	}
+	if len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.traceID[:], []byte(parts[1])); err != nil || sc.traceID == (traceID{}) {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.spanID[:], []byte(parts[2])); err != nil || sc.spanID == (spanID{}) {
+		return sc, false
+	}
+	flags, err := strconv.ParseUint(parts[3], 16, 8)
+	if err != nil {
+		return sc, false
+	}
+	sc.sampled = flags&1 == 1
+	return sc, true
+}
+
+type spanAttr struct {
+	key   string
+	value any
+}
+
+// span is a timed operation in a trace. A nil span does nothing, so
+// that callers don't have to check whether tracing is enabled.
+type span struct {
+	tracer  *Tracer
+	service string
+	name    string
+	kind    int
+	context spanContext
+	parent  spanID
+	start   time.Time
+
+	mu       sync.Mutex
+	end      time.Time
+	attrs    []spanAttr
+	errorMsg string
+}
+
+func (sp *span) setAttr(key string, value any) {
+	if sp == nil {
+		return
+	}
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	sp.attrs = append(sp.attrs, spanAttr{key, value})
+}
+
+// setError marks the span as failed, if err is not nil.
+func (sp *span) setError(err error) {
+	if sp == nil || err == nil {
+		return
+	}
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	sp.errorMsg = err.Error()
+}
+
+// setIdentity records the Tailscale identity of a requestor.
+func (sp *span) setIdentity(who *apitype.WhoIsResponse) {
+	if sp == nil || who == nil {
+		return
+	}
+	if who.UserProfile != nil {
+		sp.setAttr("tailscale.user.login", who.UserProfile.LoginName)
+	}
+	if who.Node != nil {
+		sp.setAttr("tailscale.node.name", who.Node.ComputedName)
+		if len(who.Node.Tags) > 0 {
+			sp.setAttr("tailscale.node.tags", strings.Join(who.Node.Tags, ","))
+		}
+	}
+}
+
+// inject sets the traceparent header for the span's downstream calls.
+func (sp *span) inject(h http.Header) {
+	if sp == nil {
+		return
+	}
+	h.Set("Traceparent", sp.context.traceparent())
+}
+
+// finish ends the span and queues it for export.
+func (sp *span) finish() {
+	if sp == nil {
+		return
+	}
+	sp.mu.Lock()
+	sp.end = time.Now()
+	sp.mu.Unlock()
+	if sp.context.sampled {
+		sp.tracer.enqueue(sp)
+	}
+}
+
+type spanKey struct{}
+
+func spanFromContext(ctx context.Context) *span {
+	sp, _ := ctx.Value(spanKey{}).(*span)
+	return sp
+}
+
+// Tracer records spans and exports them in batches.
+type Tracer struct {
+	config Tracing
+	client *http.Client
+
+	queue   chan *span
+	stop    chan struct{}
+	stopped chan struct{}
+	once    sync.Once
+}
+
+// NewTracer starts exporting the traces of a configuration. It returns
+// nil if no endpoint is configured.
+func NewTracer(tc Tracing) (*Tracer, error) {
+	if !tc.enabled() {
+		return nil, nil
+	}
+	if err := tc.validate(); err != nil {
+		return nil, err
+	}
+	t := &Tracer{
+		config:  tc.withDefaults(),
+		queue:   make(chan *span, maxQueuedSpans),
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if t.config.Protocol == TracingGRPC {
+		// gRPC needs HTTP/2, also without TLS:
+		transport.Protocols = new(http.Protocols)
+		transport.Protocols.SetHTTP2(true)
+		transport.Protocols.SetUnencryptedHTTP2(true)
+	}
+	t.client = &http.Client{Transport: transport, Timeout: t.config.ExportTimeout}
+	go t.run()
+	return t, nil
+}
+
+// Close exports the spans that are still queued, and stops the tracer.
+func (t *Tracer) Close() {
+	if t == nil {
+		return
+	}
+	t.once.Do(func() { close(t.stop) })
+	<-t.stopped
+}
+
+// start begins a span of a service. Without a tracer, it returns ctx
+// and a nil span.
+func (t *Tracer) start(ctx context.Context, service, name string, kind int) (context.Context, *span) {
+	if t == nil {
+		return ctx, nil
+	}
+	sp := &span{tracer: t, service: service, name: name, kind: kind, start: time.Now()}
+	if parent := spanFromContext(ctx); parent != nil {
+		sp.context = parent.context
+		sp.parent = parent.context.spanID
+	} else {
+		binary.BigEndian.PutUint64(sp.context.traceID[:8], rand.Uint64())
+		binary.BigEndian.PutUint64(sp.context.traceID[8:], rand.Uint64())
+		sp.context.sampled = t.samples(sp.context.traceID)
+	}
+	binary.BigEndian.PutUint64(sp.context.spanID[:], rand.Uint64()|1)
+	return context.WithValue(ctx, spanKey{}, sp), sp
+}
+
+// startRemote begins a server span that continues a trace from a
+// traceparent header.
+func (t *Tracer) startRemote(ctx context.Context, service, name string, remote spanContext) (context.Context, *span) {
+	if t == nil {
+		return ctx, nil
+	}
+	ctx, sp := t.start(ctx, service, name, spanKindServer)
+	sp.context.traceID = remote.traceID
+	sp.context.sampled = remote.sampled
+	sp.parent = remote.spanID
+	return ctx, sp
+}
+
+// samples decides whether a new trace is recorded, the same way for
+// the same trace ID.
+func (t *Tracer) samples(id traceID) bool {
+	if t.config.SampleRatio >= 1 {
+		return true
+	}
+	return float64(binary.BigEndian.Uint64(id[8:])) < t.config.SampleRatio*math.MaxUint64
+}
+
+func (t *Tracer) enqueue(sp *span) {
+	select {
+	case t.queue <- sp:
+	default:
+		droppedSpans.With(prometheus.Labels{"reason": "queue_full"}).Inc()
+	}
+}
+
+func (t *Tracer) run() {
+	defer close(t.stopped)
+	ticker := time.NewTicker(t.config.BatchTimeout)
+	defer ticker.Stop()
+	var batch []*span
+	for {
+		select {
+		case sp := <-t.queue:
+			batch = append(batch, sp)
+			if len(batch) >= maxQueuedSpans/8 {
+				t.export(batch)
+				batch = nil
+			}
+		case <-ticker.C:
+			t.export(batch)
+			batch = nil
+		case <-t.stop:
+			for {
+				select {
+				case sp := <-t.queue:
+					batch = append(batch, sp)
+				default:
+					t.export(batch)
+					return
+				}
+			}
+		}
+	}
+}
+
+func (t *Tracer) export(batch []*span) {
+	if len(batch) == 0 {
+		return
+	}
+	var body []byte
+	var err error
+	if t.config.Protocol == TracingHTTPJSON {
+		body, err = json.Marshal(otlpRequest(batch))
+	} else {
+		body = otlpProtobuf(batch)
+	}
+	if err == nil {
+		err = t.post(body)
+	}
+	if err != nil {
+		droppedSpans.With(prometheus.Labels{"reason": "export_failed"}).Add(float64(len(batch)))
+		slog.Warn("could not export traces",
+			"endpoint", t.config.Endpoint,
+			"spans", len(batch),
+			"error", err,
+		)
+	}
+}
+
+func (t *Tracer) post(body []byte) error {
+	contentType := "application/json"
+	switch t.config.Protocol {
+	case TracingHTTPProtobuf:
+		contentType = "application/x-protobuf"
+	case TracingGRPC:
+		// A gRPC message is prefixed with an uncompressed flag and its length:
+		body = append(binary.BigEndian.AppendUint32([]byte{0}, uint32(len(body))), body...)
+		contentType = "application/grpc"
+	}
+	req, err := http.NewRequest(http.MethodPost, t.config.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	if t.config.Protocol == TracingGRPC {
+		req.Header.Set("Te", "trailers")
+	}
+	for name, value := range t.config.Headers {
+		req.Header.Set(name, value)
+	}
+	res, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(res.Body, 64<<10))
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("collector responded with %s", res.Status)
+	}
+	if t.config.Protocol == TracingGRPC {
+		// Errors come in the trailers, or in the headers of responses
+		// without a body:
+		status, msg := res.Trailer.Get("Grpc-Status"), res.Trailer.Get("Grpc-Message")
+		if status == "" {
+			status, msg = res.Header.Get("Grpc-Status"), res.Header.Get("Grpc-Message")
+		}
+		if status != "0" {
+			if unescaped, err := url.PathUnescape(msg); err == nil {
+				msg = unescaped
+			}
+			return fmt.Errorf("collector responded with gRPC status %q: %s", status, msg)
+		}
+	}
+	return nil
+}
+
+// The OTLP JSON encoding of spans; see
+// https://opentelemetry.io/docs/specs/otlp/#json-protobuf-encoding.
+type (
+	otlpTraces struct {
+		ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+	}
+	otlpResourceSpans struct {
+		Resource   otlpResource     `json:"resource"`
+		ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+	}
+	otlpResource struct {
+		Attributes []otlpKeyValue `json:"attributes"`
+	}
+	otlpScopeSpans struct {
+		Scope otlpScope  `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+	otlpScope struct {
+		Name string `json:"name"`
+	}
+	otlpSpan struct {
+		TraceID           string         `json:"traceId"`
+		SpanID            string         `json:"spanId"`
+		ParentSpanID      string         `json:"parentSpanId,omitempty"`
+		Name              string         `json:"name"`
+		Kind              int            `json:"kind"`
+		StartTimeUnixNano string         `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+		Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+		Status            *otlpStatus    `json:"status,omitempty"`
+	}
+	otlpStatus struct {
+		Code    int    `json:"code"`
+		Message string `json:"message,omitempty"`
+	}
+	otlpKeyValue struct {
+		Key   string    `json:"key"`
+		Value otlpValue `json:"value"`
+	}
+	otlpValue struct {
+		StringValue *string `json:"stringValue,omitempty"`
+		IntValue    *string `json:"intValue,omitempty"`
+		BoolValue   *bool   `json:"boolValue,omitempty"`
+	}
+)
+
+func otlpAttr(key string, value any) otlpKeyValue {
+	kv := otlpKeyValue{Key: key}
+	switch v := value.(type) {
+	case int:
+		s := strconv.Itoa(v)
+		kv.Value.IntValue = &s
+	case bool:
+		kv.Value.BoolValue = &v
+	default:
+		s := fmt.Sprint(v)
+		kv.Value.StringValue = &s
+	}
+	return kv
+}
+
+// tracingScope is the instrumentation scope of tsnsrv's spans.
+const tracingScope = "github.com/boinkor-net/tsnsrv"
+
+// byService groups spans by the service they belong to.
+func byService(batch []*span) [][]*span {
+	var groups [][]*span
+	index := map[string]int{}
+	for _, sp := range batch {
+		i, ok := index[sp.service]
+		if !ok {
+			i = len(groups)
+			index[sp.service] = i
+			groups = append(groups, nil)
+		}
+		groups[i] = append(groups[i], sp)
+	}
+	return groups
+}
+
+// otlpRequest encodes spans in the OTLP JSON encoding.
+func otlpRequest(batch []*span) otlpTraces {
+	var req otlpTraces
+	for _, spans := range byService(batch) {
+		rs := otlpResourceSpans{
+			Resource:   otlpResource{Attributes: []otlpKeyValue{otlpAttr("service.name", spans[0].service)}},
+			ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: tracingScope}}},
+		}
+		for _, sp := range spans {
+			rs.ScopeSpans[0].Spans = append(rs.ScopeSpans[0].Spans, sp.otlp())
+		}
+		req.ResourceSpans = append(req.ResourceSpans, rs)
+	}
+	return req
+}
+
+func (sp *span) otlp() otlpSpan {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	out := otlpSpan{
+		TraceID:           hex.EncodeToString(sp.context.traceID[:]),
+		SpanID:            hex.EncodeToString(sp.context.spanID[:]),
+		Name:              sp.name,
+		Kind:              sp.kind,
+		StartTimeUnixNano: strconv.FormatInt(sp.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(sp.end.UnixNano(), 10),
+	}
+	if sp.parent != (spanID{}) {
+		out.ParentSpanID = hex.EncodeToString(sp.parent[:])
+	}
+	for _, attr := range sp.attrs {
+		out.Attributes = append(out.Attributes, otlpAttr(attr.key, attr.value))
+	}
+	if sp.errorMsg != "" {
+		out.Status = &otlpStatus{Code: 2, Message: sp.errorMsg}
+	}
+	return out
+}
+
+// protoMessage is a message in the protocol buffers encoding that
+// OTLP/gRPC and http/protobuf use, see
+// https://protobuf.dev/programming-guides/encoding/. The field numbers
+// of OTLP messages are from
+// https://github.com/open-telemetry/opentelemetry-proto.
+type protoMessage []byte
+
+func (m protoMessage) tag(field int, wireType uint64) protoMessage {
+	return binary.AppendUvarint(m, uint64(field)<<3|wireType)
+}
+
+func (m protoMessage) varint(field int, v uint64) protoMessage {
+	return binary.AppendUvarint(m.tag(field, 0), v)
+}
+
+func (m protoMessage) fixed64(field int, v uint64) protoMessage {
+	return binary.LittleEndian.AppendUint64(m.tag(field, 1), v)
+}
+
+func (m protoMessage) bytes(field int, v []byte) protoMessage {
+	return append(binary.AppendUvarint(m.tag(field, 2), uint64(len(v))), v...)
+}
+
+func (m protoMessage) str(field int, v string) protoMessage {
+	return m.bytes(field, []byte(v))
+}
+
+// otlpProtobuf encodes spans as an ExportTraceServiceRequest.
+func otlpProtobuf(batch []*span) []byte {
+	var req protoMessage
+	for _, spans := range byService(batch) {
+		resource := protoMessage(nil).bytes(1, protoAttr("service.name", spans[0].service))
+		scopeSpans := protoMessage(nil).bytes(1, protoMessage(nil).str(1, tracingScope))
+		for _, sp := range spans {
+			scopeSpans = scopeSpans.bytes(2, sp.protobuf())
+		}
+		req = req.bytes(1, protoMessage(nil).bytes(1, resource).bytes(2, scopeSpans))
+	}
+	return req
+}
+
+// protoAttr encodes a KeyValue.
+func protoAttr(key string, value any) protoMessage {
+	var v protoMessage
+	switch val := value.(type) {
+	case int:
+		v = v.varint(3, uint64(val))
+	case bool:
+		var b uint64
+		if val {
+			b = 1
+		}
+		v = v.varint(2, b)
+	default:
+		v = v.str(1, fmt.Sprint(val))
+	}
+	return protoMessage(nil).str(1, key).bytes(2, v)
+}
+
+// protobuf encodes a Span.
+func (sp *span) protobuf() protoMessage {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	m := protoMessage(nil).bytes(1, sp.context.traceID[:]).bytes(2, sp.context.spanID[:])
+	if sp.parent != (spanID{}) {
+		m = m.bytes(4, sp.parent[:])
+	}
+	m = m.str(5, sp.name).
+		varint(6, uint64(sp.kind)).
+		fixed64(7, uint64(sp.start.UnixNano())).
+		fixed64(8, uint64(sp.end.UnixNano()))
+	for _, attr := range sp.attrs {
+		m = m.bytes(9, protoAttr(attr.key, attr.value))
+	}
+	if sp.errorMsg != "" {
+		m = m.bytes(15, protoMessage(nil).str(2, sp.errorMsg).varint(3, 2))
+	}
+	return m
+}
+
+// tracingMiddleware records a server span for each request, continuing
+// the trace of tailnet clients that send a traceparent.
+func (s *ValidTailnetSrv) tracingMiddleware(forFunnel bool, next http.Handler) http.Handler {
+	if s.tracer == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var ctx context.Context
+		var sp *span
+		// Funnel clients are on the internet; their traces aren't ours.
+		if remote, ok := parseTraceparent(r.Header.Get("Traceparent")); ok && !forFunnel {
+			ctx, sp = s.tracer.startRemote(r.Context(), s.Name, r.Method, remote)
+		} else {
+			ctx, sp = s.tracer.start(r.Context(), s.Name, r.Method, spanKindServer)
+		}
+		provenance := "tailnet"
+		if forFunnel {
+			provenance = "funnel"
+		}
+		sp.setAttr("tsnsrv.service", s.Name)
+		sp.setAttr("tsnsrv.provenance", provenance)
+		sp.setAttr("http.request.method", r.Method)
+		sp.setAttr("url.path", r.URL.Path)
+		sp.setAttr("client.address", r.RemoteAddr)
+		sw := &statusWriter{ResponseWriter: w}
+		defer func() {
+			status := sw.status
+			if status == 0 {
+				status = http.StatusOK
+			}
+			sp.setAttr("http.response.status_code", status)
+			if status >= 500 {
+				sp.setError(errors.New(http.StatusText(status)))
+			}
+			if !s.SuppressWhois && s.client != nil {
+				if who, err := s.whoisFor(r); err == nil {
+					sp.setIdentity(who)
+				}
+			}
+			sp.finish()
+		}()
+		r = r.WithContext(ctx)
+		next.ServeHTTP(sw, r)
+	})
+}
+
+// tracingTransport records a client span for each upstream call, and
+// passes the trace on to the upstream.
+type tracingTransport struct {
+	service string
+	tracer  *Tracer
+	next    http.RoundTripper
+}
+
+func (t *tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, sp := t.tracer.start(req.Context(), t.service, "upstream "+req.Method, spanKindClient)
+	sp.setAttr("http.request.method", req.Method)
+	sp.setAttr("server.address", req.URL.Host)
+	sp.setAttr("url.full", req.URL.String())
+	req = req.Clone(ctx)
+	sp.inject(req.Header)
+	res, err := t.next.RoundTrip(req)
+	if p, ok := req.Context().Value(proxyContextKey).(*proxyContext); ok && p.retries > 0 {
+		sp.setAttr("tsnsrv.retries", p.retries)
+	}
+	if err != nil {
+		sp.setError(err)
+	} else {
+		sp.setAttr("http.response.status_code", res.StatusCode)
+		if res.StatusCode >= 500 {
+			sp.setError(errors.New(res.Status))
+		}
+	}
+	sp.finish()
+	return res, err
+}
@@ -0,0 +1,382 @@
+package tsnsrv
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/tailcfg"
+)
+
+func TestTracingValidate(t *testing.T) {
+	t.Parallel()
+	assert.NoError(t, Tracing{}.validate())
+	assert.NoError(t, Tracing{Endpoint: "http://localhost:4318", SampleRatio: 0.1}.validate())
+	assert.Error(t, Tracing{Endpoint: "localhost:4318"}.validate())
+	assert.Error(t, Tracing{Endpoint: "http://localhost:4318", SampleRatio: 2}.validate())
+
+	assert.Equal(t, "http://localhost:4318/v1/traces", Tracing{Endpoint: "http://localhost:4318"}.withDefaults().Endpoint)
+	assert.Equal(t, "https://otel.example.com/api/traces", Tracing{Endpoint: "https://otel.example.com/api/traces"}.withDefaults().Endpoint)
+
+	assert.NoError(t, Tracing{Endpoint: "http://localhost:4317", Protocol: TracingGRPC}.validate())
+	assert.Error(t, Tracing{Endpoint: "http://localhost:4317", Protocol: "thrift"}.validate())
+	assert.Equal(t, "http://localhost:4317"+otlpGRPCMethod, Tracing{Endpoint: "http://localhost:4317", Protocol: TracingGRPC}.withDefaults().Endpoint)
+	assert.Equal(t, TracingHTTPJSON, Tracing{Endpoint: "http://localhost:4318"}.withDefaults().Protocol)
+}
+
+func TestParseTraceparent(t *testing.T) {
+	t.Parallel()
+	const header = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	sc, ok := parseTraceparent(header)
+	require.True(t, ok)
+	assert.True(t, sc.sampled)
+	assert.Equal(t, header, sc.traceparent())
+
+	sc, ok = parseTraceparent("01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00-future")
+	require.True(t, ok, "later versions may add fields")
+	assert.False(t, sc.sampled)
+
+	for _, invalid := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e473-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e47zz-00f067aa0ba902b7-01",
+	} {
+		_, ok := parseTraceparent(invalid)
+		assert.False(t, ok, invalid)
+	}
+}
+
+// collector stands in for an OTLP collector.
+type collector struct {
+	mu    sync.Mutex
+	spans map[string]otlpSpan
+	attrs map[string]map[string]string
+	// services are the service.name of each span's resource.
+	services map[string]string
+}
+
+func newCollector(t *testing.T, protocol string) (*collector, string) {
+	c := &collector{spans: map[string]otlpSpan{}, attrs: map[string]map[string]string{}, services: map[string]string{}}
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "secret", r.Header.Get("X-Api-Key"))
+		var req otlpTraces
+		switch protocol {
+		case TracingHTTPJSON:
+			assert.Equal(t, "/v1/traces", r.URL.Path)
+			assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+			assert.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		case TracingHTTPProtobuf:
+			assert.Equal(t, "/v1/traces", r.URL.Path)
+			assert.Equal(t, "application/x-protobuf", r.Header.Get("Content-Type"))
+			body, err := io.ReadAll(r.Body)
+			assert.NoError(t, err)
+			req, err = decodeOTLPProtobuf(body)
+			assert.NoError(t, err)
+		case TracingGRPC:
+			assert.Equal(t, otlpGRPCMethod, r.URL.Path)
+			assert.Equal(t, 2, r.ProtoMajor)
+			assert.Equal(t, "application/grpc", r.Header.Get("Content-Type"))
+			body, err := io.ReadAll(r.Body)
+			assert.NoError(t, err)
+			if assert.GreaterOrEqual(t, len(body), 5) {
+				assert.Equal(t, byte(0), body[0], "messages aren't compressed")
+				assert.Equal(t, len(body)-5, int(binary.BigEndian.Uint32(body[1:5])))
+				req, err = decodeOTLPProtobuf(body[5:])
+				assert.NoError(t, err)
+			}
+			w.Header().Set("Content-Type", "application/grpc")
+			w.Write([]byte{0, 0, 0, 0, 0})
+			w.Header().Set(http.TrailerPrefix+"Grpc-Status", "0")
+		}
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		for _, rs := range req.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				for _, sp := range ss.Spans {
+					c.spans[sp.Name] = sp
+					c.services[sp.Name] = *rs.Resource.Attributes[0].Value.StringValue
+					c.attrs[sp.Name] = map[string]string{}
+					for _, kv := range sp.Attributes {
+						v := kv.Value
+						switch {
+						case v.StringValue != nil:
+							c.attrs[sp.Name][kv.Key] = *v.StringValue
+						case v.IntValue != nil:
+							c.attrs[sp.Name][kv.Key] = *v.IntValue
+						}
+					}
+				}
+			}
+		}
+	}))
+	srv.Config.Protocols = new(http.Protocols)
+	srv.Config.Protocols.SetHTTP1(true)
+	srv.Config.Protocols.SetUnencryptedHTTP2(true)
+	srv.Start()
+	t.Cleanup(srv.Close)
+	return c, srv.URL
+}
+
+// decodeOTLPProtobuf decodes an ExportTraceServiceRequest, as far as
+// tsnsrv encodes it.
+func decodeOTLPProtobuf(m []byte) (otlpTraces, error) {
+	var d protoDecoder
+	keyValue := func(m []byte) otlpKeyValue {
+		f := d.fields(m)
+		kv := otlpKeyValue{Key: d.str(f, 1)}
+		v := d.fields(d.bytes(f, 2))
+		switch {
+		case len(v[1]) > 0:
+			s := d.str(v, 1)
+			kv.Value.StringValue = &s
+		case len(v[2]) > 0:
+			b := d.uint(v, 2) != 0
+			kv.Value.BoolValue = &b
+		case len(v[3]) > 0:
+			s := strconv.FormatInt(int64(d.uint(v, 3)), 10)
+			kv.Value.IntValue = &s
+		}
+		return kv
+	}
+	var req otlpTraces
+	for _, m := range d.fields(m)[1] {
+		f := d.fields(m.([]byte))
+		var rs otlpResourceSpans
+		for _, kv := range d.fields(d.bytes(f, 1))[1] {
+			rs.Resource.Attributes = append(rs.Resource.Attributes, keyValue(kv.([]byte)))
+		}
+		for _, m := range f[2] {
+			f := d.fields(m.([]byte))
+			ss := otlpScopeSpans{Scope: otlpScope{Name: d.str(d.fields(d.bytes(f, 1)), 1)}}
+			for _, m := range f[2] {
+				f := d.fields(m.([]byte))
+				sp := otlpSpan{
+					TraceID:           hex.EncodeToString(d.bytes(f, 1)),
+					SpanID:            hex.EncodeToString(d.bytes(f, 2)),
+					ParentSpanID:      hex.EncodeToString(d.bytes(f, 4)),
+					Name:              d.str(f, 5),
+					Kind:              int(d.uint(f, 6)),
+					StartTimeUnixNano: strconv.FormatUint(d.uint(f, 7), 10),
+					EndTimeUnixNano:   strconv.FormatUint(d.uint(f, 8), 10),
+				}
+				for _, kv := range f[9] {
+					sp.Attributes = append(sp.Attributes, keyValue(kv.([]byte)))
+				}
+				if len(f[15]) > 0 {
+					status := d.fields(d.bytes(f, 15))
+					sp.Status = &otlpStatus{Code: int(d.uint(status, 3)), Message: d.str(status, 2)}
+				}
+				ss.Spans = append(ss.Spans, sp)
+			}
+			rs.ScopeSpans = append(rs.ScopeSpans, ss)
+		}
+		req.ResourceSpans = append(req.ResourceSpans, rs)
+	}
+	return req, d.err
+}
+
+// protoDecoder decodes protocol buffers messages, and remembers the
+// first error.
+type protoDecoder struct {
+	err error
+}
+
+// fields returns the values of each field of a message: []byte for
+// length-delimited fields, uint64 for others.
+func (d *protoDecoder) fields(m []byte) map[int][]any {
+	fields := map[int][]any{}
+	for len(m) > 0 && d.err == nil {
+		tag, n := binary.Uvarint(m)
+		if n <= 0 {
+			d.err = errors.New("invalid tag")
+			break
+		}
+		m = m[n:]
+		var v any
+		switch tag & 7 {
+		case 0:
+			var x uint64
+			x, n = binary.Uvarint(m)
+			if n <= 0 {
+				d.err = errors.New("invalid varint")
+				break
+			}
+			v, m = x, m[n:]
+		case 1:
+			if len(m) < 8 {
+				d.err = errors.New("short fixed64")
+				break
+			}
+			v, m = binary.LittleEndian.Uint64(m), m[8:]
+		case 2:
+			l, n := binary.Uvarint(m)
+			if n <= 0 || uint64(len(m)-n) < l {
+				d.err = errors.New("invalid length")
+				break
+			}
+			v, m = m[n:n+int(l)], m[n+int(l):]
+		default:
+			d.err = fmt.Errorf("unexpected wire type %d", tag&7)
+		}
+		fields[int(tag>>3)] = append(fields[int(tag>>3)], v)
+	}
+	return fields
+}
+
+func (d *protoDecoder) bytes(fields map[int][]any, field int) []byte {
+	if len(fields[field]) == 0 {
+		return nil
+	}
+	b, _ := fields[field][0].([]byte)
+	return b
+}
+
+func (d *protoDecoder) str(fields map[int][]any, field int) string {
+	return string(d.bytes(fields, field))
+}
+
+func (d *protoDecoder) uint(fields map[int][]any, field int) uint64 {
+	if len(fields[field]) == 0 {
+		return 0
+	}
+	x, _ := fields[field][0].(uint64)
+	return x
+}
+
+func TestTracing(t *testing.T) {
+	t.Parallel()
+	for _, protocol := range []string{TracingHTTPJSON, TracingHTTPProtobuf, TracingGRPC} {
+		t.Run(protocol, func(t *testing.T) {
+			t.Parallel()
+			testTracing(t, protocol)
+		})
+	}
+}
+
+func testTracing(t *testing.T, protocol string) {
+	c, endpoint := newCollector(t, protocol)
+	tracer, err := NewTracer(Tracing{Endpoint: endpoint, Protocol: protocol, Headers: map[string]string{"X-Api-Key": "secret"}, BatchTimeout: time.Hour})
+	require.NoError(t, err)
+
+	var authTraceparent, upstreamTraceparent string
+	auth := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authTraceparent = r.Header.Get("Traceparent")
+	}))
+	defer auth.Close()
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamTraceparent = r.Header.Get("Traceparent")
+	}))
+	defer upstream.Close()
+	dest, err := url.Parse(upstream.URL)
+	require.NoError(t, err)
+
+	s := &ValidTailnetSrv{
+		TailnetSrv: TailnetSrv{Name: "app", AuthURL: auth.URL, AuthPath: "/auth", AuthTimeout: time.Second},
+		DestURL:    dest,
+		client: &mockLocalClient{whoIsFunc: func(ctx context.Context, addr string) (*apitype.WhoIsResponse, error) {
+			return &apitype.WhoIsResponse{
+				UserProfile: &tailcfg.UserProfile{ID: 1, LoginName: "alice@example.com"},
+				Node:        &tailcfg.Node{ID: 2, ComputedName: "laptop"},
+			}, nil
+		}},
+		tracer: tracer,
+	}
+	handler := s.mux(&tracingTransport{service: s.Name, tracer: tracer, next: http.DefaultTransport}, false)
+	req := httptest.NewRequest("GET", "/photos", nil)
+	req.Header.Set("Traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	tracer.Close()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	require.Len(t, c.spans, 4)
+	server, whois, forwardAuth, proxied := c.spans["GET"], c.spans["tailscale.whois"], c.spans["forward_auth"], c.spans["upstream GET"]
+	for name, sp := range c.spans {
+		assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", sp.TraceID, "%s continues the client's trace", name)
+		assert.Equal(t, "app", c.services[name])
+	}
+	assert.Equal(t, "00f067aa0ba902b7", server.ParentSpanID)
+	assert.Equal(t, spanKindServer, server.Kind)
+	assert.Equal(t, server.SpanID, whois.ParentSpanID)
+	assert.Equal(t, server.SpanID, forwardAuth.ParentSpanID)
+	assert.Equal(t, server.SpanID, proxied.ParentSpanID)
+	assert.Equal(t, "00-4bf92f3577b34da6a3ce929d0e0e4736-"+forwardAuth.SpanID+"-01", authTraceparent)
+	assert.Equal(t, "00-4bf92f3577b34da6a3ce929d0e0e4736-"+proxied.SpanID+"-01", upstreamTraceparent)
+
+	assert.Equal(t, "tailnet", c.attrs["GET"]["tsnsrv.provenance"])
+	assert.Equal(t, "app", c.attrs["GET"]["tsnsrv.service"])
+	assert.Equal(t, "alice@example.com", c.attrs["GET"]["tailscale.user.login"])
+	assert.Equal(t, "laptop", c.attrs["GET"]["tailscale.node.name"])
+	assert.Equal(t, "200", c.attrs["GET"]["http.response.status_code"])
+	assert.Equal(t, "alice@example.com", c.attrs["tailscale.whois"]["tailscale.user.login"])
+	assert.Equal(t, "200", c.attrs["upstream GET"]["http.response.status_code"])
+}
+
+func TestTracingFunnelAndSampling(t *testing.T) {
+	t.Parallel()
+	c, endpoint := newCollector(t, TracingHTTPJSON)
+	tracer, err := NewTracer(Tracing{Endpoint: endpoint, Headers: map[string]string{"X-Api-Key": "secret"}, SampleRatio: 1e-12, BatchTimeout: time.Hour})
+	require.NoError(t, err)
+	var traceparent string
+	s := &ValidTailnetSrv{TailnetSrv: TailnetSrv{Name: "app", SuppressWhois: true}, tracer: tracer}
+	handler := s.tracingMiddleware(true, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, sp := tracer.start(r.Context(), s.Name, "upstream", spanKindClient)
+		h := http.Header{}
+		sp.inject(h)
+		traceparent = h.Get("Traceparent")
+		sp.finish()
+	}))
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	tracer.Close()
+
+	sc, ok := parseTraceparent(traceparent)
+	require.True(t, ok)
+	assert.NotEqual(t, "4bf92f3577b34da6a3ce929d0e0e4736", sc.traceparent()[3:35], "funnel requests start their own trace")
+	assert.False(t, sc.sampled, "unsampled traces are still propagated")
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	assert.Empty(t, c.spans, "unsampled spans aren't exported")
+}
+
+func TestTracingGRPCStatus(t *testing.T) {
+	t.Parallel()
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// A trailers-only response:
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Grpc-Status", "16")
+		w.Header().Set("Grpc-Message", "bad%20credentials")
+	}))
+	srv.Config.Protocols = new(http.Protocols)
+	srv.Config.Protocols.SetUnencryptedHTTP2(true)
+	srv.Start()
+	t.Cleanup(srv.Close)
+
+	tracer, err := NewTracer(Tracing{Endpoint: srv.URL, Protocol: TracingGRPC, BatchTimeout: time.Hour})
+	require.NoError(t, err)
+	defer tracer.Close()
+	err = tracer.post(otlpProtobuf(nil))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "bad credentials")
+}
@@ -0,0 +1,484 @@
+package tsnsrv
+
+import (
+	"bytes"
+	"cmp"
+	"crypto/hmac"
+	"crypto/sha1" // #nosec Some webhook senders only offer HMAC-SHA1.
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"golang.org/x/exp/slog"
+)
+
+// Webhook signature schemes.
+const (
+	// WebhookGitHub checks the X-Hub-Signature-256 header, an
+	// HMAC-SHA256 of the body.
+	WebhookGitHub = "github"
+
+	// WebhookGitLab compares the X-Gitlab-Token header to the secret.
+	WebhookGitLab = "gitlab"
+
+	// WebhookStripe checks the Stripe-Signature header, an
+	// HMAC-SHA256 of a timestamp and the body.
+	WebhookStripe = "stripe"
+
+	// WebhookHMAC checks a configurable HMAC of the body, optionally
+	// with a timestamp.
+	WebhookHMAC = "hmac"
+)
+
+var webhookResults = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "tsnsrv_webhook_verifications_total",
+	Help: "Webhook signature checks by prefix and result (valid, missing, invalid, expired, replayed, too_large)",
+}, []string{"service_name", "prefix", "result"})
+
+var (
+	errWebhookFormat  = errors.New("webhook format must be '[funnel:|tailnet:]/prefix=SCHEME;secretFile=PATH[;option=value...]'")
+	errWebhookScheme  = errors.New("webhook scheme must be \"github\", \"gitlab\", \"stripe\" or \"hmac\"")
+	errWebhookOption  = errors.New("option is only supported by the \"hmac\" webhook scheme")
+	errWebhookMissing = errors.New("no signature")
+	errWebhookInvalid = errors.New("signature doesn't match")
+	errWebhookExpired = errors.New("timestamp is outside the tolerance")
+	errWebhookReplay  = errors.New("signature was already used")
+)
+
+// WebhookConfig verifies the signatures of webhook requests under a
+// path prefix before they reach the upstream.
+type WebhookConfig struct {
+	// Prefix is the path prefix to verify, optionally restricted with
+	// a "funnel:" or "tailnet:" provenance like the entries in
+	// Prefixes.
+	Prefix string `yaml:"prefix"`
+
+	// Scheme is how requests are signed: "github", "gitlab", "stripe"
+	// or "hmac".
+	Scheme string `yaml:"scheme"`
+
+	// SecretFile contains the secret that the sender signs requests
+	// with.
+	SecretFile string `yaml:"secretFile"`
+
+	// Header carries the signature (default "X-Hub-Signature-256" for
+	// github, "X-Gitlab-Token" for gitlab, "Stripe-Signature" for
+	// stripe and "X-Signature" for hmac).
+	Header string `yaml:"header,omitempty"`
+
+	// Algorithm is the hash of the hmac scheme: "sha1", "sha256"
+	// (default) or "sha512".
+	Algorithm string `yaml:"algorithm,omitempty"`
+
+	// Encoding of the hmac scheme's signature: "hex" (default) or
+	// "base64".
+	Encoding string `yaml:"encoding,omitempty"`
+
+	// SignaturePrefix precedes the hmac scheme's signature in the
+	// header, like "sha256=" (which the github scheme always uses).
+	SignaturePrefix string `yaml:"signaturePrefix,omitempty"`
+
+	// TimestampHeader carries a Unix timestamp for the hmac scheme.
+	// If set, the signature covers "TIMESTAMP.BODY" and requests are
+	// protected against replays like with the stripe scheme.
+	TimestampHeader string `yaml:"timestampHeader,omitempty"`
+
+	// Tolerance is how far a signed timestamp may be from the current
+	// time (default 5m). Signatures are only accepted once within it.
+	Tolerance time.Duration `yaml:"tolerance,omitempty"`
+
+	// MaxBodySize is the largest request body that is verified, in
+	// bytes (default 25MiB). Larger requests are rejected.
+	MaxBodySize int64 `yaml:"maxBodySize,omitempty"`
+}
+
+func (wc WebhookConfig) withDefaults() WebhookConfig {
+	if wc.Header == "" {
+		switch wc.Scheme {
+		case WebhookGitHub:
+			wc.Header = "X-Hub-Signature-256"
+		case WebhookGitLab:
+			wc.Header = "X-Gitlab-Token"
+		case WebhookStripe:
+			wc.Header = "Stripe-Signature"
+		case WebhookHMAC:
+			wc.Header = "X-Signature"
+		}
+	}
+	if wc.Scheme == WebhookGitHub {
+		wc.SignaturePrefix = "sha256="
+	}
+	wc.Algorithm = cmp.Or(wc.Algorithm, "sha256")
+	wc.Encoding = cmp.Or(wc.Encoding, "hex")
+	wc.Tolerance = cmp.Or(wc.Tolerance, 5*time.Minute)
+	wc.MaxBodySize = cmp.Or(wc.MaxBodySize, 25<<20)
+	return wc
+}
+
+func (wc WebhookConfig) validate() error {
+	var errs []error
+	if !strings.HasPrefix(parsePrefix(wc.Prefix).path, "/") {
+		errs = append(errs, fmt.Errorf("prefix must start with '/'"))
+	}
+	switch wc.Scheme {
+	case WebhookGitHub, WebhookGitLab, WebhookStripe, WebhookHMAC:
+	default:
+		errs = append(errs, fmt.Errorf("%w, got %q", errWebhookScheme, wc.Scheme))
+	}
+	if wc.SecretFile == "" {
+		errs = append(errs, errors.New("webhooks require a secretFile"))
+	}
+	if wc.Scheme != WebhookHMAC {
+		for name, value := range map[string]string{
+			"algorithm":       wc.Algorithm,
+			"encoding":        wc.Encoding,
+			"signaturePrefix": wc.SignaturePrefix,
+			"timestampHeader": wc.TimestampHeader,
+		} {
+			if value != "" {
+				errs = append(errs, fmt.Errorf("%s: %w", name, errWebhookOption))
+			}
+		}
+	}
+	switch wc.Algorithm {
+	case "", "sha1", "sha256", "sha512":
+	default:
+		errs = append(errs, fmt.Errorf("webhook algorithm must be sha1, sha256 or sha512, got %q", wc.Algorithm))
+	}
+	switch wc.Encoding {
+	case "", "hex", "base64":
+	default:
+		errs = append(errs, fmt.Errorf("webhook encoding must be hex or base64, got %q", wc.Encoding))
+	}
+	if wc.Tolerance < 0 || wc.MaxBodySize < 0 {
+		errs = append(errs, errors.New("webhook tolerance and maxBodySize must not be negative"))
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("webhook %s: %w", wc.Prefix, errors.Join(errs...))
+	}
+	return nil
+}
+
+// parseWebhookSpec parses the commandline form of a webhook:
+//
+//	[funnel:|tailnet:]/prefix=SCHEME;secretFile=PATH[;option=value...]
+//
+// where the options are the yaml names of the WebhookConfig fields.
+func parseWebhookSpec(value string) (WebhookConfig, error) {
+	spec, options, _ := strings.Cut(value, ";")
+	prefix, scheme, ok := strings.Cut(spec, "=")
+	if !ok || prefix == "" || scheme == "" {
+		return WebhookConfig{}, fmt.Errorf("%w: got %q", errWebhookFormat, value)
+	}
+	wc := WebhookConfig{Prefix: prefix, Scheme: scheme}
+	for option := range strings.SplitSeq(options, ";") {
+		if option == "" {
+			continue
+		}
+		key, val, ok := strings.Cut(option, "=")
+		if !ok {
+			return WebhookConfig{}, fmt.Errorf("%w: invalid option %q", errWebhookFormat, option)
+		}
+		switch key {
+		case "secretFile":
+			wc.SecretFile = val
+		case "header":
+			wc.Header = val
+		case "algorithm":
+			wc.Algorithm = val
+		case "encoding":
+			wc.Encoding = val
+		case "signaturePrefix":
+			wc.SignaturePrefix = val
+		case "timestampHeader":
+			wc.TimestampHeader = val
+		case "tolerance":
+			d, err := time.ParseDuration(val)
+			if err != nil {
+				return WebhookConfig{}, fmt.Errorf("parsing duration: %w", err)
+			}
+			wc.Tolerance = d
+		case "maxBodySize":
+			n, err := strconv.ParseInt(val, 10, 64)
+			if err != nil {
+				return WebhookConfig{}, fmt.Errorf("invalid number: %w", err)
+			}
+			wc.MaxBodySize = n
+		default:
+			return WebhookConfig{}, fmt.Errorf("unknown webhook option: %q", key)
+		}
+	}
+	return wc, nil
+}
+
+// webhookFlags collects webhooks given on the commandline.
+type webhookFlags []WebhookConfig
+
+func (wf *webhookFlags) String() string {
+	var coll []string
+	for _, wc := range *wf {
+		coll = append(coll, fmt.Sprintf("%s=%s", wc.Prefix, wc.Scheme))
+	}
+	return strings.Join(coll, ", ")
+}
+
+func (wf *webhookFlags) Set(value string) error {
+	wc, err := parseWebhookSpec(value)
+	if err != nil {
+		return err
+	}
+	*wf = append(*wf, wc)
+	return nil
+}
+
+func (wf webhookFlags) validate() error {
+	var errs []error
+	for _, wc := range wf {
+		if err := wc.validate(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// load reads the webhooks' secrets, and orders them for matching.
+func (wf webhookFlags) load() ([]*webhook, error) {
+	var loaded []*webhook
+	for _, wc := range wf {
+		secret, err := readSecretKey(wc.SecretFile, "webhook secret", 1)
+		if err != nil {
+			return nil, fmt.Errorf("webhook %s: %w", wc.Prefix, err)
+		}
+		loaded = append(loaded, &webhook{
+			config: wc.withDefaults(),
+			prefix: parsePrefix(wc.Prefix),
+			secret: secret,
+		})
+	}
+	// The most specific prefix wins:
+	slices.SortStableFunc(loaded, func(a, b *webhook) int {
+		return cmp.Compare(len(b.prefix.path), len(a.prefix.path))
+	})
+	return loaded, nil
+}
+
+// webhook is a loaded WebhookConfig.
+type webhook struct {
+	config WebhookConfig
+	prefix prefix
+	secret []byte
+
+	mu   sync.Mutex
+	seen map[seenSignature]time.Time
+	// expiries lists the seen signatures in the order they expire.
+	expiries []seenSignature
+}
+
+// seenSignature identifies a signature by its decoded MAC, so the same
+// signature in another encoding (like upper case hex) is still a
+// replay.
+type seenSignature struct {
+	timestamp int64
+	mac       string
+}
+
+// verify checks the signature of a request with the given body.
+func (wh *webhook) verify(h http.Header, body []byte, now time.Time) error {
+	switch wh.config.Scheme {
+	case WebhookGitLab:
+		token := h.Get(wh.config.Header)
+		if token == "" {
+			return errWebhookMissing
+		}
+		if !hmac.Equal([]byte(token), wh.secret) {
+			return errWebhookInvalid
+		}
+		return nil
+	case WebhookStripe:
+		return wh.verifyStripe(h.Get(wh.config.Header), body, now)
+	default:
+		return wh.verifyHMAC(h, body, now)
+	}
+}
+
+// verifyStripe checks a header like "t=1492774577,v1=5257a869...",
+// which may carry several signatures while the secret is rotated.
+func (wh *webhook) verifyStripe(header string, body []byte, now time.Time) error {
+	var timestamp string
+	var signatures []string
+	for part := range strings.SplitSeq(header, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch key {
+		case "t":
+			timestamp = value
+		case "v1":
+			signatures = append(signatures, value)
+		}
+	}
+	if timestamp == "" || len(signatures) == 0 {
+		return errWebhookMissing
+	}
+	expected := wh.mac(sha256.New, []byte(timestamp+"."), body)
+	for _, sig := range signatures {
+		got, err := hex.DecodeString(sig)
+		if err == nil && hmac.Equal(got, expected) {
+			return wh.checkFresh(timestamp, got, now)
+		}
+	}
+	return errWebhookInvalid
+}
+
+// verifyHMAC checks the github and hmac schemes.
+func (wh *webhook) verifyHMAC(h http.Header, body []byte, now time.Time) error {
+	sig, ok := strings.CutPrefix(h.Get(wh.config.Header), wh.config.SignaturePrefix)
+	if !ok || sig == "" {
+		return errWebhookMissing
+	}
+	var got []byte
+	var err error
+	if wh.config.Encoding == "base64" {
+		got, err = base64.StdEncoding.DecodeString(sig)
+	} else {
+		got, err = hex.DecodeString(sig)
+	}
+	if err != nil {
+		return errWebhookInvalid
+	}
+	newHash := sha256.New
+	switch wh.config.Algorithm {
+	case "sha1":
+		newHash = sha1.New
+	case "sha512":
+		newHash = sha512.New
+	}
+	var timestamp string
+	var signed []byte
+	if wh.config.TimestampHeader != "" {
+		timestamp = h.Get(wh.config.TimestampHeader)
+		if timestamp == "" {
+			return errWebhookMissing
+		}
+		signed = []byte(timestamp + ".")
+	}
+	if !hmac.Equal(got, wh.mac(newHash, signed, body)) {
+		return errWebhookInvalid
+	}
+	if timestamp != "" {
+		return wh.checkFresh(timestamp, got, now)
+	}
+	return nil
+}
+
+func (wh *webhook) mac(newHash func() hash.Hash, prefix, body []byte) []byte {
+	m := hmac.New(newHash, wh.secret)
+	m.Write(prefix)
+	m.Write(body)
+	return m.Sum(nil)
+}
+
+// checkFresh rejects signatures whose timestamp is outside the
+// tolerance, or that were already used.
+func (wh *webhook) checkFresh(timestamp string, mac []byte, now time.Time) error {
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return errWebhookInvalid
+	}
+	if age := now.Sub(time.Unix(ts, 0)); age > wh.config.Tolerance || age < -wh.config.Tolerance {
+		return errWebhookExpired
+	}
+
+	wh.mu.Lock()
+	defer wh.mu.Unlock()
+	for len(wh.expiries) > 0 && now.After(wh.seen[wh.expiries[0]]) {
+		delete(wh.seen, wh.expiries[0])
+		wh.expiries = wh.expiries[1:]
+	}
+	sig := seenSignature{timestamp: ts, mac: string(mac)}
+	if _, ok := wh.seen[sig]; ok {
+		return errWebhookReplay
+	}
+	if wh.seen == nil {
+		wh.seen = make(map[seenSignature]time.Time)
+	}
+	// A timestamp is accepted for up to twice the tolerance, so
+	// remember the signature for that long:
+	wh.seen[sig] = now.Add(2 * wh.config.Tolerance)
+	wh.expiries = append(wh.expiries, sig)
+	return nil
+}
+
+// webhookMiddleware rejects requests under a webhook prefix whose
+// signature doesn't check out.
+func (s *ValidTailnetSrv) webhookMiddleware(forFunnel bool, next http.Handler) http.Handler {
+	if len(s.webhooks) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		idx := slices.IndexFunc(s.webhooks, func(wh *webhook) bool {
+			return wh.prefix.covers(r.URL, forFunnel)
+		})
+		if idx < 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		wh := s.webhooks[idx]
+		result := func(result string) {
+			webhookResults.With(prometheus.Labels{"service_name": s.Name, "prefix": wh.config.Prefix, "result": result}).Inc()
+		}
+
+		var body []byte
+		if wh.config.Scheme != WebhookGitLab {
+			var err error
+			body, err = io.ReadAll(io.LimitReader(r.Body, wh.config.MaxBodySize+1))
+			if err != nil {
+				http.Error(w, "Bad Request", http.StatusBadRequest)
+				return
+			}
+			if int64(len(body)) > wh.config.MaxBodySize {
+				result("too_large")
+				http.Error(w, "Request Entity Too Large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+			r.ContentLength = int64(len(body))
+			r.GetBody = func() (io.ReadCloser, error) { return io.NopCloser(bytes.NewReader(body)), nil }
+		}
+
+		if err := wh.verify(r.Header, body, time.Now()); err != nil {
+			switch {
+			case errors.Is(err, errWebhookMissing):
+				result("missing")
+			case errors.Is(err, errWebhookExpired):
+				result("expired")
+			case errors.Is(err, errWebhookReplay):
+				result("replayed")
+			default:
+				result("invalid")
+			}
+			slog.Info("rejected webhook",
+				"service", s.Name,
+				"prefix", wh.config.Prefix,
+				"remote_addr", r.RemoteAddr,
+				"url", r.URL,
+				"error", err,
+			)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		result("valid")
+		next.ServeHTTP(w, r)
+	})
+}
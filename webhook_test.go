@@ -0,0 +1,199 @@
+package tsnsrv
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseWebhookSpec(t *testing.T) {
+	t.Parallel()
+	for _, elt := range []struct {
+		spec     string
+		expected WebhookConfig
+		err      bool
+	}{
+		{spec: "funnel:/github=github;secretFile=/run/secrets/gh", expected: WebhookConfig{
+			Prefix: "funnel:/github", Scheme: WebhookGitHub, SecretFile: "/run/secrets/gh",
+		}},
+		{spec: "/hooks=hmac;secretFile=/s;header=X-Sig;algorithm=sha512;encoding=base64;signaturePrefix=v1=;timestampHeader=X-Ts;tolerance=1m;maxBodySize=1024", expected: WebhookConfig{
+			Prefix: "/hooks", Scheme: WebhookHMAC, SecretFile: "/s", Header: "X-Sig", Algorithm: "sha512", Encoding: "base64",
+			SignaturePrefix: "v1=", TimestampHeader: "X-Ts", Tolerance: time.Minute, MaxBodySize: 1024,
+		}},
+		{spec: "/hooks", err: true},
+		{spec: "=github", err: true},
+		{spec: "/hooks=github;bogus=1", err: true},
+		{spec: "/hooks=github;tolerance=soon", err: true},
+		{spec: "/hooks=github;maxBodySize=big", err: true},
+	} {
+		t.Run(elt.spec, func(t *testing.T) {
+			wc, err := parseWebhookSpec(elt.spec)
+			if elt.err {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, elt.expected, wc)
+		})
+	}
+}
+
+func TestWebhookValidate(t *testing.T) {
+	t.Parallel()
+	assert.NoError(t, WebhookConfig{Prefix: "/gh", Scheme: WebhookGitHub, SecretFile: "/s"}.validate())
+	assert.NoError(t, WebhookConfig{Prefix: "funnel:/h", Scheme: WebhookHMAC, SecretFile: "/s", Algorithm: "sha1", Encoding: "base64"}.validate())
+
+	assert.Error(t, WebhookConfig{Prefix: "gh", Scheme: WebhookGitHub, SecretFile: "/s"}.validate())
+	assert.Error(t, WebhookConfig{Prefix: "/gh", Scheme: WebhookGitHub}.validate())
+	assert.ErrorIs(t, WebhookConfig{Prefix: "/gh", Scheme: "bitbucket", SecretFile: "/s"}.validate(), errWebhookScheme)
+	assert.ErrorIs(t, WebhookConfig{Prefix: "/gh", Scheme: WebhookGitHub, SecretFile: "/s", Algorithm: "sha1"}.validate(), errWebhookOption)
+	assert.Error(t, WebhookConfig{Prefix: "/h", Scheme: WebhookHMAC, SecretFile: "/s", Algorithm: "md5"}.validate())
+	assert.Error(t, WebhookConfig{Prefix: "/h", Scheme: WebhookHMAC, SecretFile: "/s", Encoding: "base32"}.validate())
+}
+
+func testWebhookServer(t *testing.T, configs ...WebhookConfig) (http.Handler, *[]byte) {
+	t.Helper()
+	secret := filepath.Join(t.TempDir(), "secret")
+	require.NoError(t, os.WriteFile(secret, []byte("It's a Secret to Everybody\n"), 0o600))
+	for i := range configs {
+		configs[i].SecretFile = secret
+	}
+	require.NoError(t, webhookFlags(configs).validate())
+	s := &ValidTailnetSrv{TailnetSrv: TailnetSrv{Name: "test", Webhooks: configs}}
+	var err error
+	s.webhooks, err = s.Webhooks.load()
+	require.NoError(t, err)
+
+	var got []byte
+	return s.webhookMiddleware(true, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var err error
+		got, err = io.ReadAll(r.Body)
+		assert.NoError(t, err)
+	})), &got
+}
+
+func hmacHex(data string) string {
+	m := hmac.New(sha256.New, []byte("It's a Secret to Everybody"))
+	m.Write([]byte(data))
+	return hex.EncodeToString(m.Sum(nil))
+}
+
+func postWebhook(handler http.Handler, path, body string, header http.Header) int {
+	req := httptest.NewRequest("POST", path, strings.NewReader(body))
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	return w.Code
+}
+
+func TestWebhookGitHub(t *testing.T) {
+	t.Parallel()
+	handler, got := testWebhookServer(t, WebhookConfig{Prefix: "funnel:/github", Scheme: WebhookGitHub})
+
+	// From GitHub's documentation on validating webhook deliveries:
+	body := "Hello, World!"
+	sig := http.Header{"X-Hub-Signature-256": {"sha256=757107ea0eb2509fc211221cce984b8a37570b6d7586c22c46f4379c8b043e17"}}
+	assert.Equal(t, http.StatusOK, postWebhook(handler, "/github/push", body, sig))
+	assert.Equal(t, body, string(*got), "the upstream gets the body")
+
+	*got = nil
+	assert.Equal(t, http.StatusUnauthorized, postWebhook(handler, "/github/push", "Hello, Mallory!", sig))
+	assert.Equal(t, http.StatusUnauthorized, postWebhook(handler, "/github/push", body, nil))
+	assert.Equal(t, http.StatusUnauthorized, postWebhook(handler, "/github/push", body,
+		http.Header{"X-Hub-Signature-256": {"757107ea0eb2509fc211221cce984b8a37570b6d7586c22c46f4379c8b043e17"}}))
+	assert.Nil(t, *got)
+
+	assert.Equal(t, http.StatusOK, postWebhook(handler, "/other", body, nil), "other paths aren't checked")
+	*got = nil
+	for _, path := range []string{"/%67ithub/push", "/github%2Fpush"} {
+		assert.Equal(t, http.StatusUnauthorized, postWebhook(handler, path, body, nil), "encoded paths are checked: %s", path)
+	}
+	assert.Nil(t, *got)
+}
+
+func TestWebhookGitLab(t *testing.T) {
+	t.Parallel()
+	handler, _ := testWebhookServer(t, WebhookConfig{Prefix: "/gitlab", Scheme: WebhookGitLab})
+	assert.Equal(t, http.StatusOK, postWebhook(handler, "/gitlab", "{}", http.Header{"X-Gitlab-Token": {"It's a Secret to Everybody"}}))
+	assert.Equal(t, http.StatusUnauthorized, postWebhook(handler, "/gitlab", "{}", http.Header{"X-Gitlab-Token": {"guess"}}))
+	assert.Equal(t, http.StatusUnauthorized, postWebhook(handler, "/gitlab", "{}", nil))
+}
+
+func TestWebhookStripe(t *testing.T) {
+	t.Parallel()
+	handler, _ := testWebhookServer(t, WebhookConfig{Prefix: "/stripe", Scheme: WebhookStripe})
+	body := `{"type":"charge.succeeded"}`
+	signed := func(ts int64, sigs ...string) http.Header {
+		value := "t=" + strconv.FormatInt(ts, 10)
+		for _, sig := range sigs {
+			value += ",v1=" + sig
+		}
+		return http.Header{"Stripe-Signature": {value}}
+	}
+	now := time.Now().Unix()
+	sig := hmacHex(fmt.Sprintf("%d.%s", now, body))
+
+	assert.Equal(t, http.StatusOK, postWebhook(handler, "/stripe", body, signed(now, "00", sig)), "any v1 signature may match")
+	assert.Equal(t, http.StatusUnauthorized, postWebhook(handler, "/stripe", body, signed(now, sig)), "replays are rejected")
+	assert.Equal(t, http.StatusUnauthorized, postWebhook(handler, "/stripe", body, signed(now, strings.ToUpper(sig))), "re-encoded replays are rejected")
+	assert.Equal(t, http.StatusUnauthorized, postWebhook(handler, "/stripe", body, signed(now+1, sig)), "the timestamp is signed")
+
+	old := now - 3600
+	assert.Equal(t, http.StatusUnauthorized, postWebhook(handler, "/stripe", body, signed(old, hmacHex(fmt.Sprintf("%d.%s", old, body)))))
+	assert.Equal(t, http.StatusUnauthorized, postWebhook(handler, "/stripe", body, nil))
+}
+
+func TestWebhookHMAC(t *testing.T) {
+	t.Parallel()
+	handler, _ := testWebhookServer(t,
+		WebhookConfig{Prefix: "/plain", Scheme: WebhookHMAC},
+		WebhookConfig{Prefix: "/plain/sha512", Scheme: WebhookHMAC, Header: "X-Sig", Algorithm: "sha512", Encoding: "base64", SignaturePrefix: "sha512="},
+		WebhookConfig{Prefix: "/timed", Scheme: WebhookHMAC, TimestampHeader: "X-Timestamp", MaxBodySize: 64},
+	)
+	body := "ping"
+	assert.Equal(t, http.StatusOK, postWebhook(handler, "/plain", body, http.Header{"X-Signature": {hmacHex(body)}}))
+	assert.Equal(t, http.StatusUnauthorized, postWebhook(handler, "/plain", body, http.Header{"X-Signature": {hmacHex("pong")}}))
+
+	m := hmac.New(sha512.New, []byte("It's a Secret to Everybody"))
+	m.Write([]byte(body))
+	sig512 := "sha512=" + base64.StdEncoding.EncodeToString(m.Sum(nil))
+	assert.Equal(t, http.StatusOK, postWebhook(handler, "/plain/sha512", body, http.Header{"X-Sig": {sig512}}), "the most specific prefix applies")
+	assert.Equal(t, http.StatusUnauthorized, postWebhook(handler, "/plain/sha512", body, http.Header{"X-Signature": {hmacHex(body)}}))
+
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	timed := http.Header{"X-Timestamp": {ts}, "X-Signature": {hmacHex(ts + "." + body)}}
+	assert.Equal(t, http.StatusOK, postWebhook(handler, "/timed", body, timed))
+	assert.Equal(t, http.StatusUnauthorized, postWebhook(handler, "/timed", body, timed), "replays are rejected")
+	recased := http.Header{"X-Timestamp": {ts}, "X-Signature": {strings.ToUpper(hmacHex(ts + "." + body))}}
+	assert.Equal(t, http.StatusUnauthorized, postWebhook(handler, "/timed", body, recased), "re-encoded replays are rejected")
+	assert.Equal(t, http.StatusUnauthorized, postWebhook(handler, "/timed", body, http.Header{"X-Signature": {hmacHex(body)}}))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, postWebhook(handler, "/timed", strings.Repeat("x", 65), timed))
+}
+
+func TestWebhookReplayExpiry(t *testing.T) {
+	t.Parallel()
+	wh := &webhook{config: WebhookConfig{Tolerance: time.Minute}}
+	now := time.Now()
+	ts := strconv.FormatInt(now.Unix(), 10)
+	require.NoError(t, wh.checkFresh(ts, []byte("a"), now))
+	assert.ErrorIs(t, wh.checkFresh(ts, []byte("a"), now.Add(30*time.Second)), errWebhookReplay)
+	require.NoError(t, wh.checkFresh(strconv.FormatInt(now.Add(3*time.Minute).Unix(), 10), []byte("b"), now.Add(3*time.Minute)))
+	assert.NotContains(t, wh.seen, seenSignature{timestamp: now.Unix(), mac: "a"}, "expired signatures are forgotten")
+}
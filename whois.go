@@ -0,0 +1,170 @@
+package tsnsrv
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"tailscale.com/client/tailscale/apitype"
+)
+
+var whoisLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "tsnsrv_whois_cache_lookups_total",
+	Help: "Identity lookups by cache result (hit, negative_hit, miss)",
+}, []string{"service_name", "result"})
+
+var errNoWhoisClient = errors.New("no local tailscale client to look up identities with")
+
+// sharedWhoisTimeout limits lookups that requests share if WhoisTimeout
+// is 0: unlike lookups for a single request, they don't end when the
+// request does.
+const sharedWhoisTimeout = 10 * time.Second
+
+// whoisCache remembers the identities behind remote addresses for a
+// while, and collapses concurrent lookups of the same address into one.
+type whoisCache struct {
+	mu        sync.Mutex
+	entries   map[netip.Addr]*whoisEntry
+	lastSweep time.Time
+}
+
+// whoisEntry is a (pending) lookup result.
+type whoisEntry struct {
+	done    chan struct{}
+	who     *apitype.WhoIsResponse
+	err     error
+	expires time.Time
+}
+
+func (c *whoisCache) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = nil
+}
+
+// whois looks up the identity behind remoteAddr, using the cache if
+// WhoisCacheTTL is set.
+func (s *ValidTailnetSrv) whois(ctx context.Context, remoteAddr string) (*apitype.WhoIsResponse, error) {
+	if s.client == nil {
+		return nil, errNoWhoisClient
+	}
+	lookup := func(ctx context.Context, timeout time.Duration) (*apitype.WhoIsResponse, error) {
+		if timeout > 0 {
+			var cancel func()
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+		return s.client.WhoIs(ctx, remoteAddr)
+	}
+	addrPort, err := netip.ParseAddrPort(remoteAddr)
+	if err != nil {
+		return lookup(ctx, s.WhoisTimeout)
+	}
+	addr := addrPort.Addr()
+
+	c := &s.whoisCache
+	now := time.Now()
+	c.mu.Lock()
+	if e, ok := c.entries[addr]; ok && (e.expires.IsZero() || now.Before(e.expires)) {
+		c.mu.Unlock()
+		select {
+		case <-e.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		result := "hit"
+		if e.err != nil {
+			result = "negative_hit"
+		}
+		whoisLookups.With(prometheus.Labels{"service_name": s.Name, "result": result}).Inc()
+		return e.who, e.err
+	}
+	e := &whoisEntry{done: make(chan struct{})}
+	if c.entries == nil {
+		c.entries = make(map[netip.Addr]*whoisEntry)
+	}
+	c.entries[addr] = e
+	c.sweepLocked(now)
+	c.mu.Unlock()
+	whoisLookups.With(prometheus.Labels{"service_name": s.Name, "result": "miss"}).Inc()
+
+	// Other requests wait for this lookup, so it can't be canceled
+	// along with the request that happened to start it.
+	timeout := s.WhoisTimeout
+	if timeout <= 0 {
+		timeout = sharedWhoisTimeout
+	}
+	e.who, e.err = lookup(context.WithoutCancel(ctx), timeout)
+	ttl := s.WhoisCacheTTL
+	if e.err != nil {
+		ttl = s.WhoisNegativeCacheTTL
+	}
+	c.mu.Lock()
+	if ttl > 0 {
+		e.expires = time.Now().Add(ttl)
+	} else if c.entries[addr] == e {
+		delete(c.entries, addr)
+	}
+	c.mu.Unlock()
+	close(e.done)
+	return e.who, e.err
+}
+
+// sweepLocked drops expired entries, at most once per minute.
+func (c *whoisCache) sweepLocked(now time.Time) {
+	if now.Sub(c.lastSweep) < time.Minute {
+		return
+	}
+	c.lastSweep = now
+	for addr, e := range c.entries {
+		if !e.expires.IsZero() && now.After(e.expires) {
+			delete(c.entries, addr)
+		}
+	}
+}
+
+type requestIdentityKey struct{}
+
+// requestIdentity is the identity of a request's origin, looked up at
+// most once per request.
+type requestIdentity struct {
+	once sync.Once
+	who  *apitype.WhoIsResponse
+	err  error
+}
+
+// withRequestIdentity lets all handlers of a request share one identity lookup.
+func withRequestIdentity(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), requestIdentityKey{}, &requestIdentity{})
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// whoisFor returns the identity of the origin of r.
+func (s *ValidTailnetSrv) whoisFor(r *http.Request) (*apitype.WhoIsResponse, error) {
+	ri, ok := r.Context().Value(requestIdentityKey{}).(*requestIdentity)
+	if !ok {
+		return s.tracedWhois(r)
+	}
+	ri.once.Do(func() {
+		ri.who, ri.err = s.tracedWhois(r)
+	})
+	return ri.who, ri.err
+}
+
+// tracedWhois looks up the identity of the origin of r in a span of
+// the request's trace.
+func (s *ValidTailnetSrv) tracedWhois(r *http.Request) (*apitype.WhoIsResponse, error) {
+	ctx, sp := s.tracer.start(r.Context(), s.Name, "tailscale.whois", spanKindInternal)
+	who, err := s.whois(ctx, r.RemoteAddr)
+	sp.setError(err)
+	sp.setIdentity(who)
+	sp.finish()
+	return who, err
+}
@@ -0,0 +1,195 @@
+package tsnsrv
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"tailscale.com/client/tailscale/apitype"
+)
+
+// countingClient counts the WhoIs lookups it answers.
+func countingClient(calls *atomic.Int32, delay time.Duration, err error) *mockLocalClient {
+	return &mockLocalClient{whoIsFunc: func(ctx context.Context, addr string) (*apitype.WhoIsResponse, error) {
+		calls.Add(1)
+		time.Sleep(delay)
+		if err != nil {
+			return nil, err
+		}
+		return identity("user@example.com", "laptop", nil), nil
+	}}
+}
+
+func TestWhoisCache(t *testing.T) {
+	t.Parallel()
+	var calls atomic.Int32
+	s := &ValidTailnetSrv{
+		TailnetSrv: TailnetSrv{Name: "test", WhoisCacheTTL: time.Minute},
+		client:     countingClient(&calls, 0, nil),
+	}
+	for range 3 {
+		who, err := s.whois(context.Background(), "100.100.100.1:1234")
+		require.NoError(t, err)
+		assert.Equal(t, "user@example.com", who.UserProfile.LoginName)
+	}
+	// Another connection from the same node is the same identity:
+	_, err := s.whois(context.Background(), "100.100.100.1:4321")
+	require.NoError(t, err)
+	assert.Equal(t, int32(1), calls.Load())
+
+	_, err = s.whois(context.Background(), "100.100.100.2:1234")
+	require.NoError(t, err)
+	assert.Equal(t, int32(2), calls.Load())
+
+	s.whoisCache.reset()
+	_, err = s.whois(context.Background(), "100.100.100.1:1234")
+	require.NoError(t, err)
+	assert.Equal(t, int32(3), calls.Load())
+}
+
+func TestWhoisCacheDisabled(t *testing.T) {
+	t.Parallel()
+	var calls atomic.Int32
+	s := &ValidTailnetSrv{
+		TailnetSrv: TailnetSrv{Name: "test"},
+		client:     countingClient(&calls, 0, nil),
+	}
+	for range 3 {
+		_, err := s.whois(context.Background(), "100.100.100.1:1234")
+		require.NoError(t, err)
+	}
+	assert.Equal(t, int32(3), calls.Load())
+	assert.Empty(t, s.whoisCache.entries)
+}
+
+func TestWhoisCacheExpiry(t *testing.T) {
+	t.Parallel()
+	var calls atomic.Int32
+	s := &ValidTailnetSrv{
+		TailnetSrv: TailnetSrv{Name: "test", WhoisCacheTTL: 10 * time.Millisecond},
+		client:     countingClient(&calls, 0, nil),
+	}
+	_, err := s.whois(context.Background(), "100.100.100.1:1234")
+	require.NoError(t, err)
+	time.Sleep(20 * time.Millisecond)
+	_, err = s.whois(context.Background(), "100.100.100.1:1234")
+	require.NoError(t, err)
+	assert.Equal(t, int32(2), calls.Load())
+}
+
+func TestWhoisSharedLookupTimeout(t *testing.T) {
+	t.Parallel()
+	var deadlines []time.Duration
+	s := &ValidTailnetSrv{
+		TailnetSrv: TailnetSrv{Name: "test"},
+		client: &mockLocalClient{whoIsFunc: func(ctx context.Context, addr string) (*apitype.WhoIsResponse, error) {
+			deadline, ok := ctx.Deadline()
+			require.True(t, ok, "lookups must not run forever")
+			deadlines = append(deadlines, time.Until(deadline))
+			return identity("user@example.com", "laptop", nil), nil
+		}},
+	}
+	// Even without a deadline of its own, a lookup that other requests
+	// may wait for is limited:
+	_, err := s.whois(context.Background(), "100.100.100.1:1234")
+	require.NoError(t, err)
+	s.WhoisTimeout = time.Second
+	_, err = s.whois(context.Background(), "100.100.100.1:1234")
+	require.NoError(t, err)
+
+	require.Len(t, deadlines, 2)
+	assert.InDelta(t, sharedWhoisTimeout, deadlines[0], float64(time.Second))
+	assert.LessOrEqual(t, deadlines[1], time.Second)
+}
+
+func TestWhoisNegativeCache(t *testing.T) {
+	t.Parallel()
+	failure := errors.New("no such peer")
+
+	var calls atomic.Int32
+	s := &ValidTailnetSrv{
+		TailnetSrv: TailnetSrv{Name: "test", WhoisCacheTTL: time.Minute, WhoisNegativeCacheTTL: time.Minute},
+		client:     countingClient(&calls, 0, failure),
+	}
+	for range 3 {
+		_, err := s.whois(context.Background(), "100.100.100.1:1234")
+		assert.ErrorIs(t, err, failure)
+	}
+	assert.Equal(t, int32(1), calls.Load())
+
+	// Without a negative TTL, failures are retried:
+	calls.Store(0)
+	s = &ValidTailnetSrv{
+		TailnetSrv: TailnetSrv{Name: "test", WhoisCacheTTL: time.Minute},
+		client:     countingClient(&calls, 0, failure),
+	}
+	for range 3 {
+		_, err := s.whois(context.Background(), "100.100.100.1:1234")
+		assert.ErrorIs(t, err, failure)
+	}
+	assert.Equal(t, int32(3), calls.Load())
+}
+
+func TestWhoisConcurrentLookups(t *testing.T) {
+	t.Parallel()
+	var calls atomic.Int32
+	s := &ValidTailnetSrv{
+		TailnetSrv: TailnetSrv{Name: "test", WhoisCacheTTL: time.Minute},
+		client:     countingClient(&calls, 50*time.Millisecond, nil),
+	}
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			who, err := s.whois(context.Background(), "100.100.100.1:1234")
+			assert.NoError(t, err)
+			assert.NotNil(t, who)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), calls.Load())
+}
+
+func TestWhoisOncePerRequest(t *testing.T) {
+	t.Parallel()
+	var got http.Header
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+	}))
+	t.Cleanup(upstream.Close)
+	dest, err := url.Parse(upstream.URL)
+	require.NoError(t, err)
+
+	var calls atomic.Int32
+	s := &ValidTailnetSrv{
+		TailnetSrv: TailnetSrv{
+			Name:                 "test",
+			AuthURL:              "http://127.0.0.1:1",
+			AuthPath:             "/auth",
+			AuthBypassForTailnet: true,
+			Access:               []AccessRule{{Action: AccessAllow, Users: []string{"user@example.com"}}},
+			Capabilities:         CapabilityForwarding{Names: []string{"example.com/cap/app"}},
+		},
+		DestURL: dest,
+		client:  countingClient(&calls, 0, nil),
+	}
+	s.access, err = accessRules(s.Access).parse()
+	require.NoError(t, err)
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "100.100.100.1:1234"
+	w := httptest.NewRecorder()
+	s.mux(http.DefaultTransport, false).ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "user@example.com", got.Get("X-Tailscale-User-LoginName"))
+	assert.Equal(t, int32(1), calls.Load())
+}